@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"reverse-proxy/internal/adminapi"
+	"reverse-proxy/internal/balancer"
+	"reverse-proxy/internal/registrystore"
+	"reverse-proxy/internal/routing"
+)
+
+// backendRegistry exposes the proxy's backends to the admin API. Route names are SNIs,
+// "host/path" routes of HTTP mode, or listener addresses of port-forward routes.
+type backendRegistry struct {
+	config *Config
+}
+
+func (r backendRegistry) Routes() []adminapi.Route {
+	var routes []adminapi.Route
+	for _, name := range r.config.Backends.Names() {
+		if route, ok := r.Route(name); ok {
+			routes = append(routes, route)
+		}
+	}
+	return routes
+}
+
+func (r backendRegistry) Route(name string) (adminapi.Route, bool) {
+	name = canonicalRoute(name)
+	backends := listBackends(r.config, name)
+	if len(backends) == 0 {
+		return adminapi.Route{}, false
+	}
+	return adminapi.Route{Name: name, Balancing: r.config.Backends.Policy(name), Backends: backends}, true
+}
+
+func (r backendRegistry) SetBackend(route string, backend adminapi.Backend) error {
+	if isSRVName(backend.Address) {
+		return fmt.Errorf("SRV discovery is registered through /register, not as a backend")
+	}
+	if err := validateBackend(backend.Address); err != nil {
+		return err
+	}
+
+	// Only port-forward routes are named by a listener address
+	name, portForward := portForwardRoute(route)
+	if !portForward {
+		if strings.Contains(route, ":") {
+			return fmt.Errorf("invalid route name %s", route)
+		}
+		name = route
+	}
+	_, listening := r.config.PortForwards.Load(name)
+	if portForward {
+		if err := ensurePortForwardListener(r.config, name); err != nil {
+			return err
+		}
+	}
+
+	if err := persistBackend(r.config, name, backend, leaseExpiry(r.config, name, backend.Address)); err != nil {
+		if portForward && !listening {
+			closePortForwardListener(r.config, name)
+		}
+		return err
+	}
+	setBackend(r.config, name, backend)
+	return nil
+}
+
+func (r backendRegistry) SetBalancing(route, policy string) error {
+	return setBalancing(r.config, canonicalRoute(route), policy)
+}
+
+// ReplaceRoute checks the policy and every backend and binds a port-forward route's listener,
+// persists the new route, then publishes it in one swap
+func (r backendRegistry) ReplaceRoute(route string, backends []adminapi.Backend, balancing *string) error {
+	if balancing != nil {
+		if err := balancer.Valid(*balancing); err != nil {
+			return fmt.Errorf("%w: %v", adminapi.ErrInvalidBalancing, err)
+		}
+	}
+	for _, backend := range backends {
+		if isSRVName(backend.Address) {
+			return fmt.Errorf("SRV discovery is registered through /register, not as a backend")
+		}
+		if err := validateBackend(backend.Address); err != nil {
+			return fmt.Errorf("backend %s: %w", backend.Address, err)
+		}
+	}
+
+	// Only port-forward routes are named by a listener address
+	name, portForward := portForwardRoute(route)
+	if !portForward {
+		if strings.Contains(route, ":") {
+			return fmt.Errorf("invalid route name %s", route)
+		}
+		name = route
+	}
+	_, listening := r.config.PortForwards.Load(name)
+	if portForward && len(backends) > 0 {
+		if err := ensurePortForwardListener(r.config, name); err != nil {
+			return err
+		}
+	}
+
+	if err := persist(r.config, replaceRecords(r.config, name, backends, balancing)...); err != nil {
+		if portForward && !listening {
+			closePortForwardListener(r.config, name)
+		}
+		return err
+	}
+	if balancing != nil {
+		r.config.Backends.SetPolicy(name, *balancing) // Checked above
+	}
+	if len(backends) == 0 {
+		removeRoute(r.config, name)
+		return nil
+	}
+	for _, backend := range r.config.Backends.Backends(name) {
+		if !routing.Contains(backends, backend.Address) {
+			r.config.Leases.Release(name, backend.Address)
+		}
+	}
+	r.config.Backends.Replace(name, backends)
+	return nil
+}
+
+func (r backendRegistry) RemoveBackend(route, address string) (bool, error) {
+	route = canonicalRoute(route)
+	if _, ok := lookupBackend(r.config, route, address); !ok {
+		r.config.Leases.Release(route, address)
+		return false, nil
+	}
+	if err := persistRemoval(r.config, route, address); err != nil {
+		return true, err
+	}
+	r.config.Leases.Release(route, address)
+	removeBackend(r.config, route, address)
+	return true, nil
+}
+
+func (r backendRegistry) RemoveRoute(name string) (bool, error) {
+	name = canonicalRoute(name)
+	if err := persist(r.config, registrystore.Record{Op: registrystore.OpDeleteRoute, Route: name}); err != nil {
+		return r.config.Backends.Has(name), err
+	}
+	return removeRoute(r.config, name), nil
+}
+
+// removeRoute deletes a route with its leases, SRV discoveries and listener, reporting whether it had backends
+func removeRoute(config *Config, name string) bool {
+	config.Leases.ReleaseRoute(name)
+	if config.Resolver != nil {
+		config.Resolver.removeSRVDiscoveries(name)
+	}
+	existed := config.Backends.RemoveRoute(name)
+	closePortForwardListener(config, name)
+	if existed {
+		log.Printf("Removed route %s", name)
+	}
+	return existed
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strings"
+
+	"reverse-proxy/internal/adminapi"
+	"reverse-proxy/internal/configfile"
+	"reverse-proxy/internal/lease"
+	"reverse-proxy/internal/registrystore"
+	"reverse-proxy/internal/routing"
+)
+
+// newConfig builds the proxy configuration from a loaded configuration file
+func newConfig(file *configfile.File) *Config {
+	config := &Config{
+		Backends:            routing.NewTable(),
+		Leases:              lease.NewTable(),
+		RegistryFile:        file.Admin.RegistryFile,
+		APIAuthPolicy:       file.Admin.Auth,
+		ListenAddress:       file.Listeners.Proxy,
+		AdminAddress:        file.Listeners.Admin,
+		MetricsAddress:      file.Listeners.Metrics,
+		PprofAddress:        file.Listeners.Pprof,
+		TLSTermination:      file.TLS.Termination,
+		CertFile:            file.TLS.CertFile,
+		KeyFile:             file.TLS.KeyFile,
+		CertDir:             file.TLS.CertDir,
+		ACMEDirectoryURL:    file.TLS.ACME.DirectoryURL,
+		ACMEEmail:           file.TLS.ACME.Email,
+		ACMECacheDir:        file.TLS.ACME.CacheDir,
+		ACMECARoot:          file.TLS.ACME.CARoot,
+		ACMEHTTPAddress:     file.TLS.ACME.HTTPAddress,
+		ClientAuthPolicies:  file.TLS.ClientAuth,
+		TLSPolicies:         file.TLS.Policies,
+		UpstreamTLSPolicies: file.TLS.Upstream,
+		TicketKeyFile:       file.TLS.TicketKeyFile,
+		TicketKeyRotation:   file.TLS.TicketKeyRotation.Time(),
+		Cache:               newResponseCache(file.HTTPCache.MaxEntries, file.HTTPCache.MaxSize),
+		HTTPCacheMaxBody:    file.HTTPCache.MaxBody,
+		UDPRoutes:           file.UDP.Routes,
+		UDPSessionTimeout:   file.UDP.SessionTimeout.Time(),
+		UDPMaxSessions:      file.UDP.MaxSessions,
+		QUICAddress:         file.Listeners.QUIC,
+		DNSServer:           file.DNS.Server,
+		DNSCacheTTL:         file.DNS.CacheTTL.Time(),
+		DockerSocket:        file.Discovery.Docker.Socket,
+		TargetFiles:         file.Discovery.Files.Paths,
+		TargetFileRefresh:   file.Discovery.Files.RefreshInterval.Time(),
+	}
+
+	// A port-forward route stops listening once its last backend is gone. The check runs on its own,
+	// since SRV discovery changes the table while holding the resolver's lock.
+	config.Backends.OnRemove(func(route, _ string) {
+		if _, ok := portForwardRoute(route); ok {
+			go closeEmptyPortForward(config, route)
+		}
+	})
+
+	// Modes, balancing and caching of static routes are known before anything registers
+	for _, route := range file.Routes {
+		if route.Mode != "" {
+			config.RouteModes.Store(strings.ToLower(route.Name), route.Mode)
+		}
+		if route.Balancing != "" {
+			config.Backends.SetPolicy(route.Name, route.Balancing) // Validated with the file
+		}
+		if route.HTTPCache {
+			config.HTTPCache.Store(route.Name, true)
+		}
+	}
+	return config
+}
+
+// canonicalizeRoutes renames the file's port-forward routes to their canonical listener addresses,
+// rejecting two spellings of one listener
+func canonicalizeRoutes(file *configfile.File) error {
+	spelled := make(map[string]string)
+	for i, route := range file.Routes {
+		name, ok := portForwardRoute(route.Name)
+		if !ok {
+			continue
+		}
+		if other, ok := spelled[name]; ok {
+			return fmt.Errorf("routes %s and %s listen on the same address", other, route.Name)
+		}
+		spelled[name] = route.Name
+		file.Routes[i].Name = name
+	}
+	return nil
+}
+
+// addStaticRoutes registers the backends of the file's routes. They aren't written to the
+// registry log, since the file brings them back on every start.
+func addStaticRoutes(config *Config, routes []configfile.Route) error {
+	for _, route := range routes {
+		if _, ok := portForwardRoute(route.Name); ok {
+			if err := ensurePortForwardListener(config, route.Name); err != nil {
+				return fmt.Errorf("route %s: %w", route.Name, err)
+			}
+		}
+		for _, backend := range route.Backends {
+			setBackend(config, route.Name, backend.AdminBackend())
+		}
+		log.Printf("Configured route %s with %d backends", route.Name, len(route.Backends))
+	}
+	return nil
+}
+
+// reloadRoutes applies the routes of a reloaded configuration file. All changed routes are
+// swapped into the routing table at once; backends registered through the APIs are carried
+// over and in-flight connections keep the backend they picked.
+func reloadRoutes(config *Config, old, next *configfile.File, diff configfile.Diff) error {
+	previous := routesByName(old.Routes)
+	routes := routesByName(next.Routes)
+
+	// Check what can fail before changing anything
+	for _, name := range slices.Concat(diff.Added, diff.Changed) {
+		route := routes[name]
+		if route.Mode != "" && route.Mode != modePassthrough && config.TLSConfig == nil {
+			return fmt.Errorf("route %s: TLS termination was not set up at startup; restart the proxy to terminate this route", name)
+		}
+	}
+
+	// Then start the listeners of port-forward routes; if one can't bind, the ones started here close again
+	var started []string
+	for _, name := range slices.Concat(diff.Added, diff.Changed) {
+		if _, ok := portForwardRoute(name); !ok {
+			continue
+		}
+		if _, ok := config.PortForwards.Load(name); ok {
+			continue
+		}
+		if err := ensurePortForwardListener(config, name); err != nil {
+			for _, address := range started {
+				closePortForwardListener(config, address)
+			}
+			return fmt.Errorf("route %s: %w", name, err)
+		}
+		started = append(started, name)
+	}
+
+	changed := slices.Concat(diff.Added, diff.Changed, diff.Removed)
+
+	// A file backend the API changed may be in the registry log. Drop the ones the file no longer
+	// lists there first, so a failed write leaves the reload unapplied.
+	var dropped []registrystore.Record
+	for _, name := range changed {
+		for _, backend := range previous[name].Backends {
+			if !hasBackend(routes[name], backend.Address) && routing.Contains(config.Backends.Backends(name), backend.Address) {
+				dropped = append(dropped, registrystore.Record{Op: registrystore.OpDelete, Route: name, Address: backend.Address})
+			}
+		}
+	}
+	if err := persist(config, dropped...); err != nil {
+		for _, address := range started {
+			closePortForwardListener(config, address)
+		}
+		return err
+	}
+
+	reloadBalancing(config, changed, previous, routes)
+	config.Backends.Update(func(table map[string][]adminapi.Backend) {
+		for _, name := range changed {
+			// Start from the running backends: registered ones stay, the file's old ones go
+			backends := table[name]
+			for _, backend := range previous[name].Backends {
+				if !hasBackend(routes[name], backend.Address) {
+					backends = routing.Without(backends, backend.Address)
+				}
+			}
+			for _, backend := range routes[name].Backends {
+				backends = routing.With(backends, backend.AdminBackend())
+			}
+			table[name] = backends
+		}
+	})
+
+	for _, name := range changed {
+		route := routes[name]
+		if route.Mode != "" {
+			config.RouteModes.Store(strings.ToLower(name), route.Mode)
+		} else if previous[name].Mode != "" {
+			config.RouteModes.Delete(strings.ToLower(name))
+		}
+		if route.HTTPCache {
+			config.HTTPCache.Store(name, true)
+		} else {
+			config.HTTPCache.Delete(name)
+		}
+	}
+
+	// Removed port-forward routes stop listening, unless backends registered through the APIs remain
+	for _, name := range diff.Removed {
+		if _, ok := portForwardRoute(name); ok && !config.Backends.Has(name) {
+			closePortForwardListener(config, name)
+		}
+	}
+	return nil
+}
+
+func routesByName(routes []configfile.Route) map[string]configfile.Route {
+	byName := make(map[string]configfile.Route, len(routes))
+	for _, route := range routes {
+		byName[route.Name] = route
+	}
+	return byName
+}
+
+// reloadBalancing applies the balancing policies of reloaded routes before their backends change,
+// so new routes start with theirs. Routes that leave the file, or stop naming a policy, return
+// to the default; a policy set through the APIs on a route the file never configured stays.
+func reloadBalancing(config *Config, names []string, previous, routes map[string]configfile.Route) {
+	for _, name := range names {
+		if routes[name].Balancing != "" || previous[name].Balancing != "" {
+			config.Backends.SetPolicy(name, routes[name].Balancing) // Validated with the file
+		}
+	}
+}
+
+func hasBackend(route configfile.Route, address string) bool {
+	for _, backend := range route.Backends {
+		if backend.Address == address {
+			return true
+		}
+	}
+	return false
+}
+
+// validateCommand implements "l4-proxy validate <file>": it loads the file as the proxy would,
+// environment overrides included, and reports every problem found
+func validateCommand(args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: l4-proxy validate <config file>")
+		return 2
+	}
+	file, err := configfile.Load(args[0], configfile.L4)
+	if err == nil {
+		err = canonicalizeRoutes(file)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Printf("%s: configuration is valid\n", args[0])
+	return 0
+}
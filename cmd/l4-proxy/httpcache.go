@@ -0,0 +1,428 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Largest response body kept in the HTTP cache when no limit is configured
+const defaultHTTPCacheMaxBody = 1 << 20
+
+// Metrics for the HTTP cache on terminated connections
+var (
+	httpCacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxy_http_cache_requests_total",
+		Help: "Total number of HTTP requests seen by the cache on terminated connections, by result (hit, miss, bypass).",
+	}, []string{"sni", "result"})
+	httpCacheEvictions = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "proxy_http_cache_evictions_total",
+		Help: "Total number of resources evicted from the HTTP cache to stay within its limits.",
+	})
+	httpCacheBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "proxy_http_cache_bytes",
+		Help: "Bytes of responses held by the HTTP cache.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(httpCacheRequests, httpCacheEvictions, httpCacheBytes)
+}
+
+// responseCache holds the responses of the HTTP cache, evicting the least recently used
+// resources when it holds more than maxEntries of them or more than maxSize bytes
+type responseCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	maxSize    int64
+	size       int64
+	order      *list.List               // Of *cachedResource, most recently used first
+	resources  map[string]*list.Element // By primary key
+}
+
+// cachedResource is every stored variant of one resource
+type cachedResource struct {
+	key      string
+	vary     []string                   // Canonical header names from the response's Vary header
+	variants map[string]*cachedResponse // By variant key
+}
+
+// cachedResponse is a stored response and when it stops being fresh
+type cachedResponse struct {
+	statusCode int
+	header     http.Header
+	body       []byte
+	stored     time.Time
+	expires    time.Time
+}
+
+// size approximates the memory a stored response takes
+func (c *cachedResponse) size() int64 {
+	size := int64(len(c.body))
+	for name, values := range c.header {
+		for _, value := range values {
+			size += int64(len(name) + len(value))
+		}
+	}
+	return size
+}
+
+func newResponseCache(maxEntries int, maxSize int64) *responseCache {
+	return &responseCache{
+		maxEntries: maxEntries,
+		maxSize:    maxSize,
+		order:      list.New(),
+		resources:  make(map[string]*list.Element),
+	}
+}
+
+// lookup returns the stored response of a resource matching the request's varying headers, if it is still fresh
+func (c *responseCache) lookup(key string, req *http.Request) (*cachedResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.resources[key]
+	if !ok {
+		return nil, false
+	}
+	resource := element.Value.(*cachedResource)
+	variant := variantKey(key, resource.vary, req)
+	cached, ok := resource.variants[variant]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(cached.expires) {
+		c.size -= cached.size()
+		delete(resource.variants, variant)
+		if len(resource.variants) == 0 {
+			c.order.Remove(element)
+			delete(c.resources, key)
+		}
+		httpCacheBytes.Set(float64(c.size))
+		return nil, false
+	}
+	c.order.MoveToFront(element)
+	return cached, true
+}
+
+// store keeps a response as the variant of a resource selected by the request's values of the vary headers.
+// A response that varies on other headers than the stored ones replaces every stored variant.
+func (c *responseCache) store(key string, vary []string, req *http.Request, response *cachedResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var resource *cachedResource
+	if element, ok := c.resources[key]; ok {
+		resource = element.Value.(*cachedResource)
+		c.order.MoveToFront(element)
+		if !slices.Equal(resource.vary, vary) {
+			for _, cached := range resource.variants {
+				c.size -= cached.size()
+			}
+			resource.vary = vary
+			resource.variants = make(map[string]*cachedResponse)
+		}
+	} else {
+		resource = &cachedResource{key: key, vary: vary, variants: make(map[string]*cachedResponse)}
+		c.resources[key] = c.order.PushFront(resource)
+	}
+
+	variant := variantKey(key, vary, req)
+	if previous, ok := resource.variants[variant]; ok {
+		c.size -= previous.size()
+	}
+	resource.variants[variant] = response
+	c.size += response.size()
+
+	for c.order.Len() > 1 && (c.order.Len() > c.maxEntries || c.size > c.maxSize) {
+		evicted := c.order.Remove(c.order.Back()).(*cachedResource)
+		delete(c.resources, evicted.key)
+		for _, cached := range evicted.variants {
+			c.size -= cached.size()
+		}
+		httpCacheEvictions.Inc()
+	}
+	httpCacheBytes.Set(float64(c.size))
+}
+
+// proxyHTTPWithCache relays HTTP/1.1 requests from client to backend one at a time, answering cacheable
+// GET requests from the cache when it holds a fresh response. Connection upgrades fall back to a byte relay.
+func proxyHTTPWithCache(client, backend io.ReadWriter, sni string, config *Config) {
+	clientReader := bufio.NewReader(client)
+	backendReader := bufio.NewReader(backend)
+
+	for {
+		req, err := http.ReadRequest(clientReader)
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("Failed to read HTTP request for SNI %s: %v", sni, err)
+			}
+			return
+		}
+
+		key, cacheable := httpCacheKey(sni, req)
+		if !cacheable {
+			httpCacheRequests.WithLabelValues(sni, "bypass").Inc()
+		} else if cached, ok := lookupHTTPCache(config, key, req); ok {
+			httpCacheRequests.WithLabelValues(sni, "hit").Inc()
+			if err := writeCachedResponse(client, req, cached); err != nil || req.Close {
+				return
+			}
+			continue
+		} else {
+			httpCacheRequests.WithLabelValues(sni, "miss").Inc()
+		}
+
+		if err := req.Write(backend); err != nil {
+			log.Printf("Failed to send HTTP request to backend for SNI %s: %v", sni, err)
+			return
+		}
+		resp, err := readFinalResponse(backendReader, req, client)
+		if err != nil {
+			log.Printf("Failed to read HTTP response from backend for SNI %s: %v", sni, err)
+			return
+		}
+
+		// WebSockets and other upgrades leave HTTP behind
+		if resp.StatusCode == http.StatusSwitchingProtocols {
+			if err := resp.Write(client); err != nil {
+				return
+			}
+			relayBytes(client, clientReader, backend, backendReader)
+			return
+		}
+
+		if cacheable {
+			resp.Body = storeHTTPResponse(config, key, req, resp)
+		}
+		err = resp.Write(client)
+		resp.Body.Close()
+		if err != nil || req.Close || resp.Close {
+			return
+		}
+	}
+}
+
+// readFinalResponse reads the backend's response to a request, relaying informational responses such
+// as 100 Continue and 103 Early Hints to the client until the final one. 101 Switching Protocols is final.
+func readFinalResponse(backendReader *bufio.Reader, req *http.Request, client io.Writer) (*http.Response, error) {
+	for {
+		resp, err := http.ReadResponse(backendReader, req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode/100 != 1 || resp.StatusCode == http.StatusSwitchingProtocols {
+			return resp, nil
+		}
+
+		// Written by hand: Response.Write would add framing headers a 1xx response must not carry
+		var b bytes.Buffer
+		fmt.Fprintf(&b, "HTTP/1.1 %s\r\n", resp.Status)
+		resp.Header.Write(&b)
+		b.WriteString("\r\n")
+		if _, err := client.Write(b.Bytes()); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// httpCacheEnabled reports whether a route's terminated traffic goes through the HTTP cache. Routes that
+// require client certificates never do: their backends learn each client's identity and may answer
+// each one differently, so a shared cache would hand one client's responses to another.
+func httpCacheEnabled(config *Config, sni string) bool {
+	_, ok := config.HTTPCache.Load(sni)
+	return ok && config.ClientAuth.Lookup(sni) == nil
+}
+
+// httpCacheKey returns the primary cache key of a request and whether the request may use the cache at all.
+// The key starts with the SNI the connection was terminated for, so a Host header naming another
+// route can neither read nor replace that route's responses.
+func httpCacheKey(sni string, req *http.Request) (string, bool) {
+	if req.Method != http.MethodGet || req.Header.Get("Authorization") != "" {
+		return "", false
+	}
+	if directives := cacheControl(req.Header); directives["no-store"] {
+		return "", false
+	}
+	return strings.ToLower(sni) + " " + req.Method + " " + strings.ToLower(req.Host) + " " + req.URL.RequestURI(), true
+}
+
+// variantKey extends the primary key with the request's values of the headers the response varies on
+func variantKey(key string, vary []string, req *http.Request) string {
+	var b strings.Builder
+	b.WriteString(key)
+	for _, name := range vary {
+		b.WriteString("\n" + name + ": " + strings.Join(req.Header.Values(name), ", "))
+	}
+	return b.String()
+}
+
+// lookupHTTPCache returns a fresh stored response matching the request, unless the client asked to revalidate
+func lookupHTTPCache(config *Config, key string, req *http.Request) (*cachedResponse, bool) {
+	if directives := cacheControl(req.Header); directives["no-cache"] || req.Header.Get("Pragma") == "no-cache" {
+		return nil, false
+	}
+	return config.Cache.lookup(key, req)
+}
+
+func writeCachedResponse(client io.Writer, req *http.Request, cached *cachedResponse) error {
+	header := cached.header.Clone()
+	header.Set("Age", strconv.Itoa(int(time.Since(cached.stored).Seconds())))
+
+	resp := &http.Response{
+		StatusCode:    cached.statusCode,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(cached.body)),
+		ContentLength: int64(len(cached.body)),
+		Request:       req,
+		Close:         req.Close,
+	}
+	return resp.Write(client)
+}
+
+// storeHTTPResponse caches a response if it is cacheable and returns a body that still yields every byte to the client
+func storeHTTPResponse(config *Config, key string, req *http.Request, resp *http.Response) io.ReadCloser {
+	expires, ok := httpFreshUntil(resp)
+	if !ok {
+		return resp.Body
+	}
+
+	maxBody := config.HTTPCacheMaxBody
+	if maxBody <= 0 {
+		maxBody = defaultHTTPCacheMaxBody
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxBody+1))
+	rest := readCloser{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+	if err != nil || int64(len(body)) > maxBody {
+		return rest
+	}
+
+	var vary []string
+	for _, value := range resp.Header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				vary = append(vary, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	sort.Strings(vary)
+
+	// Age the backend reported counts towards the age we report
+	age, _ := strconv.Atoi(resp.Header.Get("Age"))
+	header := resp.Header.Clone()
+	header.Del("Age")
+	header.Del("Connection")
+	header.Del("Transfer-Encoding")
+	header.Del("Content-Length")
+
+	config.Cache.store(key, vary, req, &cachedResponse{
+		statusCode: resp.StatusCode,
+		header:     header,
+		body:       body,
+		stored:     time.Now().Add(-time.Duration(age) * time.Second),
+		expires:    expires,
+	})
+	return rest
+}
+
+// httpFreshUntil reports until when a response may be served from a shared cache.
+// Only responses with explicit freshness are stored, and never ones tied to a user.
+func httpFreshUntil(resp *http.Response) (time.Time, bool) {
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNonAuthoritativeInfo, http.StatusNoContent, http.StatusMultipleChoices,
+		http.StatusMovedPermanently, http.StatusNotFound, http.StatusGone:
+	default:
+		return time.Time{}, false
+	}
+
+	directives := cacheControl(resp.Header)
+	if directives["no-store"] || directives["no-cache"] || directives["private"] {
+		return time.Time{}, false
+	}
+	if resp.Header.Get("Set-Cookie") != "" || strings.Contains(resp.Header.Get("Vary"), "*") {
+		return time.Time{}, false
+	}
+
+	now := time.Now()
+	age, _ := strconv.Atoi(resp.Header.Get("Age"))
+	for _, directive := range []string{"s-maxage", "max-age"} {
+		if value, ok := cacheControlValue(resp.Header, directive); ok {
+			seconds, err := strconv.Atoi(value)
+			if err != nil || seconds-age <= 0 {
+				return time.Time{}, false
+			}
+			return now.Add(time.Duration(seconds-age) * time.Second), true
+		}
+	}
+
+	if expires, err := http.ParseTime(resp.Header.Get("Expires")); err == nil {
+		date, err := http.ParseTime(resp.Header.Get("Date"))
+		if err != nil {
+			date = now
+		}
+		if lifetime := expires.Sub(date); lifetime > 0 {
+			return now.Add(lifetime), true
+		}
+	}
+	return time.Time{}, false
+}
+
+// cacheControl returns the Cache-Control directives of a message, lowercased and without values
+func cacheControl(header http.Header) map[string]bool {
+	directives := make(map[string]bool)
+	for _, value := range header.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			name, _, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			directives[strings.ToLower(name)] = true
+		}
+	}
+	return directives
+}
+
+func cacheControlValue(header http.Header, name string) (string, bool) {
+	for _, value := range header.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			key, arg, ok := strings.Cut(strings.TrimSpace(directive), "=")
+			if ok && strings.EqualFold(key, name) {
+				return strings.Trim(arg, `"`), true
+			}
+		}
+	}
+	return "", false
+}
+
+// readCloser pairs a reader with the closer of the body it reads from
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// relayBytes copies in both directions until both sides are done; the readers may hold bytes already buffered
+func relayBytes(client io.Writer, clientReader io.Reader, backend io.Writer, backendReader io.Reader) {
+	done := make(chan struct{})
+	go func() {
+		_, _ = io.Copy(backend, clientReader)
+		done <- struct{}{}
+	}()
+	go func() {
+		_, _ = io.Copy(client, backendReader)
+		done <- struct{}{}
+	}()
+
+	<-done
+	<-done
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"reverse-proxy/internal/clientauth"
+)
+
+func cached(body string) *cachedResponse {
+	return &cachedResponse{
+		statusCode: http.StatusOK,
+		header:     http.Header{},
+		body:       []byte(body),
+		stored:     time.Now(),
+		expires:    time.Now().Add(time.Minute),
+	}
+}
+
+func TestResponseCacheVary(t *testing.T) {
+	cache := newResponseCache(10, 1<<20)
+	request := func(language string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Accept-Language", language)
+		return r
+	}
+	vary := []string{"Accept-Language"}
+	cache.store("key", vary, request("en"), cached("hello"))
+	cache.store("key", vary, request("fr"), cached("bonjour"))
+
+	for language, want := range map[string]string{"en": "hello", "fr": "bonjour"} {
+		if got, ok := cache.lookup("key", request(language)); !ok || string(got.body) != want {
+			t.Errorf("Accept-Language %s: got %v, want %q", language, got, want)
+		}
+	}
+	if _, ok := cache.lookup("key", request("de")); ok {
+		t.Error("a variant was served for a language it wasn't stored for")
+	}
+
+	// A response varying on other headers replaces every variant
+	cache.store("key", []string{"Accept-Encoding"}, request("en"), cached("plain"))
+	if _, ok := cache.lookup("key", request("fr")); !ok {
+		t.Error("the new variant doesn't match a request without Accept-Encoding")
+	}
+	if cache.size != int64(len("plain")) {
+		t.Errorf("cache size = %d after replacing the variants, want %d", cache.size, len("plain"))
+	}
+}
+
+func TestResponseCacheEviction(t *testing.T) {
+	request := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	// By entries: the least recently used resource goes first
+	cache := newResponseCache(2, 1<<20)
+	cache.store("a", nil, request, cached("a"))
+	cache.store("b", nil, request, cached("b"))
+	cache.lookup("a", request)
+	cache.store("c", nil, request, cached("c"))
+	for key, want := range map[string]bool{"a": true, "b": false, "c": true} {
+		if _, ok := cache.lookup(key, request); ok != want {
+			t.Errorf("by entries: %s cached = %v, want %v", key, ok, want)
+		}
+	}
+
+	// By bytes
+	cache = newResponseCache(10, 10)
+	cache.store("a", nil, request, cached("aaaa"))
+	cache.store("b", nil, request, cached("bbbb"))
+	cache.store("c", nil, request, cached("cccc"))
+	for key, want := range map[string]bool{"a": false, "b": true, "c": true} {
+		if _, ok := cache.lookup(key, request); ok != want {
+			t.Errorf("by bytes: %s cached = %v, want %v", key, ok, want)
+		}
+	}
+	if cache.size != 8 {
+		t.Errorf("cache size = %d, want 8", cache.size)
+	}
+
+	// A response larger than the cache still replaces everything else
+	cache.store("d", nil, request, cached(strings.Repeat("d", 20)))
+	if cache.order.Len() != 1 {
+		t.Errorf("cache holds %d resources, want only the newest", cache.order.Len())
+	}
+
+	// Expired responses are dropped when looked up
+	cache = newResponseCache(10, 1<<20)
+	stale := cached("stale")
+	stale.expires = time.Now().Add(-time.Second)
+	cache.store("a", nil, request, stale)
+	if _, ok := cache.lookup("a", request); ok || cache.size != 0 || cache.order.Len() != 0 {
+		t.Error("an expired response was served or kept")
+	}
+}
+
+func TestHTTPCacheKey(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		method    string
+		header    http.Header
+		cacheable bool
+	}{
+		{"GET", http.MethodGet, nil, true},
+		{"POST", http.MethodPost, nil, false},
+		{"HEAD", http.MethodHead, nil, false},
+		{"Authorization", http.MethodGet, http.Header{"Authorization": {"Bearer token"}}, false},
+		{"no-store", http.MethodGet, http.Header{"Cache-Control": {"max-age=0, no-store"}}, false},
+	} {
+		r := httptest.NewRequest(tc.method, "http://example.com/a?b=c", nil)
+		for name, values := range tc.header {
+			r.Header[name] = values
+		}
+		if _, ok := httpCacheKey("example.com", r); ok != tc.cacheable {
+			t.Errorf("%s: cacheable = %v, want %v", tc.name, ok, tc.cacheable)
+		}
+	}
+
+	// Routes don't share keys, whatever the Host header says
+	r := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	a, _ := httpCacheKey("a.example.com", r)
+	b, _ := httpCacheKey("b.example.com", r)
+	if a == b {
+		t.Errorf("two routes share the key %q", a)
+	}
+}
+
+func TestHTTPFreshUntil(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		status    int
+		header    http.Header
+		cacheable bool
+	}{
+		{"max-age", http.StatusOK, http.Header{"Cache-Control": {"max-age=60"}}, true},
+		{"s-maxage", http.StatusOK, http.Header{"Cache-Control": {"s-maxage=60"}}, true},
+		{"Expires", http.StatusOK, http.Header{"Expires": {time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)}}, true},
+		{"no freshness", http.StatusOK, http.Header{}, false},
+		{"older than max-age", http.StatusOK, http.Header{"Cache-Control": {"max-age=60"}, "Age": {"60"}}, false},
+		{"no-store", http.StatusOK, http.Header{"Cache-Control": {"max-age=60, no-store"}}, false},
+		{"no-cache", http.StatusOK, http.Header{"Cache-Control": {"no-cache, max-age=60"}}, false},
+		{"private", http.StatusOK, http.Header{"Cache-Control": {"private, max-age=60"}}, false},
+		{"Set-Cookie", http.StatusOK, http.Header{"Cache-Control": {"max-age=60"}, "Set-Cookie": {"id=1"}}, false},
+		{"Vary *", http.StatusOK, http.Header{"Cache-Control": {"max-age=60"}, "Vary": {"*"}}, false},
+		{"server error", http.StatusInternalServerError, http.Header{"Cache-Control": {"max-age=60"}}, false},
+	} {
+		resp := &http.Response{StatusCode: tc.status, Header: tc.header}
+		if _, ok := httpFreshUntil(resp); ok != tc.cacheable {
+			t.Errorf("%s: cacheable = %v, want %v", tc.name, ok, tc.cacheable)
+		}
+	}
+}
+
+func TestHTTPCacheRefusedWithClientAuth(t *testing.T) {
+	config := &Config{ClientAuth: clientauth.Verifiers{"secure.example.com": &clientauth.Verifier{}}}
+	config.HTTPCache.Store("example.com", true)
+	config.HTTPCache.Store("secure.example.com", true)
+
+	if !httpCacheEnabled(config, "example.com") {
+		t.Error("cache disabled for a route without client certificates")
+	}
+	if httpCacheEnabled(config, "secure.example.com") {
+		t.Error("cache enabled for a route that requires client certificates")
+	}
+	if httpCacheEnabled(config, "other.example.com") {
+		t.Error("cache enabled for a route that didn't opt in")
+	}
+}
+
+func TestProxyHTTPWithCacheRelaysInformationalResponses(t *testing.T) {
+	client, proxyClient := net.Pipe()
+	proxyBackend, backend := net.Pipe()
+	defer client.Close()
+	defer backend.Close()
+
+	var requests atomic.Int32
+	go func() {
+		reader := bufio.NewReader(backend)
+		for {
+			req, err := http.ReadRequest(reader)
+			if err != nil {
+				return
+			}
+			io.Copy(io.Discard, req.Body)
+			requests.Add(1)
+			fmt.Fprint(backend, "HTTP/1.1 100 Continue\r\n\r\n")
+			fmt.Fprint(backend, "HTTP/1.1 103 Early Hints\r\nLink: </style.css>; rel=preload\r\n\r\n")
+			fmt.Fprint(backend, "HTTP/1.1 200 OK\r\nCache-Control: max-age=60\r\nContent-Length: 5\r\n\r\nhello")
+		}
+	}()
+
+	config := &Config{Cache: newResponseCache(10, 1<<20)}
+	go func() {
+		proxyHTTPWithCache(proxyClient, proxyBackend, "example.com", config)
+		proxyClient.Close()
+		proxyBackend.Close()
+	}()
+
+	reader := bufio.NewReader(client)
+	get := func() *http.Response {
+		t.Helper()
+		fmt.Fprint(client, "GET /page HTTP/1.1\r\nHost: example.com\r\n\r\n")
+		resp, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	// The first response comes from the backend, after its informational ones
+	if resp := get(); resp.StatusCode != http.StatusContinue {
+		t.Fatalf("first response is %d, want 100", resp.StatusCode)
+	}
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusEarlyHints || resp.Header.Get("Link") == "" {
+		t.Fatalf("second response is %d %v, want 103 with its Link", resp.StatusCode, resp.Header)
+	}
+	if resp.Header.Get("Content-Length") != "" || resp.Header.Get("Connection") != "" {
+		t.Fatalf("103 relayed with framing headers %v", resp.Header)
+	}
+	resp, err = http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body, _ := io.ReadAll(resp.Body); resp.StatusCode != http.StatusOK || string(body) != "hello" {
+		t.Fatalf("final response is %d %q", resp.StatusCode, body)
+	}
+
+	// The final response was cached, not the informational ones
+	resp = get()
+	if body, _ := io.ReadAll(resp.Body); resp.StatusCode != http.StatusOK || string(body) != "hello" || resp.Header.Get("Age") == "" {
+		t.Fatalf("repeated request got %d %q %v", resp.StatusCode, body, resp.Header)
+	}
+	if n := requests.Load(); n != 1 {
+		t.Fatalf("backend saw %d requests, want 1", n)
+	}
+}
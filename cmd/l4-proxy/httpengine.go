@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"reverse-proxy/internal/clientauth"
+)
+
+// Hop-by-hop headers that apply to a single connection and are not forwarded
+var hopHeaders = []string{"Connection", "Keep-Alive", "Proxy-Connection", "TE", "Trailer", "Upgrade"}
+
+// removeHopHeaders drops the hop-by-hop headers, including those the Connection header names
+func removeHopHeaders(header http.Header) {
+	for _, value := range header.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				header.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		header.Del(name)
+	}
+}
+
+// connListener is a net.Listener for connections accepted and terminated elsewhere
+type connListener struct {
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+	addr      net.Addr
+}
+
+func newConnListener(addr net.Addr) *connListener {
+	return &connListener{
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+		addr:   addr,
+	}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *connListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.addr
+}
+
+// httpEngine serves terminated connections of HTTP routes with per-request routing and balancing
+type httpEngine struct {
+	config     *Config
+	listener   *connListener
+	transports sync.Map // Route and backend address to the *http.Transport reaching that backend
+}
+
+// newHTTPEngine starts an HTTP server that is fed connections through serve
+func newHTTPEngine(config *Config) *httpEngine {
+	engine := &httpEngine{
+		config:   config,
+		listener: newConnListener(&net.TCPAddr{}),
+	}
+
+	config.Backends.OnRemove(engine.evict)
+
+	server := &http.Server{
+		Handler:           http.HandlerFunc(engine.handleHTTPRequest),
+		ReadHeaderTimeout: 30 * time.Second,
+		IdleTimeout:       2 * time.Minute,
+	}
+	go func() {
+		if err := server.Serve(engine.listener); err != nil && err != net.ErrClosed {
+			log.Printf("HTTP engine stopped: %v", err)
+		}
+	}()
+	return engine
+}
+
+// serve hands a terminated connection to the HTTP server, which closes it when the client is done
+func (e *httpEngine) serve(conn *tls.Conn) {
+	select {
+	case e.listener.conns <- conn:
+	case <-e.listener.closed:
+		conn.Close()
+	}
+}
+
+// handleHTTPRequest routes a request by Host and path and forwards it to the next backend of the route
+func (e *httpEngine) handleHTTPRequest(w http.ResponseWriter, r *http.Request) {
+	activeConnections.Inc()
+	defer activeConnections.Dec()
+
+	// A connection may only carry requests for the name it was terminated for, so
+	// per-SNI client certificate and TLS policies can't be sidestepped through the Host header
+	host := strings.ToLower(r.Host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if !strings.EqualFold(host, strings.TrimSuffix(r.TLS.ServerName, ".")) {
+		http.Error(w, "Host does not match the TLS server name", http.StatusMisdirectedRequest)
+		return
+	}
+
+	clientIP, _, _ := net.SplitHostPort(r.RemoteAddr)
+	route, backendAddr, err := e.route(host, r.URL.Path, clientIP)
+	if err != nil {
+		http.Error(w, "No backend available", http.StatusServiceUnavailable)
+		log.Printf("No backend available for %s%s", host, r.URL.Path)
+		return
+	}
+	start := time.Now()
+	var failure error
+	defer func() { reportBackend(e.config, route, backendAddr, start, failure) }()
+
+	transport, scheme := e.transport(route, backendAddr)
+	targetHost := backendAddr
+	if strings.HasPrefix(backendAddr, unixScheme) {
+		targetHost = "unix"
+	}
+
+	// Create a new request to forward to the backend
+	target := scheme + "://" + targetHost
+	if r.URL.Path != "*" {
+		target += r.URL.RequestURI()
+	}
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, target, r.Body)
+	if err != nil {
+		http.Error(w, "Failed to create request", http.StatusInternalServerError)
+		log.Printf("Failed to create request for backend: %v", err)
+		return
+	}
+	if r.URL.Path == "*" {
+		req.URL.Opaque = "*" // OPTIONS * asks about the server rather than a resource
+	}
+	req.Header = r.Header.Clone()
+	removeHopHeaders(req.Header)
+	req.Host = r.Host
+	req.ContentLength = r.ContentLength
+
+	// Only the proxy may vouch for a client certificate
+	clientauth.StripHeaders(req.Header)
+	if identity, ok := clientauth.IdentityFrom(*r.TLS); ok {
+		identity.SetHeaders(req.Header)
+	}
+	if clientIP != "" {
+		req.Header.Add("X-Forwarded-For", clientIP)
+	}
+	req.Header.Set("X-Forwarded-Host", r.Host)
+	req.Header.Set("X-Forwarded-Proto", "https")
+
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		failure = err
+		http.Error(w, "Failed to connect to backend", http.StatusBadGateway)
+		log.Printf("Failed to connect to backend %s: %v", backendAddr, err)
+		return
+	}
+	defer resp.Body.Close()
+
+	// Copy the response back to the client
+	removeHopHeaders(resp.Header)
+	for key, values := range resp.Header {
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		failure = err
+		log.Printf("Failed to relay response from backend %s: %v", backendAddr, err)
+	}
+}
+
+// route picks the most specific route for a request: host/path prefixes from longest to shortest, then the host
+// itself. Backends register for a path by using "host/path" as their name. key identifies the client.
+// Paths that aren't absolute, like the "*" of OPTIONS *, go to the host.
+func (e *httpEngine) route(host, path, key string) (string, string, error) {
+	for prefix := strings.TrimSuffix(path, "/"); strings.HasPrefix(prefix, "/"); prefix = prefix[:strings.LastIndex(prefix, "/")] {
+		if backendAddr, err := getNextBackend(e.config, host+prefix, key); err == nil {
+			return host + prefix, backendAddr, nil
+		}
+	}
+	backendAddr, err := getNextBackend(e.config, host, key)
+	return host, backendAddr, err
+}
+
+// transport returns the transport and URL scheme for a backend of a route, re-encrypting if the route requires it
+func (e *httpEngine) transport(route, backendAddr string) (*http.Transport, string) {
+	host, _, _ := strings.Cut(route, "/")
+	upstream := e.config.UpstreamTLS.Lookup(host)
+	scheme := "http"
+	if upstream != nil {
+		scheme = "https"
+	}
+
+	key := route + "|" + backendAddr
+	if value, ok := e.transports.Load(key); ok {
+		return value.(*http.Transport), scheme
+	}
+
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialBackend(e.config, backendAddr)
+		},
+		MaxIdleConnsPerHost: 16,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	if upstream != nil {
+		// Socket backends have no hostname to verify, so they are checked against the route's host
+		backendHost, _, err := net.SplitHostPort(backendAddr)
+		if err != nil {
+			backendHost = host
+		}
+		transport.TLSClientConfig = upstream.ClientConfig(backendHost)
+	}
+	value, _ := e.transports.LoadOrStore(key, transport)
+	return value.(*http.Transport), scheme
+}
+
+// evict drops the transport of a backend that left its route and closes its idle connections.
+// Requests still in flight finish on it; their connections close once idle for IdleConnTimeout.
+func (e *httpEngine) evict(route, backendAddr string) {
+	if value, ok := e.transports.LoadAndDelete(route + "|" + backendAddr); ok {
+		value.(*http.Transport).CloseIdleConnections()
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"reverse-proxy/internal/adminapi"
+	"reverse-proxy/internal/routing"
+)
+
+// listenHTTPEngine starts an engine whose routes are empty until the test adds them
+func listenHTTPEngine(t *testing.T) *httpEngine {
+	t.Helper()
+	engine := newHTTPEngine(&Config{Backends: routing.NewTable()})
+	t.Cleanup(func() { engine.listener.Close() })
+	return engine
+}
+
+// namedBackend starts a backend that answers every request with its name
+func namedBackend(t *testing.T, name string) string {
+	t.Helper()
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, name)
+	}))
+	t.Cleanup(backend.Close)
+	return strings.TrimPrefix(backend.URL, "http://")
+}
+
+// request sends a request for host and path over a connection terminated for serverName
+func (e *httpEngine) request(serverName, host, path string, header http.Header) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, path, nil)
+	r.Host = host
+	r.TLS = &tls.ConnectionState{ServerName: serverName}
+	for name, values := range header {
+		r.Header[name] = values
+	}
+	w := httptest.NewRecorder()
+	e.handleHTTPRequest(w, r)
+	return w
+}
+
+func TestHTTPEngineHostMustMatchServerName(t *testing.T) {
+	engine := listenHTTPEngine(t)
+	backend := namedBackend(t, "ok")
+	engine.config.Backends.Add("a.example.com", adminapi.Backend{Address: backend, Weight: 1})
+	engine.config.Backends.Add("b.example.com", adminapi.Backend{Address: backend, Weight: 1})
+
+	for _, tc := range []struct {
+		serverName, host string
+		want             int
+	}{
+		{"a.example.com", "a.example.com", http.StatusOK},
+		{"a.example.com", "a.example.com:443", http.StatusOK},
+		{"a.example.com", "A.Example.com", http.StatusOK},
+		{"a.example.com.", "a.example.com", http.StatusOK},
+		{"a.example.com", "b.example.com", http.StatusMisdirectedRequest},
+		{"", "a.example.com", http.StatusMisdirectedRequest},
+	} {
+		if w := engine.request(tc.serverName, tc.host, "/", nil); w.Code != tc.want {
+			t.Errorf("SNI %q, Host %q: got %d, want %d", tc.serverName, tc.host, w.Code, tc.want)
+		}
+	}
+}
+
+func TestHTTPEnginePathPrefixRouting(t *testing.T) {
+	engine := listenHTTPEngine(t)
+	for _, route := range []string{"example.com", "example.com/api", "example.com/api/v2"} {
+		engine.config.Backends.Add(route, adminapi.Backend{Address: namedBackend(t, route), Weight: 1})
+	}
+
+	for path, want := range map[string]string{
+		"/":               "example.com",
+		"/index.html":     "example.com",
+		"/apiary":         "example.com",
+		"/api":            "example.com/api",
+		"/api/":           "example.com/api",
+		"/api/users?id=1": "example.com/api",
+		"/api/v2":         "example.com/api/v2",
+		"/api/v2/users/1": "example.com/api/v2",
+		"/api/v20":        "example.com/api",
+	} {
+		w := engine.request("example.com", "example.com", path, nil)
+		if w.Code != http.StatusOK || w.Body.String() != want {
+			t.Errorf("%s: got %d %q, want the route %s", path, w.Code, w.Body.String(), want)
+		}
+	}
+
+	// Without a host route, paths outside every prefix have nowhere to go
+	engine.config.Backends.RemoveRoute("example.com")
+	if w := engine.request("example.com", "example.com", "/other", nil); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("unrouted path got %d", w.Code)
+	}
+}
+
+func TestHTTPEngineStripsHopByHopHeaders(t *testing.T) {
+	var received http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Clone()
+		w.Header().Set("Connection", "X-Backend-Hop")
+		w.Header().Set("X-Backend-Hop", "1")
+		w.Header().Set("Keep-Alive", "timeout=5")
+		w.Header().Set("X-Backend-End", "1")
+	}))
+	defer backend.Close()
+
+	engine := listenHTTPEngine(t)
+	engine.config.Backends.Add("example.com", adminapi.Backend{Address: strings.TrimPrefix(backend.URL, "http://"), Weight: 1})
+
+	w := engine.request("example.com", "example.com", "/", http.Header{
+		"Connection":       {"X-Client-Hop, keep-alive"},
+		"X-Client-Hop":     {"1"},
+		"Keep-Alive":       {"timeout=5"},
+		"Proxy-Connection": {"keep-alive"},
+		"Te":               {"trailers"},
+		"Trailer":          {"X-Checksum"},
+		"Upgrade":          {"websocket"},
+		"X-Client-End":     {"1"},
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d", w.Code)
+	}
+
+	for _, name := range []string{"X-Client-Hop", "Keep-Alive", "Proxy-Connection", "Te", "Trailer", "Upgrade"} {
+		if value := received.Get(name); value != "" {
+			t.Errorf("backend received %s: %s", name, value)
+		}
+	}
+	if received.Get("X-Client-End") == "" || received.Get("X-Forwarded-Host") != "example.com" {
+		t.Errorf("backend didn't receive the end-to-end headers: %v", received)
+	}
+	for _, name := range []string{"Connection", "X-Backend-Hop", "Keep-Alive"} {
+		if value := w.Header().Get(name); value != "" {
+			t.Errorf("client received %s: %s", name, value)
+		}
+	}
+	if w.Header().Get("X-Backend-End") == "" {
+		t.Errorf("client didn't receive the end-to-end headers: %v", w.Header())
+	}
+}
+
+func TestHTTPEngineEvictsTransports(t *testing.T) {
+	engine := listenHTTPEngine(t)
+	backend := namedBackend(t, "ok")
+	engine.config.Backends.Add("example.com", adminapi.Backend{Address: backend, Weight: 1})
+	engine.config.Backends.Add("example.com/api", adminapi.Backend{Address: backend, Weight: 1})
+
+	cached := func(route string) bool {
+		_, ok := engine.transports.Load(route + "|" + backend)
+		return ok
+	}
+	engine.request("example.com", "example.com", "/", nil)
+	engine.request("example.com", "example.com", "/api", nil)
+	if !cached("example.com") || !cached("example.com/api") {
+		t.Fatal("no transports kept for the backend")
+	}
+
+	engine.config.Backends.Remove("example.com/api", backend)
+	if cached("example.com/api") {
+		t.Error("transport kept after its backend was removed")
+	}
+	if !cached("example.com") {
+		t.Error("transport of another route evicted")
+	}
+	engine.config.Backends.RemoveRoute("example.com")
+	if cached("example.com") {
+		t.Error("transport kept after its route was removed")
+	}
+}
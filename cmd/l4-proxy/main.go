@@ -2,32 +2,102 @@ package main
 
 import (
 	"bufio"
-	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/http"
+	"os"
 	"runtime"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/shirou/gopsutil/cpu"
+
+	"reverse-proxy/internal/acmecert"
+	"reverse-proxy/internal/adminapi"
+	"reverse-proxy/internal/apiauth"
+	"reverse-proxy/internal/balancer"
+	"reverse-proxy/internal/certstore"
+	"reverse-proxy/internal/clientauth"
+	"reverse-proxy/internal/configfile"
+	"reverse-proxy/internal/lease"
+	"reverse-proxy/internal/registrystore"
+	"reverse-proxy/internal/routing"
+	"reverse-proxy/internal/ticketkeys"
+	"reverse-proxy/internal/tlspolicy"
+	"reverse-proxy/internal/upstreamtls"
 )
 
 import _ "net/http/pprof"
 
+const unixScheme = "unix://" // Prefix of Unix domain socket backend addresses
+
+// TLS modes a route can declare
+const (
+	modePassthrough = "passthrough" // Forward the encrypted stream to the backend
+	modeTerminate   = "terminate"   // Terminate TLS at the proxy
+	modeHTTP        = "http"        // Terminate TLS and serve requests through the in-process HTTP engine
+)
+
 type Config struct {
-	Backends       sync.Map // Thread-safe map for backend name-to-address mapping
-	BackendIndices sync.Map // Tracks the next backend to use for each SNI (round-robin)
-	TLSTermination bool     // Enable or disable TLS termination
-	CertFile       string   // Path to TLS certificate file (if termination enabled)
-	KeyFile        string   // Path to TLS private key file (if termination enabled)
-	Cache          sync.Map // A thread-safe cache for storing responses
+	Backends            *routing.Table                // Routes and their backends, replaced as a whole on every change
+	Leases              *lease.Table                  // Expiry of backends registered with a TTL
+	RegistryFile        string                        // Log the registry is persisted to and restored from (empty to keep it in memory)
+	Store               *registrystore.Store          // Opened from RegistryFile
+	APIAuthPolicy       apiauth.Policy                // Who may register backends and use the admin API (open if empty)
+	APIAuth             *apiauth.Authorizer           // Loaded from APIAuthPolicy
+	ListenAddress       string                        // Listener for TLS and SNI-routed traffic
+	AdminAddress        string                        // Listener for the registration and admin APIs
+	MetricsAddress      string                        // Listener for Prometheus metrics (empty to disable)
+	PprofAddress        string                        // Listener for profiling endpoints (empty to disable)
+	Reloader            *configfile.Reloader          // Reloads the routes of the configuration file (nil without one)
+	TLSTermination      bool                          // Default mode: terminate TLS for SNIs without a mode of their own
+	RouteModes          sync.Map                      // SNI to its TLS mode (modePassthrough, modeTerminate or modeHTTP)
+	CertFile            string                        // Path to the default TLS certificate file (if termination enabled)
+	KeyFile             string                        // Path to the default TLS private key file (if termination enabled)
+	CertDir             string                        // Directory of per-SNI cert/key pairs (if termination enabled)
+	Certificates        *certstore.Store              // Certificates indexed by SAN, loaded from CertFile/KeyFile and CertDir
+	ACMEDirectoryURL    string                        // ACME directory for automatic certificates (empty to disable)
+	ACMEEmail           string                        // Contact address for the ACME account
+	ACMECacheDir        string                        // Where ACME account keys and certificates are stored
+	ACMECARoot          string                        // PEM bundle trusted for the ACME directory (e.g. Pebble's test CA)
+	ACMEHTTPAddress     string                        // Listener for HTTP-01 challenges
+	ACME                *acmecert.Manager             // Obtains and renews certificates for registered SNIs
+	ClientAuthPolicies  map[string]clientauth.Policy  // Per-SNI client certificate requirements (if termination enabled)
+	ClientAuth          clientauth.Verifiers          // Loaded from ClientAuthPolicies
+	TLSPolicies         map[string]tlspolicy.Policy   // Per-SNI TLS versions, cipher suites, curves and ALPN (termination and passthrough)
+	TLSRules            tlspolicy.Rules               // Loaded from TLSPolicies
+	UpstreamTLSPolicies map[string]upstreamtls.Policy // Per-SNI TLS to backends after termination
+	UpstreamTLS         upstreamtls.Routes            // Loaded from UpstreamTLSPolicies
+	TLSConfig           *tls.Config                   // Server configuration shared by all terminated connections
+	HTTPEngine          *httpEngine                   // Serves terminated routes in modeHTTP request by request
+	TicketKeyFile       string                        // Session ticket key seed shared with other instances (empty for a per-process seed)
+	TicketKeyRotation   time.Duration                 // How long each session ticket key encrypts new tickets
+	Cache               *responseCache                // Responses stored by the HTTP cache, shared by every route
+	HTTPCache           sync.Map                      // SNIs whose terminated traffic is parsed as HTTP/1.1 to cache GET responses (opt-in)
+	HTTPCacheMaxBody    int64                         // Largest response body the HTTP cache stores
+	UDPRoutes           map[string]string             // UDP listener address to route name (backends register under the route name)
+	UDPSessionTimeout   time.Duration                 // Idle time after which a UDP session is expired
+	UDPMaxSessions      int                           // Maximum number of UDP sessions per listener (0 for unlimited)
+	QUICAddress         string                        // UDP address for SNI routing of QUIC connections (empty to disable)
+	PortForwards        sync.Map                      // Listener address to net.Listener for plain TCP port-forward routes
+	DNSServer           string                        // DNS server (host:port) for backend hostnames; empty for the system resolver
+	DNSCacheTTL         time.Duration                 // How long resolved backend addresses and SRV records are reused
+	Resolver            *backendResolver              // Resolves backend hostnames and SRV records (nil to dial directly)
+	DockerSocket        string                        // Docker Engine API socket to discover labeled containers on (empty to disable)
+	TargetFiles         []string                      // Target files or patterns to discover backends from (empty to disable)
+	TargetFileRefresh   time.Duration                 // How often target files are checked for changes
 }
 
 // Metrics for Prometheus
@@ -49,6 +119,10 @@ var (
 		Help:    "Histogram of request latency in seconds.",
 		Buckets: prometheus.LinearBuckets(0, 2, 10),
 	})
+	tlsHandshakes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxy_tls_handshakes_total",
+		Help: "Total number of completed TLS handshakes on terminated connections, by whether a session was resumed.",
+	}, []string{"resumed"})
 )
 
 var (
@@ -84,6 +158,7 @@ func getCPUUsage() (float64, error) {
 func init() {
 	// Register metrics with Prometheus
 	prometheus.MustRegister(activeConnections, totalRequests, requestErrors, requestLatency, cpuUsage, cpuUsageMetric, memoryUsage, goroutines)
+	prometheus.MustRegister(tlsHandshakes)
 }
 
 // Proxy listens for incoming connections
@@ -96,9 +171,20 @@ func startProxy(address string, config *Config) error {
 
 	log.Printf("Listening on %s", address)
 
+	serveConnections(listener, func(conn net.Conn) {
+		handleConnection(conn, config)
+	})
+	return nil
+}
+
+// Accept connections until the listener is closed, recording metrics for each one
+func serveConnections(listener net.Listener, handle func(conn net.Conn)) {
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
 			log.Printf("Failed to accept connection: %v", err)
 			continue
 		}
@@ -116,104 +202,179 @@ func startProxy(address string, config *Config) error {
 			startTime := time.Now()
 			totalRequests.Inc() // Increment total requests
 
-			if config.TLSTermination {
-				handleTLSTerminationConnection(conn, config)
-			} else {
-				handleConnection(conn, config)
-			}
+			handle(conn)
 
 			duration := time.Since(startTime).Milliseconds()
 			requestLatency.Observe(float64(duration))
 		}()
 	}
 }
-func handleTLSTerminationConnection(conn net.Conn, config *Config) {
-	defer conn.Close()
-
-	// Load TLS certificate and private key
-	cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
-	if err != nil {
-		log.Printf("Failed to load TLS certificate: %v", err)
-		return
-	}
-
-	tlsConfig := &tls.Config{
-		Certificates: []tls.Certificate{cert},
-		GetCertificate: func(info *tls.ClientHelloInfo) (*tls.Certificate, error) {
-			log.Printf("Received connection with SNI: %s", info.ServerName)
-			return &cert, nil
-		},
-	}
 
+func handleTLSTerminationConnection(conn net.Conn, config *Config) {
 	// Wrap the connection in TLS
-	tlsConn := tls.Server(conn, tlsConfig)
+	tlsConn := tls.Server(conn, config.TLSConfig)
 	if err := tlsConn.Handshake(); err != nil {
 		log.Printf("TLS handshake failed: %v", err)
+		conn.Close()
 		return
 	}
-	defer tlsConn.Close()
+	tlsHandshakes.WithLabelValues(strconv.FormatBool(tlsConn.ConnectionState().DidResume)).Inc()
 
-	sni := tlsConn.ConnectionState().ServerName
+	// HTTP routes are served request by request; the HTTP engine closes the connection when the client is done
+	if !acmecert.IsChallenge(tlsConn.ConnectionState()) && routeMode(config, tlsConn.ConnectionState().ServerName) == modeHTTP {
+		config.HTTPEngine.serve(tlsConn)
+		return
+	}
+	defer tlsConn.Close()
 
-	// Check the cache for a response
-	cacheKey := fmt.Sprintf("tls:%s", sni)
-	if cachedResponse, found := getFromCache(config, cacheKey); found {
-		log.Printf("Cache hit for SNI: %s", sni)
-		handleCachedResponse(tlsConn, cachedResponse)
+	// TLS-ALPN-01 validation connections end after the handshake
+	if acmecert.IsChallenge(tlsConn.ConnectionState()) {
+		log.Printf("Answered ACME challenge for SNI: %s", tlsConn.ConnectionState().ServerName)
 		return
 	}
 
-	// Get the next backend using round-robin
-	backendAddr, err := getNextBackend(config, sni)
+	state := tlsConn.ConnectionState()
+	sni := state.ServerName
+	identity, verified := clientauth.IdentityFrom(state)
+
+	// Get the next backend from the route's balancer
+	backendAddr, err := getNextBackend(config, sni, clientKey(conn.RemoteAddr()))
 	if err != nil {
 		log.Printf("No backend found for SNI: %s", sni)
 		return
 	}
+	start := time.Now()
+	defer func() { reportBackend(config, sni, backendAddr, start, err) }()
 
 	// Connect to the backend
-	backendConn, err := net.Dial("tcp", backendAddr)
+	var backendConn net.Conn
+	backendConn, err = dialBackend(config, backendAddr)
 	if err != nil {
 		log.Printf("Failed to connect to backend: %v", err)
 		return
 	}
 	defer backendConn.Close()
 
-	// Forward traffic and cache the response
-	log.Printf("Forwarding plaintext traffic between client and backend (%s)", backendAddr)
-	responseBuffer := &bytes.Buffer{}
-	done := make(chan struct{})
-	teeReader := io.TeeReader(backendConn, responseBuffer)
-
-	go func() {
-		_, _ = io.Copy(backendConn, tlsConn)
-		done <- struct{}{}
-	}()
-	go func() {
-		_, _ = io.Copy(tlsConn, teeReader)
-		done <- struct{}{}
-	}()
+	// Pass the verified client identity to the backend in a PROXY v2 header
+	if verified {
+		if err = writeProxyHeaderV2(backendConn, conn.RemoteAddr(), conn.LocalAddr(), tlsIdentityTLVs(state, identity)); err != nil {
+			log.Printf("Failed to send PROXY header to backend: %v", err)
+			return
+		}
+	}
 
-	<-done
-	<-done
+	// Re-encrypt to the backend if the route requires it
+	if upstream := config.UpstreamTLS.Lookup(sni); upstream != nil {
+		host, _, _ := net.SplitHostPort(backendAddr)
+		backendTLS := tls.Client(backendConn, upstream.ClientConfig(host))
+		if err = backendTLS.Handshake(); err != nil {
+			log.Printf("TLS handshake with backend %s failed: %v", backendAddr, err)
+			return
+		}
+		defer backendTLS.Close()
+		backendConn = backendTLS
+	}
 
-	storeInCache(config, cacheKey, responseBuffer.Bytes())
-	log.Printf("Response cached for SNI: %s", sni)
+	// Routes that opted in are parsed as HTTP/1.1 so cacheable responses can be shared between clients
+	if httpCacheEnabled(config, sni) {
+		log.Printf("Proxying HTTP/1.1 between client and backend (%s) with caching", backendAddr)
+		proxyHTTPWithCache(tlsConn, backendConn, sni, config)
+	} else {
+		log.Printf("Forwarding plaintext traffic between client and backend (%s)", backendAddr)
+		relayBytes(tlsConn, tlsConn, backendConn, backendConn)
+	}
 
 	log.Printf("Connection closed for SNI: %s", tlsConn.ConnectionState().ServerName)
 }
 
+// newTLSConfig builds the server configuration shared by every terminated connection.
+// It lives as long as the proxy so session tickets it issues can be resumed.
+func newTLSConfig(config *Config) *tls.Config {
+	// Choose the certificate by SNI from the certificate store, or from ACME when enabled
+	tlsConfig := &tls.Config{
+		GetCertificate: func(info *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			log.Printf("Received connection with SNI: %s", info.ServerName)
+			if config.ACME != nil {
+				return config.ACME.GetCertificate(info)
+			}
+			return config.Certificates.GetCertificate(info)
+		},
+	}
+	tlsConfig.GetConfigForClient = configForClient(config, tlsConfig)
+
+	// Rotate session ticket keys derived from a seed other instances can share
+	rotator, err := ticketkeys.New(ticketkeys.Config{
+		KeyFile:  config.TicketKeyFile,
+		Rotation: config.TicketKeyRotation,
+		Keep:     2,
+	})
+	if err != nil {
+		log.Fatalf("Failed to set up session ticket keys: %v", err)
+	}
+	rotator.Apply(tlsConfig)
+	go rotator.Run()
+
+	return tlsConfig
+}
+
+// configForClient selects per-SNI TLS settings: ACME challenges first, then the TLS policy and client certificate requirements
+func configForClient(config *Config, base *tls.Config) func(*tls.ClientHelloInfo) (*tls.Config, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		if config.ACME != nil {
+			if challenge, err := config.ACME.GetConfigForClient(hello); challenge != nil || err != nil {
+				return challenge, err
+			}
+		}
+
+		rule := config.TLSRules.Lookup(hello.ServerName)
+		verifier := config.ClientAuth.Lookup(hello.ServerName)
+		httpRoute := routeMode(config, hello.ServerName) == modeHTTP
+		if rule == nil && verifier == nil && !httpRoute {
+			return nil, nil
+		}
+
+		perSNI := base.Clone()
+		perSNI.GetConfigForClient = nil
+		if httpRoute {
+			perSNI.NextProtos = []string{"h2", "http/1.1"}
+		}
+		if rule != nil {
+			rule.Apply(perSNI)
+		}
+		if verifier != nil {
+			verifier.Apply(perSNI)
+		}
+		return perSNI, nil
+	}
+}
+
 // Handle individual connections
 func handleConnection(conn net.Conn, config *Config) {
 	bufferedConn := newBufferedConn(conn)
 
+	// The TLS server reads the ClientHello again from the buffered connection and closes it when done.
+	// Without an SNI only the default mode applies; termination serves the fallback certificate.
+	sni, err := extractSNI(bufferedConn)
+	if (err == nil && terminates(config, sni)) || (err != nil && config.TLSTermination) {
+		handleTLSTerminationConnection(bufferedConn, config)
+		return
+	}
+
 	defer bufferedConn.Close()
 
-	sni, err := extractSNI(bufferedConn)
 	if err != nil {
 		log.Printf("Failed to extract SNI: %v", err)
 		return
 	}
 
+	// The backend terminates TLS, so a policy can only turn away clients that offer nothing it allows
+	if rule := config.TLSRules.Lookup(sni); rule != nil {
+		if err := checkClientHello(bufferedConn, rule); err != nil {
+			log.Printf("Rejected ClientHello for SNI %s: %v", sni, err)
+			return
+		}
+	}
+
 	// Parse SNI
 	serviceName, err := parseSNI(sni)
 	if err != nil {
@@ -221,60 +382,99 @@ func handleConnection(conn net.Conn, config *Config) {
 		return
 	}
 
-	// Get the next backend using round-robin
-	backendAddr, err := getNextBackend(config, serviceName)
+	// Get the next backend from the route's balancer
+	backendAddr, err := getNextBackend(config, serviceName, clientKey(conn.RemoteAddr()))
 	if err != nil {
 		log.Printf("No backend found for SNI: %s", sni)
 		return
 	}
 
 	// Forward traffic
-	if err := forwardTraffic(bufferedConn, backendAddr, config); err != nil {
+	start := time.Now()
+	err = forwardTraffic(bufferedConn, backendAddr, config)
+	reportBackend(config, serviceName, backendAddr, start, err)
+	if err != nil {
 		log.Printf("Failed to forward traffic: %v", err)
 	}
 }
 
-func handleCachedResponse(tlsConn *tls.Conn, cachedResponse []byte) {
-	writer := bufio.NewWriter(tlsConn)
-
-	// Write the cached response to the client
-	_, err := writer.Write(cachedResponse)
+func extractSNI(bufferedConn bufferedConn) (string, error) {
+	buf, err := peekClientHello(bufferedConn)
 	if err != nil {
-		log.Printf("Error writing cached response: %v", err)
+		return "", err
 	}
 
-	// Gracefully close the connection after writing
-	err = writer.Flush()
+	// Parse the ClientHello to extract the SNI
+	sni, err := parseTLSClientHello(buf)
 	if err != nil {
-		log.Printf("Error flushing cached response: %v", err)
+		return "", fmt.Errorf("failed to parse ClientHello: %w", err)
 	}
 
-	// Signal the end of the write stream without closing the entire connection
-	err = tlsConn.CloseWrite()
+	return sni, nil
+}
+
+// routeMode returns the TLS mode of an SNI, falling back to TLSTermination for SNIs without one
+func routeMode(config *Config, sni string) string {
+	if mode, ok := config.RouteModes.Load(strings.ToLower(strings.TrimSuffix(sni, "."))); ok {
+		return mode.(string)
+	}
+	if config.TLSTermination {
+		return modeTerminate
+	}
+	return modePassthrough
+}
+
+// terminates reports whether the proxy terminates TLS for an SNI
+func terminates(config *Config, sni string) bool {
+	return routeMode(config, sni) != modePassthrough
+}
+
+// terminationNeeded reports whether any route may be terminated, so certificates must be loaded
+func terminationNeeded(config *Config) bool {
+	needed := config.TLSTermination
+	config.RouteModes.Range(func(_, mode any) bool {
+		needed = needed || mode != modePassthrough
+		return !needed
+	})
+	return needed
+}
+
+// checkClientHello enforces a TLS policy on a peeked ClientHello, answering with an alert if it fails
+func checkClientHello(bufferedConn bufferedConn, rule *tlspolicy.Rule) error {
+	buf, err := peekClientHello(bufferedConn)
 	if err != nil {
-		log.Printf("Error signaling write closure: %v", err)
-		return
+		return err
+	}
+	hello, err := tlspolicy.ParseClientHello(buf[5:])
+	if err != nil {
+		return fmt.Errorf("failed to parse ClientHello: %w", err)
 	}
 
-	log.Println("Cached response sent and connection closed")
+	err = rule.Check(hello)
+	var rejection *tlspolicy.Rejection
+	if errors.As(err, &rejection) {
+		bufferedConn.Write(rejection.AlertRecord())
+	}
+	return err
 }
 
-func extractSNI(bufferedConn bufferedConn) (string, error) {
+// peekClientHello returns the TLS record holding the ClientHello without consuming it
+func peekClientHello(bufferedConn bufferedConn) ([]byte, error) {
 	// Peek into the connection to read the TLS ClientHello without consuming the data
 	// Use a buffered reader to peek at the handshake
 	// Peek the initial bytes to determine the handshake length
 	initialPeek := 5 // Minimum size to read the TLS record header
 	buf, err := bufferedConn.Peek(initialPeek)
 	if err != nil {
-		return "", fmt.Errorf("failed to read initial TLS handshake: %w", err)
+		return nil, fmt.Errorf("failed to read initial TLS handshake: %w", err)
 	}
 
 	// Verify this is a TLS handshake record
 	if len(buf) < initialPeek {
-		return "", fmt.Errorf("not enough data for TLS handshake")
+		return nil, fmt.Errorf("not enough data for TLS handshake")
 	}
 	if buf[0] != 0x16 { // Record type: Handshake
-		return "", fmt.Errorf("not a TLS handshake record")
+		return nil, fmt.Errorf("not a TLS handshake record")
 	}
 
 	// Extract the handshake length
@@ -284,23 +484,22 @@ func extractSNI(bufferedConn bufferedConn) (string, error) {
 	// Peek the entire handshake message
 	buf, err = bufferedConn.Peek(totalPeek)
 	if err != nil {
-		return "", fmt.Errorf("failed to read full TLS handshake: %w", err)
+		return nil, fmt.Errorf("failed to read full TLS handshake: %w", err)
 	}
 
 	if len(buf) < totalPeek {
-		return "", fmt.Errorf("not enough data for full TLS handshake")
+		return nil, fmt.Errorf("not enough data for full TLS handshake")
 	}
 
-	// Parse the ClientHello to extract the SNI
-	sni, err := parseTLSClientHello(buf)
-	if err != nil {
-		return "", fmt.Errorf("failed to parse ClientHello: %w", err)
-	}
-
-	return sni, nil
+	return buf, nil
 }
 
 func parseTLSClientHello(data []byte) (string, error) {
+	// Every read below is checked against the record, so a truncated or spoofed one returns an error
+	if len(data) < 5 {
+		return "", fmt.Errorf("incomplete TLS record header")
+	}
+
 	// Ensure the protocol version is at least TLS 1.0
 	if data[1] != 0x03 || (data[2] != 0x01 && data[2] != 0x02 && data[2] != 0x03) {
 		return "", fmt.Errorf("unsupported TLS version")
@@ -311,8 +510,12 @@ func parseTLSClientHello(data []byte) (string, error) {
 	if len(data)-5 < recordLen {
 		return "", fmt.Errorf("incomplete handshake record")
 	}
+	data = data[:5+recordLen]
 
 	// Skip to the ClientHello message
+	if len(data) < 6 {
+		return "", fmt.Errorf("empty handshake record")
+	}
 	handshakeType := data[5]
 	if handshakeType != 0x01 { // Handshake type: ClientHello
 		return "", fmt.Errorf("not a ClientHello message")
@@ -320,28 +523,28 @@ func parseTLSClientHello(data []byte) (string, error) {
 
 	// Skip past the fixed-length parts of the ClientHello
 	offset := 43
-	if len(data) < offset {
+	if len(data) < offset+1 {
 		return "", fmt.Errorf("invalid ClientHello message")
 	}
 
 	// Get the session ID length and skip it
 	sessionIDLen := int(data[offset])
 	offset += 1 + sessionIDLen
-	if len(data) < offset {
+	if len(data) < offset+2 {
 		return "", fmt.Errorf("invalid ClientHello session ID")
 	}
 
 	// Get the cipher suites length and skip it
 	cipherSuitesLen := int(data[offset])<<8 | int(data[offset+1])
 	offset += 2 + cipherSuitesLen
-	if len(data) < offset {
+	if len(data) < offset+1 {
 		return "", fmt.Errorf("invalid ClientHello cipher suites")
 	}
 
 	// Get the compression methods length and skip it
 	compressionMethodsLen := int(data[offset])
 	offset += 1 + compressionMethodsLen
-	if len(data) < offset {
+	if len(data) < offset+2 {
 		return "", fmt.Errorf("invalid ClientHello compression methods")
 	}
 
@@ -365,9 +568,12 @@ func parseTLSClientHello(data []byte) (string, error) {
 
 		// Check if this is the SNI extension (type 0x00)
 		if extType == 0x00 {
-			// Parse the SNI extension
+			// Parse the SNI extension: list length, name type, name length, name
+			if extLen < 5 {
+				return "", fmt.Errorf("invalid SNI extension")
+			}
 			sniLen := int(data[offset+3])<<8 | int(data[offset+4])
-			if offset+5+sniLen > end {
+			if 5+sniLen > extLen {
 				return "", fmt.Errorf("invalid SNI length")
 			}
 			return string(data[offset+5 : offset+5+sniLen]), nil
@@ -388,7 +594,7 @@ func parseSNI(sni string) (string, error) {
 
 // Forward traffic to the backend service
 func forwardTraffic(conn net.Conn, backendAddr string, config *Config) error {
-	backendConn, err := net.Dial("tcp", backendAddr)
+	backendConn, err := dialBackend(config, backendAddr)
 	if err != nil {
 		return fmt.Errorf("failed to connect to backend: %w", err)
 	}
@@ -420,6 +626,34 @@ func forwardTraffic(conn net.Conn, backendAddr string, config *Config) error {
 	return nil
 }
 
+// dialBackend connects to a backend given as host:port or as unix:///path/to.sock
+func dialBackend(config *Config, backendAddr string) (net.Conn, error) {
+	if path, ok := strings.CutPrefix(backendAddr, unixScheme); ok {
+		return net.Dial("unix", path)
+	}
+	if config.Resolver != nil {
+		return config.Resolver.dial(context.Background(), backendAddr)
+	}
+	return net.Dial("tcp", backendAddr)
+}
+
+// validateBackend checks that a Unix socket backend exists before it is registered
+func validateBackend(backendAddr string) error {
+	path, ok := strings.CutPrefix(backendAddr, unixScheme)
+	if !ok {
+		return nil
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("socket %s is not accessible: %w", path, err)
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s is not a Unix socket", path)
+	}
+	return nil
+}
+
 type bufferedConn struct {
 	r        *bufio.Reader
 	net.Conn // So that most methods are embedded
@@ -441,107 +675,293 @@ func (b bufferedConn) Read(p []byte) (int, error) {
 	return b.r.Read(p)
 }
 
+// backendRegistration is the payload of /register and /deregister
+type backendRegistration struct {
+	Name      string `json:"name"`     // SNI the backend serves
+	Port      int    `json:"port"`     // Or: port of a plain TCP port-forward route
+	Listener  string `json:"listener"` // Or: listener address of a plain TCP port-forward route
+	Address   string `json:"address"`
+	Mode      string `json:"mode"`      // Optional TLS mode of the SNI: passthrough, terminate or http
+	Balancing string `json:"balancing"` // Optional balancing policy of the route, see balancer.Policies
+	TTL       int    `json:"ttl"`       // Seconds until the backend is evicted unless registered again (0 to keep it until deregistered)
+}
+
+// route validates that a registration names exactly one route and returns its name;
+// port-forward routes are keyed by their listener address
+func (reg *backendRegistration) route() (string, error) {
+	routes := 0
+	for _, set := range []bool{reg.Name != "", reg.Port != 0, reg.Listener != ""} {
+		if set {
+			routes++
+		}
+	}
+	if routes != 1 || reg.Address == "" {
+		return "", fmt.Errorf("address and exactly one of name, port or listener are required")
+	}
+	if reg.Name != "" {
+		return reg.Name, nil
+	}
+	return portForwardAddress(reg.Port, reg.Listener)
+}
+
+// decodeRegistration parses and authorizes a registration request, answering the client if it fails
+func decodeRegistration(w http.ResponseWriter, r *http.Request, config *Config) (*backendRegistration, string, bool) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return nil, "", false
+	}
+
+	// Decode the JSON payload
+	var reg backendRegistration
+	if err := json.NewDecoder(r.Body).Decode(&reg); err != nil {
+		http.Error(w, "Invalid JSON payload", http.StatusBadRequest)
+		return nil, "", false
+	}
+
+	name, err := reg.route()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, "", false
+	}
+	if err := config.APIAuth.Authorize(r, name); err != nil {
+		http.Error(w, err.Error(), apiauth.Status(err))
+		return nil, "", false
+	}
+	return &reg, name, true
+}
+
 func startRegistrationServer(config *Config, address string) {
-	http.HandleFunc("/register", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+	// A mux of its own keeps the registry off the metrics and pprof listeners
+	mux := http.NewServeMux()
+
+	// Registering again renews the lease of a registration with a TTL
+	mux.HandleFunc("/register", func(w http.ResponseWriter, r *http.Request) {
+		registration, name, ok := decodeRegistration(w, r, config)
+		if !ok {
 			return
 		}
 
-		var registration struct {
-			Name    string `json:"name"`
-			Address string `json:"address"`
+		// Validate the registration
+		switch registration.Mode {
+		case "", modePassthrough:
+		case modeTerminate, modeHTTP:
+			if config.TLSConfig == nil {
+				http.Error(w, "TLS termination is not configured on this proxy", http.StatusBadRequest)
+				return
+			}
+		default:
+			http.Error(w, "Mode must be passthrough, terminate or http", http.StatusBadRequest)
+			return
+		}
+		if registration.Mode != "" && registration.Name == "" {
+			http.Error(w, "Mode only applies to SNI routes", http.StatusBadRequest)
+			return
+		}
+		if err := balancer.Valid(registration.Balancing); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ttl, err := lease.TTL(registration.TTL)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if ttl > 0 && isSRVName(registration.Address) {
+			http.Error(w, "SRV discovery can't be registered with a TTL", http.StatusBadRequest)
+			return
 		}
 
-		// Decode the JSON payload
-		if err := json.NewDecoder(r.Body).Decode(&registration); err != nil {
-			http.Error(w, "Invalid JSON payload", http.StatusBadRequest)
+		if err := validateBackend(registration.Address); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
-		// Validate the registration
-		if registration.Name == "" || registration.Address == "" {
-			http.Error(w, "Name and Address are required", http.StatusBadRequest)
+		// A listener this registration starts closes again if the registration fails
+		started := false
+		if registration.Port != 0 || registration.Listener != "" {
+			_, listening := config.PortForwards.Load(name)
+			if err := ensurePortForwardListener(config, name); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			started = !listening
+		}
+
+		// Write the registration through to the registry log before applying it. HTTP routes may
+		// register per path as "host/path"; the mode belongs to the host.
+		sni, _, _ := strings.Cut(name, "/")
+		sni = strings.ToLower(sni)
+		srv := isSRVName(registration.Address) && config.Resolver != nil
+		var records []registrystore.Record
+		if registration.Mode != "" {
+			records = append(records, registrystore.Record{Op: registrystore.OpMode, Route: sni, Value: registration.Mode})
+		}
+		if registration.Balancing != "" && registration.Balancing != config.Backends.Policy(name) {
+			records = append(records, registrystore.Record{Op: registrystore.OpBalancing, Route: name, Value: registration.Balancing})
+		}
+		if srv {
+			records = append(records, registrystore.Record{Op: registrystore.OpSRV, Route: name, Value: registration.Address})
+		} else {
+			backend, ok := lookupBackend(config, name, registration.Address)
+			if !ok {
+				backend = adminapi.Backend{Address: registration.Address, Weight: adminapi.DefaultWeight}
+			}
+			var expires *time.Time
+			if ttl > 0 {
+				at := time.Now().Add(ttl)
+				expires = &at
+			}
+			records = append(records, registrystore.Record{Op: registrystore.OpSet, Route: name, Backend: &backend, Expires: expires})
+		}
+		if err := persist(config, records...); err != nil {
+			if started {
+				closePortForwardListener(config, name)
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		// Register the backend
-		addBackend(config, registration.Name, registration.Address)
-		log.Printf("Registered backend: %s -> %s", registration.Name, registration.Address)
+		if registration.Mode != "" {
+			config.RouteModes.Store(sni, registration.Mode)
+		}
+		if registration.Balancing != "" {
+			config.Backends.SetPolicy(name, registration.Balancing) // Checked above
+		}
+
+		// SRV names populate the pool from DNS instead of being dialed directly
+		if srv {
+			config.Resolver.addSRVDiscovery(config, name, registration.Address)
+			log.Printf("Registered SRV discovery: %s -> %s", name, registration.Address)
+			w.WriteHeader(http.StatusOK)
+			fmt.Fprintf(w, "SRV discovery %s registered successfully for %s", registration.Address, name)
+			return
+		}
+
+		// Register the backend, leasing it first so an expiring lease can't evict the renewed registration
+		if ttl > 0 {
+			config.Leases.Renew(name, registration.Address, ttl)
+		} else {
+			config.Leases.Release(name, registration.Address)
+		}
+		addBackend(config, name, registration.Address)
+		log.Printf("Registered backend: %s -> %s", name, registration.Address)
 		w.WriteHeader(http.StatusOK)
-		fmt.Fprintf(w, "Backend %s registered successfully", registration.Name)
+		if ttl > 0 {
+			fmt.Fprintf(w, "Backend %s registered successfully for %s", name, ttl)
+			return
+		}
+		fmt.Fprintf(w, "Backend %s registered successfully", name)
 	})
 
-	log.Printf("Registration server listening on %s", address)
-	if err := http.ListenAndServe(address, nil); err != nil {
+	// Explicit deregistration for backends shutting down cleanly
+	mux.HandleFunc("/deregister", func(w http.ResponseWriter, r *http.Request) {
+		registration, name, ok := decodeRegistration(w, r, config)
+		if !ok {
+			return
+		}
+
+		// Deregistering an SRV name stops its discovery along with the backends it found
+		if isSRVName(registration.Address) && config.Resolver != nil {
+			if !config.Resolver.hasSRVDiscovery(name, registration.Address) {
+				http.Error(w, "SRV discovery is not registered", http.StatusNotFound)
+				return
+			}
+			if err := persist(config, registrystore.Record{Op: registrystore.OpDeleteSRV, Route: name, Value: registration.Address}); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			config.Resolver.removeSRVDiscovery(name, registration.Address)
+			w.WriteHeader(http.StatusOK)
+			fmt.Fprintf(w, "SRV discovery %s deregistered successfully for %s", registration.Address, name)
+			return
+		}
+
+		if _, ok := lookupBackend(config, name, registration.Address); !ok {
+			config.Leases.Release(name, registration.Address)
+			http.Error(w, "Backend is not registered", http.StatusNotFound)
+			return
+		}
+		if err := persistRemoval(config, name, registration.Address); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		config.Leases.Release(name, registration.Address)
+		removeBackend(config, name, registration.Address)
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "Backend %s deregistered successfully", name)
+	})
+
+	// Versioned admin API for listing and editing the registry
+	api := adminapi.NewHandler(backendRegistry{config}, config.APIAuth)
+	if config.Reloader != nil {
+		api.HandleConfig(config.Reloader)
+	}
+	mux.Handle("/api/v1/", api)
+
+	server := &http.Server{Addr: address, Handler: mux, TLSConfig: config.APIAuth.TLSConfig()}
+	var err error
+	if server.TLSConfig != nil {
+		log.Printf("Registration server listening on %s (TLS)", address)
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		log.Printf("Registration server listening on %s", address)
+		err = server.ListenAndServe()
+	}
+	if err != nil {
 		log.Fatalf("Failed to start registration server: %v", err)
 	}
 }
 
 func addBackend(config *Config, sni string, backend string) {
-	// Get the current list of backends for the SNI
-	value, _ := config.Backends.LoadOrStore(sni, &sync.Map{})
-	backends := value.(*sync.Map)
-
-	// Add the backend to the list
-	backends.Store(backend, true) // Use true as a placeholder value
+	// Add the backend to the route, keeping the weight and metadata of one registered before
+	config.Backends.Add(sni, adminapi.Backend{Address: backend, Weight: adminapi.DefaultWeight})
 	log.Printf("Added backend %s for SNI: %s", backend, sni)
 }
 
-func removeBackend(config *Config, sni string, backend string) {
-	// Get the current list of backends for the SNI
-	value, ok := config.Backends.Load(sni)
-	if !ok {
+// setBackend adds or replaces a backend along with its weight and metadata
+func setBackend(config *Config, sni string, backend adminapi.Backend) {
+	config.Backends.Set(sni, backend)
+}
+
+// removeBackend reports whether the backend was registered
+func removeBackend(config *Config, sni string, backend string) bool {
+	if !config.Backends.Has(sni) {
 		log.Printf("No backends found for SNI: %s", sni)
-		return
+		return false
+	}
+	if !config.Backends.Remove(sni, backend) {
+		return false
 	}
-	backends := value.(*sync.Map)
-
-	// Remove the backend
-	backends.Delete(backend)
 	log.Printf("Removed backend %s for SNI: %s", backend, sni)
+	return true
 }
 
-func getNextBackend(config *Config, sni string) (string, error) {
-	// Get the list of backends for the SNI
-	value, ok := config.Backends.Load(sni)
-	if !ok {
-		return "", fmt.Errorf("no backends available for SNI: %s", sni)
-	}
-	backends := value.(*sync.Map)
-
-	// Convert the map keys to a slice
-	var backendList []string
-	backends.Range(func(key, value any) bool {
-		backendList = append(backendList, key.(string))
-		return true
-	})
+// listBackends returns a copy of the backends of a route sorted by address
+func listBackends(config *Config, sni string) []adminapi.Backend {
+	return slices.Clone(config.Backends.Backends(sni))
+}
 
-	if len(backendList) == 0 {
+// getNextBackend picks a backend with the route's balancer; key identifies the client to
+// policies that keep clients on one backend. Every pick is ended with reportBackend.
+func getNextBackend(config *Config, sni, key string) (string, error) {
+	backend, ok := config.Backends.Pick(sni, key)
+	if !ok {
 		return "", fmt.Errorf("no backends available for SNI: %s", sni)
 	}
-
-	// Get the current index for round-robin
-	indexValue, _ := config.BackendIndices.LoadOrStore(sni, 0)
-	index := indexValue.(int)
-
-	// Select the backend and update the index
-	backend := backendList[index]
-	config.BackendIndices.Store(sni, (index+1)%len(backendList))
-
 	return backend, nil
 }
 
-func getFromCache(config *Config, key string) ([]byte, bool) {
-	value, ok := config.Cache.Load(key)
-	if !ok {
-		return nil, false
-	}
-	return value.([]byte), true
+// reportBackend ends a pick, telling the route's balancer how long the backend was used and whether it failed
+func reportBackend(config *Config, sni, backend string, start time.Time, err error) {
+	config.Backends.Report(sni, backend, time.Since(start), err)
 }
 
-func storeInCache(config *Config, key string, data []byte) {
-	config.Cache.Store(key, data)
+// clientKey identifies a client to the balancers: its address without the port
+func clientKey(addr net.Addr) string {
+	if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+		return host
+	}
+	return addr.String()
 }
 
 func collectProfilingMetrics() {
@@ -573,6 +993,28 @@ func collectCPUMetrics() {
 	}
 }
 
+// Obtain certificates over ACME for every registered SNI and answer HTTP-01 challenges
+func startACME(config *Config) {
+	manager, err := acmecert.New(acmecert.Config{
+		DirectoryURL: config.ACMEDirectoryURL,
+		Email:        config.ACMEEmail,
+		CacheDir:     config.ACMECacheDir,
+		CARootFile:   config.ACMECARoot,
+		HostPolicy: func(host string) bool {
+			return config.Backends.Has(host)
+		},
+	}, config.Certificates)
+	if err != nil {
+		log.Fatalf("Failed to start ACME: %v", err)
+	}
+	config.ACME = manager
+
+	go func() {
+		log.Printf("ACME HTTP-01 challenge server listening on %s", config.ACMEHTTPAddress)
+		log.Println(http.ListenAndServe(config.ACMEHTTPAddress, manager.HTTPHandler(nil)))
+	}()
+}
+
 func startMetricsServer(metricsAddr string) {
 	http.Handle("/metrics", promhttp.Handler())
 	log.Printf("Metrics server listening on %s", metricsAddr)
@@ -580,33 +1022,165 @@ func startMetricsServer(metricsAddr string) {
 }
 
 func main() {
-	// Initialize the proxy configuration
-	config := &Config{
-		Backends:       sync.Map{},
-		BackendIndices: sync.Map{},
-		TLSTermination: false, // Set to false for end-to-end TLS
-		CertFile:       "cert.pem",
-		KeyFile:        "key.pem",
-		Cache:          sync.Map{},
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		os.Exit(validateCommand(os.Args[2:]))
+	}
+
+	configFile := flag.String("config", "", "YAML or JSON configuration file (built-in defaults when empty)")
+	registryFile := flag.String("registry-file", "", "log the backend registry is persisted to, overriding admin.registry_file")
+	emptyRegistry := flag.Bool("empty-registry", false, "discard the persisted registry and start without backends")
+	acmeDirectory := flag.String("acme-directory", "", "ACME directory URL to obtain certificates from, overriding tls.acme.directory_url")
+	flag.Parse()
+
+	// Initialize the proxy configuration; reloads read the file the same way
+	loadFile := func() (*configfile.File, error) {
+		file, err := configfile.Load(*configFile, configfile.L4)
+		if err != nil {
+			return nil, err
+		}
+		flag.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "registry-file":
+				file.Admin.RegistryFile = *registryFile
+			case "acme-directory":
+				file.TLS.ACME.DirectoryURL = *acmeDirectory
+			}
+		})
+		if err := canonicalizeRoutes(file); err != nil {
+			return nil, err
+		}
+		return file, nil
+	}
+	file, err := loadFile()
+	if err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+	config := newConfig(file)
+
+	// Without grants anyone who reaches the registration server may register backends
+	config.APIAuth, err = apiauth.Load(config.APIAuthPolicy)
+	if err != nil {
+		log.Fatalf("Failed to load registration API policy: %v", err)
+	}
+	if len(config.APIAuthPolicy.Tokens) == 0 && len(config.APIAuthPolicy.Clients) == 0 {
+		config.APIAuth = nil
+		log.Printf("Warning: registration API is unauthenticated; set admin.auth to restrict it")
+	}
+
+	// Resolve backend hostnames on a timer rather than on every connection
+	config.Resolver = newBackendResolver(config.DNSServer, config.DNSCacheTTL)
+	go config.Resolver.refreshLoop()
+
+	// TLS policies apply to passthrough as well as terminated connections
+	config.TLSRules, err = tlspolicy.LoadAll(config.TLSPolicies)
+	if err != nil {
+		log.Fatalf("Failed to load TLS policies: %v", err)
+	}
+
+	// Restore what was registered before the restart, modes included, before deciding whether to terminate TLS
+	if config.RegistryFile != "" {
+		store, records, err := registrystore.Open(config.RegistryFile, *emptyRegistry)
+		if err != nil {
+			log.Fatalf("Failed to open registry log: %v", err)
+		}
+		config.Store = store
+		restoreRegistry(config, records)
+		go config.Store.Run(10 * time.Minute)
+	}
+	if err := addStaticRoutes(config, file.Routes); err != nil {
+		log.Fatalf("Failed to configure routes: %v", err)
+	}
+
+	// Load the certificates once and reload them when the files change
+	if terminationNeeded(config) {
+		certificates, err := certstore.New(config.CertDir, certstore.Pair{CertFile: config.CertFile, KeyFile: config.KeyFile})
+		if err != nil {
+			log.Fatalf("Failed to load TLS certificates: %v", err)
+		}
+		config.Certificates = certificates
+		go config.Certificates.Watch(5 * time.Second)
+		go config.Certificates.StapleOCSP(time.Minute)
+
+		if config.ACMEDirectoryURL != "" {
+			startACME(config)
+		}
+
+		config.ClientAuth, err = clientauth.LoadAll(config.ClientAuthPolicies)
+		if err != nil {
+			log.Fatalf("Failed to load client certificate policies: %v", err)
+		}
+		go config.ClientAuth.Watch(5 * time.Second)
+
+		config.UpstreamTLS, err = upstreamtls.LoadAll(config.UpstreamTLSPolicies)
+		if err != nil {
+			log.Fatalf("Failed to load upstream TLS policies: %v", err)
+		}
+
+		config.TLSConfig = newTLSConfig(config)
+		config.HTTPEngine = newHTTPEngine(config)
 	}
 
 	go collectCPUMetrics()
 
 	go collectProfilingMetrics()
 
-	go func() {
-		log.Println("Starting pprof server on :6060")
-		log.Println(http.ListenAndServe(":6060", nil)) // Use default pprof routes
-	}()
+	if config.PprofAddress != "" {
+		go func() {
+			log.Printf("Starting pprof server on %s", config.PprofAddress)
+			log.Println(http.ListenAndServe(config.PprofAddress, nil)) // Use default pprof routes
+		}()
+	}
+
+	if config.MetricsAddress != "" {
+		go startMetricsServer(config.MetricsAddress)
+	}
+
+	// Evict backends that stopped renewing their registration. Nothing is written to the registry
+	// log: their records carry the expiry, so replaying and compacting the log drop them anyway.
+	go config.Leases.Run(time.Second, func(route, address string) {
+		removeBackend(config, route, address)
+	})
 
-	go startMetricsServer(":9100")
+	// Apply route changes on SIGHUP or when the file changes
+	if *configFile != "" {
+		config.Reloader = configfile.NewReloader(*configFile, file, loadFile, func(old, next *configfile.File, diff configfile.Diff) error {
+			return reloadRoutes(config, old, next, diff)
+		})
+		go config.Reloader.Run(5 * time.Second)
+	}
+
+	// Follow labeled containers and target files for the backends of routes
+	if config.DockerSocket != "" {
+		startDockerDiscovery(config)
+	}
+	if len(config.TargetFiles) > 0 {
+		startFileDiscovery(config)
+	}
 
 	// Start the registration server
-	go startRegistrationServer(config, ":8081") // Registration server on port 8081
+	go startRegistrationServer(config, config.AdminAddress)
+
+	// Start a UDP listener for every UDP route
+	for address, route := range config.UDPRoutes {
+		go func(address, route string) {
+			if err := startUDPProxy(address, route, config); err != nil {
+				log.Printf("Failed to start UDP proxy for route %s: %v", route, err)
+			}
+		}(address, route)
+	}
+
+	// Route QUIC (HTTP/3) by SNI on the UDP side of the proxy port
+	if config.QUICAddress != "" {
+		go func() {
+			if err := startQUICProxy(config.QUICAddress, config); err != nil {
+				log.Printf("Failed to start QUIC proxy: %v", err)
+			}
+		}()
+	}
 
-	err := startProxy(":443", config)
+	err = startProxy(config.ListenAddress, config)
 	if err != nil {
 		log.Fatalf("Failed to start proxy server: %v", err)
 	}
-	log.Println("Proxy server listening on :443")
+	log.Printf("Proxy server listening on %s", config.ListenAddress)
 }
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"testing"
+)
+
+// rfc9001Record wraps the ClientHello of RFC 9001, Appendix A in a TLS handshake record
+func rfc9001Record(t testing.TB) []byte {
+	t.Helper()
+	frame := mustHex(t, rfc9001CryptoFrame)
+	// CRYPTO frame type, offset and two-byte length precede the ClientHello
+	hello := frame[4 : 4+(int(frame[2]&0x3f)<<8|int(frame[3]))]
+	return append([]byte{0x16, 0x03, 0x01, byte(len(hello) >> 8), byte(len(hello))}, hello...)
+}
+
+func TestParseTLSClientHello(t *testing.T) {
+	record := rfc9001Record(t)
+	sni, err := parseTLSClientHello(record)
+	if err != nil || sni != "example.com" {
+		t.Fatalf("parseTLSClientHello = %q, %v; want example.com", sni, err)
+	}
+
+	// withRecordLen rewrites the record header to claim n bytes of the data that follows
+	withRecordLen := func(data []byte, n int) []byte {
+		data = append([]byte(nil), data...)
+		data[3], data[4] = byte(n>>8), byte(n)
+		return data
+	}
+	for name, data := range map[string][]byte{
+		"empty":                 nil,
+		"header only":           record[:3],
+		"record header":         record[:5],
+		"short record":          record[:43],
+		"fixed part only":       withRecordLen(record[:43], 38),
+		"session ID cut":        withRecordLen(record[:44], 39),
+		"cipher suites cut":     withRecordLen(record[:47], 42),
+		"extensions cut":        withRecordLen(record[:100], 95),
+		"past the record":       withRecordLen(record, 80),
+		"not a ClientHello":     append(append([]byte(nil), record[:5]...), append([]byte{0x02}, record[6:]...)...),
+		"unsupported version":   append([]byte{0x16, 0x02, 0x00}, record[3:]...),
+		"empty handshake":       {0x16, 0x03, 0x01, 0x00, 0x00},
+		"43 bytes of handshake": withRecordLen(append(append([]byte(nil), record[:6]...), make([]byte, 37)...), 38),
+	} {
+		if _, err := parseTLSClientHello(data); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+
+	// An SNI extension too short to hold a name
+	truncatedSNI := append([]byte(nil), record...)
+	for i := 43; i+4 < len(truncatedSNI); i++ {
+		// The server_name extension of the RFC 9001 ClientHello: type 0, length 0x10
+		if truncatedSNI[i] == 0x00 && truncatedSNI[i+1] == 0x00 && truncatedSNI[i+2] == 0x00 && truncatedSNI[i+3] == 0x10 {
+			truncatedSNI[i+3] = 0x02
+			break
+		}
+	}
+	if _, err := parseTLSClientHello(truncatedSNI); err == nil {
+		t.Error("truncated SNI extension: expected an error")
+	}
+}
+
+func FuzzParseTLSClientHello(f *testing.F) {
+	record := rfc9001Record(f)
+	f.Add(record)
+	for _, n := range []int{0, 5, 6, 43, 44, 100} {
+		f.Add(record[:n])
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		parseTLSClientHello(data)
+	})
+}
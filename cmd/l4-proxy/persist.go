@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"reverse-proxy/internal/adminapi"
+	"reverse-proxy/internal/balancer"
+	"reverse-proxy/internal/registrystore"
+	"reverse-proxy/internal/routing"
+)
+
+// lookupBackend returns a registered backend with its weight and metadata
+func lookupBackend(config *Config, route, address string) (adminapi.Backend, bool) {
+	return config.Backends.Backend(route, address)
+}
+
+// persistBackend writes a backend as it is about to be registered, with the lease it will hold
+// if expires is set, through to the registry log
+func persistBackend(config *Config, route string, backend adminapi.Backend, expires *time.Time) error {
+	return persist(config, registrystore.Record{Op: registrystore.OpSet, Route: route, Backend: &backend, Expires: expires})
+}
+
+// leaseExpiry returns when a backend's current lease runs out, or nil if it has none
+func leaseExpiry(config *Config, route, address string) *time.Time {
+	if expires, ok := config.Leases.Expiry(route, address); ok {
+		return &expires
+	}
+	return nil
+}
+
+// replaceRecords returns the records that set a route's backends to exactly the ones given, leases
+// kept, and its balancing policy unless balancing is nil
+func replaceRecords(config *Config, route string, backends []adminapi.Backend, balancing *string) []registrystore.Record {
+	var records []registrystore.Record
+	if balancing != nil && *balancing != config.Backends.Policy(route) {
+		records = append(records, registrystore.Record{Op: registrystore.OpBalancing, Route: route, Value: *balancing})
+	}
+	if len(backends) == 0 {
+		return append(records, registrystore.Record{Op: registrystore.OpDeleteRoute, Route: route})
+	}
+	for _, backend := range config.Backends.Backends(route) {
+		if !routing.Contains(backends, backend.Address) {
+			records = append(records, registrystore.Record{Op: registrystore.OpDelete, Route: route, Address: backend.Address})
+		}
+	}
+	for _, backend := range backends {
+		records = append(records, registrystore.Record{Op: registrystore.OpSet, Route: route, Backend: &backend, Expires: leaseExpiry(config, route, backend.Address)})
+	}
+	return records
+}
+
+func persistRemoval(config *Config, route, address string) error {
+	return persist(config, registrystore.Record{Op: registrystore.OpDelete, Route: route, Address: address})
+}
+
+// persist appends records to the registry log. The error wraps adminapi.ErrNotPersisted, so the
+// APIs answer 500 for changes that wouldn't survive a restart.
+func persist(config *Config, records ...registrystore.Record) error {
+	if err := config.Store.Append(records...); err != nil {
+		log.Printf("Failed to persist registry record: %v", err)
+		return fmt.Errorf("%w: %v", adminapi.ErrNotPersisted, err)
+	}
+	return nil
+}
+
+// setBalancing writes the balancing policy of a route through to the registry log, then applies it
+func setBalancing(config *Config, route, policy string) error {
+	if config.Backends.Policy(route) == policy {
+		return nil
+	}
+	if err := balancer.Valid(policy); err != nil {
+		return fmt.Errorf("%w: %v", adminapi.ErrInvalidBalancing, err)
+	}
+	if err := persist(config, registrystore.Record{Op: registrystore.OpBalancing, Route: route, Value: policy}); err != nil {
+		return err
+	}
+	config.Backends.SetPolicy(route, policy) // Checked above
+	log.Printf("Set balancing policy of %s to %q", route, policy)
+	return nil
+}
+
+// restoreRegistry replays the registry log into the routing state before any listener starts
+func restoreRegistry(config *Config, records []registrystore.Record) {
+	backends := 0
+	for _, record := range records {
+		record.Route = canonicalRoute(record.Route)
+		switch record.Op {
+		case registrystore.OpMode:
+			config.RouteModes.Store(record.Route, record.Value)
+		case registrystore.OpBalancing:
+			if err := config.Backends.SetPolicy(record.Route, record.Value); err != nil {
+				log.Printf("Failed to restore balancing policy of %s: %v", record.Route, err)
+			}
+		case registrystore.OpSRV:
+			config.Resolver.addSRVDiscovery(config, record.Route, record.Value)
+		case registrystore.OpSet:
+			if _, _, err := net.SplitHostPort(record.Route); err == nil {
+				if err := ensurePortForwardListener(config, record.Route); err != nil {
+					log.Printf("Failed to restore port-forward route %s: %v", record.Route, err)
+					continue
+				}
+			}
+			if record.Expires != nil {
+				config.Leases.Renew(record.Route, record.Backend.Address, time.Until(*record.Expires))
+			}
+			setBackend(config, record.Route, *record.Backend)
+			backends++
+		}
+	}
+	log.Printf("Restored %d backends from registry log %s", backends, config.RegistryFile)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Serializes listener creation so concurrent registrations for one port don't race on bind
+var portForwardMu sync.Mutex
+
+// portForwardAddress normalizes the port or listener of a port-forward route into its listener address
+func portForwardAddress(port int, listener string) (string, error) {
+	if listener == "" {
+		if port <= 0 || port > 65535 {
+			return "", fmt.Errorf("invalid port: %d", port)
+		}
+		return ":" + strconv.Itoa(port), nil
+	}
+
+	_, portStr, err := net.SplitHostPort(listener)
+	if err != nil {
+		return "", fmt.Errorf("invalid listener address: %w", err)
+	}
+	if n, err := strconv.Atoi(portStr); err != nil || n <= 0 || n > 65535 {
+		return "", fmt.Errorf("invalid listener port: %s", portStr)
+	}
+	name, _ := portForwardRoute(listener)
+	return name, nil
+}
+
+// portForwardRoute reports whether a route name is a listener address, and returns its canonical form:
+// wildcard hosts are written as ":port", so "0.0.0.0:6379" and port 6379 name the same route
+func portForwardRoute(name string) (string, bool) {
+	host, port, err := net.SplitHostPort(name)
+	if err != nil {
+		return name, false
+	}
+	if n, err := strconv.Atoi(port); err == nil {
+		port = strconv.Itoa(n)
+	}
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		return ":" + port, true
+	}
+	return net.JoinHostPort(strings.ToLower(host), port), true
+}
+
+// canonicalRoute returns the name a route is kept under
+func canonicalRoute(name string) string {
+	name, _ = portForwardRoute(name)
+	return name
+}
+
+// ensurePortForwardListener starts a listener for a port-forward route unless one is already running
+func ensurePortForwardListener(config *Config, address string) error {
+	portForwardMu.Lock()
+	defer portForwardMu.Unlock()
+
+	if _, ok := config.PortForwards.Load(address); ok {
+		return nil
+	}
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return fmt.Errorf("failed to start listener: %w", err)
+	}
+
+	config.PortForwards.Store(address, listener)
+
+	log.Printf("Listening on %s for port-forward route", address)
+
+	go serveConnections(listener, func(conn net.Conn) {
+		handlePortForwardConnection(conn, address, config)
+	})
+	return nil
+}
+
+// closePortForwardListener stops the listener of a removed port-forward route; connections it accepted carry on
+func closePortForwardListener(config *Config, route string) {
+	portForwardMu.Lock()
+	defer portForwardMu.Unlock()
+
+	if listener, ok := config.PortForwards.LoadAndDelete(route); ok {
+		listener.(net.Listener).Close()
+		log.Printf("Stopped listening on %s for removed port-forward route", route)
+	}
+}
+
+// closeEmptyPortForward stops the listener of a port-forward route left without backends, as when its last
+// backend deregisters or its lease expires. Routes populated from SRV records keep listening while DNS
+// finds no targets, since the discovery can't start the listener again.
+func closeEmptyPortForward(config *Config, route string) {
+	if config.Resolver != nil && config.Resolver.hasSRVDiscoveries(route) {
+		return
+	}
+
+	portForwardMu.Lock()
+	defer portForwardMu.Unlock()
+
+	if config.Backends.Has(route) {
+		return // Registered again meanwhile
+	}
+	if listener, ok := config.PortForwards.LoadAndDelete(route); ok {
+		listener.(net.Listener).Close()
+		log.Printf("Stopped listening on %s: the port-forward route has no backends left", route)
+	}
+}
+
+// Handle a connection on a port-forward route: no SNI, the listener selects the backend pool
+func handlePortForwardConnection(conn net.Conn, route string, config *Config) {
+	defer conn.Close()
+
+	// Get the next backend from the route's balancer
+	backendAddr, err := getNextBackend(config, route, clientKey(conn.RemoteAddr()))
+	if err != nil {
+		log.Printf("No backend found for listener: %s", route)
+		return
+	}
+
+	// Forward traffic
+	start := time.Now()
+	err = forwardTraffic(conn, backendAddr, config)
+	reportBackend(config, route, backendAddr, start, err)
+	if err != nil {
+		log.Printf("Failed to forward traffic: %v", err)
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"reverse-proxy/internal/adminapi"
+	"reverse-proxy/internal/configfile"
+	"reverse-proxy/internal/lease"
+	"reverse-proxy/internal/routing"
+)
+
+// freePort returns a TCP port nothing listens on
+func freePort(t *testing.T) string {
+	t.Helper()
+	probe, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer probe.Close()
+	_, port, _ := net.SplitHostPort(probe.Addr().String())
+	return port
+}
+
+// bound reports whether something listens on a port
+func bound(port string) bool {
+	listener, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		return true
+	}
+	listener.Close()
+	return false
+}
+
+func TestPortForwardRouteIsCanonical(t *testing.T) {
+	for name, want := range map[string]string{
+		":6379":          ":6379",
+		"0.0.0.0:6379":   ":6379",
+		"[::]:6379":      ":6379",
+		"0.0.0.0:06379":  ":6379",
+		"127.0.0.1:6379": "127.0.0.1:6379",
+		"LocalHost:6379": "localhost:6379",
+	} {
+		if got, ok := portForwardRoute(name); !ok || got != want {
+			t.Errorf("portForwardRoute(%q) = %q, %v; want %q", name, got, ok, want)
+		}
+	}
+	if _, ok := portForwardRoute("foo.com"); ok {
+		t.Error("SNI route taken for a port-forward route")
+	}
+
+	byPort, _ := portForwardAddress(6379, "")
+	byListener, _ := portForwardAddress(0, "0.0.0.0:6379")
+	if byPort != byListener {
+		t.Errorf("port 6379 names %q, listener 0.0.0.0:6379 names %q", byPort, byListener)
+	}
+}
+
+func TestRemovingPortForwardRouteClosesListener(t *testing.T) {
+	config := &Config{Backends: routing.NewTable(), Leases: lease.NewTable()}
+	registry := backendRegistry{config: config}
+
+	// Registered under its wildcard spelling
+	port := freePort(t)
+	if err := registry.SetBackend("0.0.0.0:"+port, adminapi.Backend{Address: "127.0.0.1:1", Weight: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := registry.Route(":" + port); !ok {
+		t.Fatal("route not found under its canonical name")
+	}
+	if err := registry.SetBackend(":"+port, adminapi.Backend{Address: "127.0.0.1:2", Weight: 1}); err != nil {
+		t.Fatalf("second spelling of the listener: %v", err)
+	}
+
+	if removed, err := registry.RemoveRoute("0.0.0.0:" + port); !removed || err != nil {
+		t.Fatalf("route not removed: %v", err)
+	}
+	if _, ok := config.PortForwards.Load(":" + port); ok {
+		t.Fatal("listener still registered")
+	}
+	if bound(port) {
+		t.Fatal("port still bound after the route was removed")
+	}
+}
+
+func TestReloadBindsAfterChecks(t *testing.T) {
+	config := &Config{Backends: routing.NewTable(), Leases: lease.NewTable()}
+	port := freePort(t)
+	forward := configfile.Route{Name: ":" + port, Backends: []configfile.Backend{{Address: "127.0.0.1:1"}}}
+	empty := &configfile.File{}
+
+	// A route that can't be applied rejects the reload before anything binds
+	terminated := configfile.Route{Name: "foo.com", Mode: modeTerminate}
+	next := &configfile.File{Routes: []configfile.Route{forward, terminated}}
+	if err := reloadRoutes(config, empty, next, configfile.Compare(empty, next)); err == nil {
+		t.Fatal("expected the reload to fail without TLS termination")
+	}
+	if bound(port) {
+		t.Fatal("rejected reload bound its port-forward listener")
+	}
+
+	// A listener that can't bind closes the ones the same reload started
+	busy, err := net.Listen("tcp", ":"+freePort(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	_, busyPort, _ := net.SplitHostPort(busy.Addr().String())
+	next = &configfile.File{Routes: []configfile.Route{forward, {Name: ":" + busyPort}}}
+	if err := reloadRoutes(config, empty, next, configfile.Compare(empty, next)); err == nil {
+		t.Fatal("expected the reload to fail on a port in use")
+	}
+	if bound(port) {
+		t.Fatal("failed reload left a listener behind")
+	}
+
+	next = &configfile.File{Routes: []configfile.Route{forward}}
+	if err := reloadRoutes(config, empty, next, configfile.Compare(empty, next)); err != nil {
+		t.Fatal(err)
+	}
+	if !bound(port) {
+		t.Fatal("added port-forward route isn't listening")
+	}
+
+	// Removing the route closes its listener
+	if err := reloadRoutes(config, next, empty, configfile.Compare(next, empty)); err != nil {
+		t.Fatal(err)
+	}
+	if bound(port) {
+		t.Fatal("removed port-forward route still listening")
+	}
+}
+
+func TestReplacingPortForwardRoute(t *testing.T) {
+	config := &Config{Backends: routing.NewTable(), Leases: lease.NewTable()}
+	registry := backendRegistry{config: config}
+	port := freePort(t)
+
+	invalid := []adminapi.Backend{{Address: "127.0.0.1:1", Weight: 1}, {Address: "unix:///nonexistent.sock", Weight: 1}}
+	if err := registry.ReplaceRoute("0.0.0.0:"+port, invalid, nil); err == nil {
+		t.Fatal("expected an error for an unusable backend")
+	}
+	if bound(port) || config.Backends.Has(":"+port) {
+		t.Fatal("rejected replace bound the listener or changed the route")
+	}
+
+	if err := registry.ReplaceRoute("0.0.0.0:"+port, invalid[:1], nil); err != nil {
+		t.Fatal(err)
+	}
+	if !bound(port) || !config.Backends.Has(":"+port) {
+		t.Fatal("replaced port-forward route isn't listening under its canonical name")
+	}
+
+	if err := registry.ReplaceRoute(":"+port, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if bound(port) {
+		t.Fatal("emptied port-forward route still listening")
+	}
+}
+
+// eventually waits for cond, which changes in the background
+func eventually(t *testing.T, cond func() bool, what string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal(what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestEmptyPortForwardRouteStopsListening(t *testing.T) {
+	config := newConfig(&configfile.File{})
+	registry := backendRegistry{config: config}
+	port := freePort(t)
+	route := ":" + port
+
+	for _, address := range []string{"127.0.0.1:1", "127.0.0.1:2"} {
+		if err := registry.SetBackend(route, adminapi.Backend{Address: address, Weight: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if removed, err := registry.RemoveBackend(route, "127.0.0.1:1"); !removed || err != nil {
+		t.Fatalf("backend not removed: %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if !bound(port) {
+		t.Fatal("route with a backend left stopped listening")
+	}
+
+	// The last backend goes the way an expired lease evicts it
+	removeBackend(config, route, "127.0.0.1:2")
+	eventually(t, func() bool { return !bound(port) }, "port still bound after the last backend left")
+	if _, ok := config.PortForwards.Load(route); ok {
+		t.Fatal("listener still registered")
+	}
+
+	// Registering again starts a new listener
+	if err := registry.SetBackend(route, adminapi.Backend{Address: "127.0.0.1:1", Weight: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if !bound(port) {
+		t.Fatal("route registered again isn't listening")
+	}
+	registry.RemoveRoute(route)
+}
+
+func TestRegisterChecksBackendBeforeBinding(t *testing.T) {
+	config := &Config{Backends: routing.NewTable(), Leases: lease.NewTable()}
+	address := "127.0.0.1:" + freePort(t)
+	go startRegistrationServer(config, address)
+	eventually(t, func() bool {
+		conn, err := net.Dial("tcp", address)
+		if err == nil {
+			conn.Close()
+		}
+		return err == nil
+	}, "registration server never started")
+
+	port := freePort(t)
+	body := fmt.Sprintf(`{"port": %s, "address": "unix:///nonexistent.sock"}`, port)
+	resp, err := http.Post("http://"+address+"/register", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("unusable backend answered %d", resp.StatusCode)
+	}
+	if bound(port) {
+		t.Fatal("rejected registration bound its port-forward listener")
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"reverse-proxy/internal/clientauth"
+)
+
+// PROXY protocol v2 signature and TLV types (https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt)
+var proxyV2Signature = []byte{0x0d, 0x0a, 0x0d, 0x0a, 0x00, 0x0d, 0x0a, 0x51, 0x55, 0x49, 0x54, 0x0a}
+
+const (
+	pp2TypeAuthority    = 0x02
+	pp2TypeSSL          = 0x20
+	pp2SubtypeSSLVer    = 0x21
+	pp2SubtypeSSLCN     = 0x22
+	pp2SubtypeSSLCipher = 0x23
+	pp2ClientSSL        = 0x01
+	pp2ClientCertConn   = 0x02
+
+	// Custom TLVs for identity details the spec has no type for
+	pp2TypeClientSubject     = 0xe0
+	pp2TypeClientSANs        = 0xe1
+	pp2TypeClientFingerprint = 0xe2
+)
+
+// proxyTLV is a single type-length-value entry of a PROXY v2 header
+type proxyTLV struct {
+	typ   byte
+	value []byte
+}
+
+func appendTLV(buf []byte, tlv proxyTLV) []byte {
+	buf = append(buf, tlv.typ, byte(len(tlv.value)>>8), byte(len(tlv.value)))
+	return append(buf, tlv.value...)
+}
+
+// writeProxyHeaderV2 writes a PROXY v2 header describing a proxied connection from src to dst
+func writeProxyHeaderV2(w io.Writer, src, dst net.Addr, tlvs []proxyTLV) error {
+	var addresses []byte
+	family := byte(0x00) // UNSPEC: the receiver ignores the address block
+
+	srcTCP, srcOK := src.(*net.TCPAddr)
+	dstTCP, dstOK := dst.(*net.TCPAddr)
+	if srcOK && dstOK {
+		if src4, dst4 := srcTCP.IP.To4(), dstTCP.IP.To4(); src4 != nil && dst4 != nil {
+			family = 0x11 // TCP over IPv4
+			addresses = append(append(addresses, src4...), dst4...)
+		} else {
+			family = 0x21 // TCP over IPv6
+			addresses = append(append(addresses, srcTCP.IP.To16()...), dstTCP.IP.To16()...)
+		}
+		addresses = binary.BigEndian.AppendUint16(addresses, uint16(srcTCP.Port))
+		addresses = binary.BigEndian.AppendUint16(addresses, uint16(dstTCP.Port))
+	}
+
+	payload := addresses
+	for _, tlv := range tlvs {
+		payload = appendTLV(payload, tlv)
+	}
+	if len(payload) > 0xffff {
+		return fmt.Errorf("PROXY header too large")
+	}
+
+	var header bytes.Buffer
+	header.Write(proxyV2Signature)
+	header.WriteByte(0x21) // Version 2, PROXY command
+	header.WriteByte(family)
+	binary.Write(&header, binary.BigEndian, uint16(len(payload)))
+	header.Write(payload)
+
+	_, err := w.Write(header.Bytes())
+	return err
+}
+
+// tlsIdentityTLVs describes a terminated TLS connection and its verified client for the backend
+func tlsIdentityTLVs(state tls.ConnectionState, identity *clientauth.Identity) []proxyTLV {
+	ssl := []byte{pp2ClientSSL | pp2ClientCertConn, 0, 0, 0, 0} // Client flags, then verify result 0 (success)
+	ssl = appendTLV(ssl, proxyTLV{pp2SubtypeSSLVer, []byte(tls.VersionName(state.Version))})
+	ssl = appendTLV(ssl, proxyTLV{pp2SubtypeSSLCipher, []byte(tls.CipherSuiteName(state.CipherSuite))})
+	if cn := state.VerifiedChains[0][0].Subject.CommonName; cn != "" {
+		ssl = appendTLV(ssl, proxyTLV{pp2SubtypeSSLCN, []byte(cn)})
+	}
+
+	return []proxyTLV{
+		{pp2TypeAuthority, []byte(state.ServerName)},
+		{pp2TypeSSL, ssl},
+		{pp2TypeClientSubject, []byte(identity.Subject)},
+		{pp2TypeClientSANs, []byte(strings.Join(identity.SANs(), ", "))},
+		{pp2TypeClientFingerprint, []byte(identity.Fingerprint)},
+	}
+}
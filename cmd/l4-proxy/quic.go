@@ -0,0 +1,739 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"reverse-proxy/internal/tlspolicy"
+)
+
+// QUIC versions whose Initial packets the proxy can open
+const (
+	quicVersion1       = 0x00000001
+	quicVersion2       = 0x6b3343cf
+	quicVersionDraft29 = 0xff00001d
+)
+
+const (
+	quicMaxPending      = 1024            // Maximum number of connections waiting for a complete ClientHello
+	quicPendingTimeout  = 5 * time.Second // How long to wait for the rest of a ClientHello
+	quicMaxCryptoBuffer = 64 * 1024       // Largest ClientHello the proxy will reassemble
+	quicMaxBuffered     = 32              // Datagrams buffered per connection until its session exists
+)
+
+// quicInitialParams holds the version-specific constants used to protect Initial packets
+type quicInitialParams struct {
+	salt        []byte
+	labelPrefix string // Prefix of the key, iv and hp labels
+	initialType byte   // Long header packet type of Initial packets
+}
+
+var quicVersions = map[uint32]quicInitialParams{
+	// RFC 9001, Section 5.2
+	quicVersion1: {
+		salt:        []byte{0x38, 0x76, 0x2c, 0xf7, 0xf5, 0x59, 0x34, 0xb3, 0x4d, 0x17, 0x9a, 0xe6, 0xa4, 0xc8, 0x0c, 0xad, 0xcc, 0xbb, 0x7f, 0x0a},
+		labelPrefix: "quic",
+		initialType: 0x0,
+	},
+	// RFC 9369, Section 3.3
+	quicVersion2: {
+		salt:        []byte{0x0d, 0xed, 0xe3, 0xde, 0xf7, 0x00, 0xa6, 0xdb, 0x81, 0x93, 0x81, 0xbe, 0x6e, 0x26, 0x9d, 0xcb, 0xf9, 0xbd, 0x2e, 0xd9},
+		labelPrefix: "quicv2",
+		initialType: 0x1,
+	},
+	// draft-ietf-quic-tls-29, still sent by some older clients
+	quicVersionDraft29: {
+		salt:        []byte{0xaf, 0xbf, 0xec, 0x28, 0x99, 0x93, 0xd2, 0x4c, 0x9e, 0x97, 0x86, 0xf1, 0x9c, 0x61, 0x11, 0xe0, 0x43, 0x90, 0xa8, 0x99},
+		labelPrefix: "quic",
+		initialType: 0x0,
+	},
+}
+
+// quicLongHeader is the unprotected part of a long header packet
+type quicLongHeader struct {
+	version    uint32
+	packetType byte
+	dcid       []byte
+	scid       []byte
+	token      []byte
+	pnOffset   int // Offset of the protected packet number
+	length     int // Length of packet number and payload
+}
+
+// parseQUICLongHeader parses the invariant and version-specific fields of a long header packet
+func parseQUICLongHeader(packet []byte) (*quicLongHeader, error) {
+	if len(packet) < 7 || packet[0]&0x80 == 0 {
+		return nil, fmt.Errorf("not a long header packet")
+	}
+
+	hdr := &quicLongHeader{
+		version:    binary.BigEndian.Uint32(packet[1:5]),
+		packetType: (packet[0] >> 4) & 0x03,
+	}
+	offset := 5
+
+	// Destination and source connection IDs
+	dcidLen := int(packet[offset])
+	offset++
+	if dcidLen > 20 || len(packet) < offset+dcidLen+1 {
+		return nil, fmt.Errorf("invalid destination connection ID")
+	}
+	hdr.dcid = packet[offset : offset+dcidLen]
+	offset += dcidLen
+
+	scidLen := int(packet[offset])
+	offset++
+	if scidLen > 20 || len(packet) < offset+scidLen {
+		return nil, fmt.Errorf("invalid source connection ID")
+	}
+	hdr.scid = packet[offset : offset+scidLen]
+	offset += scidLen
+
+	params, ok := quicVersions[hdr.version]
+	if !ok || hdr.packetType != params.initialType {
+		return hdr, nil // Only Initial packets carry a token and a length we need
+	}
+
+	tokenLen, n, err := readQUICVarint(packet[offset:])
+	if err != nil || len(packet) < offset+n+int(tokenLen) {
+		return nil, fmt.Errorf("invalid token length")
+	}
+	offset += n
+	hdr.token = packet[offset : offset+int(tokenLen)]
+	offset += int(tokenLen)
+
+	length, n, err := readQUICVarint(packet[offset:])
+	if err != nil || len(packet) < offset+n+int(length) {
+		return nil, fmt.Errorf("invalid packet length")
+	}
+	offset += n
+	hdr.pnOffset = offset
+	hdr.length = int(length)
+
+	return hdr, nil
+}
+
+// isInitial reports whether the header belongs to an Initial packet of a supported version
+func (h *quicLongHeader) isInitial() bool {
+	params, ok := quicVersions[h.version]
+	return ok && h.packetType == params.initialType
+}
+
+// readQUICVarint decodes a variable-length integer (RFC 9000, Section 16)
+func readQUICVarint(data []byte) (uint64, int, error) {
+	if len(data) == 0 {
+		return 0, 0, fmt.Errorf("empty varint")
+	}
+	n := 1 << (data[0] >> 6)
+	if len(data) < n {
+		return 0, 0, fmt.Errorf("truncated varint")
+	}
+	value := uint64(data[0] & 0x3f)
+	for i := 1; i < n; i++ {
+		value = value<<8 | uint64(data[i])
+	}
+	return value, n, nil
+}
+
+// quicClientInitialKeys derives the client Initial key, IV and header protection key from the original DCID
+func quicClientInitialKeys(version uint32, dcid []byte) (key, iv, hp []byte, err error) {
+	params, ok := quicVersions[version]
+	if !ok {
+		return nil, nil, nil, fmt.Errorf("unsupported QUIC version: %#x", version)
+	}
+
+	initialSecret := hkdfExtract(params.salt, dcid)
+	clientSecret := hkdfExpandLabel(initialSecret, "client in", sha256.Size)
+
+	key = hkdfExpandLabel(clientSecret, params.labelPrefix+" key", 16)
+	iv = hkdfExpandLabel(clientSecret, params.labelPrefix+" iv", 12)
+	hp = hkdfExpandLabel(clientSecret, params.labelPrefix+" hp", 16)
+	return key, iv, hp, nil
+}
+
+func hkdfExtract(salt, secret []byte) []byte {
+	mac := hmac.New(sha256.New, salt)
+	mac.Write(secret)
+	return mac.Sum(nil)
+}
+
+// hkdfExpandLabel implements HKDF-Expand-Label from RFC 8446 with an empty context
+func hkdfExpandLabel(secret []byte, label string, length int) []byte {
+	fullLabel := "tls13 " + label
+	info := []byte{byte(length >> 8), byte(length), byte(len(fullLabel))}
+	info = append(info, fullLabel...)
+	info = append(info, 0)
+
+	var out, block []byte
+	for counter := byte(1); len(out) < length; counter++ {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(block)
+		mac.Write(info)
+		mac.Write([]byte{counter})
+		block = mac.Sum(nil)
+		out = append(out, block...)
+	}
+	return out[:length]
+}
+
+// decryptQUICInitial removes header protection from a client Initial packet and returns its plaintext frames
+func decryptQUICInitial(packet []byte, hdr *quicLongHeader, originalDCID []byte) ([]byte, error) {
+	key, iv, hpKey, err := quicClientInitialKeys(hdr.version, originalDCID)
+	if err != nil {
+		return nil, err
+	}
+
+	// The header protection sample starts 4 bytes after the packet number
+	end := hdr.pnOffset + hdr.length
+	if hdr.pnOffset+4+aes.BlockSize > end {
+		return nil, fmt.Errorf("packet too short for header protection sample")
+	}
+	hp, err := aes.NewCipher(hpKey)
+	if err != nil {
+		return nil, err
+	}
+	mask := make([]byte, aes.BlockSize)
+	hp.Encrypt(mask, packet[hdr.pnOffset+4:hdr.pnOffset+4+aes.BlockSize])
+
+	// Work on a copy so the datagram is forwarded untouched
+	header := make([]byte, hdr.pnOffset+4)
+	copy(header, packet)
+	header[0] ^= mask[0] & 0x0f
+	pnLen := int(header[0]&0x03) + 1
+	header = header[:hdr.pnOffset+pnLen]
+
+	var pn uint64
+	for i := 0; i < pnLen; i++ {
+		header[hdr.pnOffset+i] ^= mask[1+i]
+		pn = pn<<8 | uint64(header[hdr.pnOffset+i])
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, len(iv))
+	copy(nonce, iv)
+	for i := 0; i < 8; i++ {
+		nonce[len(nonce)-1-i] ^= byte(pn >> (8 * i))
+	}
+
+	plaintext, err := aead.Open(nil, nonce, packet[hdr.pnOffset+pnLen:end], header)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt Initial packet: %w", err)
+	}
+	return plaintext, nil
+}
+
+// quicCryptoStream reassembles CRYPTO frame data that may arrive out of order or across packets
+type quicCryptoStream struct {
+	fragments map[uint64][]byte
+	size      int
+}
+
+// addFrames collects the CRYPTO frames from a decrypted Initial payload
+func (s *quicCryptoStream) addFrames(payload []byte) error {
+	if s.fragments == nil {
+		s.fragments = make(map[uint64][]byte)
+	}
+
+	for len(payload) > 0 {
+		frameType, n, err := readQUICVarint(payload)
+		if err != nil {
+			return err
+		}
+		payload = payload[n:]
+
+		switch {
+		case frameType == 0x00 || frameType == 0x01: // PADDING, PING
+		case frameType == 0x02 || frameType == 0x03: // ACK
+			if payload, err = skipQUICAckFrame(payload, frameType == 0x03); err != nil {
+				return err
+			}
+		case frameType == 0x06: // CRYPTO
+			offset, n, err := readQUICVarint(payload)
+			if err != nil {
+				return err
+			}
+			payload = payload[n:]
+			length, n, err := readQUICVarint(payload)
+			if err != nil || uint64(len(payload)-n) < length {
+				return fmt.Errorf("invalid CRYPTO frame")
+			}
+			payload = payload[n:]
+
+			s.size += int(length)
+			if s.size > quicMaxCryptoBuffer {
+				return fmt.Errorf("ClientHello exceeds %d bytes", quicMaxCryptoBuffer)
+			}
+			s.fragments[offset] = append([]byte(nil), payload[:length]...)
+			payload = payload[length:]
+		case frameType == 0x1c: // CONNECTION_CLOSE
+			return fmt.Errorf("connection closed by client")
+		default:
+			return fmt.Errorf("unexpected frame type %#x in Initial packet", frameType)
+		}
+	}
+	return nil
+}
+
+// skipQUICAckFrame skips over the body of an ACK frame
+func skipQUICAckFrame(payload []byte, ecn bool) ([]byte, error) {
+	// Largest Acknowledged, ACK Delay, ACK Range Count, First ACK Range
+	fields := 4
+	var rangeCount uint64
+	for i := 0; i < fields; i++ {
+		value, n, err := readQUICVarint(payload)
+		if err != nil {
+			return nil, err
+		}
+		payload = payload[n:]
+		if i == 2 {
+			rangeCount = value
+		}
+	}
+
+	// Gap and ACK Range Length per range, then three ECN counts
+	remaining := 2 * rangeCount
+	if ecn {
+		remaining += 3
+	}
+	for i := uint64(0); i < remaining; i++ {
+		_, n, err := readQUICVarint(payload)
+		if err != nil {
+			return nil, err
+		}
+		payload = payload[n:]
+	}
+	return payload, nil
+}
+
+// clientHello returns the complete ClientHello handshake message once it has been fully received
+func (s *quicCryptoStream) clientHello() ([]byte, bool) {
+	offsets := make([]uint64, 0, len(s.fragments))
+	for offset := range s.fragments {
+		offsets = append(offsets, offset)
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+
+	// Join the contiguous prefix of the stream
+	var data []byte
+	for _, offset := range offsets {
+		if offset > uint64(len(data)) {
+			break
+		}
+		fragment := s.fragments[offset]
+		if end := offset + uint64(len(fragment)); end > uint64(len(data)) {
+			data = append(data, fragment[uint64(len(data))-offset:]...)
+		}
+	}
+
+	if len(data) < 4 {
+		return nil, false
+	}
+	helloLen := 4 + (int(data[1])<<16 | int(data[2])<<8 | int(data[3]))
+	if len(data) < helloLen {
+		return nil, false
+	}
+	return data[:helloLen], true
+}
+
+// extractQUICSNI wraps a reassembled ClientHello in a TLS record header and extracts its SNI
+func extractQUICSNI(clientHello []byte) (string, error) {
+	if len(clientHello) > 0xffff {
+		return "", fmt.Errorf("ClientHello too large")
+	}
+	record := make([]byte, 0, 5+len(clientHello))
+	record = append(record, 0x16, 0x03, 0x01, byte(len(clientHello)>>8), byte(len(clientHello)))
+	record = append(record, clientHello...)
+	return parseTLSClientHello(record)
+}
+
+// quicSession pins a QUIC connection to a backend
+type quicSession struct {
+	*udpSession
+	route string
+	cids  []string // Connection IDs the session is indexed by
+	addrs []string // Client addresses the session is indexed by
+}
+
+// quicPending buffers the first datagrams of a connection until its ClientHello is complete
+// and, while the backend is dialed, holds the datagrams that arrive in the meantime
+type quicPending struct {
+	datagrams [][]byte
+	crypto    quicCryptoStream
+	created   time.Time
+	dialing   bool // The ClientHello is complete and a session is being created
+}
+
+// quicProxy routes QUIC connections by SNI without terminating them
+type quicProxy struct {
+	listener *net.UDPConn
+	config   *Config
+
+	mu      sync.Mutex
+	byCID   map[string]*quicSession // Sessions keyed by connection ID
+	byAddr  map[string]*quicSession // Sessions keyed by client address, for unknown connection IDs
+	cidLens map[int]int             // Reference counts of known connection ID lengths, for short headers
+	pending map[string]*quicPending // Keyed by original destination connection ID
+}
+
+// Proxy listens for QUIC datagrams and routes each connection by the SNI in its Initial packets
+func startQUICProxy(address string, config *Config) error {
+	udpAddr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return fmt.Errorf("failed to resolve UDP address: %w", err)
+	}
+
+	listener, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return fmt.Errorf("failed to start QUIC listener: %w", err)
+	}
+	defer listener.Close()
+
+	log.Printf("Listening on %s/udp for QUIC", address)
+
+	proxy := &quicProxy{
+		listener: listener,
+		config:   config,
+		byCID:    make(map[string]*quicSession),
+		byAddr:   make(map[string]*quicSession),
+		cidLens:  make(map[int]int),
+		pending:  make(map[string]*quicPending),
+	}
+	return proxy.serve()
+}
+
+func (p *quicProxy) serve() error {
+	buf := make([]byte, udpBufferSize)
+
+	for {
+		n, clientAddr, err := p.listener.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			log.Printf("Failed to read QUIC datagram: %v", err)
+			continue
+		}
+
+		p.handleDatagram(buf[:n], clientAddr)
+	}
+}
+
+func (p *quicProxy) handleDatagram(datagram []byte, clientAddr *net.UDPAddr) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if session := p.lookupSession(datagram, clientAddr); session != nil {
+		p.forward(session, datagram, clientAddr)
+		return
+	}
+
+	hdr, err := parseQUICLongHeader(datagram)
+	if err != nil || !hdr.isInitial() {
+		udpDrops.WithLabelValues("quic", "unknown_connection").Inc()
+		return
+	}
+
+	// Buffer datagrams until the ClientHello is complete
+	dcid := string(hdr.dcid)
+	pending, ok := p.pending[dcid]
+	if !ok {
+		p.expirePending()
+		if len(p.pending) >= quicMaxPending {
+			udpDrops.WithLabelValues("quic", "pending_limit").Inc()
+			return
+		}
+		pending = &quicPending{created: time.Now()}
+		p.pending[dcid] = pending
+	}
+	if len(pending.datagrams) >= quicMaxBuffered {
+		udpDrops.WithLabelValues("quic", "pending_limit").Inc()
+		return
+	}
+	pending.datagrams = append(pending.datagrams, append([]byte(nil), datagram...))
+	if pending.dialing {
+		return // Forwarded once the session exists
+	}
+
+	// A datagram may carry several coalesced packets
+	for packet := datagram; len(packet) > 0; {
+		hdr, err := parseQUICLongHeader(packet)
+		if err != nil || !hdr.isInitial() {
+			break
+		}
+		payload, err := decryptQUICInitial(packet, hdr, hdr.dcid)
+		if err != nil {
+			delete(p.pending, dcid)
+			udpDrops.WithLabelValues("quic", "decrypt_failed").Inc()
+			log.Printf("Failed to open QUIC Initial from %s: %v", clientAddr, err)
+			return
+		}
+		if err := pending.crypto.addFrames(payload); err != nil {
+			delete(p.pending, dcid)
+			udpDrops.WithLabelValues("quic", "invalid_initial").Inc()
+			log.Printf("Invalid QUIC Initial from %s: %v", clientAddr, err)
+			return
+		}
+		packet = packet[hdr.pnOffset+hdr.length:]
+	}
+
+	clientHello, complete := pending.crypto.clientHello()
+	if !complete {
+		return
+	}
+
+	sni, err := extractQUICSNI(clientHello)
+	if err != nil {
+		delete(p.pending, dcid)
+		udpDrops.WithLabelValues("quic", "no_sni").Inc()
+		log.Printf("Failed to extract SNI from QUIC ClientHello: %v", err)
+		return
+	}
+
+	// QUIC is always TLS 1.3, but the policy may still restrict suites, curves and ALPN
+	if rule := p.config.TLSRules.Lookup(sni); rule != nil {
+		hello, err := tlspolicy.ParseClientHello(clientHello)
+		if err == nil {
+			err = rule.Check(hello)
+		}
+		if err != nil {
+			delete(p.pending, dcid)
+			udpDrops.WithLabelValues("quic", "tls_policy").Inc()
+			log.Printf("Rejected QUIC ClientHello for SNI %s: %v", sni, err)
+			return
+		}
+	}
+
+	// Resolving and dialing the backend must not stall other connections, so the pending entry
+	// stays behind as a marker that buffers this connection's datagrams until the session exists
+	pending.dialing = true
+	go p.connect(sni, hdr.dcid, clientAddr, pending)
+}
+
+// connect creates the session of a connection whose ClientHello is complete and forwards the datagrams buffered for it
+func (p *quicProxy) connect(sni string, dcid []byte, clientAddr *net.UDPAddr, pending *quicPending) {
+	session, err := p.newSession(sni, clientAddr)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.pending[string(dcid)] == pending {
+		delete(p.pending, string(dcid))
+	}
+	if err != nil {
+		log.Printf("Dropping QUIC connection for SNI %s: %v", sni, err)
+		return
+	}
+
+	// Another session may have claimed the connection ID while the backend was dialed
+	if existing, ok := p.byCID[string(dcid)]; ok {
+		session.backend.Close()
+		reportBackend(p.config, session.route, session.address, session.started, nil)
+		for _, buffered := range pending.datagrams {
+			p.forward(existing, buffered, clientAddr)
+		}
+		return
+	}
+
+	p.indexCID(session, dcid)
+	p.indexAddr(session, clientAddr)
+	udpSessions.WithLabelValues(session.route).Inc()
+	log.Printf("New QUIC session for SNI %s -> %s", sni, session.address)
+	go p.relayReplies(session)
+
+	for _, buffered := range pending.datagrams {
+		p.forward(session, buffered, clientAddr)
+	}
+}
+
+// lookupSession finds the session a datagram belongs to by connection ID, falling back to the client address
+func (p *quicProxy) lookupSession(datagram []byte, clientAddr *net.UDPAddr) *quicSession {
+	if len(datagram) == 0 {
+		return nil
+	}
+
+	if datagram[0]&0x80 != 0 {
+		if hdr, err := parseQUICLongHeader(datagram); err == nil {
+			if session, ok := p.byCID[string(hdr.dcid)]; ok {
+				return session
+			}
+		}
+	} else {
+		// Short headers do not encode the connection ID length
+		for cidLen := range p.cidLens {
+			if len(datagram) > cidLen {
+				if session, ok := p.byCID[string(datagram[1:1+cidLen])]; ok {
+					return session
+				}
+			}
+		}
+	}
+
+	return p.byAddr[clientAddr.String()]
+}
+
+// newSession picks a backend for the SNI and dials it. It runs without p.mu; the caller indexes the session.
+func (p *quicProxy) newSession(sni string, clientAddr *net.UDPAddr) (*quicSession, error) {
+	// Parse SNI
+	serviceName, err := parseSNI(sni)
+	if err != nil {
+		udpDrops.WithLabelValues("quic", "no_sni").Inc()
+		return nil, err
+	}
+
+	// Get the next backend from the route's balancer
+	backendAddr, err := getNextBackend(p.config, serviceName, clientAddr.IP.String())
+	if err != nil {
+		// Any client can name any SNI, so only configured routes get series of their own
+		label := serviceName
+		if !p.config.Backends.Has(serviceName) {
+			label = "unknown"
+		}
+		udpDrops.WithLabelValues(label, "no_backend").Inc()
+		return nil, err
+	}
+
+	udp, err := newUDPSession(p.config, clientAddr, backendAddr)
+	if err != nil {
+		reportBackend(p.config, serviceName, backendAddr, time.Now(), err)
+		udpDrops.WithLabelValues(serviceName, "dial_failed").Inc()
+		return nil, err
+	}
+
+	return &quicSession{udpSession: udp, route: serviceName}, nil
+}
+
+// forward sends a client datagram to the session's backend, following client migration
+func (p *quicProxy) forward(session *quicSession, datagram []byte, clientAddr *net.UDPAddr) {
+	if current := session.client.Load(); current.String() != clientAddr.String() {
+		session.client.Store(clientAddr)
+		p.indexAddr(session, clientAddr)
+	}
+
+	// Client -> Backend
+	if _, err := session.backend.Write(datagram); err != nil {
+		udpDrops.WithLabelValues(session.route, "write_failed").Inc()
+		log.Printf("Failed to forward QUIC datagram to backend: %v", err)
+		return
+	}
+	session.touch()
+	udpPackets.WithLabelValues(session.route, "upstream").Inc()
+}
+
+// indexCID pins a connection ID to the session, taking it from any session that held it
+func (p *quicProxy) indexCID(session *quicSession, cid []byte) {
+	key := string(cid)
+	owner, indexed := p.byCID[key]
+	if len(cid) == 0 || owner == session {
+		return
+	}
+	p.byCID[key] = session
+	if !indexed {
+		p.cidLens[len(cid)]++ // The lengths count indexed connection IDs, not sessions holding them
+	}
+	session.cids = append(session.cids, key)
+}
+
+func (p *quicProxy) indexAddr(session *quicSession, clientAddr *net.UDPAddr) {
+	key := clientAddr.String()
+	if p.byAddr[key] == session {
+		return
+	}
+	p.byAddr[key] = session
+	session.addrs = append(session.addrs, key)
+}
+
+// relayReplies copies backend datagrams back to the client and learns the connection IDs the backend chooses
+func (p *quicProxy) relayReplies(session *quicSession) {
+	defer p.expireSession(session)
+
+	buf := make([]byte, udpBufferSize)
+	timeout := p.config.UDPSessionTimeout
+	if timeout <= 0 {
+		timeout = defaultUDPSessionTimeout
+	}
+
+	for {
+		session.backend.SetReadDeadline(time.Now().Add(timeout))
+		n, err := session.backend.Read(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() && session.idleFor() < timeout {
+				continue // Client traffic kept the session alive
+			}
+			return
+		}
+		session.touch()
+
+		// The backend's source connection ID becomes the client's destination connection ID
+		if hdr, err := parseQUICLongHeader(buf[:n]); err == nil {
+			p.mu.Lock()
+			p.indexCID(session, hdr.scid)
+			p.mu.Unlock()
+		}
+
+		// Backend -> Client
+		if _, err := p.listener.WriteToUDP(buf[:n], session.client.Load()); err != nil {
+			udpDrops.WithLabelValues(session.route, "write_failed").Inc()
+			log.Printf("Failed to forward QUIC datagram to client: %v", err)
+			continue
+		}
+		udpPackets.WithLabelValues(session.route, "downstream").Inc()
+	}
+}
+
+func (p *quicProxy) expireSession(session *quicSession) {
+	p.mu.Lock()
+	p.unindex(session)
+	p.mu.Unlock()
+
+	session.backend.Close()
+	reportBackend(p.config, session.route, session.address, session.started, nil)
+	udpSessions.WithLabelValues(session.route).Dec()
+	log.Printf("QUIC session for route %s expired", session.route)
+}
+
+// unindex drops the connection IDs and client addresses the session still holds
+func (p *quicProxy) unindex(session *quicSession) {
+	for _, cid := range session.cids {
+		if p.byCID[cid] != session {
+			continue // Taken over by another session, which now accounts for it
+		}
+		delete(p.byCID, cid)
+		if p.cidLens[len(cid)]--; p.cidLens[len(cid)] == 0 {
+			delete(p.cidLens, len(cid))
+		}
+	}
+	for _, addr := range session.addrs {
+		if p.byAddr[addr] == session {
+			delete(p.byAddr, addr)
+		}
+	}
+}
+
+// expirePending drops connections whose ClientHello never completed
+func (p *quicProxy) expirePending() {
+	for dcid, pending := range p.pending {
+		if !pending.dialing && time.Since(pending.created) > quicPendingTimeout {
+			delete(p.pending, dcid)
+			udpDrops.WithLabelValues("quic", "incomplete_initial").Add(float64(len(pending.datagrams)))
+		}
+	}
+}
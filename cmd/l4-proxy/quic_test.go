@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/hex"
+	"net"
+	"testing"
+	"time"
+
+	"reverse-proxy/internal/adminapi"
+	"reverse-proxy/internal/lease"
+	"reverse-proxy/internal/routing"
+)
+
+// Client Initial of RFC 9001, Appendix A
+const (
+	rfc9001DCID = "8394c8f03e515708"
+
+	// Appendix A.2: the CRYPTO frame holding the ClientHello, padded to 1162 bytes
+	rfc9001CryptoFrame = "060040f1010000ed0303ebf8fa56f12939b9584a3896472ec40bb863cfd3e868" +
+		"04fe3a47f06a2b69484c00000413011302010000c000000010000e00000b6578" +
+		"616d706c652e636f6dff01000100000a00080006001d00170018001000070005" +
+		"04616c706e000500050100000000003300260024001d00209370b2c9caa47fba" +
+		"baf4559fedba753de171fa71f50f1ce15d43e994ec74d748002b000302030400" +
+		"0d0010000e0403050306030203080408050806002d00020101001c0002400100" +
+		"3900320408ffffffffffffffff05048000ffff07048000ffff08011001048000" +
+		"75300901100f088394c8f03e51570806048000ffff"
+	rfc9001PayloadLen = 1162
+
+	rfc9001Header          = "c300000001088394c8f03e5157080000449e00000002"
+	rfc9001ProtectedHeader = "c000000001088394c8f03e5157080000449e7b9aec34"
+	rfc9001Tag             = "e221af44860018ab0856972e194cd934"
+)
+
+func mustHex(t testing.TB, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// protectQUICInitial seals a client Initial packet the way a QUIC client does (RFC 9001, Section 5)
+func protectQUICInitial(t *testing.T, version uint32, dcid, header, payload []byte, pnLen int) []byte {
+	t.Helper()
+	key, iv, hpKey, err := quicClientInitialKeys(version, dcid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pnOffset := len(header) - pnLen
+
+	var pn uint64
+	for _, b := range header[pnOffset:] {
+		pn = pn<<8 | uint64(b)
+	}
+	nonce := append([]byte(nil), iv...)
+	for i := 0; i < 8; i++ {
+		nonce[len(nonce)-1-i] ^= byte(pn >> (8 * i))
+	}
+	block, _ := aes.NewCipher(key)
+	aead, _ := cipher.NewGCM(block)
+	packet := aead.Seal(append([]byte(nil), header...), nonce, payload, header)
+
+	hp, _ := aes.NewCipher(hpKey)
+	mask := make([]byte, aes.BlockSize)
+	hp.Encrypt(mask, packet[pnOffset+4:pnOffset+4+aes.BlockSize])
+	packet[0] ^= mask[0] & 0x0f
+	for i := 0; i < pnLen; i++ {
+		packet[pnOffset+i] ^= mask[1+i]
+	}
+	return packet
+}
+
+func rfc9001Packet(t *testing.T) []byte {
+	payload := make([]byte, rfc9001PayloadLen)
+	copy(payload, mustHex(t, rfc9001CryptoFrame))
+	return protectQUICInitial(t, quicVersion1, mustHex(t, rfc9001DCID), mustHex(t, rfc9001Header), payload, 4)
+}
+
+func TestQUICClientInitialKeys(t *testing.T) {
+	// RFC 9001, Appendix A.1
+	key, iv, hp, err := quicClientInitialKeys(quicVersion1, mustHex(t, rfc9001DCID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		name string
+		got  []byte
+		want string
+	}{
+		{"key", key, "1f369613dd76d5467730efcbe3b1a22d"},
+		{"iv", iv, "fa044b2f42a3fd3b46fb255c"},
+		{"hp", hp, "9f50449e04a0e810283a1e9933adedd2"},
+	} {
+		if hex.EncodeToString(c.got) != c.want {
+			t.Errorf("%s = %x, want %s", c.name, c.got, c.want)
+		}
+	}
+
+	if _, _, _, err := quicClientInitialKeys(0x0a0a0a0a, nil); err == nil {
+		t.Error("expected an error for an unsupported version")
+	}
+}
+
+func TestDecryptQUICInitialRFC9001(t *testing.T) {
+	packet := rfc9001Packet(t)
+
+	// The sealed packet must match the one in Appendix A.2 before the proxy's side is checked
+	if len(packet) != 1200 {
+		t.Fatalf("packet is %d bytes, want 1200", len(packet))
+	}
+	if got := hex.EncodeToString(packet[:len(rfc9001ProtectedHeader)/2]); got != rfc9001ProtectedHeader {
+		t.Fatalf("protected header = %s, want %s", got, rfc9001ProtectedHeader)
+	}
+	if got := hex.EncodeToString(packet[len(packet)-16:]); got != rfc9001Tag {
+		t.Fatalf("tag = %s, want %s", got, rfc9001Tag)
+	}
+
+	hdr, err := parseQUICLongHeader(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hdr.isInitial() || hex.EncodeToString(hdr.dcid) != rfc9001DCID || hdr.length != 1182 {
+		t.Fatalf("unexpected header: %+v", hdr)
+	}
+
+	original := append([]byte(nil), packet...)
+	payload, err := decryptQUICInitial(packet, hdr, hdr.dcid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(packet, original) {
+		t.Error("decryption modified the datagram, which is forwarded as received")
+	}
+	if want := mustHex(t, rfc9001CryptoFrame); !bytes.HasPrefix(payload, want) {
+		t.Fatalf("payload starts %x, want %x", payload[:len(want)], want)
+	}
+
+	var stream quicCryptoStream
+	if err := stream.addFrames(payload); err != nil {
+		t.Fatal(err)
+	}
+	hello, ok := stream.clientHello()
+	if !ok {
+		t.Fatal("ClientHello incomplete")
+	}
+	sni, err := extractQUICSNI(hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sni != "example.com" {
+		t.Errorf("SNI = %q, want example.com", sni)
+	}
+}
+
+func TestDecryptQUICInitialRejectsTampering(t *testing.T) {
+	packet := rfc9001Packet(t)
+	packet[len(packet)-20] ^= 0x01
+
+	hdr, err := parseQUICLongHeader(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := decryptQUICInitial(packet, hdr, hdr.dcid); err == nil {
+		t.Error("expected a tampered packet to fail authentication")
+	}
+}
+
+// A ClientHello split over two packets, arriving in reverse order, is reassembled
+func TestQUICCryptoStreamReassembly(t *testing.T) {
+	frame := mustHex(t, rfc9001CryptoFrame)
+	hello := frame[4:] // Type, offset and length are one, one and two bytes
+	split := 100
+
+	cryptoFrame := func(offset int, data []byte) []byte {
+		frame := []byte{0x06, byte(offset)} // Offsets below 64 fit in one byte
+		if offset >= 64 {
+			frame = []byte{0x06, 0x40 | byte(offset>>8), byte(offset)}
+		}
+		frame = append(frame, 0x40|byte(len(data)>>8), byte(len(data)))
+		return append(frame, data...)
+	}
+
+	dcid := mustHex(t, rfc9001DCID)
+	var stream quicCryptoStream
+	for i, part := range [][]byte{cryptoFrame(split, hello[split:]), cryptoFrame(0, hello[:split])} {
+		payload := make([]byte, 1100)
+		copy(payload, part)
+		length := 4 + len(payload) + 16 // Packet number, payload and tag
+		header := append([]byte{0xc3, 0, 0, 0, 1, byte(len(dcid))}, dcid...)
+		header = append(header, 0, 0, 0x40|byte(length>>8), byte(length), 0, 0, 0, byte(i+1))
+		packet := protectQUICInitial(t, quicVersion1, dcid, header, payload, 4)
+
+		hdr, err := parseQUICLongHeader(packet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		plaintext, err := decryptQUICInitial(packet, hdr, hdr.dcid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := stream.addFrames(plaintext); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := stream.clientHello(); ok != (i == 1) {
+			t.Fatalf("after packet %d: complete = %v", i+1, ok)
+		}
+	}
+
+	got, _ := stream.clientHello()
+	if !bytes.Equal(got, hello) {
+		t.Error("reassembled ClientHello differs from the original")
+	}
+}
+
+// Connection IDs stay counted while any session holds them, and only once
+func TestQUICConnectionIDIndex(t *testing.T) {
+	p := &quicProxy{
+		byCID:   make(map[string]*quicSession),
+		byAddr:  make(map[string]*quicSession),
+		cidLens: make(map[int]int),
+	}
+	a := &quicSession{route: "a"}
+	b := &quicSession{route: "b"}
+
+	p.indexCID(a, []byte("12345678"))
+	p.indexCID(b, []byte("12345678")) // The backend reused a's connection ID for b
+	p.indexCID(b, []byte("abcd"))
+	if p.cidLens[8] != 1 || p.cidLens[4] != 1 {
+		t.Fatalf("cidLens = %v, want one of each length", p.cidLens)
+	}
+
+	p.unindex(a)
+	if p.byCID["12345678"] != b || p.cidLens[8] != 1 {
+		t.Fatalf("expiring a dropped b's connection ID: byCID = %v, cidLens = %v", p.byCID, p.cidLens)
+	}
+	p.unindex(b)
+	if len(p.byCID) != 0 || len(p.cidLens) != 0 {
+		t.Fatalf("after expiring both: byCID = %v, cidLens = %v", p.byCID, p.cidLens)
+	}
+}
+
+// listenQUICProxy starts a QUIC proxy on a loopback port
+func listenQUICProxy(t *testing.T, config *Config) *net.UDPConn {
+	t.Helper()
+	listener, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := &quicProxy{
+		listener: listener,
+		config:   config,
+		byCID:    make(map[string]*quicSession),
+		byAddr:   make(map[string]*quicSession),
+		cidLens:  make(map[int]int),
+		pending:  make(map[string]*quicPending),
+	}
+	go proxy.serve()
+	t.Cleanup(func() { listener.Close() })
+	return listener
+}
+
+func readUDP(t *testing.T, conn *net.UDPConn) ([]byte, *net.UDPAddr) {
+	t.Helper()
+	buf := make([]byte, udpBufferSize)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, addr, err := conn.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf[:n], addr
+}
+
+func TestQUICProxyRoutesBySNI(t *testing.T) {
+	backend, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+
+	config := &Config{Backends: routing.NewTable(), Leases: lease.NewTable()}
+	config.Backends.Add("example.com", adminapi.Backend{Address: backend.LocalAddr().String(), Weight: 1})
+	proxy := listenQUICProxy(t, config)
+
+	client, err := net.DialUDP("udp", nil, proxy.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	packet := rfc9001Packet(t)
+	client.Write(packet)
+	got, session := readUDP(t, backend)
+	if !bytes.Equal(got, packet) {
+		t.Fatal("backend didn't receive the client's Initial")
+	}
+
+	// Later datagrams of the connection follow it to the same backend, and replies reach the client
+	client.Write(packet)
+	if got, _ := readUDP(t, backend); !bytes.Equal(got, packet) {
+		t.Fatal("retransmitted Initial not forwarded")
+	}
+	backend.WriteToUDP([]byte("reply"), session)
+	if got, _ := readUDP(t, client); string(got) != "reply" {
+		t.Fatalf("client got %q", got)
+	}
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"reverse-proxy/internal/adminapi"
+	"reverse-proxy/internal/routing"
+)
+
+const (
+	defaultDNSCacheTTL  = 30 * time.Second       // Used when Config.DNSCacheTTL is unset
+	happyEyeballsDelay  = 250 * time.Millisecond // Connection Attempt Delay from RFC 8305
+	dnsLookupTimeout    = 5 * time.Second
+	dnsEvictAfterUnused = 10 // Refresh intervals a hostname may go unused before it is dropped from the cache
+)
+
+// resolvedHost is a cached A/AAAA lookup for a backend hostname
+type resolvedHost struct {
+	ips      []net.IP
+	lastUsed time.Time
+}
+
+// srvDiscovery populates a route's backend pool from an SRV record
+type srvDiscovery struct {
+	route  string
+	name   string          // e.g. _https._tcp.svc.example.com
+	source *routing.Source // Backends currently added to the route from this record
+}
+
+// dialResult is the outcome of one Happy Eyeballs connection attempt
+type dialResult struct {
+	conn net.Conn
+	err  error
+}
+
+// backendResolver resolves backend hostnames on a timer instead of on every connect
+type backendResolver struct {
+	resolver *net.Resolver
+	ttl      time.Duration
+
+	mu    sync.Mutex
+	hosts map[string]*resolvedHost
+	srvs  map[string]*srvDiscovery // Keyed by route and SRV name
+}
+
+// newBackendResolver creates a resolver that queries server (host:port), or the system resolver if server is empty
+func newBackendResolver(server string, ttl time.Duration) *backendResolver {
+	if ttl <= 0 {
+		ttl = defaultDNSCacheTTL
+	}
+
+	resolver := net.DefaultResolver
+	if server != "" {
+		resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, network, server)
+			},
+		}
+	}
+
+	return &backendResolver{
+		resolver: resolver,
+		ttl:      ttl,
+		hosts:    make(map[string]*resolvedHost),
+		srvs:     make(map[string]*srvDiscovery),
+	}
+}
+
+// isSRVName reports whether a backend address is an SRV name such as _https._tcp.svc.example.com
+func isSRVName(backendAddr string) bool {
+	_, _, err := net.SplitHostPort(backendAddr)
+	return err != nil && strings.HasPrefix(backendAddr, "_")
+}
+
+// lookupHost returns the cached addresses for a hostname, resolving it on first use
+func (r *backendResolver) lookupHost(ctx context.Context, host string) ([]net.IP, error) {
+	r.mu.Lock()
+	if cached, ok := r.hosts[host]; ok {
+		cached.lastUsed = time.Now()
+		ips := cached.ips
+		r.mu.Unlock()
+		return ips, nil
+	}
+	r.mu.Unlock()
+
+	ips, err := r.resolve(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	r.hosts[host] = &resolvedHost{ips: ips, lastUsed: time.Now()}
+	r.mu.Unlock()
+	return ips, nil
+}
+
+func (r *backendResolver) resolve(ctx context.Context, host string) ([]net.IP, error) {
+	addrs, err := r.resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %s: %w", host, err)
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no addresses found for %s", host)
+	}
+
+	ips := make([]net.IP, len(addrs))
+	for i, addr := range addrs {
+		ips[i] = addr.IP
+	}
+	return ips, nil
+}
+
+// dial connects to host:port, racing the resolved addresses with Happy Eyeballs (RFC 8305)
+func (r *backendResolver) dial(ctx context.Context, backendAddr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(backendAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	var dialer net.Dialer
+	if net.ParseIP(host) != nil {
+		return dialer.DialContext(ctx, "tcp", backendAddr)
+	}
+
+	ips, err := r.lookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips = interleaveAddressFamilies(ips)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan dialResult, len(ips))
+
+	var firstErr error
+	next, pending := 0, 0
+	for next < len(ips) || pending > 0 {
+		if next < len(ips) {
+			addr := net.JoinHostPort(ips[next].String(), port)
+			next++
+			pending++
+			go func() {
+				conn, err := dialer.DialContext(ctx, "tcp", addr)
+				results <- dialResult{conn, err}
+			}()
+		}
+
+		// Start the next attempt after the delay unless this one settles first
+		var delay <-chan time.Time
+		if next < len(ips) {
+			delay = time.After(happyEyeballsDelay)
+		}
+
+		select {
+		case result := <-results:
+			pending--
+			if result.err == nil {
+				go closeLateConnections(results, pending)
+				return result.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = result.err
+			}
+		case <-delay:
+		}
+	}
+
+	return nil, firstErr
+}
+
+// closeLateConnections closes attempts that succeed after another attempt already won the race
+func closeLateConnections(results <-chan dialResult, pending int) {
+	for i := 0; i < pending; i++ {
+		if result := <-results; result.conn != nil {
+			result.conn.Close()
+		}
+	}
+}
+
+// interleaveAddressFamilies alternates IPv6 and IPv4 addresses, starting with the family of the first one
+func interleaveAddressFamilies(ips []net.IP) []net.IP {
+	var primary, secondary []net.IP
+	firstIsV4 := ips[0].To4() != nil
+	for _, ip := range ips {
+		if (ip.To4() != nil) == firstIsV4 {
+			primary = append(primary, ip)
+		} else {
+			secondary = append(secondary, ip)
+		}
+	}
+
+	interleaved := make([]net.IP, 0, len(ips))
+	for i := 0; i < len(primary) || i < len(secondary); i++ {
+		if i < len(primary) {
+			interleaved = append(interleaved, primary[i])
+		}
+		if i < len(secondary) {
+			interleaved = append(interleaved, secondary[i])
+		}
+	}
+	return interleaved
+}
+
+// addSRVDiscovery starts populating a route's pool from an SRV record
+func (r *backendResolver) addSRVDiscovery(config *Config, route, name string) {
+	key := route + "|" + name
+
+	r.mu.Lock()
+	discovery, ok := r.srvs[key]
+	if !ok {
+		discovery = &srvDiscovery{route: route, name: name, source: config.Backends.NewSource()}
+		r.srvs[key] = discovery
+	}
+	r.mu.Unlock()
+
+	r.reconcileSRV(discovery)
+}
+
+// hasSRVDiscovery reports whether a route's pool is populated from an SRV record
+func (r *backendResolver) hasSRVDiscovery(route, name string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.srvs[route+"|"+name]
+	return ok
+}
+
+// hasSRVDiscoveries reports whether any SRV record populates a route's pool
+func (r *backendResolver) hasSRVDiscoveries(route string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, discovery := range r.srvs {
+		if discovery.route == route {
+			return true
+		}
+	}
+	return false
+}
+
+// removeSRVDiscovery stops populating a route's pool from an SRV record and removes the
+// backends it added, reporting whether the discovery existed
+func (r *backendResolver) removeSRVDiscovery(route, name string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	discovery, ok := r.srvs[route+"|"+name]
+	if !ok {
+		return false
+	}
+	delete(r.srvs, route+"|"+name)
+	discovery.source.Sync(nil)
+	log.Printf("Removed SRV discovery: %s -> %s", route, name)
+	return true
+}
+
+// removeSRVDiscoveries stops every SRV discovery of a route
+func (r *backendResolver) removeSRVDiscoveries(route string) {
+	r.mu.Lock()
+	var names []string
+	for _, discovery := range r.srvs {
+		if discovery.route == route {
+			names = append(names, discovery.name)
+		}
+	}
+	r.mu.Unlock()
+
+	for _, name := range names {
+		r.removeSRVDiscovery(route, name)
+	}
+}
+
+// reconcileSRV looks up an SRV record and adds or removes the route's backends to match it
+func (r *backendResolver) reconcileSRV(discovery *srvDiscovery) {
+	ctx, cancel := context.WithTimeout(context.Background(), dnsLookupTimeout)
+	defer cancel()
+
+	_, records, err := r.resolver.LookupSRV(ctx, "", "", discovery.name)
+	if err != nil {
+		// Keep the current pool; a failed lookup is not evidence the targets are gone
+		log.Printf("Failed to look up SRV record %s: %v", discovery.name, err)
+		return
+	}
+
+	var backends []adminapi.Backend
+	for _, record := range records {
+		backends = append(backends, adminapi.Backend{
+			Address:  net.JoinHostPort(strings.TrimSuffix(record.Target, "."), strconv.Itoa(int(record.Port))),
+			Weight:   adminapi.DefaultWeight,
+			Metadata: map[string]string{"source": "srv", "srv": discovery.name},
+		})
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.srvs[discovery.route+"|"+discovery.name] != discovery {
+		return // Removed while the lookup was in flight
+	}
+	changed, removed, skipped := discovery.source.Sync(map[string][]adminapi.Backend{discovery.route: backends})
+	if changed > 0 || removed > 0 || skipped > 0 {
+		log.Printf("SRV discovery %s for %s: %d backends added or changed, %d removed, %d skipped as registered elsewhere",
+			discovery.name, discovery.route, changed, removed, skipped)
+	}
+}
+
+// refreshLoop re-resolves cached hostnames and SRV records every TTL
+func (r *backendResolver) refreshLoop() {
+	ticker := time.NewTicker(r.ttl)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		r.mu.Lock()
+		hosts := make([]string, 0, len(r.hosts))
+		for host, cached := range r.hosts {
+			if time.Since(cached.lastUsed) > dnsEvictAfterUnused*r.ttl {
+				delete(r.hosts, host)
+				continue
+			}
+			hosts = append(hosts, host)
+		}
+		srvs := make([]*srvDiscovery, 0, len(r.srvs))
+		for _, discovery := range r.srvs {
+			srvs = append(srvs, discovery)
+		}
+		r.mu.Unlock()
+
+		for _, host := range hosts {
+			ctx, cancel := context.WithTimeout(context.Background(), dnsLookupTimeout)
+			ips, err := r.resolve(ctx, host)
+			cancel()
+			if err != nil {
+				// Keep serving the last known addresses
+				log.Printf("Failed to refresh backend %s: %v", host, err)
+				continue
+			}
+
+			r.mu.Lock()
+			if cached, ok := r.hosts[host]; ok {
+				cached.ips = ips
+			}
+			r.mu.Unlock()
+		}
+
+		for _, discovery := range srvs {
+			r.reconcileSRV(discovery)
+		}
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"reverse-proxy/internal/adminapi"
+	"reverse-proxy/internal/routing"
+)
+
+// DNS record types the fake server answers
+const (
+	dnsTypeA   = 1
+	dnsTypeSRV = 33
+)
+
+// fakeDNS is an in-process DNS server over UDP answering A and SRV queries from maps
+type fakeDNS struct {
+	conn    net.PacketConn
+	queries atomic.Int64
+
+	mu  sync.Mutex
+	a   map[string]net.IP     // By name with a trailing dot
+	srv map[string][]*net.SRV // By name with a trailing dot
+}
+
+func newFakeDNS(t *testing.T) *fakeDNS {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &fakeDNS{conn: conn, a: make(map[string]net.IP), srv: make(map[string][]*net.SRV)}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if reply := d.answer(buf[:n]); reply != nil {
+				conn.WriteTo(reply, addr)
+			}
+		}
+	}()
+	return d
+}
+
+func (d *fakeDNS) addr() string { return d.conn.LocalAddr().String() }
+
+func (d *fakeDNS) setA(name string, ip string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.a[name] = net.ParseIP(ip).To4()
+}
+
+func (d *fakeDNS) setSRV(name string, records ...*net.SRV) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.srv[name] = records
+}
+
+// answer builds the reply to one query: the question echoed, then the matching records
+func (d *fakeDNS) answer(query []byte) []byte {
+	if len(query) < 12 {
+		return nil
+	}
+	d.queries.Add(1)
+
+	// The question: labels, then type and class
+	offset := 12
+	var labels []string
+	for offset < len(query) && query[offset] != 0 {
+		n := int(query[offset])
+		labels = append(labels, string(query[offset+1:offset+1+n]))
+		offset += 1 + n
+	}
+	offset++
+	if offset+4 > len(query) {
+		return nil
+	}
+	name := strings.ToLower(strings.Join(labels, ".")) + "."
+	qtype := binary.BigEndian.Uint16(query[offset:])
+	question := query[12 : offset+4]
+
+	d.mu.Lock()
+	var answers [][]byte
+	known := false
+	if ip, ok := d.a[name]; ok {
+		known = true
+		if qtype == dnsTypeA {
+			answers = append(answers, ip)
+		}
+	}
+	if records, ok := d.srv[name]; ok {
+		known = true
+		if qtype == dnsTypeSRV {
+			for _, record := range records {
+				rdata := binary.BigEndian.AppendUint16(nil, record.Priority)
+				rdata = binary.BigEndian.AppendUint16(rdata, record.Weight)
+				rdata = binary.BigEndian.AppendUint16(rdata, record.Port)
+				answers = append(answers, append(rdata, encodeDNSName(record.Target)...))
+			}
+		}
+	}
+	d.mu.Unlock()
+
+	flags := uint16(0x8180) // Response, recursion desired and available
+	if !known {
+		flags |= 3 // NXDOMAIN
+	}
+	reply := binary.BigEndian.AppendUint16(nil, binary.BigEndian.Uint16(query))
+	reply = binary.BigEndian.AppendUint16(reply, flags)
+	reply = binary.BigEndian.AppendUint16(reply, 1)
+	reply = binary.BigEndian.AppendUint16(reply, uint16(len(answers)))
+	reply = append(reply, 0, 0, 0, 0)
+	reply = append(reply, question...)
+	for _, rdata := range answers {
+		reply = append(reply, 0xc0, 12) // Pointer to the question's name
+		reply = binary.BigEndian.AppendUint16(reply, qtype)
+		reply = binary.BigEndian.AppendUint16(reply, 1) // IN
+		reply = binary.BigEndian.AppendUint32(reply, 60)
+		reply = binary.BigEndian.AppendUint16(reply, uint16(len(rdata)))
+		reply = append(reply, rdata...)
+	}
+	return reply
+}
+
+func encodeDNSName(name string) []byte {
+	var encoded []byte
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		encoded = append(encoded, byte(len(label)))
+		encoded = append(encoded, label...)
+	}
+	return append(encoded, 0)
+}
+
+func TestResolverCachesLookups(t *testing.T) {
+	dns := newFakeDNS(t)
+	dns.setA("backend.test.", "127.0.0.1")
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	r := newBackendResolver(dns.addr(), time.Minute)
+	for i := 0; i < 3; i++ {
+		conn, err := r.dial(context.Background(), "backend.test:"+port)
+		if err != nil {
+			t.Fatalf("dial %d: %v", i, err)
+		}
+		conn.Close()
+	}
+	// One A and one AAAA query for the first dial; the others use the cache
+	if n := dns.queries.Load(); n > 2 {
+		t.Errorf("%d queries for three dials, want the first dial's only", n)
+	}
+
+	if _, err := r.dial(context.Background(), "missing.test:"+port); err == nil {
+		t.Error("expected dialing an unknown name to fail")
+	}
+}
+
+func TestSRVDiscovery(t *testing.T) {
+	dns := newFakeDNS(t)
+	dns.setSRV("_https._tcp.svc.test.",
+		&net.SRV{Target: "a.svc.test.", Port: 8443, Priority: 10, Weight: 1},
+		&net.SRV{Target: "b.svc.test.", Port: 8443, Priority: 10, Weight: 1},
+	)
+
+	config := &Config{Backends: routing.NewTable()}
+	r := newBackendResolver(dns.addr(), time.Minute)
+	config.Resolver = r
+
+	// A registered backend shares the route, and one of the SRV targets
+	config.Backends.Add("foo.com", adminapi.Backend{Address: "b.svc.test:8443", Weight: 5})
+	config.Backends.Add("foo.com", adminapi.Backend{Address: "10.0.0.9:443", Weight: 1})
+
+	r.addSRVDiscovery(config, "foo.com", "_https._tcp.svc.test")
+	want := func(addresses ...string) {
+		t.Helper()
+		var got []string
+		for _, backend := range config.Backends.Backends("foo.com") {
+			got = append(got, backend.Address)
+		}
+		if strings.Join(got, " ") != strings.Join(addresses, " ") {
+			t.Fatalf("backends = %v, want %v", got, addresses)
+		}
+	}
+	want("10.0.0.9:443", "a.svc.test:8443", "b.svc.test:8443")
+	if b, _ := config.Backends.Backend("foo.com", "b.svc.test:8443"); b.Weight != 5 {
+		t.Fatalf("SRV discovery changed the registered backend: %+v", b)
+	}
+
+	// The record changes on the next refresh
+	dns.setSRV("_https._tcp.svc.test.", &net.SRV{Target: "c.svc.test.", Port: 8443})
+	r.mu.Lock()
+	discovery := r.srvs["foo.com|_https._tcp.svc.test"]
+	r.mu.Unlock()
+	r.reconcileSRV(discovery)
+	want("10.0.0.9:443", "b.svc.test:8443", "c.svc.test:8443")
+
+	// A failed lookup keeps the pool
+	dns.mu.Lock()
+	delete(dns.srv, "_https._tcp.svc.test.")
+	dns.mu.Unlock()
+	r.reconcileSRV(discovery)
+	want("10.0.0.9:443", "b.svc.test:8443", "c.svc.test:8443")
+
+	// Removal takes the discovered backends and leaves the registered ones
+	if !r.removeSRVDiscovery("foo.com", "_https._tcp.svc.test") {
+		t.Fatal("discovery not found")
+	}
+	want("10.0.0.9:443", "b.svc.test:8443")
+	if r.removeSRVDiscovery("foo.com", "_https._tcp.svc.test") {
+		t.Fatal("discovery removed twice")
+	}
+
+	// A refresh that was in flight during the removal doesn't bring the backends back
+	dns.setSRV("_https._tcp.svc.test.", &net.SRV{Target: "d.svc.test.", Port: 8443})
+	r.reconcileSRV(discovery)
+	want("10.0.0.9:443", "b.svc.test:8443")
+}
+
+func TestSRVDiscoveriesEndWithTheirRoute(t *testing.T) {
+	dns := newFakeDNS(t)
+	dns.setSRV("_a._tcp.test.", &net.SRV{Target: "a.test.", Port: 1})
+	dns.setSRV("_b._tcp.test.", &net.SRV{Target: "b.test.", Port: 2})
+
+	config := &Config{Backends: routing.NewTable()}
+	r := newBackendResolver(dns.addr(), time.Minute)
+	r.addSRVDiscovery(config, "foo.com", "_a._tcp.test")
+	r.addSRVDiscovery(config, "foo.com", "_b._tcp.test")
+	r.addSRVDiscovery(config, "bar.com", "_a._tcp.test")
+
+	r.removeSRVDiscoveries("foo.com")
+	if config.Backends.Has("foo.com") {
+		t.Errorf("foo.com still has %v", config.Backends.Backends("foo.com"))
+	}
+	if len(r.srvs) != 1 || len(config.Backends.Backends("bar.com")) != 1 {
+		t.Errorf("bar.com's discovery was affected: %v", r.srvs)
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	udpBufferSize            = 64 * 1024        // Largest possible UDP payload
+	defaultUDPSessionTimeout = 30 * time.Second // Used when Config.UDPSessionTimeout is unset
+	udpMaxBuffered           = 32               // Datagrams buffered per client while its session is dialed
+)
+
+// Metrics for UDP proxying
+var (
+	udpSessions = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "proxy_udp_sessions",
+		Help: "Number of active UDP sessions per route.",
+	}, []string{"route"})
+	udpPackets = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxy_udp_packets_total",
+		Help: "Total number of UDP packets forwarded by the proxy.",
+	}, []string{"route", "direction"})
+	udpDrops = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxy_udp_dropped_packets_total",
+		Help: "Total number of UDP packets dropped by the proxy.",
+	}, []string{"route", "reason"})
+)
+
+func init() {
+	prometheus.MustRegister(udpSessions, udpPackets, udpDrops)
+}
+
+// udpSession pins a single client address to a backend for the lifetime of the session
+type udpSession struct {
+	client     atomic.Pointer[net.UDPAddr] // Latest address the client sent from
+	backend    *net.UDPConn                // Connected socket to the chosen backend
+	address    string                      // Address of the chosen backend
+	started    time.Time
+	lastActive atomic.Int64 // Unix nanoseconds of the last packet in either direction
+}
+
+func (s *udpSession) touch() {
+	s.lastActive.Store(time.Now().UnixNano())
+}
+
+func (s *udpSession) idleFor() time.Duration {
+	return time.Since(time.Unix(0, s.lastActive.Load()))
+}
+
+// udpProxy owns one UDP listener and its session table
+type udpProxy struct {
+	route    string
+	listener *net.UDPConn
+	config   *Config
+
+	mu       sync.Mutex
+	sessions map[string]*udpSession // Keyed by client address
+	pending  map[string]*udpPending // Clients whose session is being dialed, keyed by client address
+}
+
+// udpPending holds a client's datagrams while its backend is resolved and dialed
+type udpPending struct {
+	datagrams [][]byte
+}
+
+// Proxy listens for incoming UDP datagrams for a single route
+func startUDPProxy(address string, route string, config *Config) error {
+	udpAddr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return fmt.Errorf("failed to resolve UDP address: %w", err)
+	}
+
+	listener, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return fmt.Errorf("failed to start UDP listener: %w", err)
+	}
+	defer listener.Close()
+
+	log.Printf("Listening on %s/udp for route %s", address, route)
+
+	proxy := &udpProxy{
+		route:    route,
+		listener: listener,
+		config:   config,
+		sessions: make(map[string]*udpSession),
+		pending:  make(map[string]*udpPending),
+	}
+	return proxy.serve()
+}
+
+func (p *udpProxy) serve() error {
+	buf := make([]byte, udpBufferSize)
+
+	for {
+		n, clientAddr, err := p.listener.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			log.Printf("Failed to read UDP datagram: %v", err)
+			continue
+		}
+
+		p.handleDatagram(buf[:n], clientAddr)
+	}
+}
+
+// handleDatagram forwards a client datagram to its session's backend. The first datagram of a
+// client starts dialing a session in the background, so a slow backend doesn't hold up other
+// clients; datagrams arriving meanwhile are buffered and forwarded in order once it exists.
+func (p *udpProxy) handleDatagram(datagram []byte, clientAddr *net.UDPAddr) {
+	key := clientAddr.String()
+
+	p.mu.Lock()
+	session, ok := p.sessions[key]
+	if ok {
+		p.mu.Unlock()
+		p.forward(session, datagram)
+		return
+	}
+	defer p.mu.Unlock()
+
+	pending, ok := p.pending[key]
+	if !ok {
+		// Sessions being dialed count against the limit
+		if limit := p.config.UDPMaxSessions; limit > 0 && len(p.sessions)+len(p.pending) >= limit {
+			udpDrops.WithLabelValues(p.route, "session_limit").Inc()
+			log.Printf("Dropping datagram from %s: session table full for route: %s", clientAddr, p.route)
+			return
+		}
+		pending = &udpPending{}
+		p.pending[key] = pending
+		go p.connect(key, clientAddr, pending)
+	}
+	if len(pending.datagrams) >= udpMaxBuffered {
+		udpDrops.WithLabelValues(p.route, "pending_limit").Inc()
+		return
+	}
+	pending.datagrams = append(pending.datagrams, append([]byte(nil), datagram...))
+}
+
+// connect creates a client's session and forwards the datagrams buffered for it
+func (p *udpProxy) connect(key string, clientAddr *net.UDPAddr, pending *udpPending) {
+	session, err := p.newSession(clientAddr)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.pending, key)
+	if err != nil {
+		log.Printf("Dropping %d datagrams from %s: %v", len(pending.datagrams), clientAddr, err)
+		return
+	}
+
+	p.sessions[key] = session
+	udpSessions.WithLabelValues(p.route).Inc()
+	log.Printf("New UDP session %s -> %s for route %s", key, session.address, p.route)
+	go p.relayReplies(key, session)
+
+	// Still holding the lock, so later datagrams can't overtake the buffered ones
+	for _, datagram := range pending.datagrams {
+		p.forward(session, datagram)
+	}
+}
+
+// newSession picks a backend for a client and dials it. It runs without p.mu.
+func (p *udpProxy) newSession(clientAddr *net.UDPAddr) (*udpSession, error) {
+	// Get the next backend from the route's balancer
+	backendAddr, err := getNextBackend(p.config, p.route, clientAddr.IP.String())
+	if err != nil {
+		udpDrops.WithLabelValues(p.route, "no_backend").Inc()
+		return nil, err
+	}
+
+	session, err := newUDPSession(p.config, clientAddr, backendAddr)
+	if err != nil {
+		reportBackend(p.config, p.route, backendAddr, time.Now(), err)
+		udpDrops.WithLabelValues(p.route, "dial_failed").Inc()
+		return nil, err
+	}
+	return session, nil
+}
+
+// forward sends a client datagram to the session's backend
+func (p *udpProxy) forward(session *udpSession, datagram []byte) {
+	// Client -> Backend
+	if _, err := session.backend.Write(datagram); err != nil {
+		udpDrops.WithLabelValues(p.route, "write_failed").Inc()
+		log.Printf("Failed to forward datagram to backend: %v", err)
+		return
+	}
+	session.touch()
+	udpPackets.WithLabelValues(p.route, "upstream").Inc()
+}
+
+func newUDPSession(config *Config, clientAddr *net.UDPAddr, backendAddr string) (*udpSession, error) {
+	raddr, err := resolveUDPBackend(config, backendAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve backend: %w", err)
+	}
+
+	backendConn, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to backend: %w", err)
+	}
+
+	session := &udpSession{backend: backendConn, address: backendAddr, started: time.Now()}
+	session.client.Store(clientAddr)
+	session.touch()
+	return session, nil
+}
+
+// resolveUDPBackend resolves a backend address, using the cached lookups of the backend resolver when available
+func resolveUDPBackend(config *Config, backendAddr string) (*net.UDPAddr, error) {
+	host, portStr, err := net.SplitHostPort(backendAddr)
+	if err != nil || config.Resolver == nil || net.ParseIP(host) != nil {
+		return net.ResolveUDPAddr("udp", backendAddr)
+	}
+
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port: %s", portStr)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), dnsLookupTimeout)
+	defer cancel()
+	ips, err := config.Resolver.lookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	return &net.UDPAddr{IP: ips[0], Port: port}, nil
+}
+
+// relayReplies copies backend datagrams back to the client until the session goes idle
+func (p *udpProxy) relayReplies(key string, session *udpSession) {
+	defer p.expireSession(key, session)
+
+	buf := make([]byte, udpBufferSize)
+	timeout := p.config.UDPSessionTimeout
+	if timeout <= 0 {
+		timeout = defaultUDPSessionTimeout
+	}
+
+	for {
+		session.backend.SetReadDeadline(time.Now().Add(timeout))
+		n, err := session.backend.Read(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() && session.idleFor() < timeout {
+				continue // Client traffic kept the session alive
+			}
+			return
+		}
+		session.touch()
+
+		// Backend -> Client
+		if _, err := p.listener.WriteToUDP(buf[:n], session.client.Load()); err != nil {
+			udpDrops.WithLabelValues(p.route, "write_failed").Inc()
+			log.Printf("Failed to forward datagram to client: %v", err)
+			continue
+		}
+		udpPackets.WithLabelValues(p.route, "downstream").Inc()
+	}
+}
+
+func (p *udpProxy) expireSession(key string, session *udpSession) {
+	p.mu.Lock()
+	if p.sessions[key] == session {
+		delete(p.sessions, key)
+	}
+	p.mu.Unlock()
+
+	session.backend.Close()
+	reportBackend(p.config, p.route, session.address, session.started, nil)
+	udpSessions.WithLabelValues(p.route).Dec()
+	log.Printf("UDP session %s expired for route %s", key, p.route)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"reverse-proxy/internal/adminapi"
+	"reverse-proxy/internal/routing"
+)
+
+// udpEcho starts a backend that answers every datagram with its name
+func udpEcho(t *testing.T, name string) string {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, udpBufferSize)
+		for {
+			_, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteToUDP([]byte(name), addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+// listenUDPProxy starts a proxy for one route on a loopback port
+func listenUDPProxy(t *testing.T, route string, config *Config) *udpProxy {
+	t.Helper()
+	listener, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := &udpProxy{
+		route:    route,
+		listener: listener,
+		config:   config,
+		sessions: make(map[string]*udpSession),
+		pending:  make(map[string]*udpPending),
+	}
+	go proxy.serve()
+	t.Cleanup(func() { listener.Close() })
+	return proxy
+}
+
+// exchange sends a datagram through the proxy and returns the reply, or "" if none arrives
+func exchange(t *testing.T, client *net.UDPConn, wait time.Duration) string {
+	t.Helper()
+	if _, err := client.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, udpBufferSize)
+	client.SetReadDeadline(time.Now().Add(wait))
+	n, err := client.Read(buf)
+	if err != nil {
+		return ""
+	}
+	return string(buf[:n])
+}
+
+func (p *udpProxy) sessionCount() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.sessions)
+}
+
+func TestUDPProxySessions(t *testing.T) {
+	config := &Config{
+		Backends:          routing.NewTable(),
+		UDPMaxSessions:    1,
+		UDPSessionTimeout: 300 * time.Millisecond,
+	}
+	config.Backends.Add("dns", adminapi.Backend{Address: udpEcho(t, "a"), Weight: 1})
+	config.Backends.Add("dns", adminapi.Backend{Address: udpEcho(t, "b"), Weight: 1})
+	proxy := listenUDPProxy(t, "dns", config)
+
+	dial := func() *net.UDPConn {
+		client, err := net.DialUDP("udp", nil, proxy.listener.LocalAddr().(*net.UDPAddr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { client.Close() })
+		return client
+	}
+	first, second := dial(), dial()
+
+	// Every datagram of a client reaches the backend its session was pinned to
+	pinned := exchange(t, first, 5*time.Second)
+	if pinned == "" {
+		t.Fatal("no reply through the proxy")
+	}
+	for i := 0; i < 4; i++ {
+		if got := exchange(t, first, 5*time.Second); got != pinned {
+			t.Fatalf("datagram %d reached %q, session is pinned to %q", i, got, pinned)
+		}
+	}
+
+	// The table is full, so another client is turned away
+	if got := exchange(t, second, 100*time.Millisecond); got != "" {
+		t.Fatalf("client beyond UDPMaxSessions got a reply from %q", got)
+	}
+
+	// Once idle, the session expires and frees its slot
+	deadline := time.Now().Add(5 * time.Second)
+	for proxy.sessionCount() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("idle session never expired")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if got := exchange(t, second, 5*time.Second); got == "" {
+		t.Fatal("no reply after the idle session expired")
+	}
+}
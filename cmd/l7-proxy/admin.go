@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"reverse-proxy/internal/adminapi"
+	"reverse-proxy/internal/balancer"
+	"reverse-proxy/internal/registrystore"
+	"reverse-proxy/internal/routing"
+)
+
+// backendRegistry exposes the proxy's backends to the admin API; route names are hosts
+type backendRegistry struct {
+	config *Config
+}
+
+func (r backendRegistry) Routes() []adminapi.Route {
+	var routes []adminapi.Route
+	for _, name := range r.config.Backends.Names() {
+		if route, ok := r.Route(name); ok {
+			routes = append(routes, route)
+		}
+	}
+	return routes
+}
+
+func (r backendRegistry) Route(name string) (adminapi.Route, bool) {
+	backends := listBackends(r.config, name)
+	if len(backends) == 0 {
+		return adminapi.Route{}, false
+	}
+	return adminapi.Route{Name: name, Balancing: r.config.Backends.Policy(name), Backends: backends}, true
+}
+
+func (r backendRegistry) SetBackend(route string, backend adminapi.Backend) error {
+	if err := validateBackend(backend.Address); err != nil {
+		return err
+	}
+	if err := persistBackend(r.config, route, backend, leaseExpiry(r.config, route, backend.Address)); err != nil {
+		return err
+	}
+	setBackend(r.config, route, backend)
+	return nil
+}
+
+func (r backendRegistry) SetBalancing(route, policy string) error {
+	return setBalancing(r.config, route, policy)
+}
+
+// ReplaceRoute checks the policy and every backend, persists the new route, then publishes it in one swap
+func (r backendRegistry) ReplaceRoute(host string, backends []adminapi.Backend, balancing *string) error {
+	if balancing != nil {
+		if err := balancer.Valid(*balancing); err != nil {
+			return fmt.Errorf("%w: %v", adminapi.ErrInvalidBalancing, err)
+		}
+	}
+	for _, backend := range backends {
+		if err := validateBackend(backend.Address); err != nil {
+			return fmt.Errorf("backend %s: %w", backend.Address, err)
+		}
+	}
+	if err := persist(r.config, replaceRecords(r.config, host, backends, balancing)...); err != nil {
+		return err
+	}
+
+	if balancing != nil {
+		r.config.Backends.SetPolicy(host, *balancing) // Checked above
+	}
+	for _, backend := range r.config.Backends.Backends(host) {
+		if !routing.Contains(backends, backend.Address) {
+			r.config.Leases.Release(host, backend.Address)
+		}
+	}
+	r.config.Backends.Replace(host, backends)
+	return nil
+}
+
+func (r backendRegistry) RemoveBackend(route, address string) (bool, error) {
+	if _, ok := lookupBackend(r.config, route, address); !ok {
+		r.config.Leases.Release(route, address)
+		return false, nil
+	}
+	if err := persistRemoval(r.config, route, address); err != nil {
+		return true, err
+	}
+	r.config.Leases.Release(route, address)
+	removeBackend(r.config, route, address)
+	return true, nil
+}
+
+func (r backendRegistry) RemoveRoute(name string) (bool, error) {
+	if err := persist(r.config, registrystore.Record{Op: registrystore.OpDeleteRoute, Route: name}); err != nil {
+		return r.config.Backends.Has(name), err
+	}
+	r.config.Leases.ReleaseRoute(name)
+	existed := r.config.Backends.RemoveRoute(name)
+	if existed {
+		log.Printf("Removed route %s", name)
+	}
+	return existed, nil
+}
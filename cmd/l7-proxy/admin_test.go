@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"reverse-proxy/internal/adminapi"
+	"reverse-proxy/internal/lease"
+	"reverse-proxy/internal/routing"
+)
+
+func addresses(backends []adminapi.Backend) []string {
+	var addresses []string
+	for _, backend := range backends {
+		addresses = append(addresses, backend.Address)
+	}
+	return addresses
+}
+
+func TestReplaceRouteIsAtomic(t *testing.T) {
+	config := &Config{Backends: routing.NewTable(), Leases: lease.NewTable()}
+	config.Backends.Add("example.com", adminapi.Backend{Address: "http://127.0.0.1:8001", Weight: 1})
+	config.Backends.Add("example.com", adminapi.Backend{Address: "http://127.0.0.1:8002", Weight: 1})
+	api := adminapi.NewHandler(backendRegistry{config: config}, nil)
+
+	replace := func(body string) int {
+		r := httptest.NewRequest(http.MethodPut, "/api/v1/routes/example.com", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, r)
+		return w.Code
+	}
+	unchanged := func() {
+		t.Helper()
+		want := []string{"http://127.0.0.1:8001", "http://127.0.0.1:8002"}
+		if got := addresses(config.Backends.Backends("example.com")); !slices.Equal(got, want) {
+			t.Fatalf("failed replace left backends %v, want %v", got, want)
+		}
+		if policy := config.Backends.Policy("example.com"); policy != "" {
+			t.Fatalf("failed replace set the policy to %q", policy)
+		}
+	}
+
+	// The last backend can't be used, so none of the others may be applied either
+	if code := replace(`{"balancing": "round_robin", "backends": [{"address": "http://127.0.0.1:8003"}, {"address": "unix:///nonexistent.sock"}]}`); code != http.StatusUnprocessableEntity {
+		t.Fatalf("invalid backend answered %d", code)
+	}
+	unchanged()
+	if code := replace(`{"balancing": "fastest-ever", "backends": [{"address": "http://127.0.0.1:8003"}]}`); code != http.StatusUnprocessableEntity {
+		t.Fatalf("invalid policy answered %d", code)
+	}
+	unchanged()
+
+	if code := replace(`{"balancing": "round_robin", "backends": [{"address": "http://127.0.0.1:8002", "weight": 3}, {"address": "http://127.0.0.1:8003"}]}`); code != http.StatusOK {
+		t.Fatalf("replace answered %d", code)
+	}
+	if got := addresses(config.Backends.Backends("example.com")); !slices.Equal(got, []string{"http://127.0.0.1:8002", "http://127.0.0.1:8003"}) {
+		t.Fatalf("replaced backends = %v", got)
+	}
+	if backend, _ := config.Backends.Backend("example.com", "http://127.0.0.1:8002"); backend.Weight != 3 {
+		t.Fatalf("kept backend has weight %d, want 3", backend.Weight)
+	}
+	if policy := config.Backends.Policy("example.com"); policy != "round_robin" {
+		t.Fatalf("policy = %q", policy)
+	}
+
+	// Replacing with no backends deletes the route
+	if code := replace(`{"backends": []}`); code != http.StatusNoContent {
+		t.Fatalf("emptying the route answered %d", code)
+	}
+	if config.Backends.Has("example.com") {
+		t.Fatal("emptied route still has backends")
+	}
+}
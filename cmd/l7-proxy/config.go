@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"sync"
+
+	"reverse-proxy/internal/adminapi"
+	"reverse-proxy/internal/configfile"
+	"reverse-proxy/internal/lease"
+	"reverse-proxy/internal/registrystore"
+	"reverse-proxy/internal/routing"
+)
+
+// newConfig builds the proxy configuration from a loaded configuration file
+func newConfig(file *configfile.File) *Config {
+	config := &Config{
+		Backends:     routing.NewTable(),
+		Leases:       lease.NewTable(),
+		RegistryFile: file.Admin.RegistryFile,
+		Cache:        &sync.Map{},
+		TLSCertFile:  file.TLS.CertFile,
+		TLSKeyFile:   file.TLS.KeyFile,
+		CertDir:      file.TLS.CertDir,
+
+		ListenAddress:  file.Listeners.Proxy,
+		AdminAddress:   file.Listeners.Admin,
+		MetricsAddress: file.Listeners.Metrics,
+		PprofAddress:   file.Listeners.Pprof,
+
+		ACMEDirectoryURL: file.TLS.ACME.DirectoryURL,
+		ACMEEmail:        file.TLS.ACME.Email,
+		ACMECacheDir:     file.TLS.ACME.CacheDir,
+		ACMECARoot:       file.TLS.ACME.CARoot,
+		ACMEHTTPAddress:  file.TLS.ACME.HTTPAddress,
+
+		ClientAuthPolicies:  file.TLS.ClientAuth,
+		TLSPolicies:         file.TLS.Policies,
+		UpstreamTLSPolicies: file.TLS.Upstream,
+
+		TicketKeyFile:     file.TLS.TicketKeyFile,
+		TicketKeyRotation: file.TLS.TicketKeyRotation.Time(),
+
+		APIAuthPolicy: file.Admin.Auth,
+
+		DockerSocket:      file.Discovery.Docker.Socket,
+		TargetFiles:       file.Discovery.Files.Paths,
+		TargetFileRefresh: file.Discovery.Files.RefreshInterval.Time(),
+	}
+	config.Backends.OnRemove(closeBackendTransport)
+	return config
+}
+
+// addStaticRoutes registers the backends of the file's routes. They aren't written to the
+// registry log, since the file brings them back on every start.
+func addStaticRoutes(config *Config, routes []configfile.Route) {
+	for _, route := range routes {
+		if route.Balancing != "" {
+			config.Backends.SetPolicy(route.Name, route.Balancing) // Validated with the file
+		}
+		for _, backend := range route.Backends {
+			setBackend(config, route.Name, backend.AdminBackend())
+		}
+		log.Printf("Configured route %s with %d backends", route.Name, len(route.Backends))
+	}
+}
+
+// reloadRoutes applies the routes of a reloaded configuration file. All changed routes are
+// swapped into the routing table at once; backends registered through the APIs are carried
+// over and in-flight requests keep the backend they picked.
+func reloadRoutes(config *Config, old, next *configfile.File, diff configfile.Diff) error {
+	previous := routesByName(old.Routes)
+	routes := routesByName(next.Routes)
+
+	changed := slices.Concat(diff.Added, diff.Changed, diff.Removed)
+
+	// A file backend the API changed may be in the registry log. Drop the ones the file no longer
+	// lists there first, so a failed write leaves the reload unapplied.
+	var dropped []registrystore.Record
+	for _, name := range changed {
+		for _, backend := range previous[name].Backends {
+			if !hasBackend(routes[name], backend.Address) && routing.Contains(config.Backends.Backends(name), backend.Address) {
+				dropped = append(dropped, registrystore.Record{Op: registrystore.OpDelete, Route: name, Address: backend.Address})
+			}
+		}
+	}
+	if err := persist(config, dropped...); err != nil {
+		return err
+	}
+
+	reloadBalancing(config, changed, previous, routes)
+	config.Backends.Update(func(table map[string][]adminapi.Backend) {
+		for _, name := range changed {
+			// Start from the running backends: registered ones stay, the file's old ones go
+			backends := table[name]
+			for _, backend := range previous[name].Backends {
+				if !hasBackend(routes[name], backend.Address) {
+					backends = routing.Without(backends, backend.Address)
+				}
+			}
+			for _, backend := range routes[name].Backends {
+				backends = routing.With(backends, backend.AdminBackend())
+			}
+			table[name] = backends
+		}
+	})
+	return nil
+}
+
+func routesByName(routes []configfile.Route) map[string]configfile.Route {
+	byName := make(map[string]configfile.Route, len(routes))
+	for _, route := range routes {
+		byName[route.Name] = route
+	}
+	return byName
+}
+
+// reloadBalancing applies the balancing policies of reloaded routes before their backends change,
+// so new routes start with theirs. Routes that leave the file, or stop naming a policy, return
+// to the default; a policy set through the APIs on a route the file never configured stays.
+func reloadBalancing(config *Config, names []string, previous, routes map[string]configfile.Route) {
+	for _, name := range names {
+		if routes[name].Balancing != "" || previous[name].Balancing != "" {
+			config.Backends.SetPolicy(name, routes[name].Balancing) // Validated with the file
+		}
+	}
+}
+
+func hasBackend(route configfile.Route, address string) bool {
+	for _, backend := range route.Backends {
+		if backend.Address == address {
+			return true
+		}
+	}
+	return false
+}
+
+// validateCommand implements "l7-proxy validate <file>": it loads the file as the proxy would,
+// environment overrides included, and reports every problem found
+func validateCommand(args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: l7-proxy validate <config file>")
+		return 2
+	}
+	if _, err := configfile.Load(args[0], configfile.L7); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Printf("%s: configuration is valid\n", args[0])
+	return 0
+}
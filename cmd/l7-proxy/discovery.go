@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strings"
+
+	"reverse-proxy/internal/adminapi"
+	"reverse-proxy/internal/dockerwatch"
+	"reverse-proxy/internal/filesd"
+	"reverse-proxy/internal/routing"
+)
+
+// Discovered backends aren't written to the registry log: their source brings them back after a restart
+
+// startDockerDiscovery keeps the backends of labeled containers in the routing table
+func startDockerDiscovery(config *Config) {
+	source := config.Backends.NewSource()
+	watcher := dockerwatch.New(config.DockerSocket, func(targets []dockerwatch.Target) {
+		routes := make(map[string][]adminapi.Backend)
+		for _, target := range targets {
+			backend := target.Backend(discoveredURL(target.Scheme, target.Address))
+			if usable(backend, "container "+target.Container) {
+				routes[target.Route] = append(routes[target.Route], backend)
+			}
+		}
+		syncDiscovered(source, "Docker", routes)
+	})
+
+	log.Printf("Discovering backends from Docker containers on %s", config.DockerSocket)
+	go watcher.Run(context.Background())
+}
+
+// startFileDiscovery keeps the backends listed in target files in the routing table
+func startFileDiscovery(config *Config) {
+	source := config.Backends.NewSource()
+	watcher := filesd.New(config.TargetFiles, func(targets []filesd.Target) {
+		routes := make(map[string][]adminapi.Backend)
+		for _, target := range targets {
+			backend := target.Backend(discoveredURL(target.Scheme, target.Address))
+			if usable(backend, "target "+target.Address+" in "+target.File) {
+				routes[target.Route] = append(routes[target.Route], backend)
+			}
+		}
+		syncDiscovered(source, "File", routes)
+	})
+
+	log.Printf("Discovering backends from target files %v", config.TargetFiles)
+	go watcher.Run(context.Background(), config.TargetFileRefresh)
+}
+
+// discoveredURL turns a discovered host:port into a backend URL, over HTTP unless a scheme is given.
+// Targets that are already URLs, such as unix:// sockets, are kept as they are.
+func discoveredURL(scheme, address string) string {
+	if strings.Contains(address, "://") {
+		return address
+	}
+	if scheme == "" {
+		scheme = "http"
+	}
+	return scheme + "://" + address
+}
+
+// usable checks a discovered backend the way registrations are checked
+func usable(backend adminapi.Backend, what string) bool {
+	err := backend.Validate()
+	if err == nil {
+		err = validateBackend(backend.Address)
+	}
+	if err != nil {
+		log.Printf("Ignoring %s: %v", what, err)
+		return false
+	}
+	return true
+}
+
+// syncDiscovered replaces a source's backends with the ones it found
+func syncDiscovered(source *routing.Source, name string, routes map[string][]adminapi.Backend) {
+	changed, removed, skipped := source.Sync(routes)
+	if changed > 0 || removed > 0 || skipped > 0 {
+		log.Printf("%s discovery: %d backends added or changed, %d removed, %d skipped as registered elsewhere",
+			name, changed, removed, skipped)
+	}
+}
@@ -1,25 +1,89 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/shirou/gopsutil/cpu"
 	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
 	"runtime"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
+
+	"reverse-proxy/internal/acmecert"
+	"reverse-proxy/internal/adminapi"
+	"reverse-proxy/internal/apiauth"
+	"reverse-proxy/internal/balancer"
+	"reverse-proxy/internal/certstore"
+	"reverse-proxy/internal/clientauth"
+	"reverse-proxy/internal/configfile"
+	"reverse-proxy/internal/lease"
+	"reverse-proxy/internal/registrystore"
+	"reverse-proxy/internal/routing"
+	"reverse-proxy/internal/ticketkeys"
+	"reverse-proxy/internal/tlspolicy"
+	"reverse-proxy/internal/upstreamtls"
 )
 
+const unixScheme = "unix://" // Prefix of Unix domain socket backend URLs
+
+// HTTP transports for Unix socket and re-encrypted backends, keyed by route and backend URL
+var backendTransports sync.Map
+
 type Config struct {
-	Backends       *sync.Map // Map of host/path to backend addresses
-	BackendIndices *sync.Map // Tracks the next backend for each host/path (round-robin)
-	Cache          *sync.Map // A thread-safe cache for storing responses
-	TLSCertFile    string    // Path to TLS certificate file
-	TLSKeyFile     string    // Path to TLS private key file
+	Backends    *routing.Table // Routes by host/path and their backends, replaced as a whole on every change
+	Cache       *sync.Map      // A thread-safe cache for storing responses
+	TLSCertFile string         // Path to the default TLS certificate file
+	TLSKeyFile  string         // Path to the default TLS private key file
+	CertDir     string         // Directory of per-host cert/key pairs
+
+	Certificates     *certstore.Store  // Certificates indexed by SAN, loaded from TLSCertFile/TLSKeyFile and CertDir
+	ACMEDirectoryURL string            // ACME directory for automatic certificates (empty to disable)
+	ACMEEmail        string            // Contact address for the ACME account
+	ACMECacheDir     string            // Where ACME account keys and certificates are stored
+	ACMECARoot       string            // PEM bundle trusted for the ACME directory (e.g. Pebble's test CA)
+	ACMEHTTPAddress  string            // Listener for HTTP-01 challenges
+	ACME             *acmecert.Manager // Obtains and renews certificates for registered hosts
+
+	ClientAuthPolicies map[string]clientauth.Policy // Per-host client certificate requirements
+	ClientAuth         clientauth.Verifiers         // Loaded from ClientAuthPolicies
+	TLSPolicies        map[string]tlspolicy.Policy  // Per-host TLS versions, cipher suites, curves and ALPN
+	TLSRules           tlspolicy.Rules              // Loaded from TLSPolicies
+
+	UpstreamTLSPolicies map[string]upstreamtls.Policy // Per-host TLS settings for reaching backends over HTTPS
+	UpstreamTLS         upstreamtls.Routes            // Loaded from UpstreamTLSPolicies
+
+	TicketKeyFile     string        // Session ticket key seed shared with other instances (empty for a per-process seed)
+	TicketKeyRotation time.Duration // How long each session ticket key encrypts new tickets
+
+	Leases        *lease.Table         // Expiry of backends registered with a TTL
+	RegistryFile  string               // Log the registry is persisted to and restored from (empty to keep it in memory)
+	Store         *registrystore.Store // Opened from RegistryFile
+	APIAuthPolicy apiauth.Policy       // Who may register backends and use the admin API (open if empty)
+	APIAuth       *apiauth.Authorizer  // Loaded from APIAuthPolicy
+
+	ListenAddress  string // Listener for HTTPS traffic
+	AdminAddress   string // Listener for the registration and admin APIs
+	MetricsAddress string // Listener for Prometheus metrics (empty to disable)
+	PprofAddress   string // Listener for profiling endpoints (empty to disable)
+
+	Reloader *configfile.Reloader // Reloads the routes of the configuration file (nil without one)
+
+	DockerSocket      string        // Docker Engine API socket to discover labeled containers on (empty to disable)
+	TargetFiles       []string      // Target files or patterns to discover backends from (empty to disable)
+	TargetFileRefresh time.Duration // How often target files are checked for changes
 }
 
 // Metrics for Prometheus
@@ -41,6 +105,10 @@ var (
 		Help:    "Histogram of request latency in seconds.",
 		Buckets: prometheus.LinearBuckets(0, 5, 60),
 	})
+	tlsHandshakes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "l7_proxy_tls_handshakes_total",
+		Help: "Total number of completed TLS handshakes, by whether a session was resumed.",
+	}, []string{"resumed"})
 )
 
 var (
@@ -76,75 +144,166 @@ func getCPUUsage() (float64, error) {
 func init() {
 	// Register metrics with Prometheus
 	prometheus.MustRegister(activeConnections, totalRequests, requestErrors, requestLatency, cpuUsage, cpuUsageMetric, memoryUsage, goroutines)
+	prometheus.MustRegister(tlsHandshakes)
+}
+
+// backendRegistration is the payload of /register-backend and /deregister-backend
+type backendRegistration struct {
+	Host      string `json:"host"`
+	Backend   string `json:"backend"`
+	Balancing string `json:"balancing"` // Optional balancing policy of the host, see balancer.Policies
+	TTL       int    `json:"ttl"`       // Seconds until the backend is evicted unless registered again (0 to keep it until deregistered)
+}
+
+// decodeRegistration parses and authorizes a registration request, answering the client if it fails
+func decodeRegistration(w http.ResponseWriter, r *http.Request, config *Config) (*backendRegistration, bool) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return nil, false
+	}
+
+	// Parse the JSON payload
+	var registration backendRegistration
+	if err := json.NewDecoder(r.Body).Decode(&registration); err != nil {
+		http.Error(w, "Invalid JSON payload", http.StatusBadRequest)
+		return nil, false
+	}
+
+	// Validate the input
+	if registration.Host == "" || registration.Backend == "" {
+		http.Error(w, "Host and Backend are required", http.StatusBadRequest)
+		return nil, false
+	}
+
+	if err := config.APIAuth.Authorize(r, registration.Host); err != nil {
+		http.Error(w, err.Error(), apiauth.Status(err))
+		return nil, false
+	}
+	return &registration, true
 }
 
 func startBackendRegistrationAPI(config *Config) {
-	http.HandleFunc("/register-backend", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+	// A mux of its own keeps the registry off the proxy, metrics and pprof listeners
+	mux := http.NewServeMux()
+	// Registering again renews the lease of a registration with a TTL
+	mux.HandleFunc("/register-backend", func(w http.ResponseWriter, r *http.Request) {
+		registration, ok := decodeRegistration(w, r, config)
+		if !ok {
 			return
 		}
 
-		var registration struct {
-			Host    string `json:"host"`
-			Backend string `json:"backend"`
+		ttl, err := lease.TTL(registration.TTL)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
 		}
-
-		// Parse the JSON payload
-		if err := json.NewDecoder(r.Body).Decode(&registration); err != nil {
-			http.Error(w, "Invalid JSON payload", http.StatusBadRequest)
+		if err := validateBackend(registration.Backend); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := balancer.Valid(registration.Balancing); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
-		// Validate the input
-		if registration.Host == "" || registration.Backend == "" {
-			http.Error(w, "Host and Backend are required", http.StatusBadRequest)
+		// Write the registration through to the registry log before applying it
+		backend, ok := lookupBackend(config, registration.Host, registration.Backend)
+		if !ok {
+			backend = adminapi.Backend{Address: registration.Backend, Weight: adminapi.DefaultWeight}
+		}
+		var expires *time.Time
+		if ttl > 0 {
+			at := time.Now().Add(ttl)
+			expires = &at
+		}
+		records := []registrystore.Record{{Op: registrystore.OpSet, Route: registration.Host, Backend: &backend, Expires: expires}}
+		if registration.Balancing != "" && registration.Balancing != config.Backends.Policy(registration.Host) {
+			records = append(records, registrystore.Record{Op: registrystore.OpBalancing, Route: registration.Host, Value: registration.Balancing})
+		}
+		if err := persist(config, records...); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		if registration.Balancing != "" {
+			config.Backends.SetPolicy(registration.Host, registration.Balancing) // Checked above
+		}
 
-		// Add the backend
+		// Add the backend, leasing it first so an expiring lease can't evict the renewed registration
+		if ttl > 0 {
+			config.Leases.Renew(registration.Host, registration.Backend, ttl)
+		} else {
+			config.Leases.Release(registration.Host, registration.Backend)
+		}
 		addBackend(config, registration.Host, registration.Backend)
 		w.WriteHeader(http.StatusOK)
 		fmt.Fprintf(w, "Backend %s registered successfully for host %s", registration.Backend, registration.Host)
 	})
 
+	// Explicit deregistration for backends shutting down cleanly
+	mux.HandleFunc("/deregister-backend", func(w http.ResponseWriter, r *http.Request) {
+		registration, ok := decodeRegistration(w, r, config)
+		if !ok {
+			return
+		}
+
+		if _, ok := lookupBackend(config, registration.Host, registration.Backend); !ok {
+			config.Leases.Release(registration.Host, registration.Backend)
+			http.Error(w, "Backend is not registered", http.StatusNotFound)
+			return
+		}
+		if err := persistRemoval(config, registration.Host, registration.Backend); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		config.Leases.Release(registration.Host, registration.Backend)
+		removeBackend(config, registration.Host, registration.Backend)
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "Backend %s deregistered successfully for host %s", registration.Backend, registration.Host)
+	})
+
+	// Versioned admin API for listing and editing the registry
+	api := adminapi.NewHandler(backendRegistry{config}, config.APIAuth)
+	if config.Reloader != nil {
+		api.HandleConfig(config.Reloader)
+	}
+	mux.Handle("/api/v1/", api)
+
+	server := &http.Server{Addr: config.AdminAddress, Handler: mux, TLSConfig: config.APIAuth.TLSConfig()}
 	go func() {
-		log.Println("Backend registration API listening on :8081")
-		if err := http.ListenAndServe(":8081", nil); err != nil {
+		var err error
+		if server.TLSConfig != nil {
+			log.Printf("Backend registration API listening on %s (TLS)", config.AdminAddress)
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			log.Printf("Backend registration API listening on %s", config.AdminAddress)
+			err = server.ListenAndServe()
+		}
+		if err != nil {
 			log.Fatalf("Failed to start backend registration API: %v", err)
 		}
 	}()
 }
 
-func getNextBackend(config *Config, host string) (string, error) {
-	value, ok := config.Backends.Load(host)
-	if !ok {
-		return "", fmt.Errorf("no backends available for host: %s", host)
-	}
-
-	// Convert the backends map to a slice
-	backends := value.(*sync.Map)
-	var backendList []string
-	backends.Range(func(key, _ any) bool {
-		backendList = append(backendList, key.(string))
-		return true
-	})
+// listBackends returns a copy of the backends of a host sorted by address
+func listBackends(config *Config, host string) []adminapi.Backend {
+	return slices.Clone(config.Backends.Backends(host))
+}
 
-	if len(backendList) == 0 {
+// getNextBackend picks a backend with the host's balancer; key identifies the client to
+// policies that keep clients on one backend. Every pick is ended with reportBackend.
+func getNextBackend(config *Config, host, key string) (string, error) {
+	backend, ok := config.Backends.Pick(host, key)
+	if !ok {
 		return "", fmt.Errorf("no backends available for host: %s", host)
 	}
-
-	// Get or initialize the index
-	indexValue, _ := config.BackendIndices.LoadOrStore(host, 0)
-	index := indexValue.(int)
-
-	// Select the backend and update the index
-	backend := backendList[index]
-	config.BackendIndices.Store(host, (index+1)%len(backendList))
-
 	return backend, nil
 }
 
+// reportBackend ends a pick, telling the host's balancer how long the request took and whether it failed
+func reportBackend(config *Config, host, backend string, start time.Time, err error) {
+	config.Backends.Report(host, backend, time.Since(start), err)
+}
+
 func getFromCache(config *Config, key string) ([]byte, bool) {
 	value, ok := config.Cache.Load(key)
 	if !ok {
@@ -165,6 +324,10 @@ func handleHTTPRequest(w http.ResponseWriter, r *http.Request, config *Config) {
 	totalRequests.Inc() // Increment total requests
 
 	host := r.Host
+	if misdirected(config, r) {
+		http.Error(w, "Host does not match the TLS server name", http.StatusMisdirectedRequest)
+		return
+	}
 
 	//// Check the cache
 	//cacheKey := fmt.Sprintf("%s:%s", host, r.URL.String())
@@ -174,16 +337,22 @@ func handleHTTPRequest(w http.ResponseWriter, r *http.Request, config *Config) {
 	//	return
 	//}
 
-	// Get the next backend using round-robin
-	backendURL, err := getNextBackend(config, host)
+	// Get the next backend from the host's balancer
+	clientIP, _, _ := net.SplitHostPort(r.RemoteAddr)
+	backendURL, err := getNextBackend(config, host, clientIP)
 	if err != nil {
 		http.Error(w, "No backend available", http.StatusServiceUnavailable)
 		log.Printf("No backend available for host: %s", host)
 		return
 	}
+	var failure error
+	defer func() { reportBackend(config, host, backendURL, startTime, failure) }()
+
+	// Unix socket and re-encrypted backends are reached through their own transport
+	client, targetURL := backendClient(config, host, backendURL)
 
 	// Create a new request to forward to the backend
-	req, err := http.NewRequest(r.Method, backendURL+r.URL.Path, r.Body)
+	req, err := http.NewRequest(r.Method, targetURL+r.URL.Path, r.Body)
 	if err != nil {
 		http.Error(w, "Failed to create request", http.StatusInternalServerError)
 		log.Printf("Failed to create request for backend: %v", err)
@@ -191,10 +360,18 @@ func handleHTTPRequest(w http.ResponseWriter, r *http.Request, config *Config) {
 	}
 	req.Header = r.Header
 
+	// Only the proxy may vouch for a client certificate
+	clientauth.StripHeaders(req.Header)
+	if r.TLS != nil {
+		if identity, ok := clientauth.IdentityFrom(*r.TLS); ok {
+			identity.SetHeaders(req.Header)
+		}
+	}
+
 	// Perform the request to the backend
-	client := &http.Client{}
 	resp, err := client.Do(req)
 	if err != nil {
+		failure = err
 		http.Error(w, "Failed to connect to backend", http.StatusBadGateway)
 		log.Printf("Failed to connect to backend: %v", err)
 		return
@@ -204,6 +381,7 @@ func handleHTTPRequest(w http.ResponseWriter, r *http.Request, config *Config) {
 	// Copy the response back to the client
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
+		failure = err
 		http.Error(w, "Failed to read backend response", http.StatusInternalServerError)
 		log.Printf("Failed to read backend response: %v", err)
 		return
@@ -227,6 +405,101 @@ func handleHTTPRequest(w http.ResponseWriter, r *http.Request, config *Config) {
 	requestLatency.Observe(float64(duration))
 }
 
+// misdirected reports whether a request's Host names another server than its connection was
+// terminated for while either name has a TLS policy or client certificate requirement, so those
+// can't be sidestepped through the Host header. Other names keep routing on the Host header alone.
+func misdirected(config *Config, r *http.Request) bool {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(host, ".")
+	serverName := ""
+	if r.TLS != nil {
+		serverName = strings.TrimSuffix(r.TLS.ServerName, ".")
+	}
+	if strings.EqualFold(host, serverName) {
+		return false
+	}
+	for _, name := range []string{host, serverName} {
+		if config.ClientAuth.Lookup(name) != nil || config.TLSRules.Lookup(name) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// backendClient returns the HTTP client and base URL for a backend.
+// Backends given as unix:///path/to.sock are dialed over the socket, and hosts
+// with an upstream TLS policy reach their backends over HTTPS.
+func backendClient(config *Config, host string, backendURL string) (*http.Client, string) {
+	upstream := config.UpstreamTLS.Lookup(host)
+	path, isUnix := strings.CutPrefix(backendURL, unixScheme)
+	if !isUnix && upstream == nil {
+		return &http.Client{}, backendURL
+	}
+
+	targetURL := backendURL
+	if isUnix {
+		targetURL = "http://unix"
+	}
+	if upstream != nil {
+		// Backends may be registered as http:// or https:// URLs; either way the route re-encrypts
+		if u, err := url.Parse(targetURL); err == nil {
+			u.Scheme = "https"
+			targetURL = u.String()
+		}
+	}
+
+	key := host + "|" + backendURL
+	value, ok := backendTransports.Load(key)
+	if !ok {
+		transport := &http.Transport{IdleConnTimeout: 90 * time.Second}
+		if isUnix {
+			transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", path)
+			}
+		}
+		if upstream != nil {
+			// Socket backends have no hostname to verify, so they are checked against the requested host
+			serverName := ""
+			if isUnix {
+				serverName, _, _ = strings.Cut(host, ":")
+			}
+			transport.TLSClientConfig = upstream.ClientConfig(serverName)
+			transport.ForceAttemptHTTP2 = true
+		}
+		value, _ = backendTransports.LoadOrStore(key, transport)
+	}
+	return &http.Client{Transport: value.(*http.Transport)}, targetURL
+}
+
+// closeBackendTransport drops the transport of a backend that left its route and closes its idle
+// connections. Requests still in flight finish on it; their connections close once idle for IdleConnTimeout.
+func closeBackendTransport(host, backendURL string) {
+	if value, ok := backendTransports.LoadAndDelete(host + "|" + backendURL); ok {
+		value.(*http.Transport).CloseIdleConnections()
+	}
+}
+
+// validateBackend checks that a Unix socket backend exists before it is registered
+func validateBackend(backendURL string) error {
+	path, ok := strings.CutPrefix(backendURL, unixScheme)
+	if !ok {
+		return nil
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("socket %s is not accessible: %w", path, err)
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s is not a Unix socket", path)
+	}
+	return nil
+}
+
 func collectCPUMetrics() {
 	for {
 		cpuUsageCurr, err := getCPUUsage()
@@ -239,15 +512,25 @@ func collectCPUMetrics() {
 }
 
 func addBackend(config *Config, host string, backend string) {
-	// Get or initialize the backend list
-	value, _ := config.Backends.LoadOrStore(host, &sync.Map{})
-	backends := value.(*sync.Map)
-
-	// Add the backend to the list
-	backends.Store(backend, true) // `true` acts as a placeholder
+	// Add the backend to the route, keeping the weight and metadata of one registered before
+	config.Backends.Add(host, adminapi.Backend{Address: backend, Weight: adminapi.DefaultWeight})
 	log.Printf("Registered backend: %s -> %s", host, backend)
 }
 
+// setBackend adds or replaces a backend along with its weight and metadata
+func setBackend(config *Config, host string, backend adminapi.Backend) {
+	config.Backends.Set(host, backend)
+}
+
+// removeBackend reports whether the backend was registered
+func removeBackend(config *Config, host string, backend string) bool {
+	if !config.Backends.Remove(host, backend) {
+		return false
+	}
+	log.Printf("Deregistered backend: %s -> %s", host, backend)
+	return true
+}
+
 func collectProfilingMetrics() {
 	var memStats runtime.MemStats
 
@@ -266,6 +549,55 @@ func collectProfilingMetrics() {
 	}
 }
 
+// configForClient selects per-host TLS settings: ACME challenges first, then the TLS policy and client certificate requirements
+func configForClient(config *Config, base *tls.Config) func(*tls.ClientHelloInfo) (*tls.Config, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		if config.ACME != nil {
+			if challenge, err := config.ACME.GetConfigForClient(hello); challenge != nil || err != nil {
+				return challenge, err
+			}
+		}
+
+		rule := config.TLSRules.Lookup(hello.ServerName)
+		verifier := config.ClientAuth.Lookup(hello.ServerName)
+		if rule == nil && verifier == nil {
+			return nil, nil
+		}
+
+		perHost := base.Clone()
+		perHost.GetConfigForClient = nil
+		if rule != nil {
+			rule.Apply(perHost)
+		}
+		if verifier != nil {
+			verifier.Apply(perHost)
+		}
+		return perHost, nil
+	}
+}
+
+// Obtain certificates over ACME for every registered host and answer HTTP-01 challenges
+func startACME(config *Config) {
+	manager, err := acmecert.New(acmecert.Config{
+		DirectoryURL: config.ACMEDirectoryURL,
+		Email:        config.ACMEEmail,
+		CacheDir:     config.ACMECacheDir,
+		CARootFile:   config.ACMECARoot,
+		HostPolicy: func(host string) bool {
+			return config.Backends.Has(host)
+		},
+	}, config.Certificates)
+	if err != nil {
+		log.Fatalf("Failed to start ACME: %v", err)
+	}
+	config.ACME = manager
+
+	go func() {
+		log.Printf("ACME HTTP-01 challenge server listening on %s", config.ACMEHTTPAddress)
+		log.Println(http.ListenAndServe(config.ACMEHTTPAddress, manager.HTTPHandler(nil)))
+	}()
+}
+
 func startMetricsServer(metricsAddr string) {
 	http.Handle("/metrics", promhttp.Handler())
 	log.Printf("Metrics server listening on %s", metricsAddr)
@@ -273,24 +605,125 @@ func startMetricsServer(metricsAddr string) {
 }
 
 func main() {
-	config := &Config{
-		Backends:       &sync.Map{},
-		BackendIndices: &sync.Map{},
-		Cache:          &sync.Map{},
-		TLSCertFile:    "cert.pem",
-		TLSKeyFile:     "key.pem",
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		os.Exit(validateCommand(os.Args[2:]))
+	}
+
+	configFile := flag.String("config", "", "YAML or JSON configuration file (built-in defaults when empty)")
+	registryFile := flag.String("registry-file", "", "log the backend registry is persisted to, overriding admin.registry_file")
+	emptyRegistry := flag.Bool("empty-registry", false, "discard the persisted registry and start without backends")
+	acmeDirectory := flag.String("acme-directory", "", "ACME directory URL to obtain certificates from, overriding tls.acme.directory_url")
+	flag.Parse()
+
+	// Reloads read the file the same way
+	loadFile := func() (*configfile.File, error) {
+		file, err := configfile.Load(*configFile, configfile.L7)
+		if err != nil {
+			return nil, err
+		}
+		flag.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "registry-file":
+				file.Admin.RegistryFile = *registryFile
+			case "acme-directory":
+				file.TLS.ACME.DirectoryURL = *acmeDirectory
+			}
+		})
+		return file, nil
+	}
+	file, err := loadFile()
+	if err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+	config := newConfig(file)
+
+	// Restore what was registered before the restart
+	if config.RegistryFile != "" {
+		store, records, err := registrystore.Open(config.RegistryFile, *emptyRegistry)
+		if err != nil {
+			log.Fatalf("Failed to open registry log: %v", err)
+		}
+		config.Store = store
+		restoreRegistry(config, records)
+		go config.Store.Run(10 * time.Minute)
+	}
+	addStaticRoutes(config, file.Routes)
+
+	// Load the certificates once and reload them when the files change
+	certificates, err := certstore.New(config.CertDir, certstore.Pair{CertFile: config.TLSCertFile, KeyFile: config.TLSKeyFile})
+	if err != nil {
+		log.Fatalf("Failed to load TLS certificates: %v", err)
+	}
+	config.Certificates = certificates
+	go config.Certificates.Watch(5 * time.Second)
+	go config.Certificates.StapleOCSP(time.Minute)
+
+	if config.ACMEDirectoryURL != "" {
+		startACME(config)
+	}
+
+	config.ClientAuth, err = clientauth.LoadAll(config.ClientAuthPolicies)
+	if err != nil {
+		log.Fatalf("Failed to load client certificate policies: %v", err)
+	}
+	go config.ClientAuth.Watch(5 * time.Second)
+
+	config.TLSRules, err = tlspolicy.LoadAll(config.TLSPolicies)
+	if err != nil {
+		log.Fatalf("Failed to load TLS policies: %v", err)
+	}
+
+	config.UpstreamTLS, err = upstreamtls.LoadAll(config.UpstreamTLSPolicies)
+	if err != nil {
+		log.Fatalf("Failed to load upstream TLS policies: %v", err)
+	}
+
+	// Without grants anyone who reaches the registration API may register backends
+	config.APIAuth, err = apiauth.Load(config.APIAuthPolicy)
+	if err != nil {
+		log.Fatalf("Failed to load registration API policy: %v", err)
+	}
+	if len(config.APIAuthPolicy.Tokens) == 0 && len(config.APIAuthPolicy.Clients) == 0 {
+		config.APIAuth = nil
+		log.Printf("Warning: registration API is unauthenticated; set admin.auth to restrict it")
 	}
 
 	go collectCPUMetrics()
 
 	go collectProfilingMetrics()
 
-	go func() {
-		log.Println("Starting pprof server on :6060")
-		log.Println(http.ListenAndServe(":6060", nil)) // Use default pprof routes
-	}()
+	if config.PprofAddress != "" {
+		go func() {
+			log.Printf("Starting pprof server on %s", config.PprofAddress)
+			log.Println(http.ListenAndServe(config.PprofAddress, nil)) // Use default pprof routes
+		}()
+	}
+
+	if config.MetricsAddress != "" {
+		go startMetricsServer(config.MetricsAddress)
+	}
+
+	// Evict backends that stopped renewing their registration. Nothing is written to the registry
+	// log: their records carry the expiry, so replaying and compacting the log drop them anyway.
+	go config.Leases.Run(time.Second, func(host, backend string) {
+		removeBackend(config, host, backend)
+	})
+
+	// Apply route changes on SIGHUP or when the file changes
+	if *configFile != "" {
+		config.Reloader = configfile.NewReloader(*configFile, file, loadFile, func(old, next *configfile.File, diff configfile.Diff) error {
+			return reloadRoutes(config, old, next, diff)
+		})
+		go config.Reloader.Run(5 * time.Second)
+	}
 
-	go startMetricsServer(":9100")
+	// Follow labeled containers and target files for the backends of hosts
+	if config.DockerSocket != "" {
+		startDockerDiscovery(config)
+	}
+	if len(config.TargetFiles) > 0 {
+		startFileDiscovery(config)
+	}
 
 	// Start backend registration API
 	startBackendRegistrationAPI(config)
@@ -300,12 +733,41 @@ func main() {
 		handleHTTPRequest(w, r, config)
 	})
 
+	// Choose the certificate by host from the certificate store, or from ACME when enabled
+	tlsConfig := &tls.Config{
+		GetCertificate: config.Certificates.GetCertificate,
+		NextProtos:     []string{"h2", "http/1.1"},
+	}
+	if config.ACME != nil {
+		tlsConfig.GetCertificate = config.ACME.GetCertificate
+	}
+	tlsConfig.GetConfigForClient = configForClient(config, tlsConfig)
+
+	// Runs for every handshake, including resumed ones
+	tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+		tlsHandshakes.WithLabelValues(strconv.FormatBool(state.DidResume)).Inc()
+		return nil
+	}
+
+	// Rotate session ticket keys derived from a seed other instances can share
+	rotator, err := ticketkeys.New(ticketkeys.Config{
+		KeyFile:  config.TicketKeyFile,
+		Rotation: config.TicketKeyRotation,
+		Keep:     2,
+	})
+	if err != nil {
+		log.Fatalf("Failed to set up session ticket keys: %v", err)
+	}
+	rotator.Apply(tlsConfig)
+	go rotator.Run()
+
 	server := &http.Server{
-		Addr: ":443",
+		Addr:      config.ListenAddress,
+		TLSConfig: tlsConfig,
 	}
 
-	log.Printf("Starting L7 reverse proxy on :443")
-	if err := server.ListenAndServeTLS(config.TLSCertFile, config.TLSKeyFile); err != nil {
+	log.Printf("Starting L7 reverse proxy on %s", config.ListenAddress)
+	if err := server.ListenAndServeTLS("", ""); err != nil {
 		log.Fatalf("Failed to start server: %v", err)
 	}
 }
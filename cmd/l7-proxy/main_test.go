@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"reverse-proxy/internal/adminapi"
+	"reverse-proxy/internal/clientauth"
+	"reverse-proxy/internal/configfile"
+	"reverse-proxy/internal/routing"
+	"reverse-proxy/internal/tlspolicy"
+)
+
+// proxied sends a request for host over a connection terminated for serverName, the way l7-client does
+func proxied(config *Config, serverName, host string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, "https://"+serverName+"/", nil)
+	r.Host = host
+	r.TLS = &tls.ConnectionState{ServerName: serverName}
+	w := httptest.NewRecorder()
+	handleHTTPRequest(w, r, config)
+	return w
+}
+
+func TestHostRoutesWithoutPolicies(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello from example.com")
+	}))
+	defer backend.Close()
+
+	config := &Config{Backends: routing.NewTable()}
+	config.Backends.Add("example.com", adminapi.Backend{Address: backend.URL, Weight: adminapi.DefaultWeight})
+
+	// l7-client dials https://localhost and routes with the Host header
+	w := proxied(config, "localhost", "example.com")
+	if w.Code != http.StatusOK || w.Body.String() != "hello from example.com" {
+		t.Fatalf("l7-client request got %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestHostMustMatchServerNameWithPolicies(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	config := &Config{
+		Backends:   routing.NewTable(),
+		ClientAuth: clientauth.Verifiers{"secure.example.com": &clientauth.Verifier{}},
+		TLSRules:   tlspolicy.Rules{"*.strict.example.com": &tlspolicy.Rule{}},
+	}
+	for _, host := range []string{"example.com", "secure.example.com", "api.strict.example.com"} {
+		config.Backends.Add(host, adminapi.Backend{Address: backend.URL, Weight: adminapi.DefaultWeight})
+	}
+
+	for _, tc := range []struct {
+		serverName, host string
+		want             int
+	}{
+		{"localhost", "example.com", http.StatusOK},
+		{"secure.example.com", "secure.example.com", http.StatusOK},
+		{"api.strict.example.com", "api.strict.example.com", http.StatusOK},
+		// Client certificates required by the Host can't be skipped by a handshake for another name
+		{"localhost", "secure.example.com", http.StatusMisdirectedRequest},
+		{"", "secure.example.com", http.StatusMisdirectedRequest},
+		// A connection made under a name's policy only serves that name
+		{"secure.example.com", "example.com", http.StatusMisdirectedRequest},
+		{"api.strict.example.com", "example.com", http.StatusMisdirectedRequest},
+	} {
+		if w := proxied(config, tc.serverName, tc.host); w.Code != tc.want {
+			t.Errorf("SNI %q, Host %q: got %d, want %d", tc.serverName, tc.host, w.Code, tc.want)
+		}
+	}
+
+	// Ports, case and a trailing dot don't make a Host another name
+	for _, host := range []string{"secure.example.com:443", "SECURE.example.com", "secure.example.com."} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Host = host
+		r.TLS = &tls.ConnectionState{ServerName: "secure.example.com"}
+		if misdirected(config, r) {
+			t.Errorf("Host %q taken for another name than secure.example.com", host)
+		}
+	}
+}
+
+func TestBackendTransportsEvicted(t *testing.T) {
+	config := newConfig(&configfile.File{})
+	const backend = "unix:///run/example.sock"
+	config.Backends.Add("example.com", adminapi.Backend{Address: backend, Weight: adminapi.DefaultWeight})
+	config.Backends.Add("other.example.com", adminapi.Backend{Address: backend, Weight: adminapi.DefaultWeight})
+	backendClient(config, "example.com", backend)
+	backendClient(config, "other.example.com", backend)
+
+	config.Backends.Remove("example.com", backend)
+	if _, ok := backendTransports.Load("example.com|" + backend); ok {
+		t.Error("transport kept after its backend was removed")
+	}
+	if _, ok := backendTransports.Load("other.example.com|" + backend); !ok {
+		t.Error("transport of another route evicted")
+	}
+	config.Backends.RemoveRoute("other.example.com")
+	if _, ok := backendTransports.Load("other.example.com|" + backend); ok {
+		t.Error("transport kept after its route was removed")
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"reverse-proxy/internal/adminapi"
+	"reverse-proxy/internal/balancer"
+	"reverse-proxy/internal/registrystore"
+	"reverse-proxy/internal/routing"
+)
+
+// lookupBackend returns a registered backend with its weight and metadata
+func lookupBackend(config *Config, host, address string) (adminapi.Backend, bool) {
+	return config.Backends.Backend(host, address)
+}
+
+// persistBackend writes a backend as it is about to be registered, with the lease it will hold
+// if expires is set, through to the registry log
+func persistBackend(config *Config, host string, backend adminapi.Backend, expires *time.Time) error {
+	return persist(config, registrystore.Record{Op: registrystore.OpSet, Route: host, Backend: &backend, Expires: expires})
+}
+
+// leaseExpiry returns when a backend's current lease runs out, or nil if it has none
+func leaseExpiry(config *Config, host, address string) *time.Time {
+	if expires, ok := config.Leases.Expiry(host, address); ok {
+		return &expires
+	}
+	return nil
+}
+
+// replaceRecords returns the records that set a host's backends to exactly the ones given, leases
+// kept, and its balancing policy unless balancing is nil
+func replaceRecords(config *Config, host string, backends []adminapi.Backend, balancing *string) []registrystore.Record {
+	var records []registrystore.Record
+	if balancing != nil && *balancing != config.Backends.Policy(host) {
+		records = append(records, registrystore.Record{Op: registrystore.OpBalancing, Route: host, Value: *balancing})
+	}
+	if len(backends) == 0 {
+		return append(records, registrystore.Record{Op: registrystore.OpDeleteRoute, Route: host})
+	}
+	for _, backend := range config.Backends.Backends(host) {
+		if !routing.Contains(backends, backend.Address) {
+			records = append(records, registrystore.Record{Op: registrystore.OpDelete, Route: host, Address: backend.Address})
+		}
+	}
+	for _, backend := range backends {
+		records = append(records, registrystore.Record{Op: registrystore.OpSet, Route: host, Backend: &backend, Expires: leaseExpiry(config, host, backend.Address)})
+	}
+	return records
+}
+
+func persistRemoval(config *Config, host, address string) error {
+	return persist(config, registrystore.Record{Op: registrystore.OpDelete, Route: host, Address: address})
+}
+
+// persist appends records to the registry log. The error wraps adminapi.ErrNotPersisted, so the
+// APIs answer 500 for changes that wouldn't survive a restart.
+func persist(config *Config, records ...registrystore.Record) error {
+	if err := config.Store.Append(records...); err != nil {
+		log.Printf("Failed to persist registry record: %v", err)
+		return fmt.Errorf("%w: %v", adminapi.ErrNotPersisted, err)
+	}
+	return nil
+}
+
+// setBalancing writes the balancing policy of a host through to the registry log, then applies it
+func setBalancing(config *Config, host, policy string) error {
+	if config.Backends.Policy(host) == policy {
+		return nil
+	}
+	if err := balancer.Valid(policy); err != nil {
+		return fmt.Errorf("%w: %v", adminapi.ErrInvalidBalancing, err)
+	}
+	if err := persist(config, registrystore.Record{Op: registrystore.OpBalancing, Route: host, Value: policy}); err != nil {
+		return err
+	}
+	config.Backends.SetPolicy(host, policy) // Checked above
+	log.Printf("Set balancing policy of %s to %q", host, policy)
+	return nil
+}
+
+// restoreRegistry replays the registry log into the backend map before the APIs start
+func restoreRegistry(config *Config, records []registrystore.Record) {
+	backends := 0
+	for _, record := range records {
+		if record.Op == registrystore.OpBalancing {
+			if err := config.Backends.SetPolicy(record.Route, record.Value); err != nil {
+				log.Printf("Failed to restore balancing policy of %s: %v", record.Route, err)
+			}
+			continue
+		}
+		if record.Op != registrystore.OpSet {
+			continue
+		}
+		if record.Expires != nil {
+			config.Leases.Renew(record.Route, record.Backend.Address, time.Until(*record.Expires))
+		}
+		setBackend(config, record.Route, *record.Backend)
+		backends++
+	}
+	log.Printf("Restored %d backends from registry log %s", backends, config.RegistryFile)
+}
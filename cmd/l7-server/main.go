@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"os"
 )
 
 func main() {
@@ -46,8 +47,16 @@ func registerWithProxy(proxyURL, host, backend string) error {
 		return fmt.Errorf("failed to marshal registration payload: %w", err)
 	}
 
-	// Send the registration request
-	resp, err := http.Post(proxyURL, "application/json", bytes.NewReader(data))
+	// Send the registration request, authenticating if the proxy requires a token
+	req, err := http.NewRequest(http.MethodPost, proxyURL, bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("failed to create registration request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token := os.Getenv("PROXY_REGISTRATION_TOKEN"); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return fmt.Errorf("failed to send registration request: %w", err)
 	}
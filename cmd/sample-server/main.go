@@ -9,6 +9,10 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 func main() {
@@ -16,6 +20,8 @@ func main() {
 	serviceName := "example.com"
 	serviceAddress := "127.0.0.1:8080"
 	proxyRegistrationEndpoint := "http://localhost:8081/register"
+	proxyDeregistrationEndpoint := "http://localhost:8081/deregister"
+	registrationTTL := 30 * time.Second // The proxy evicts the backend if it stops renewing
 
 	// Load TLS certificate and key
 	cert, err := tls.LoadX509KeyPair("cert.pem", "key.pem")
@@ -24,12 +30,15 @@ func main() {
 	}
 
 	// Register the backend with the proxy
-	err = registerWithProxy(proxyRegistrationEndpoint, serviceName, serviceAddress)
+	err = registerWithProxy(proxyRegistrationEndpoint, serviceName, serviceAddress, registrationTTL)
 	if err != nil {
 		log.Fatalf("Failed to register with proxy: %v", err)
 	}
 	log.Printf("Backend registered: %s -> %s", serviceName, serviceAddress)
 
+	stop := make(chan struct{})
+	go renewRegistration(proxyRegistrationEndpoint, serviceName, serviceAddress, registrationTTL, stop)
+
 	// Start the backend server
 	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
 
@@ -41,6 +50,19 @@ func main() {
 
 	log.Printf("Backend server listening on %s", serviceAddress)
 
+	// Deregister on shutdown instead of waiting for the lease to expire
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		close(stop)
+		if err := deregisterFromProxy(proxyDeregistrationEndpoint, serviceName, serviceAddress); err != nil {
+			log.Printf("Failed to deregister from proxy: %v", err)
+		}
+		listener.Close()
+		os.Exit(0)
+	}()
+
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
@@ -78,19 +100,56 @@ func handleConnection(conn net.Conn) {
 	}
 }
 
-func registerWithProxy(endpoint, name, address string) error {
-	// Prepare the registration payload
-	payload := map[string]string{
+// registerWithProxy registers the backend, or renews its lease if it is already registered
+func registerWithProxy(endpoint, name, address string, ttl time.Duration) error {
+	return postToProxy(endpoint, map[string]any{
 		"name":    name,
 		"address": address,
+		"ttl":     int(ttl / time.Second),
+	})
+}
+
+// deregisterFromProxy removes the backend from the proxy
+func deregisterFromProxy(endpoint, name, address string) error {
+	return postToProxy(endpoint, map[string]any{
+		"name":    name,
+		"address": address,
+	})
+}
+
+// renewRegistration registers again at a third of the TTL, so a lost heartbeat or two doesn't evict the backend
+func renewRegistration(endpoint, name, address string, ttl time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(ttl / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := registerWithProxy(endpoint, name, address, ttl); err != nil {
+				log.Printf("Failed to renew registration: %v", err)
+			}
+		}
 	}
+}
+
+func postToProxy(endpoint string, payload map[string]any) error {
 	data, err := json.Marshal(payload)
 	if err != nil {
 		return fmt.Errorf("failed to marshal registration payload: %w", err)
 	}
 
-	// Make the HTTP POST request to the proxy
-	resp, err := http.Post(endpoint, "application/json", bytes.NewReader(data))
+	// Send the registration request, authenticating if the proxy requires a token
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("failed to create registration request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token := os.Getenv("PROXY_REGISTRATION_TOKEN"); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return fmt.Errorf("failed to send registration request: %w", err)
 	}
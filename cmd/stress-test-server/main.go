@@ -9,17 +9,20 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"os"
 	"sync"
 	"time"
 )
 
 // Server represents a backend server instance.
 type Server struct {
-	serviceName string
-	address     string
-	stopChan    chan struct{}
-	waitGroup   *sync.WaitGroup
-	listener    net.Listener
+	serviceName            string
+	address                string
+	stopChan               chan struct{}
+	waitGroup              *sync.WaitGroup
+	listener               net.Listener
+	mu                     sync.Mutex
+	deregistrationEndpoint string // Set once registered, so Stop can deregister
 }
 
 // NewServer initializes a new Server instance.
@@ -49,16 +52,21 @@ func NewServer(serviceName, address string, waitGroup *sync.WaitGroup) *Server {
 }
 
 // Start launches the server to listen for connections and process messages.
-func (s *Server) Start(certFile, keyFile, proxyRegistrationEndpoint string) {
+// The registration is leased for ttl and renewed until the server stops.
+func (s *Server) Start(certFile, keyFile, proxyRegistrationEndpoint, proxyDeregistrationEndpoint string, ttl time.Duration) {
 	defer s.waitGroup.Done()
 
 	// Register the server with the proxy
-	err := registerWithProxy(proxyRegistrationEndpoint, s.serviceName, s.address)
+	err := registerWithProxy(proxyRegistrationEndpoint, s.serviceName, s.address, ttl)
 	if err != nil {
 		log.Printf("Server %s failed to register with proxy: %v", s.serviceName, err)
 		return
 	}
 	log.Printf("Server %s registered with proxy", s.serviceName)
+	s.mu.Lock()
+	s.deregistrationEndpoint = proxyDeregistrationEndpoint
+	s.mu.Unlock()
+	go s.renewRegistration(proxyRegistrationEndpoint, ttl)
 
 	defer s.listener.Close()
 
@@ -84,10 +92,36 @@ func (s *Server) Start(certFile, keyFile, proxyRegistrationEndpoint string) {
 	}
 }
 
-// Stop signals the server to stop listening for connections.
+// Stop signals the server to stop listening for connections and deregisters it from the proxy.
 func (s *Server) Stop() {
 	close(s.stopChan)
 	s.listener.Close()
+
+	s.mu.Lock()
+	endpoint := s.deregistrationEndpoint
+	s.mu.Unlock()
+	if endpoint != "" {
+		if err := deregisterFromProxy(endpoint, s.serviceName, s.address); err != nil {
+			log.Printf("Server %s failed to deregister from proxy: %v", s.serviceName, err)
+		}
+	}
+}
+
+// renewRegistration registers again at a third of the TTL until the server stops.
+func (s *Server) renewRegistration(endpoint string, ttl time.Duration) {
+	ticker := time.NewTicker(ttl / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stopChan:
+			return
+		case <-ticker.C:
+			if err := registerWithProxy(endpoint, s.serviceName, s.address, ttl); err != nil {
+				log.Printf("Server %s failed to renew registration: %v", s.serviceName, err)
+			}
+		}
+	}
 }
 
 // handleConnection processes an incoming client connection.
@@ -112,18 +146,39 @@ func (s *Server) handleConnection(conn net.Conn) {
 	}
 }
 
-// registerWithProxy registers the server with the proxy.
-func registerWithProxy(endpoint, name, address string) error {
-	payload := map[string]string{
+// registerWithProxy registers the server with the proxy, or renews its lease.
+func registerWithProxy(endpoint, name, address string, ttl time.Duration) error {
+	return postToProxy(endpoint, map[string]any{
 		"name":    name,
 		"address": address,
-	}
+		"ttl":     int(ttl / time.Second),
+	})
+}
+
+// deregisterFromProxy removes the server from the proxy.
+func deregisterFromProxy(endpoint, name, address string) error {
+	return postToProxy(endpoint, map[string]any{
+		"name":    name,
+		"address": address,
+	})
+}
+
+func postToProxy(endpoint string, payload map[string]any) error {
 	data, err := json.Marshal(payload)
 	if err != nil {
 		return fmt.Errorf("failed to marshal registration payload: %w", err)
 	}
 
-	resp, err := http.Post(endpoint, "application/json", bytes.NewReader(data))
+	// Send the registration request, authenticating if the proxy requires a token
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("failed to create registration request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token := os.Getenv("PROXY_REGISTRATION_TOKEN"); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return fmt.Errorf("failed to send registration request: %w", err)
 	}
@@ -138,11 +193,13 @@ func registerWithProxy(endpoint, name, address string) error {
 
 func main() {
 	const (
-		numServers                = 50
-		proxyRegistrationEndpoint = "http://localhost:8081/register"
-		certFile                  = "cert.pem"
-		keyFile                   = "key.pem"
-		startPort                 = 8082
+		numServers                  = 50
+		proxyRegistrationEndpoint   = "http://localhost:8081/register"
+		proxyDeregistrationEndpoint = "http://localhost:8081/deregister"
+		registrationTTL             = 30 * time.Second
+		certFile                    = "cert.pem"
+		keyFile                     = "key.pem"
+		startPort                   = 8082
 	)
 
 	var wg sync.WaitGroup
@@ -156,7 +213,7 @@ func main() {
 
 		server := NewServer(serviceName, address, &wg)
 		servers[i] = server
-		go server.Start(certFile, keyFile, proxyRegistrationEndpoint)
+		go server.Start(certFile, keyFile, proxyRegistrationEndpoint, proxyDeregistrationEndpoint, registrationTTL)
 	}
 
 	// Wait for some time (e.g., 10 seconds) to simulate workload
@@ -31,8 +31,9 @@ func (c *Client) Start(proxyAddress, targetService string) {
 
 	// TLS configuration
 	tlsConfig := &tls.Config{
-		ServerName:         targetService, // SNI field
-		InsecureSkipVerify: true,          // Skip verification for self-signed certificates
+		ServerName:         targetService,                   // SNI field
+		InsecureSkipVerify: true,                            // Skip verification for self-signed certificates
+		ClientSessionCache: tls.NewLRUClientSessionCache(1), // Resume the previous session on reconnect
 	}
 
 	for {
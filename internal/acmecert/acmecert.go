@@ -0,0 +1,127 @@
+// Package acmecert obtains and renews certificates for registered hostnames over ACME.
+package acmecert
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+
+	"reverse-proxy/internal/certstore"
+)
+
+// Config describes the ACME account and where certificates are kept
+type Config struct {
+	DirectoryURL string                 // ACME directory, e.g. Let's Encrypt or a local Pebble instance
+	Email        string                 // Contact address for the ACME account (optional)
+	CacheDir     string                 // Directory where the account key and certificates are stored
+	RenewBefore  time.Duration          // How long before expiry certificates are renewed
+	CARootFile   string                 // PEM bundle trusted for the directory's TLS (e.g. Pebble's test CA)
+	HostPolicy   func(host string) bool // Reports whether a certificate may be requested for a hostname
+}
+
+// Manager answers TLS-ALPN-01 and HTTP-01 challenges and serves the certificates it obtains
+type Manager struct {
+	manager *autocert.Manager
+	static  *certstore.Store
+}
+
+// New creates a manager. Certificates in static, if set, take precedence over ACME for the names they cover.
+func New(config Config, static *certstore.Store) (*Manager, error) {
+	if config.DirectoryURL == "" {
+		return nil, fmt.Errorf("ACME directory URL is required")
+	}
+	if config.CacheDir == "" {
+		return nil, fmt.Errorf("ACME cache directory is required")
+	}
+
+	client := &acme.Client{DirectoryURL: config.DirectoryURL}
+	if config.CARootFile != "" {
+		pem, err := os.ReadFile(config.CARootFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ACME CA root: %w", err)
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", config.CARootFile)
+		}
+		client.HTTPClient = &http.Client{
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}},
+		}
+	}
+
+	manager := &autocert.Manager{
+		Prompt:      autocert.AcceptTOS,
+		Cache:       autocert.DirCache(config.CacheDir),
+		Client:      client,
+		Email:       config.Email,
+		RenewBefore: config.RenewBefore,
+		HostPolicy: func(_ context.Context, host string) error {
+			if config.HostPolicy != nil && !config.HostPolicy(host) {
+				return fmt.Errorf("host %s is not registered", host)
+			}
+			return nil
+		},
+	}
+
+	log.Printf("ACME enabled with directory %s, certificates stored in %s", config.DirectoryURL, config.CacheDir)
+	return &Manager{manager: manager, static: static}, nil
+}
+
+// GetCertificate serves ACME challenges, then static certificates, then certificates obtained over ACME.
+// Hostnames the policy rejects get the static fallback certificate. ACME certificates are stapled by the static store.
+func (m *Manager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if isChallenge(hello) {
+		return m.manager.GetCertificate(hello)
+	}
+
+	if m.static != nil {
+		if cert, ok := m.static.Lookup(hello.ServerName); ok {
+			return cert, nil
+		}
+	}
+
+	cert, err := m.manager.GetCertificate(hello)
+	if m.static == nil {
+		return cert, err
+	}
+	if err != nil {
+		log.Printf("ACME certificate unavailable for %s: %v", hello.ServerName, err)
+		return m.static.GetCertificate(hello)
+	}
+	return m.static.Staple(cert), nil
+}
+
+// HTTPHandler answers HTTP-01 challenges and passes every other request to fallback.
+// A nil fallback redirects requests to HTTPS.
+func (m *Manager) HTTPHandler(fallback http.Handler) http.Handler {
+	return m.manager.HTTPHandler(fallback)
+}
+
+// IsChallenge reports whether a connection negotiated the TLS-ALPN-01 protocol and only exists to answer a challenge
+func IsChallenge(state tls.ConnectionState) bool {
+	return state.NegotiatedProtocol == acme.ALPNProto
+}
+
+// GetConfigForClient returns a dedicated configuration for TLS-ALPN-01 challenge handshakes and nil for all others,
+// so the server's own ALPN list doesn't need to advertise the challenge protocol
+func (m *Manager) GetConfigForClient(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	if !isChallenge(hello) {
+		return nil, nil
+	}
+	return &tls.Config{
+		NextProtos:     []string{acme.ALPNProto},
+		GetCertificate: m.manager.GetCertificate,
+	}, nil
+}
+
+func isChallenge(hello *tls.ClientHelloInfo) bool {
+	return len(hello.SupportedProtos) == 1 && hello.SupportedProtos[0] == acme.ALPNProto
+}
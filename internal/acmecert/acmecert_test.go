@@ -0,0 +1,187 @@
+package acmecert
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme"
+
+	"reverse-proxy/internal/certstore"
+)
+
+// staticStore returns a store holding one self-signed certificate for name
+func staticStore(t *testing.T, name string) *certstore.Store {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "static.crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	os.WriteFile(filepath.Join(dir, "static.key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+	store, err := certstore.New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func names(t *testing.T, cert *tls.Certificate) []string {
+	t.Helper()
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf.DNSNames
+}
+
+func TestNewRequiresDirectoryAndCache(t *testing.T) {
+	if _, err := New(Config{CacheDir: t.TempDir()}, nil); err == nil {
+		t.Error("expected an error without a directory URL")
+	}
+	if _, err := New(Config{DirectoryURL: "https://acme.test/directory"}, nil); err == nil {
+		t.Error("expected an error without a cache directory")
+	}
+	if _, err := New(Config{DirectoryURL: "https://acme.test/directory", CacheDir: t.TempDir(), CARootFile: "missing.pem"}, nil); err == nil {
+		t.Error("expected an error for a missing CA root")
+	}
+}
+
+// Static certificates win, and names the policy rejects get the static fallback without contacting the directory
+func TestGetCertificatePrefersStatic(t *testing.T) {
+	m, err := New(Config{
+		DirectoryURL: "https://127.0.0.1:1/directory",
+		CacheDir:     t.TempDir(),
+		HostPolicy:   func(host string) bool { return host == "registered.test" },
+	}, staticStore(t, "static.test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"static.test", "unregistered.test"} {
+		cert, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: name})
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if got := names(t, cert); !slices.Equal(got, []string{"static.test"}) {
+			t.Errorf("%s got the certificate for %v", name, got)
+		}
+	}
+}
+
+func TestChallengeConfig(t *testing.T) {
+	m, err := New(Config{DirectoryURL: "https://acme.test/directory", CacheDir: t.TempDir()}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := m.GetConfigForClient(&tls.ClientHelloInfo{SupportedProtos: []string{"h2", "http/1.1"}})
+	if config != nil || err != nil {
+		t.Fatalf("regular handshake got a dedicated configuration: %v, %v", config, err)
+	}
+	config, err = m.GetConfigForClient(&tls.ClientHelloInfo{SupportedProtos: []string{acme.ALPNProto}})
+	if err != nil || config == nil || !slices.Equal(config.NextProtos, []string{acme.ALPNProto}) {
+		t.Fatalf("challenge handshake configuration = %v, %v", config, err)
+	}
+	if !IsChallenge(tls.ConnectionState{NegotiatedProtocol: acme.ALPNProto}) || IsChallenge(tls.ConnectionState{NegotiatedProtocol: "h2"}) {
+		t.Fatal("IsChallenge misreports the negotiated protocol")
+	}
+}
+
+// TestPebble obtains a certificate from a running Pebble instance over TLS-ALPN-01. It runs when
+// PEBBLE_DIRECTORY is set, e.g. https://localhost:14000/dir, with PEBBLE_CA_ROOT pointing at Pebble's
+// test CA. Pebble must resolve PEBBLE_DOMAIN (default acme.test) to this host, for example with
+// pebble-challtestsrv -defaultIPv4 127.0.0.1, and validate on PEBBLE_TLS_ADDRESS (default :5001).
+func TestPebble(t *testing.T) {
+	directory := os.Getenv("PEBBLE_DIRECTORY")
+	if directory == "" {
+		t.Skip("PEBBLE_DIRECTORY not set")
+	}
+	domain := os.Getenv("PEBBLE_DOMAIN")
+	if domain == "" {
+		domain = "acme.test"
+	}
+	address := os.Getenv("PEBBLE_TLS_ADDRESS")
+	if address == "" {
+		address = ":5001"
+	}
+
+	m, err := New(Config{
+		DirectoryURL: directory,
+		CacheDir:     t.TempDir(),
+		CARootFile:   os.Getenv("PEBBLE_CA_ROOT"),
+		HostPolicy:   func(host string) bool { return host == domain },
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Answer the validation handshakes the way the proxies do
+	listener, err := tls.Listen("tcp", address, &tls.Config{
+		GetCertificate:     m.GetCertificate,
+		GetConfigForClient: m.GetConfigForClient,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				conn.SetDeadline(time.Now().Add(10 * time.Second))
+				conn.(*tls.Conn).Handshake()
+			}(conn)
+		}
+	}()
+
+	cert, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: domain})
+	if err != nil {
+		t.Fatalf("failed to obtain a certificate: %v", err)
+	}
+	if got := names(t, cert); !slices.Contains(got, domain) {
+		t.Fatalf("certificate is for %v, want %s", got, domain)
+	}
+
+	// The second handshake is served from the manager's cache
+	again, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: domain})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(again.Certificate[0], cert.Certificate[0]) {
+		t.Fatal("second request issued another certificate")
+	}
+}
@@ -0,0 +1,116 @@
+// Package adminapi serves the versioned REST API that manages a proxy's backend registry.
+//
+// Both proxies expose the same schema under /api/v1:
+//
+//	GET    /api/v1/routes                                list routes
+//	GET    /api/v1/routes/{name}                         get a route
+//	PUT    /api/v1/routes/{name}                         replace all backends, and optionally the balancing, of a route
+//	DELETE /api/v1/routes/{name}                         delete a route
+//	GET    /api/v1/routes/{name}/backends                list the backends of a route
+//	POST   /api/v1/routes/{name}/backends                create a backend
+//	GET    /api/v1/routes/{name}/backends/{addr}         get a backend
+//	PUT    /api/v1/routes/{name}/backends/{addr}         create or replace a backend
+//	PATCH  /api/v1/routes/{name}/backends/{addr}         update the weight or metadata of a backend
+//	DELETE /api/v1/routes/{name}/backends/{addr}         delete a backend
+//
+// Names and addresses are single path segments, so slashes in them must be escaped as %2F.
+// Every route and backend carries an ETag; writes honor If-Match and If-None-Match so
+// concurrent clients don't overwrite each other's changes.
+package adminapi
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Bounds of a backend's weight; a weight of 0 keeps a backend registered without sending it traffic
+const (
+	DefaultWeight = 1
+	MaxWeight     = 1000
+)
+
+// Backend is one address of a route
+type Backend struct {
+	Address  string            `json:"address"`
+	Weight   int               `json:"weight"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// Route is a routing name and the backends serving it
+type Route struct {
+	Name      string    `json:"name"`
+	Balancing string    `json:"balancing,omitempty"` // Balancing policy; empty for the proxy's default
+	Backends  []Backend `json:"backends"`
+}
+
+// Registry is the backend registry of a proxy
+type Registry interface {
+	// Routes returns every route with at least one backend, sorted by name
+	Routes() []Route
+	// Route returns a route with its backends sorted by address
+	Route(name string) (Route, bool)
+	// SetBackend creates or replaces a backend, returning an error if the proxy can't use it or didn't persist it
+	SetBackend(route string, backend Backend) error
+	// SetBalancing sets the balancing policy of a route, "" for the default, returning an error if the policy is unknown
+	SetBalancing(route, policy string) error
+	// ReplaceRoute sets the backends of a route to exactly the ones given, and its balancing policy
+	// unless balancing is nil, deleting the route if there are none. Every backend and the policy are
+	// checked before anything changes, so the route is either replaced as a whole or left as it was.
+	ReplaceRoute(route string, backends []Backend, balancing *string) error
+	// RemoveBackend deletes a backend, reporting whether it existed
+	RemoveBackend(route, address string) (bool, error)
+	// RemoveRoute deletes a route and all its backends, reporting whether it existed
+	RemoveRoute(name string) (bool, error)
+}
+
+// ErrInvalidBalancing is wrapped by registry errors of unknown balancing policies
+var ErrInvalidBalancing = errors.New("invalid balancing policy")
+
+// ErrNotPersisted is wrapped by registry errors of changes that couldn't be written to the proxy's
+// registry log, and so weren't applied either. The API answers them with 500.
+var ErrNotPersisted = errors.New("change not persisted")
+
+// Validate checks the fields every proxy requires of a backend
+func (b Backend) Validate() error {
+	if b.Address == "" {
+		return fmt.Errorf("address is required")
+	}
+	if b.Weight < 0 || b.Weight > MaxWeight {
+		return fmt.Errorf("weight must be between 0 and %d", MaxWeight)
+	}
+	return nil
+}
+
+// SortBackends orders backends by address, the order in which registries return them
+func SortBackends(backends []Backend) {
+	slices.SortFunc(backends, func(a, b Backend) int {
+		return strings.Compare(a.Address, b.Address)
+	})
+}
+
+// etag is a strong entity tag over the JSON form of a value
+func etag(value any) string {
+	data, _ := json.Marshal(value) // Maps marshal with sorted keys, so equal values give equal tags
+	sum := sha256.Sum256(data)
+	return `"` + hex.EncodeToString(sum[:8]) + `"`
+}
+
+// matchesETag reports whether an If-Match or If-None-Match header value lists the current tag.
+// The current tag is empty when the resource doesn't exist.
+func matchesETag(header, current string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" && current != "" {
+			return true
+		}
+		if candidate == current && current != "" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,49 @@
+package adminapi
+
+import (
+	"net/http"
+	"time"
+)
+
+// ReloadStatus describes the configuration a proxy runs and the outcome of its last reload
+type ReloadStatus struct {
+	Path            string     `json:"path"`
+	Generation      int        `json:"generation"` // Incremented by every reload that applied changes
+	LastAttempt     *time.Time `json:"last_attempt,omitempty"`
+	LastSuccess     *time.Time `json:"last_success,omitempty"`
+	LastError       string     `json:"last_error,omitempty"`       // Of the last attempt, empty if it succeeded
+	Changes         []string   `json:"changes,omitempty"`          // What the last successful reload changed
+	RestartRequired []string   `json:"restart_required,omitempty"` // Sections changed on disk that only apply after a restart
+}
+
+// Reloader reloads a proxy's configuration file
+type Reloader interface {
+	ReloadStatus() ReloadStatus
+	// Reload applies the file as it is on disk, returning why it was rejected if it was
+	Reload() error
+}
+
+// HandleConfig adds the configuration endpoints:
+//
+//	GET    /api/v1/config            status of the configuration file and its last reload
+//	POST   /api/v1/config/reload     reload the configuration file now
+//
+// Reloading changes every route, so it requires a grant for all routes ("*").
+func (h *Handler) HandleConfig(reloader Reloader) {
+	h.mux.HandleFunc("GET /api/v1/config", func(w http.ResponseWriter, r *http.Request) {
+		if !h.authorize(w, r, "") {
+			return
+		}
+		writeJSON(w, r, http.StatusOK, reloader.ReloadStatus())
+	})
+	h.mux.HandleFunc("POST /api/v1/config/reload", func(w http.ResponseWriter, r *http.Request) {
+		if !h.authorize(w, r, "*") {
+			return
+		}
+		if err := reloader.Reload(); err != nil {
+			writeError(w, http.StatusUnprocessableEntity, CodeInvalidConfig, err.Error())
+			return
+		}
+		writeJSON(w, r, http.StatusOK, reloader.ReloadStatus())
+	})
+}
@@ -0,0 +1,496 @@
+package adminapi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"reverse-proxy/internal/apiauth"
+)
+
+// Largest request body the API accepts
+const maxBodySize = 1 << 20
+
+// Error codes of the API's JSON errors
+const (
+	CodeUnauthorized       = "unauthorized"
+	CodeForbidden          = "forbidden"
+	CodeNotFound           = "not_found"
+	CodeMethodNotAllowed   = "method_not_allowed"
+	CodeInvalidRequest     = "invalid_request"
+	CodeInvalidBackend     = "invalid_backend"
+	CodeConflict           = "conflict"
+	CodePreconditionFailed = "precondition_failed"
+	CodeInvalidConfig      = "invalid_config"
+	CodeNotPersisted       = "not_persisted"
+)
+
+// Error is the body of every error response, wrapped as {"error": {...}}
+type Error struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Handler serves the API for a registry
+type Handler struct {
+	registry Registry
+	auth     *apiauth.Authorizer
+	mux      *http.ServeMux
+
+	// Writes through the API are serialized, so a precondition holds until the write it guards is done
+	mu sync.Mutex
+}
+
+// NewHandler returns the API for a registry; mount it at /api/v1/. Callers only see and manage
+// the routes auth grants them; a nil auth leaves the API open.
+func NewHandler(registry Registry, auth *apiauth.Authorizer) *Handler {
+	h := &Handler{registry: registry, auth: auth, mux: http.NewServeMux()}
+
+	h.mux.HandleFunc("GET /api/v1/routes", h.listRoutes)
+	h.mux.HandleFunc("GET /api/v1/routes/{name}", h.getRoute)
+	h.mux.HandleFunc("PUT /api/v1/routes/{name}", h.replaceRoute)
+	h.mux.HandleFunc("DELETE /api/v1/routes/{name}", h.deleteRoute)
+	h.mux.HandleFunc("GET /api/v1/routes/{name}/backends", h.listBackends)
+	h.mux.HandleFunc("POST /api/v1/routes/{name}/backends", h.createBackend)
+	h.mux.HandleFunc("GET /api/v1/routes/{name}/backends/{addr}", h.getBackend)
+	h.mux.HandleFunc("PUT /api/v1/routes/{name}/backends/{addr}", h.putBackend)
+	h.mux.HandleFunc("PATCH /api/v1/routes/{name}/backends/{addr}", h.patchBackend)
+	h.mux.HandleFunc("DELETE /api/v1/routes/{name}/backends/{addr}", h.deleteBackend)
+	h.mux.HandleFunc("/", h.notFound)
+	return h
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+// notFound answers requests no pattern matched, telling a wrong method apart from a wrong path
+func (h *Handler) notFound(w http.ResponseWriter, r *http.Request) {
+	for _, method := range []string{http.MethodGet, http.MethodPut, http.MethodPost, http.MethodPatch, http.MethodDelete} {
+		probe := r.Clone(r.Context())
+		probe.Method = method
+		if _, pattern := h.mux.Handler(probe); pattern != "/" {
+			writeError(w, http.StatusMethodNotAllowed, CodeMethodNotAllowed, fmt.Sprintf("method %s is not allowed here", r.Method))
+			return
+		}
+	}
+	writeError(w, http.StatusNotFound, CodeNotFound, "no such endpoint")
+}
+
+func (h *Handler) listRoutes(w http.ResponseWriter, r *http.Request) {
+	if !h.authorize(w, r, "") {
+		return
+	}
+	routes := []Route{}
+	for _, route := range h.registry.Routes() {
+		if h.auth.Allowed(r, route.Name) {
+			routes = append(routes, route)
+		}
+	}
+	writeJSON(w, r, http.StatusOK, struct {
+		Routes []Route `json:"routes"`
+	}{routes})
+}
+
+func (h *Handler) getRoute(w http.ResponseWriter, r *http.Request) {
+	if !h.authorize(w, r, r.PathValue("name")) {
+		return
+	}
+	route, ok := h.registry.Route(r.PathValue("name"))
+	if !ok {
+		writeError(w, http.StatusNotFound, CodeNotFound, fmt.Sprintf("route %s not found", r.PathValue("name")))
+		return
+	}
+	writeJSON(w, r, http.StatusOK, route)
+}
+
+// replaceRoute sets the backends of a route to exactly the ones given, creating the route if needed
+func (h *Handler) replaceRoute(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if !h.authorize(w, r, name) {
+		return
+	}
+	var body struct {
+		Balancing *string          `json:"balancing"` // Left as it is when absent
+		Backends  []backendRequest `json:"backends"`
+	}
+	if !decodeBody(w, r, &body) {
+		return
+	}
+
+	desired := make(map[string]Backend, len(body.Backends))
+	order := make([]Backend, 0, len(body.Backends))
+	for i, request := range body.Backends {
+		backend := request.backend()
+		if err := backend.Validate(); err != nil {
+			writeError(w, http.StatusUnprocessableEntity, CodeInvalidBackend, fmt.Sprintf("backend %d: %v", i, err))
+			return
+		}
+		if _, ok := desired[backend.Address]; ok {
+			writeError(w, http.StatusUnprocessableEntity, CodeInvalidBackend, fmt.Sprintf("backend %s is listed twice", backend.Address))
+			return
+		}
+		desired[backend.Address] = backend
+		order = append(order, backend)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	current, existed := h.registry.Route(name)
+	if !h.checkPreconditions(w, r, routeETag(current, existed)) {
+		return
+	}
+	if err := h.registry.ReplaceRoute(name, order, body.Balancing); err != nil {
+		code := CodeInvalidBackend
+		if errors.Is(err, ErrInvalidBalancing) {
+			code = CodeInvalidRequest
+		}
+		writeRegistryError(w, err, code)
+		return
+	}
+	log.Printf("Admin API replaced route %s with %d backends", name, len(desired))
+
+	route, ok := h.registry.Route(name)
+	if !ok {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	status := http.StatusOK
+	if !existed {
+		status = http.StatusCreated
+	}
+	writeJSON(w, r, status, route)
+}
+
+func (h *Handler) deleteRoute(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if !h.authorize(w, r, name) {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	current, existed := h.registry.Route(name)
+	if !existed {
+		writeError(w, http.StatusNotFound, CodeNotFound, fmt.Sprintf("route %s not found", name))
+		return
+	}
+	if !h.checkPreconditions(w, r, routeETag(current, existed)) {
+		return
+	}
+	if _, err := h.registry.RemoveRoute(name); err != nil {
+		writeRegistryError(w, err, CodeInvalidRequest)
+		return
+	}
+	log.Printf("Admin API deleted route %s", name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) listBackends(w http.ResponseWriter, r *http.Request) {
+	if !h.authorize(w, r, r.PathValue("name")) {
+		return
+	}
+	route, ok := h.registry.Route(r.PathValue("name"))
+	if !ok {
+		writeError(w, http.StatusNotFound, CodeNotFound, fmt.Sprintf("route %s not found", r.PathValue("name")))
+		return
+	}
+	writeJSON(w, r, http.StatusOK, struct {
+		Backends []Backend `json:"backends"`
+	}{route.Backends})
+}
+
+func (h *Handler) createBackend(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if !h.authorize(w, r, name) {
+		return
+	}
+	var request backendRequest
+	if !decodeBody(w, r, &request) {
+		return
+	}
+	backend := request.backend()
+	if err := backend.Validate(); err != nil {
+		writeError(w, http.StatusUnprocessableEntity, CodeInvalidBackend, err.Error())
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.backend(name, backend.Address); ok {
+		writeError(w, http.StatusConflict, CodeConflict, fmt.Sprintf("backend %s already exists in route %s", backend.Address, name))
+		return
+	}
+	h.setBackend(w, r, name, backend, http.StatusCreated)
+}
+
+func (h *Handler) getBackend(w http.ResponseWriter, r *http.Request) {
+	if !h.authorize(w, r, r.PathValue("name")) {
+		return
+	}
+	backend, ok := h.backend(r.PathValue("name"), r.PathValue("addr"))
+	if !ok {
+		writeError(w, http.StatusNotFound, CodeNotFound, fmt.Sprintf("backend %s not found in route %s", r.PathValue("addr"), r.PathValue("name")))
+		return
+	}
+	writeJSON(w, r, http.StatusOK, backend)
+}
+
+// putBackend creates or replaces a backend; the address comes from the path
+func (h *Handler) putBackend(w http.ResponseWriter, r *http.Request) {
+	name, address := r.PathValue("name"), r.PathValue("addr")
+	if !h.authorize(w, r, name) {
+		return
+	}
+	var request backendRequest
+	if !decodeBody(w, r, &request) {
+		return
+	}
+	backend := request.backend()
+	if backend.Address != "" && backend.Address != address {
+		writeError(w, http.StatusUnprocessableEntity, CodeInvalidBackend, "address in the body differs from the path")
+		return
+	}
+	backend.Address = address
+	if err := backend.Validate(); err != nil {
+		writeError(w, http.StatusUnprocessableEntity, CodeInvalidBackend, err.Error())
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	current, existed := h.backend(name, address)
+	if !h.checkPreconditions(w, r, backendETag(current, existed)) {
+		return
+	}
+	status := http.StatusOK
+	if !existed {
+		status = http.StatusCreated
+	}
+	h.setBackend(w, r, name, backend, status)
+}
+
+// patchBackend updates only the fields present in the body; metadata keys set to null are removed
+func (h *Handler) patchBackend(w http.ResponseWriter, r *http.Request) {
+	name, address := r.PathValue("name"), r.PathValue("addr")
+	if !h.authorize(w, r, name) {
+		return
+	}
+	var patch struct {
+		Weight   *int               `json:"weight"`
+		Metadata map[string]*string `json:"metadata"`
+	}
+	if !decodeBody(w, r, &patch) {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	backend, ok := h.backend(name, address)
+	if !ok {
+		writeError(w, http.StatusNotFound, CodeNotFound, fmt.Sprintf("backend %s not found in route %s", address, name))
+		return
+	}
+	if !h.checkPreconditions(w, r, backendETag(backend, ok)) {
+		return
+	}
+
+	if patch.Weight != nil {
+		backend.Weight = *patch.Weight
+	}
+	if len(patch.Metadata) > 0 {
+		metadata := make(map[string]string, len(backend.Metadata)+len(patch.Metadata))
+		for key, value := range backend.Metadata {
+			metadata[key] = value
+		}
+		for key, value := range patch.Metadata {
+			if value == nil {
+				delete(metadata, key)
+			} else {
+				metadata[key] = *value
+			}
+		}
+		backend.Metadata = metadata
+	}
+	if err := backend.Validate(); err != nil {
+		writeError(w, http.StatusUnprocessableEntity, CodeInvalidBackend, err.Error())
+		return
+	}
+	h.setBackend(w, r, name, backend, http.StatusOK)
+}
+
+func (h *Handler) deleteBackend(w http.ResponseWriter, r *http.Request) {
+	name, address := r.PathValue("name"), r.PathValue("addr")
+	if !h.authorize(w, r, name) {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	current, ok := h.backend(name, address)
+	if !ok {
+		writeError(w, http.StatusNotFound, CodeNotFound, fmt.Sprintf("backend %s not found in route %s", address, name))
+		return
+	}
+	if !h.checkPreconditions(w, r, backendETag(current, ok)) {
+		return
+	}
+	if _, err := h.registry.RemoveBackend(name, address); err != nil {
+		writeRegistryError(w, err, CodeInvalidBackend)
+		return
+	}
+	log.Printf("Admin API deleted backend %s from route %s", address, name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// authorize answers 401 or 403 unless the caller may manage the route
+func (h *Handler) authorize(w http.ResponseWriter, r *http.Request, route string) bool {
+	err := h.auth.Authorize(r, route)
+	if err == nil {
+		return true
+	}
+	status := apiauth.Status(err)
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeError(w, status, CodeUnauthorized, err.Error())
+	} else {
+		writeError(w, status, CodeForbidden, err.Error())
+	}
+	return false
+}
+
+// setBackend stores a backend and answers with its new representation
+func (h *Handler) setBackend(w http.ResponseWriter, r *http.Request, route string, backend Backend, status int) {
+	if err := h.registry.SetBackend(route, backend); err != nil {
+		writeRegistryError(w, err, CodeInvalidBackend)
+		return
+	}
+	log.Printf("Admin API set backend %s in route %s (weight %d)", backend.Address, route, backend.Weight)
+
+	stored, ok := h.backend(route, backend.Address)
+	if !ok {
+		stored = backend
+	}
+	if status == http.StatusCreated {
+		w.Header().Set("Location", "/api/v1/routes/"+url.PathEscape(route)+"/backends/"+url.PathEscape(backend.Address))
+	}
+	writeJSON(w, r, status, stored)
+}
+
+func (h *Handler) backend(route, address string) (Backend, bool) {
+	current, ok := h.registry.Route(route)
+	if !ok {
+		return Backend{}, false
+	}
+	for _, backend := range current.Backends {
+		if backend.Address == address {
+			return backend, true
+		}
+	}
+	return Backend{}, false
+}
+
+// checkPreconditions evaluates If-Match and If-None-Match against the current tag of the resource,
+// which is empty if it doesn't exist, and answers 412 when they fail
+func (h *Handler) checkPreconditions(w http.ResponseWriter, r *http.Request, current string) bool {
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" && !matchesETag(ifMatch, current) {
+		writeError(w, http.StatusPreconditionFailed, CodePreconditionFailed, "resource has changed; fetch it again and retry")
+		return false
+	}
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" && matchesETag(ifNoneMatch, current) {
+		writeError(w, http.StatusPreconditionFailed, CodePreconditionFailed, "resource already exists")
+		return false
+	}
+	return true
+}
+
+func routeETag(route Route, ok bool) string {
+	if !ok {
+		return ""
+	}
+	return etag(route)
+}
+
+func backendETag(backend Backend, ok bool) string {
+	if !ok {
+		return ""
+	}
+	return etag(backend)
+}
+
+// backendRequest is a backend as clients send it, with the weight defaulting when omitted
+type backendRequest struct {
+	Address  string            `json:"address"`
+	Weight   *int              `json:"weight"`
+	Metadata map[string]string `json:"metadata"`
+}
+
+func (b backendRequest) backend() Backend {
+	backend := Backend{Address: b.Address, Weight: DefaultWeight, Metadata: b.Metadata}
+	if b.Weight != nil {
+		backend.Weight = *b.Weight
+	}
+	return backend
+}
+
+// decodeBody parses a JSON request body strictly and answers 400 if it can't
+func decodeBody(w http.ResponseWriter, r *http.Request, value any) bool {
+	decoder := json.NewDecoder(io.LimitReader(r.Body, maxBodySize))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(value); err != nil {
+		var syntaxErr *json.SyntaxError
+		message := fmt.Sprintf("invalid JSON body: %v", err)
+		if errors.As(err, &syntaxErr) || errors.Is(err, io.EOF) {
+			message = "request body must be a JSON object"
+		}
+		writeError(w, http.StatusBadRequest, CodeInvalidRequest, message)
+		return false
+	}
+	return true
+}
+
+// writeJSON answers with a value and its ETag, or 304 if the client already holds it
+func writeJSON(w http.ResponseWriter, r *http.Request, status int, value any) {
+	tag := etag(value)
+	w.Header().Set("ETag", tag)
+	if r.Method == http.MethodGet && matchesETag(r.Header.Get("If-None-Match"), tag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(value); err != nil {
+		log.Printf("Failed to write admin API response: %v", err)
+	}
+}
+
+// writeRegistryError answers a registry error: 500 for a change that wasn't persisted, otherwise 422 with code
+func writeRegistryError(w http.ResponseWriter, err error, code string) {
+	if errors.Is(err, ErrNotPersisted) {
+		writeError(w, http.StatusInternalServerError, CodeNotPersisted, err.Error())
+		return
+	}
+	writeError(w, http.StatusUnprocessableEntity, code, err.Error())
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(struct {
+		Error Error `json:"error"`
+	}{Error{Code: code, Message: message}})
+}
@@ -0,0 +1,273 @@
+// Package apiauth authenticates callers of the registration and admin APIs and scopes them to route names.
+//
+// Callers present a bearer token or, when the API is served over TLS, a client certificate.
+// Each grant lists the route-name patterns its holder may manage: an exact name such as
+// "api.example.com", a wildcard such as "*.example.com" covering every subdomain, or "*" for all routes.
+package apiauth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Errors returned by Authorize
+var (
+	ErrUnauthenticated = errors.New("authentication required")
+	ErrForbidden       = errors.New("not allowed to manage this route")
+)
+
+// Policy lists who may use the APIs. Each token grant needs Token or TokenFile.
+type Policy struct {
+	Tokens       []TokenGrant  `json:"tokens" yaml:"tokens"`
+	Clients      []ClientGrant `json:"clients" yaml:"clients"`
+	ClientCAFile string        `json:"client_ca_file" yaml:"client_ca_file"` // CAs issuing the certificates of Clients
+	CertFile     string        `json:"cert_file" yaml:"cert_file"`           // Server certificate; the APIs are served over TLS when set
+	KeyFile      string        `json:"key_file" yaml:"key_file"`             // Private key of CertFile
+}
+
+// TokenGrant lets the holder of a bearer token manage routes
+type TokenGrant struct {
+	Name      string   `json:"name" yaml:"name"`             // Who holds the token, for audit logs
+	Token     string   `json:"token" yaml:"token"`           // The token itself
+	TokenFile string   `json:"token_file" yaml:"token_file"` // Or: file holding the token, so it stays out of the configuration
+	Routes    []string `json:"routes" yaml:"routes"`         // Route-name patterns the token may manage
+}
+
+// ClientGrant lets the holder of a client certificate manage routes
+type ClientGrant struct {
+	Identity string   `json:"identity" yaml:"identity"` // Common name, DNS, email or URI SAN, or hex SHA-256 fingerprint of the certificate
+	Routes   []string `json:"routes" yaml:"routes"`
+}
+
+// Authorizer enforces a loaded Policy
+type Authorizer struct {
+	tokens    []token
+	clients   []ClientGrant
+	tlsConfig *tls.Config
+}
+
+type token struct {
+	name   string
+	digest [sha256.Size]byte
+	routes []string
+}
+
+// principal is an authenticated caller
+type principal struct {
+	name   string
+	routes []string
+}
+
+// Load reads the tokens, client CAs and server certificate of a policy
+func Load(policy Policy) (*Authorizer, error) {
+	a := &Authorizer{clients: policy.Clients}
+
+	for i, grant := range policy.Tokens {
+		value := grant.Token
+		if grant.TokenFile != "" {
+			data, err := os.ReadFile(grant.TokenFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read token file: %w", err)
+			}
+			value = strings.TrimSpace(string(data))
+		}
+		if value == "" {
+			return nil, fmt.Errorf("token %d (%s) is empty", i, grant.Name)
+		}
+		if err := checkPatterns(grant.Routes); err != nil {
+			return nil, fmt.Errorf("token %s: %w", grant.Name, err)
+		}
+		name := grant.Name
+		if name == "" {
+			name = fmt.Sprintf("token %d", i)
+		}
+		a.tokens = append(a.tokens, token{name: name, digest: sha256.Sum256([]byte(value)), routes: grant.Routes})
+	}
+
+	for _, grant := range policy.Clients {
+		if grant.Identity == "" {
+			return nil, fmt.Errorf("client grant without identity")
+		}
+		if err := checkPatterns(grant.Routes); err != nil {
+			return nil, fmt.Errorf("client %s: %w", grant.Identity, err)
+		}
+	}
+
+	if policy.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(policy.CertFile, policy.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load API server certificate: %w", err)
+		}
+		a.tlsConfig = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		}
+	}
+	if policy.ClientCAFile != "" {
+		if a.tlsConfig == nil {
+			return nil, fmt.Errorf("client certificates require cert_file and key_file")
+		}
+		roots, err := loadCAs(policy.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		// Token holders connect without a certificate
+		a.tlsConfig.ClientCAs = roots
+		a.tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	} else if len(policy.Clients) > 0 {
+		return nil, fmt.Errorf("client grants require client_ca_file")
+	}
+
+	return a, nil
+}
+
+func loadCAs(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read API client CA bundle: %w", err)
+	}
+	roots := x509.NewCertPool()
+	found := false
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		ca, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse API client CA: %w", err)
+		}
+		roots.AddCert(ca)
+		found = true
+	}
+	if !found {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return roots, nil
+}
+
+func checkPatterns(patterns []string) error {
+	if len(patterns) == 0 {
+		return fmt.Errorf("no route patterns")
+	}
+	for _, pattern := range patterns {
+		if pattern == "" || (strings.Contains(pattern, "*") && pattern != "*" && !strings.HasPrefix(pattern, "*.")) {
+			return fmt.Errorf("invalid route pattern %q", pattern)
+		}
+	}
+	return nil
+}
+
+// TLSConfig returns the server configuration for serving the APIs, or nil to serve them in plain HTTP
+func (a *Authorizer) TLSConfig() *tls.Config {
+	if a == nil {
+		return nil
+	}
+	return a.tlsConfig
+}
+
+// Authorize checks that a request may manage a route, audit-logging it if not.
+// An empty route only requires the caller to be authenticated. A nil Authorizer allows everything.
+func (a *Authorizer) Authorize(r *http.Request, route string) error {
+	if a == nil {
+		return nil
+	}
+
+	caller, err := a.authenticate(r)
+	if err == nil && route != "" && !caller.allows(route) {
+		err = ErrForbidden
+	}
+	if err != nil {
+		name := "anonymous"
+		if caller != nil {
+			name = caller.name
+		}
+		log.Printf("Audit: rejected %s %s from %s as %s for route %q: %v", r.Method, r.URL.Path, r.RemoteAddr, name, route, err)
+	}
+	return err
+}
+
+// Allowed reports whether a request may see a route, without audit-logging; used to filter listings
+func (a *Authorizer) Allowed(r *http.Request, route string) bool {
+	if a == nil {
+		return true
+	}
+	caller, err := a.authenticate(r)
+	return err == nil && caller.allows(route)
+}
+
+// Status returns the HTTP status for an Authorize error
+func Status(err error) int {
+	if errors.Is(err, ErrUnauthenticated) {
+		return http.StatusUnauthorized
+	}
+	return http.StatusForbidden
+}
+
+func (a *Authorizer) authenticate(r *http.Request) (*principal, error) {
+	if header := r.Header.Get("Authorization"); header != "" {
+		scheme, value, _ := strings.Cut(header, " ")
+		if !strings.EqualFold(scheme, "Bearer") || value == "" {
+			return nil, ErrUnauthenticated
+		}
+		digest := sha256.Sum256([]byte(strings.TrimSpace(value)))
+		for _, t := range a.tokens {
+			if subtle.ConstantTimeCompare(digest[:], t.digest[:]) == 1 {
+				return &principal{name: t.name, routes: t.routes}, nil
+			}
+		}
+		return nil, fmt.Errorf("%w: unknown token", ErrUnauthenticated)
+	}
+
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 && len(r.TLS.VerifiedChains[0]) > 0 {
+		leaf := r.TLS.VerifiedChains[0][0]
+		names := identities(leaf)
+		for _, grant := range a.clients {
+			for _, name := range names {
+				if strings.EqualFold(grant.Identity, name) {
+					return &principal{name: "certificate " + leaf.Subject.CommonName, routes: grant.Routes}, nil
+				}
+			}
+		}
+		return &principal{name: "certificate " + leaf.Subject.CommonName}, ErrForbidden
+	}
+
+	return nil, ErrUnauthenticated
+}
+
+// identities returns every name a client certificate may be granted under
+func identities(leaf *x509.Certificate) []string {
+	fingerprint := sha256.Sum256(leaf.Raw)
+	names := []string{leaf.Subject.CommonName, hex.EncodeToString(fingerprint[:])}
+	names = append(names, leaf.DNSNames...)
+	names = append(names, leaf.EmailAddresses...)
+	for _, uri := range leaf.URIs {
+		names = append(names, uri.String())
+	}
+	return names
+}
+
+// allows matches a route against the caller's patterns. HTTP routes named "host/path" match by host.
+func (p *principal) allows(route string) bool {
+	route = strings.ToLower(route)
+	host, _, _ := strings.Cut(route, "/")
+	for _, pattern := range p.routes {
+		pattern = strings.ToLower(pattern)
+		switch {
+		case pattern == "*", pattern == route, pattern == host:
+			return true
+		case strings.HasPrefix(pattern, "*.") && strings.HasSuffix(host, pattern[1:]):
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,198 @@
+// Package balancer implements the policies that choose a backend of a route.
+//
+// Each route owns one Balancer. The routing table tells it which backends the route has;
+// the proxy asks it for a backend per connection or request and reports how that went, which
+// the adaptive policies use to steer traffic.
+package balancer
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"reverse-proxy/internal/adminapi"
+)
+
+// Policy names
+const (
+	RoundRobin       = "round_robin"       // Rotate through the backends in address order, one pick each
+	Weighted         = "weighted"          // Round-robin giving each backend as many picks per cycle as its weight
+	Random           = "random"            // Uniformly random backend
+	LeastConnections = "least_connections" // Fewest picks in progress relative to weight
+	Hash             = "hash"              // Same backend for the same key (client address) while the backends don't change
+	P2CEWMA          = "p2c_ewma"          // Better of two random backends by latency average and load
+)
+
+// Default is the policy of routes that don't choose one
+const Default = Weighted
+
+// Policies lists every policy name
+var Policies = []string{RoundRobin, Weighted, Random, LeastConnections, Hash, P2CEWMA}
+
+// Balancer picks backends for one route. Every method is safe for concurrent use.
+type Balancer interface {
+	// Pick chooses a backend; key identifies the client for policies that keep clients on one backend.
+	// It reports false if no backend has a weight above zero.
+	Pick(key string) (string, bool)
+	// Add adds a backend or updates its weight
+	Add(backend adminapi.Backend)
+	// Remove drops a backend
+	Remove(address string)
+	// Report ends a pick: how long the connection or request took and whether it failed
+	Report(address string, latency time.Duration, err error)
+}
+
+// Valid checks a policy name; empty selects Default
+func Valid(policy string) error {
+	if policy == "" || slices.Contains(Policies, policy) {
+		return nil
+	}
+	return fmt.Errorf("unknown balancing policy %q (want one of %v)", policy, Policies)
+}
+
+// New returns an empty balancer for a policy; empty selects Default
+func New(policy string) (Balancer, error) {
+	switch policy {
+	case RoundRobin:
+		return &roundRobin{}, nil
+	case "", Weighted:
+		return &weighted{}, nil
+	case Random:
+		return &random{}, nil
+	case LeastConnections:
+		return &leastConnections{}, nil
+	case Hash:
+		return &hash{}, nil
+	case P2CEWMA:
+		return &p2cEWMA{}, nil
+	}
+	return nil, Valid(policy)
+}
+
+// Penalty counted as the latency of a failed pick by adaptive policies
+const failurePenalty = time.Second
+
+// How quickly latency averages forget old samples
+const ewmaDecay = 10 * time.Second
+
+// backend is an immutable backend entry; its statistics are shared by every entry of the address
+type backend struct {
+	address string
+	weight  uint64
+	*stats
+}
+
+// stats are what adaptive policies know about a backend
+type stats struct {
+	active atomic.Int64 // Picks not reported yet
+
+	mu      sync.Mutex // Serializes updates of the average
+	ewma    atomic.Uint64
+	updated time.Time
+}
+
+func (s *stats) latency() float64 {
+	return math.Float64frombits(s.ewma.Load())
+}
+
+// observe folds a sample into the latency average, weighing old samples down by their age.
+// The average is peak-sensitive: a slower sample replaces it at once, so a backend that
+// slows down or fails is avoided immediately and only regains traffic as it recovers.
+func (s *stats) observe(latency time.Duration, err error) {
+	if err != nil && latency < failurePenalty {
+		latency = failurePenalty
+	}
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sample := float64(latency)
+	if !s.updated.IsZero() && sample < s.latency() {
+		keep := math.Exp(-float64(now.Sub(s.updated)) / float64(ewmaDecay))
+		sample = s.latency()*keep + sample*(1-keep)
+	}
+	s.ewma.Store(math.Float64bits(sample))
+	s.updated = now
+}
+
+// release ends a pick of the backend
+func (s *stats) release() {
+	if s.active.Add(-1) < 0 {
+		s.active.Add(1) // Reported to a balancer that didn't make the pick, after a policy change
+	}
+}
+
+// pool is the backend set every policy builds on. Writers replace the set; readers load it without locking.
+type pool struct {
+	mu       sync.Mutex
+	all      map[string]*backend
+	sorted   atomic.Pointer[[]*backend] // Every backend, sorted by address
+	eligible atomic.Pointer[[]*backend] // Backends with a weight above zero, sorted by address
+}
+
+func (p *pool) Add(b adminapi.Backend) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.all == nil {
+		p.all = make(map[string]*backend)
+	}
+	// Statistics outlive weight changes
+	s := &stats{}
+	if existing, ok := p.all[b.Address]; ok {
+		s = existing.stats
+	}
+	p.all[b.Address] = &backend{address: b.Address, weight: uint64(b.Weight), stats: s}
+	p.publish()
+}
+
+func (p *pool) Remove(address string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.all, address)
+	p.publish()
+}
+
+func (p *pool) publish() {
+	sorted := make([]*backend, 0, len(p.all))
+	for _, b := range p.all {
+		sorted = append(sorted, b)
+	}
+	slices.SortFunc(sorted, func(a, b *backend) int {
+		return strings.Compare(a.address, b.address)
+	})
+	eligible := slices.DeleteFunc(slices.Clone(sorted), func(b *backend) bool {
+		return b.weight == 0
+	})
+	p.sorted.Store(&sorted)
+	p.eligible.Store(&eligible)
+}
+
+func (p *pool) backends() []*backend {
+	if eligible := p.eligible.Load(); eligible != nil {
+		return *eligible
+	}
+	return nil
+}
+
+// lookup finds the backend of a reported pick, which may have lost its weight since
+func (p *pool) lookup(address string) *backend {
+	sorted := p.sorted.Load()
+	if sorted == nil {
+		return nil
+	}
+	backends := *sorted
+	i, ok := slices.BinarySearchFunc(backends, address, func(b *backend, address string) int {
+		return strings.Compare(b.address, address)
+	})
+	if !ok {
+		return nil
+	}
+	return backends[i]
+}
+
+// Report does nothing for policies that don't adapt to outcomes
+func (p *pool) Report(string, time.Duration, error) {}
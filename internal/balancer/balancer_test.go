@@ -0,0 +1,242 @@
+package balancer
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"reverse-proxy/internal/adminapi"
+)
+
+// newBalancer returns a balancer of a policy holding the backends, by address and weight
+func newBalancer(t *testing.T, policy string, backends map[string]int) Balancer {
+	t.Helper()
+	b, err := New(policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for address, weight := range backends {
+		b.Add(adminapi.Backend{Address: address, Weight: weight})
+	}
+	return b
+}
+
+// picks counts the backends n picks went to, reporting each pick at once
+func picks(t *testing.T, b Balancer, n int, key func(i int) string) map[string]int {
+	t.Helper()
+	counts := make(map[string]int)
+	for i := 0; i < n; i++ {
+		address, ok := b.Pick(key(i))
+		if !ok {
+			t.Fatalf("pick %d found no backend", i)
+		}
+		b.Report(address, time.Millisecond, nil)
+		counts[address]++
+	}
+	return counts
+}
+
+func sameKey(int) string { return "" }
+
+func clientKey(i int) string { return fmt.Sprintf("10.1.%d.%d", i/256, i%256) }
+
+func TestValid(t *testing.T) {
+	for _, policy := range append([]string{""}, Policies...) {
+		if err := Valid(policy); err != nil {
+			t.Errorf("Valid(%q) = %v", policy, err)
+		}
+		if _, err := New(policy); err != nil {
+			t.Errorf("New(%q) = %v", policy, err)
+		}
+	}
+	if err := Valid("fastest"); err == nil {
+		t.Error("unknown policy accepted")
+	}
+	if _, err := New("fastest"); err == nil {
+		t.Error("balancer made for an unknown policy")
+	}
+}
+
+func TestZeroWeightExcluded(t *testing.T) {
+	for _, policy := range Policies {
+		t.Run(policy, func(t *testing.T) {
+			b := newBalancer(t, policy, nil)
+			if _, ok := b.Pick("client"); ok {
+				t.Fatal("picked from an empty balancer")
+			}
+			b.Add(adminapi.Backend{Address: "10.0.0.1:443", Weight: 0})
+			if _, ok := b.Pick("client"); ok {
+				t.Fatal("picked a backend with weight zero")
+			}
+
+			b.Add(adminapi.Backend{Address: "10.0.0.2:443", Weight: 1})
+			if counts := picks(t, b, 50, clientKey); counts["10.0.0.2:443"] != 50 {
+				t.Fatalf("picks = %v, want all on 10.0.0.2:443", counts)
+			}
+
+			// Draining a backend takes it out of rotation; removing the last one empties the balancer
+			b.Add(adminapi.Backend{Address: "10.0.0.2:443", Weight: 0})
+			if _, ok := b.Pick("client"); ok {
+				t.Fatal("picked a drained backend")
+			}
+			b.Remove("10.0.0.1:443")
+			b.Remove("10.0.0.2:443")
+			if _, ok := b.Pick("client"); ok {
+				t.Fatal("picked a removed backend")
+			}
+		})
+	}
+}
+
+func TestDistribution(t *testing.T) {
+	backends := map[string]int{"10.0.0.1:443": 1, "10.0.0.2:443": 3}
+
+	// Deterministic policies split a whole number of cycles exactly
+	for policy, want := range map[string]map[string]int{
+		Weighted:   {"10.0.0.1:443": 100, "10.0.0.2:443": 300},
+		RoundRobin: {"10.0.0.1:443": 200, "10.0.0.2:443": 200},
+	} {
+		counts := picks(t, newBalancer(t, policy, backends), 400, sameKey)
+		for address, n := range want {
+			if counts[address] != n {
+				t.Errorf("%s: %s got %d picks, want %d", policy, address, counts[address], n)
+			}
+		}
+	}
+
+	// Weighted cycles give each backend its picks in a row, in address order
+	b := newBalancer(t, Weighted, backends)
+	for i, want := range []string{"10.0.0.1:443", "10.0.0.2:443", "10.0.0.2:443", "10.0.0.2:443", "10.0.0.1:443"} {
+		if got, _ := b.Pick(""); got != want {
+			t.Fatalf("weighted pick %d = %s, want %s", i, got, want)
+		}
+	}
+
+	// Random ignores weights; hash gives each backend its weight's share of the keys
+	within := func(policy, address string, got, want int) {
+		t.Helper()
+		if got < want*85/100 || got > want*115/100 {
+			t.Errorf("%s: %s got %d picks, want about %d", policy, address, got, want)
+		}
+	}
+	counts := picks(t, newBalancer(t, Random, backends), 4000, sameKey)
+	within(Random, "10.0.0.1:443", counts["10.0.0.1:443"], 2000)
+	within(Random, "10.0.0.2:443", counts["10.0.0.2:443"], 2000)
+	counts = picks(t, newBalancer(t, Hash, backends), 4000, clientKey)
+	within(Hash, "10.0.0.1:443", counts["10.0.0.1:443"], 1000)
+	within(Hash, "10.0.0.2:443", counts["10.0.0.2:443"], 3000)
+}
+
+func TestHashStableAcrossChurn(t *testing.T) {
+	b := newBalancer(t, Hash, map[string]int{"10.0.0.1:443": 1, "10.0.0.2:443": 1, "10.0.0.3:443": 1})
+	assign := func() map[string]string {
+		assigned := make(map[string]string)
+		for i := 0; i < 3000; i++ {
+			address, _ := b.Pick(clientKey(i))
+			assigned[clientKey(i)] = address
+		}
+		return assigned
+	}
+	before := assign()
+	if again := assign(); fmt.Sprint(again) != fmt.Sprint(before) {
+		t.Fatal("the same keys went to other backends without any change")
+	}
+
+	// A new backend only takes keys over; none move between the others
+	b.Add(adminapi.Backend{Address: "10.0.0.4:443", Weight: 1})
+	added := assign()
+	moved := 0
+	for key, address := range added {
+		if address != before[key] {
+			if address != "10.0.0.4:443" {
+				t.Fatalf("key %s moved from %s to %s", key, before[key], address)
+			}
+			moved++
+		}
+	}
+	if moved < 500 || moved > 1000 {
+		t.Errorf("%d of 3000 keys moved to the new backend, want about 750", moved)
+	}
+
+	// A removed backend's keys spread over the others; everyone else's stay
+	b.Remove("10.0.0.2:443")
+	for key, address := range assign() {
+		if added[key] != "10.0.0.2:443" && address != added[key] {
+			t.Fatalf("key %s moved from %s to %s", key, added[key], address)
+		}
+	}
+
+	// Lowering a weight only moves keys away from that backend
+	b.Add(adminapi.Backend{Address: "10.0.0.1:443", Weight: 3})
+	removed := assign()
+	b.Add(adminapi.Backend{Address: "10.0.0.1:443", Weight: 1})
+	for key, address := range assign() {
+		if address != removed[key] && removed[key] != "10.0.0.1:443" {
+			t.Fatalf("lowering a weight moved key %s from %s to %s", key, removed[key], address)
+		}
+	}
+}
+
+func TestLeastConnectionsAccounting(t *testing.T) {
+	b := newBalancer(t, LeastConnections, map[string]int{"10.0.0.1:443": 1, "10.0.0.2:443": 3})
+
+	// Picks in progress count against a backend relative to its weight
+	open := make(map[string]int)
+	for i := 0; i < 8; i++ {
+		address, _ := b.Pick("")
+		open[address]++
+	}
+	if open["10.0.0.1:443"] != 2 || open["10.0.0.2:443"] != 6 {
+		t.Fatalf("open picks = %v, want 2 and 6", open)
+	}
+
+	// Reports end picks, so the backend they free up is picked next
+	for i := 0; i < 3; i++ {
+		b.Report("10.0.0.2:443", time.Millisecond, nil)
+	}
+	for i := 0; i < 3; i++ {
+		if got, _ := b.Pick(""); got != "10.0.0.2:443" {
+			t.Fatalf("pick %d after reports went to %s", i, got)
+		}
+	}
+
+	// Failures end picks too, and reports of unknown backends or without a pick change nothing
+	b.Report("10.0.0.9:443", time.Millisecond, nil)
+	for i := 0; i < 10; i++ {
+		b.Report("10.0.0.1:443", time.Millisecond, fmt.Errorf("refused"))
+	}
+	if got, _ := b.Pick(""); got != "10.0.0.1:443" {
+		t.Fatalf("pick after 10.0.0.1:443 went idle went to %s", got)
+	}
+	if got, _ := b.Pick(""); got != "10.0.0.1:443" {
+		t.Fatalf("surplus reports left 10.0.0.1:443 with a negative count; second pick went to %s", got)
+	}
+	if got, _ := b.Pick(""); got != "10.0.0.2:443" {
+		t.Fatalf("third pick went to %s, want 10.0.0.2:443 at 2 of 3 picks per weight", got)
+	}
+}
+
+func TestP2CEWMAAvoidsSlowBackends(t *testing.T) {
+	b := newBalancer(t, P2CEWMA, map[string]int{"10.0.0.1:443": 1, "10.0.0.2:443": 1})
+	b.Pick("")
+	b.Pick("")
+	b.Report("10.0.0.1:443", 100*time.Millisecond, nil)
+	b.Report("10.0.0.2:443", time.Millisecond, nil)
+
+	// With two backends both are always sampled, so the cheaper one wins until its load adds up
+	for i := 0; i < 10; i++ {
+		if got, _ := b.Pick(""); got != "10.0.0.2:443" {
+			t.Fatalf("pick %d went to the slow backend", i)
+		}
+	}
+
+	// A failure counts as a slow pick
+	for i := 0; i < 10; i++ {
+		b.Report("10.0.0.2:443", time.Millisecond, nil)
+	}
+	b.Pick("")
+	b.Report("10.0.0.2:443", time.Millisecond, fmt.Errorf("reset"))
+	if got, _ := b.Pick(""); got != "10.0.0.1:443" {
+		t.Fatalf("pick after a failure went to %s", got)
+	}
+}
@@ -0,0 +1,179 @@
+package balancer
+
+import (
+	"math"
+	"math/rand/v2"
+	"sync/atomic"
+	"time"
+)
+
+// roundRobin gives every backend with a weight above zero one pick per cycle
+type roundRobin struct {
+	pool
+	next atomic.Uint64
+}
+
+func (b *roundRobin) Pick(string) (string, bool) {
+	backends := b.backends()
+	if len(backends) == 0 {
+		return "", false
+	}
+	return backends[(b.next.Add(1)-1)%uint64(len(backends))].address, true
+}
+
+// weighted gives every backend as many consecutive picks per cycle as its weight
+type weighted struct {
+	pool
+	next atomic.Uint64
+}
+
+func (b *weighted) Pick(string) (string, bool) {
+	backends := b.backends()
+	var total uint64
+	for _, backend := range backends {
+		total += backend.weight
+	}
+	if total == 0 {
+		return "", false
+	}
+
+	// Select the backend whose share of the cycle holds the position
+	index := (b.next.Add(1) - 1) % total
+	for _, backend := range backends {
+		if index < backend.weight {
+			return backend.address, true
+		}
+		index -= backend.weight
+	}
+	return "", false
+}
+
+// random picks uniformly, ignoring weights other than zero
+type random struct {
+	pool
+}
+
+func (b *random) Pick(string) (string, bool) {
+	backends := b.backends()
+	if len(backends) == 0 {
+		return "", false
+	}
+	return backends[rand.IntN(len(backends))].address, true
+}
+
+// leastConnections picks the backend with the fewest unreported picks per unit of weight,
+// rotating the starting point so ties are shared
+type leastConnections struct {
+	pool
+	next atomic.Uint64
+}
+
+func (b *leastConnections) Pick(string) (string, bool) {
+	backends := b.backends()
+	if len(backends) == 0 {
+		return "", false
+	}
+
+	start := int((b.next.Add(1) - 1) % uint64(len(backends)))
+	best := backends[start]
+	for i := 1; i < len(backends); i++ {
+		candidate := backends[(start+i)%len(backends)]
+		// Compare active/weight without dividing
+		if uint64(candidate.active.Load())*best.weight < uint64(best.active.Load())*candidate.weight {
+			best = candidate
+		}
+	}
+	best.active.Add(1)
+	return best.address, true
+}
+
+func (b *leastConnections) Report(address string, _ time.Duration, _ error) {
+	if backend := b.lookup(address); backend != nil {
+		backend.release()
+	}
+}
+
+// hash keeps a key on one backend with weighted rendezvous hashing: adding or removing a
+// backend only moves the keys that belong to it
+type hash struct {
+	pool
+}
+
+func (b *hash) Pick(key string) (string, bool) {
+	backends := b.backends()
+	if len(backends) == 0 {
+		return "", false
+	}
+
+	var best *backend
+	var bestScore float64
+	for _, backend := range backends {
+		score := rendezvousScore(key, backend.address, backend.weight)
+		if best == nil || score > bestScore {
+			best, bestScore = backend, score
+		}
+	}
+	return best.address, true
+}
+
+// rendezvousScore ranks a backend for a key; weights scale the share of keys a backend wins
+func rendezvousScore(key, address string, weight uint64) float64 {
+	// FNV-1a over key, a separator and address, then a finalizer to spread the bits
+	h := uint64(14695981039346656037)
+	for i := 0; i < len(key); i++ {
+		h = (h ^ uint64(key[i])) * 1099511628211
+	}
+	h = (h ^ 0xff) * 1099511628211
+	for i := 0; i < len(address); i++ {
+		h = (h ^ uint64(address[i])) * 1099511628211
+	}
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+
+	// Map to (0, 1) and take -weight/ln(u), which gives each backend weight/total of the keys
+	u := (float64(h>>11) + 0.5) / (1 << 53)
+	return -float64(weight) / math.Log(u)
+}
+
+// p2cEWMA samples two backends and picks the one with the lower expected cost: the average
+// latency of its recent picks, times the picks still in progress
+type p2cEWMA struct {
+	pool
+}
+
+func (b *p2cEWMA) Pick(string) (string, bool) {
+	backends := b.backends()
+	switch len(backends) {
+	case 0:
+		return "", false
+	case 1:
+		backends[0].active.Add(1)
+		return backends[0].address, true
+	}
+
+	i := rand.IntN(len(backends))
+	j := rand.IntN(len(backends) - 1)
+	if j >= i {
+		j++
+	}
+	best := backends[i]
+	if cost(backends[j]) < cost(best) {
+		best = backends[j]
+	}
+	best.active.Add(1)
+	return best.address, true
+}
+
+func (b *p2cEWMA) Report(address string, latency time.Duration, err error) {
+	if backend := b.lookup(address); backend != nil {
+		backend.observe(latency, err)
+		backend.release()
+	}
+}
+
+// cost of sending one more pick to a backend. Backends without samples yet cost nothing,
+// so new backends get tried; weights divide the cost.
+func cost(b *backend) float64 {
+	return b.latency() * float64(b.active.Load()+1) / float64(b.weight)
+}
@@ -0,0 +1,286 @@
+// Package certstore serves TLS certificates by SNI from a directory of cert/key pairs.
+package certstore
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Pair is an explicit certificate and private key file
+type Pair struct {
+	CertFile string
+	KeyFile  string
+}
+
+// snapshot is an immutable index of the loaded certificates
+type snapshot struct {
+	exact    map[string]*entry // Keyed by lowercase DNS name
+	wildcard map[string]*entry // Keyed by the parent domain of a *.domain name
+	fallback *entry            // Served when no name matches
+	entries  []*entry          // Every loaded certificate once, in load order
+	state    string            // Fingerprint of the files the snapshot was loaded from
+}
+
+// entry is a loaded certificate. The served copy is replaced whenever its OCSP staple changes.
+type entry struct {
+	name   string // First name on the certificate, for logs and metrics
+	leaf   *x509.Certificate
+	cert   *tls.Certificate                // As loaded, without a staple
+	served atomic.Pointer[tls.Certificate] // Handed to handshakes
+	staple atomic.Pointer[staple]          // Current OCSP response, nil if none
+}
+
+// Store holds the certificates for every SNI the proxy terminates
+type Store struct {
+	dir     string
+	pairs   []Pair
+	current atomic.Pointer[snapshot]
+
+	mu       sync.Mutex
+	external map[string]*entry // Certificates passed to Staple, keyed by name
+	wake     chan struct{}     // Asks StapleOCSP for an early pass
+}
+
+// New loads the explicit pairs and every cert/key pair in dir.
+// In dir, a certificate named <name>.crt or <name>.pem is paired with <name>.key.
+// A missing directory is treated as empty.
+func New(dir string, pairs ...Pair) (*Store, error) {
+	s := &Store{dir: dir, pairs: pairs, external: make(map[string]*entry), wake: make(chan struct{}, 1)}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload re-reads all certificates and swaps them in atomically.
+// On error the previously loaded certificates stay in use.
+func (s *Store) Reload() error {
+	state, err := s.fingerprint()
+	if err != nil {
+		return err
+	}
+
+	next := &snapshot{
+		exact:    make(map[string]*entry),
+		wildcard: make(map[string]*entry),
+		state:    state,
+	}
+
+	// Explicit pairs load first so they provide the fallback; directory entries win on shared names
+	dirPairs, err := s.dirPairs()
+	if err != nil {
+		return err
+	}
+	pairs := append(append([]Pair(nil), s.pairs...), dirPairs...)
+
+	for _, pair := range pairs {
+		cert, err := loadPair(pair)
+		if err != nil {
+			return err
+		}
+		next.add(cert, s.current.Load())
+	}
+
+	if next.fallback == nil {
+		return fmt.Errorf("no certificates found in %s", s.dir)
+	}
+
+	previous := s.current.Swap(next)
+	s.forgetStaples(previous)
+	log.Printf("Loaded %d certificate names (%d wildcard)", len(next.exact), len(next.wildcard))
+	return nil
+}
+
+// dirPairs lists the cert/key pairs in the store's directory
+func (s *Store) dirPairs() ([]Pair, error) {
+	if s.dir == "" {
+		return nil, nil
+	}
+
+	entries, err := os.ReadDir(s.dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read certificate directory: %w", err)
+	}
+
+	var pairs []Pair
+	for _, entry := range entries {
+		ext := filepath.Ext(entry.Name())
+		if entry.IsDir() || (ext != ".crt" && ext != ".pem") {
+			continue
+		}
+		keyFile := filepath.Join(s.dir, strings.TrimSuffix(entry.Name(), ext)+".key")
+		if _, err := os.Stat(keyFile); err != nil {
+			continue // Not a certificate, or its key has not been written yet
+		}
+		pairs = append(pairs, Pair{CertFile: filepath.Join(s.dir, entry.Name()), KeyFile: keyFile})
+	}
+	return pairs, nil
+}
+
+func loadPair(pair Pair) (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(pair.CertFile, pair.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load %s: %w", pair.CertFile, err)
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", pair.CertFile, err)
+		}
+	}
+	return &cert, nil
+}
+
+// add indexes a certificate under its DNS SANs, or its common name if it has none.
+// A staple held by the previous snapshot for the same certificate is kept.
+func (n *snapshot) add(cert *tls.Certificate, previous *snapshot) {
+	names := certNames(cert.Leaf)
+	e := newEntry(cert)
+	if old := previous.find(cert.Leaf); old != nil {
+		if current := old.staple.Load(); current != nil {
+			e.setStaple(current)
+		}
+	}
+	n.entries = append(n.entries, e)
+
+	for _, name := range names {
+		name = normalize(name)
+		if parent, ok := strings.CutPrefix(name, "*."); ok {
+			n.wildcard[parent] = e
+		} else {
+			n.exact[name] = e
+		}
+	}
+
+	if n.fallback == nil {
+		n.fallback = e
+	}
+}
+
+// newEntry wraps a certificate with its leaf parsed, served without a staple
+func newEntry(cert *tls.Certificate) *entry {
+	e := &entry{leaf: cert.Leaf, cert: cert}
+	if names := certNames(cert.Leaf); len(names) > 0 {
+		e.name = normalize(names[0])
+	}
+	e.served.Store(cert)
+	return e
+}
+
+// certNames returns the DNS SANs of a certificate, or its common name if it has none
+func certNames(leaf *x509.Certificate) []string {
+	if len(leaf.DNSNames) == 0 && leaf.Subject.CommonName != "" {
+		return []string{leaf.Subject.CommonName}
+	}
+	return leaf.DNSNames
+}
+
+// find returns the entry holding the same leaf certificate, if any
+func (n *snapshot) find(leaf *x509.Certificate) *entry {
+	if n == nil {
+		return nil
+	}
+	for _, e := range n.entries {
+		if e.leaf.Equal(leaf) {
+			return e
+		}
+	}
+	return nil
+}
+
+// lookup finds the certificate for a server name: exact match first, then a wildcard for its parent domain
+func (n *snapshot) lookup(serverName string) (*tls.Certificate, bool) {
+	name := normalize(serverName)
+	if e, ok := n.exact[name]; ok {
+		return e.served.Load(), true
+	}
+	if _, parent, ok := strings.Cut(name, "."); ok {
+		if e, ok := n.wildcard[parent]; ok {
+			return e.served.Load(), true
+		}
+	}
+	return nil, false
+}
+
+func normalize(name string) string {
+	return strings.TrimSuffix(strings.ToLower(name), ".")
+}
+
+// GetCertificate chooses a certificate by the ClientHello's server name, for use in tls.Config
+func (s *Store) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	current := s.current.Load()
+	if cert, ok := current.lookup(hello.ServerName); ok {
+		return cert, nil
+	}
+	return current.fallback.served.Load(), nil
+}
+
+// Lookup returns the certificate for a server name, without falling back to the default certificate
+func (s *Store) Lookup(serverName string) (*tls.Certificate, bool) {
+	return s.current.Load().lookup(serverName)
+}
+
+// fingerprint summarizes the names, sizes and modification times of the store's files
+func (s *Store) fingerprint() (string, error) {
+	var parts []string
+
+	if s.dir != "" {
+		entries, err := os.ReadDir(s.dir)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return "", fmt.Errorf("failed to read certificate directory: %w", err)
+		}
+		for _, entry := range entries {
+			info, err := entry.Info()
+			if err != nil {
+				continue
+			}
+			parts = append(parts, fmt.Sprintf("%s:%d:%d", entry.Name(), info.Size(), info.ModTime().UnixNano()))
+		}
+	}
+
+	for _, pair := range s.pairs {
+		for _, file := range []string{pair.CertFile, pair.KeyFile} {
+			if info, err := os.Stat(file); err == nil {
+				parts = append(parts, fmt.Sprintf("%s:%d:%d", file, info.Size(), info.ModTime().UnixNano()))
+			}
+		}
+	}
+
+	sort.Strings(parts)
+	return strings.Join(parts, "|"), nil
+}
+
+// Watch polls the certificate files and reloads the store whenever they change
+func (s *Store) Watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		state, err := s.fingerprint()
+		if err != nil {
+			log.Printf("Failed to check certificates for changes: %v", err)
+			continue
+		}
+		if state == s.current.Load().state {
+			continue
+		}
+
+		if err := s.Reload(); err != nil {
+			log.Printf("Failed to reload certificates, keeping the previous set: %v", err)
+			continue
+		}
+		log.Printf("Reloaded certificates from %s", s.dir)
+	}
+}
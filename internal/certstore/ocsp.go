@@ -0,0 +1,305 @@
+package certstore
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/crypto/ocsp"
+)
+
+// Responses without a NextUpdate are refreshed this often
+const defaultStapleLifetime = time.Hour
+
+// Metrics for OCSP stapling
+var (
+	stapleThisUpdate = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tls_ocsp_staple_this_update_timestamp_seconds",
+		Help: "Time the stapled OCSP response was produced, by certificate.",
+	}, []string{"certificate"})
+	stapleNextUpdate = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tls_ocsp_staple_next_update_timestamp_seconds",
+		Help: "Time the stapled OCSP response expires, by certificate.",
+	}, []string{"certificate"})
+	stapleFetchErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tls_ocsp_fetch_errors_total",
+		Help: "Total number of failed OCSP response fetches, by certificate.",
+	}, []string{"certificate"})
+)
+
+func init() {
+	prometheus.MustRegister(stapleThisUpdate, stapleNextUpdate, stapleFetchErrors)
+}
+
+// staple is a verified OCSP response for a certificate
+type staple struct {
+	der        []byte
+	status     int
+	thisUpdate time.Time
+	nextUpdate time.Time
+}
+
+// due reports whether the response should be replaced: halfway through its validity, like most CAs expect
+func (st *staple) due(now time.Time) bool {
+	if st.nextUpdate.IsZero() {
+		return now.After(st.thisUpdate.Add(defaultStapleLifetime))
+	}
+	return now.After(st.thisUpdate.Add(st.nextUpdate.Sub(st.thisUpdate) / 2))
+}
+
+// expired reports whether clients would reject the response
+func (st *staple) expired(now time.Time) bool {
+	return !st.nextUpdate.IsZero() && now.After(st.nextUpdate)
+}
+
+// setStaple publishes a copy of the certificate carrying the response, or the bare certificate for nil
+func (e *entry) setStaple(st *staple) {
+	e.staple.Store(st)
+	if st == nil {
+		e.served.Store(e.cert)
+		return
+	}
+	stapled := *e.cert
+	stapled.OCSPStaple = st.der
+	e.served.Store(&stapled)
+}
+
+// StapleOCSP keeps an OCSP response stapled to every certificate whose issuer runs a responder.
+// Responses are fetched on start and refreshed halfway through their validity. When a refresh fails the
+// previous response is served until it expires, after which handshakes continue without a staple.
+func (s *Store) StapleOCSP(interval time.Duration) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	issuers := make(map[string]*x509.Certificate) // Issuers downloaded from AIA URLs, keyed by URL
+
+	for {
+		s.refreshStaples(client, issuers, time.Now())
+
+		select {
+		case <-time.After(interval):
+		case <-s.wake:
+		}
+	}
+}
+
+// refreshStaples replaces every response that is due
+func (s *Store) refreshStaples(client *http.Client, issuers map[string]*x509.Certificate, now time.Time) {
+	for _, e := range s.entries(now) {
+		if len(e.leaf.OCSPServer) == 0 {
+			continue
+		}
+		if current := e.staple.Load(); current != nil && !current.due(now) {
+			continue
+		}
+
+		st, err := fetchStaple(client, e, issuers)
+		if err != nil {
+			stapleFetchErrors.WithLabelValues(e.name).Inc()
+			log.Printf("Failed to refresh OCSP staple for %s: %v", e.name, err)
+			if current := e.staple.Load(); current != nil && current.expired(now) {
+				log.Printf("OCSP staple for %s expired, serving the certificate without one", e.name)
+				e.setStaple(nil)
+				stapleThisUpdate.DeleteLabelValues(e.name)
+				stapleNextUpdate.DeleteLabelValues(e.name)
+			}
+			continue
+		}
+
+		if st.status == ocsp.Revoked {
+			log.Printf("OCSP responder reports the certificate for %s as revoked", e.name)
+		}
+		e.setStaple(st)
+		stapleThisUpdate.WithLabelValues(e.name).Set(float64(st.thisUpdate.Unix()))
+		if st.nextUpdate.IsZero() {
+			stapleNextUpdate.DeleteLabelValues(e.name)
+		} else {
+			stapleNextUpdate.WithLabelValues(e.name).Set(float64(st.nextUpdate.Unix()))
+		}
+	}
+}
+
+// entries lists the loaded certificates and those passed to Staple, dropping the latter once they expire
+func (s *Store) entries(now time.Time) []*entry {
+	entries := append([]*entry(nil), s.current.Load().entries...)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name, e := range s.external {
+		if now.After(e.leaf.NotAfter) {
+			delete(s.external, name)
+			s.forgetStaple(e.name)
+			continue
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+// Staple returns the certificate carrying the OCSP response kept for it. Certificates that are not loaded from
+// the store's files, such as those obtained over ACME, are stapled from then on; one replaces the previous
+// certificate with the same name, as a renewal does.
+func (s *Store) Staple(cert *tls.Certificate) *tls.Certificate {
+	if cert.Leaf == nil {
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return cert
+		}
+		withLeaf := *cert
+		withLeaf.Leaf = leaf
+		cert = &withLeaf
+	}
+	if len(cert.Leaf.OCSPServer) == 0 {
+		return cert
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e := newEntry(cert)
+	if old, ok := s.external[e.name]; ok {
+		if old.leaf.Equal(cert.Leaf) {
+			return old.served.Load()
+		}
+		stapleThisUpdate.DeleteLabelValues(e.name)
+		stapleNextUpdate.DeleteLabelValues(e.name)
+	}
+	s.external[e.name] = e
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return cert
+}
+
+// forgetStaples deletes the metric series of certificates the previous snapshot served and the current one doesn't
+func (s *Store) forgetStaples(previous *snapshot) {
+	if previous == nil {
+		return
+	}
+	current := s.current.Load()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, e := range previous.entries {
+		if current.find(e.leaf) != nil {
+			continue
+		}
+		if _, ok := s.external[e.name]; ok {
+			continue
+		}
+		s.forgetStaple(e.name)
+	}
+}
+
+// forgetStaple deletes a certificate's metric series unless a loaded certificate of the same name still uses them
+func (s *Store) forgetStaple(name string) {
+	for _, e := range s.current.Load().entries {
+		if e.name == name && e.staple.Load() != nil {
+			return
+		}
+	}
+	stapleThisUpdate.DeleteLabelValues(name)
+	stapleNextUpdate.DeleteLabelValues(name)
+	for _, e := range s.current.Load().entries {
+		if e.name == name {
+			return
+		}
+	}
+	stapleFetchErrors.DeleteLabelValues(name)
+}
+
+// fetchStaple asks the certificate's OCSP responders for its status, trying each in turn
+func fetchStaple(client *http.Client, e *entry, issuers map[string]*x509.Certificate) (*staple, error) {
+	issuer, err := findIssuer(client, e, issuers)
+	if err != nil {
+		return nil, err
+	}
+
+	request, err := ocsp.CreateRequest(e.leaf, issuer, &ocsp.RequestOptions{Hash: crypto.SHA1})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OCSP request: %w", err)
+	}
+
+	for _, server := range e.leaf.OCSPServer {
+		var der []byte
+		der, err = postOCSP(client, server, request)
+		if err != nil {
+			continue
+		}
+
+		var response *ocsp.Response
+		response, err = ocsp.ParseResponseForCert(der, e.leaf, issuer)
+		if err != nil {
+			err = fmt.Errorf("invalid OCSP response from %s: %w", server, err)
+			continue
+		}
+		if response.Status == ocsp.Unknown {
+			err = fmt.Errorf("OCSP responder %s does not know the certificate", server)
+			continue
+		}
+		return &staple{
+			der:        der,
+			status:     response.Status,
+			thisUpdate: response.ThisUpdate,
+			nextUpdate: response.NextUpdate,
+		}, nil
+	}
+	return nil, err
+}
+
+func postOCSP(client *http.Client, server string, request []byte) ([]byte, error) {
+	resp, err := client.Post(server, "application/ocsp-request", bytes.NewReader(request))
+	if err != nil {
+		return nil, fmt.Errorf("OCSP request to %s failed: %w", server, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("OCSP responder %s returned %s", server, resp.Status)
+	}
+	der, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read OCSP response from %s: %w", server, err)
+	}
+	return der, nil
+}
+
+// findIssuer returns the certificate that signed the leaf: from the loaded chain if present,
+// otherwise downloaded from the leaf's issuing certificate URL
+func findIssuer(client *http.Client, e *entry, issuers map[string]*x509.Certificate) (*x509.Certificate, error) {
+	if len(e.cert.Certificate) > 1 {
+		issuer, err := x509.ParseCertificate(e.cert.Certificate[1])
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse issuer certificate: %w", err)
+		}
+		return issuer, nil
+	}
+
+	for _, url := range e.leaf.IssuingCertificateURL {
+		if issuer, ok := issuers[url]; ok {
+			return issuer, nil
+		}
+		resp, err := client.Get(url)
+		if err != nil {
+			continue
+		}
+		der, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		resp.Body.Close()
+		if err != nil {
+			continue
+		}
+		issuer, err := x509.ParseCertificate(der)
+		if err != nil {
+			continue
+		}
+		issuers[url] = issuer
+		return issuer, nil
+	}
+	return nil, fmt.Errorf("certificate chain has no issuer")
+}
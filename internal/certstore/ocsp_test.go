@@ -0,0 +1,358 @@
+package certstore
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// testCA issues certificates and answers OCSP requests for them
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	url  string
+
+	requests atomic.Int64
+	mu       sync.Mutex
+	status   map[string]int // By serial number; absent serials are answered with Good
+	failing  bool           // Answer with 500
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	ca := &testCA{cert: cert, key: key, status: make(map[string]int)}
+
+	server := httptest.NewServer(http.HandlerFunc(ca.respond))
+	t.Cleanup(server.Close)
+	ca.url = server.URL
+	return ca
+}
+
+func (ca *testCA) respond(w http.ResponseWriter, r *http.Request) {
+	ca.requests.Add(1)
+	body, _ := io.ReadAll(r.Body)
+	request, err := ocsp.ParseRequest(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ca.mu.Lock()
+	status, known := ca.status[request.SerialNumber.String()]
+	failing := ca.failing
+	ca.mu.Unlock()
+	if failing {
+		http.Error(w, "unavailable", http.StatusInternalServerError)
+		return
+	}
+	if !known {
+		status = ocsp.Good
+	}
+
+	now := time.Now()
+	response, err := ocsp.CreateResponse(ca.cert, ca.cert, ocsp.Response{
+		Status:       status,
+		SerialNumber: request.SerialNumber,
+		ThisUpdate:   now.Add(-time.Minute),
+		NextUpdate:   now.Add(time.Hour),
+		RevokedAt:    now.Add(-time.Minute),
+	}, ca.key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/ocsp-response")
+	w.Write(response)
+}
+
+func (ca *testCA) set(serial *big.Int, status int) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	ca.status[serial.String()] = status
+}
+
+func (ca *testCA) fail(failing bool) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	ca.failing = failing
+}
+
+var serials atomic.Int64
+
+// issue returns a certificate for name that points at the CA's responder, chained to the CA
+func (ca *testCA) issue(t *testing.T, name string) *tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(100 + serials.Add(1)),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(12 * time.Hour),
+		OCSPServer:   []string{ca.url},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	return &tls.Certificate{Certificate: [][]byte{der, ca.cert.Raw}, PrivateKey: key, Leaf: leaf}
+}
+
+// write saves a certificate and its key to dir as <name>.crt and <name>.key
+func write(t *testing.T, dir, name string, cert *tls.Certificate) {
+	t.Helper()
+	var certPEM []byte
+	for _, der := range cert.Certificate {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(filepath.Join(dir, name+".crt"), certPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, name+".key"), keyPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// stapleStatus returns the status in the certificate's staple, or -1 without one
+func stapleStatus(t *testing.T, cert *tls.Certificate, issuer *x509.Certificate) int {
+	t.Helper()
+	if len(cert.OCSPStaple) == 0 {
+		return -1
+	}
+	response, err := ocsp.ParseResponse(cert.OCSPStaple, issuer)
+	if err != nil {
+		t.Fatalf("invalid staple: %v", err)
+	}
+	return response.Status
+}
+
+func served(t *testing.T, s *Store, name string) *tls.Certificate {
+	t.Helper()
+	cert, err := s.GetCertificate(&tls.ClientHelloInfo{ServerName: name})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// hasSeries reports whether a metric has a series for the certificate, deleting it
+func hasSeries(vec interface{ DeleteLabelValues(...string) bool }, name string) bool {
+	return vec.DeleteLabelValues(name)
+}
+
+func refresh(s *Store, now time.Time) {
+	s.refreshStaples(http.DefaultClient, make(map[string]*x509.Certificate), now)
+}
+
+func TestStapleOCSP(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	good := ca.issue(t, "good.test")
+	revoked := ca.issue(t, "revoked.test")
+	write(t, dir, "good", good)
+	write(t, dir, "revoked", revoked)
+	ca.set(revoked.Leaf.SerialNumber, ocsp.Revoked)
+
+	s, err := New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := stapleStatus(t, served(t, s, "good.test"), ca.cert); status != -1 {
+		t.Fatalf("staple before the first refresh: %d", status)
+	}
+
+	refresh(s, time.Now())
+	if status := stapleStatus(t, served(t, s, "good.test"), ca.cert); status != ocsp.Good {
+		t.Fatalf("good.test staple status = %d, want good", status)
+	}
+	if status := stapleStatus(t, served(t, s, "revoked.test"), ca.cert); status != ocsp.Revoked {
+		t.Fatalf("revoked.test staple status = %d, want revoked", status)
+	}
+
+	// Responses that aren't due yet aren't fetched again
+	requests := ca.requests.Load()
+	refresh(s, time.Now())
+	if ca.requests.Load() != requests {
+		t.Fatal("refreshed a response that wasn't due")
+	}
+
+	// A failed refresh keeps the response until it expires
+	ca.fail(true)
+	refresh(s, time.Now().Add(45*time.Minute))
+	if status := stapleStatus(t, served(t, s, "good.test"), ca.cert); status != ocsp.Good {
+		t.Fatalf("staple after a failed refresh = %d, want the previous one", status)
+	}
+	refresh(s, time.Now().Add(2*time.Hour))
+	if status := stapleStatus(t, served(t, s, "good.test"), ca.cert); status != -1 {
+		t.Fatalf("expired staple still served: %d", status)
+	}
+	if hasSeries(stapleThisUpdate, "good.test") || !hasSeries(stapleFetchErrors, "good.test") {
+		t.Fatal("metrics don't reflect the expired staple")
+	}
+}
+
+func TestStapleOCSPUnknownCertificate(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	cert := ca.issue(t, "unknown.test")
+	write(t, dir, "unknown", cert)
+	ca.set(cert.Leaf.SerialNumber, ocsp.Unknown)
+
+	s, err := New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	refresh(s, time.Now())
+	if status := stapleStatus(t, served(t, s, "unknown.test"), ca.cert); status != -1 {
+		t.Fatalf("stapled a response of status %d for a certificate the responder doesn't know", status)
+	}
+	if !hasSeries(stapleFetchErrors, "unknown.test") {
+		t.Fatal("fetch error not counted")
+	}
+}
+
+// Certificates obtained elsewhere, such as over ACME, are stapled once passed to Staple
+func TestStapleExternalCertificate(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	write(t, dir, "static", ca.issue(t, "static.test"))
+	s, err := New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	acme := ca.issue(t, "acme.test")
+	if got := s.Staple(acme); got != acme {
+		t.Fatal("first Staple didn't return the certificate as is")
+	}
+	select {
+	case <-s.wake:
+	default:
+		t.Fatal("Staple didn't ask for an early refresh")
+	}
+
+	refresh(s, time.Now())
+	if status := stapleStatus(t, s.Staple(acme), ca.cert); status != ocsp.Good {
+		t.Fatalf("staple status = %d, want good", status)
+	}
+	if _, ok := s.Lookup("acme.test"); ok {
+		t.Fatal("stapled certificate was added to the store's names")
+	}
+
+	// A renewal replaces the certificate and its metrics
+	renewed := ca.issue(t, "acme.test")
+	if status := stapleStatus(t, s.Staple(renewed), ca.cert); status != -1 {
+		t.Fatal("renewed certificate carries the previous certificate's staple")
+	}
+	if hasSeries(stapleThisUpdate, "acme.test") {
+		t.Fatal("metrics of the replaced certificate kept")
+	}
+	refresh(s, time.Now())
+	if status := stapleStatus(t, s.Staple(renewed), ca.cert); status != ocsp.Good {
+		t.Fatalf("renewed staple status = %d, want good", status)
+	}
+
+	// Expired certificates are dropped
+	refresh(s, time.Now().Add(24*time.Hour))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.external) != 0 {
+		t.Fatalf("expired certificates kept: %v", s.external)
+	}
+}
+
+func TestReloadForgetsRemovedCertificates(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	write(t, dir, "kept", ca.issue(t, "kept.test"))
+	write(t, dir, "removed", ca.issue(t, "removed.test"))
+	write(t, dir, "replaced", ca.issue(t, "replaced.test"))
+
+	s, err := New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	refresh(s, time.Now())
+
+	os.Remove(filepath.Join(dir, "removed.crt"))
+	os.Remove(filepath.Join(dir, "removed.key"))
+	write(t, dir, "replaced", ca.issue(t, "replaced.test"))
+	if err := s.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	if status := stapleStatus(t, served(t, s, "kept.test"), ca.cert); status != ocsp.Good {
+		t.Fatal("reload dropped the staple of an unchanged certificate")
+	}
+	if !hasSeries(stapleThisUpdate, "kept.test") || !hasSeries(stapleNextUpdate, "kept.test") {
+		t.Fatal("reload deleted the metrics of an unchanged certificate")
+	}
+	if hasSeries(stapleThisUpdate, "removed.test") || hasSeries(stapleNextUpdate, "removed.test") {
+		t.Fatal("reload kept the metrics of a removed certificate")
+	}
+	if hasSeries(stapleThisUpdate, "replaced.test") {
+		t.Fatal("reload kept the previous certificate's staple metrics")
+	}
+}
+
+// The chain's issuer is used when present, so no AIA download is needed
+func TestFindIssuerFromChain(t *testing.T) {
+	ca := newTestCA(t)
+	e := newEntry(ca.issue(t, "chain.test"))
+	issuer, err := findIssuer(http.DefaultClient, e, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !issuer.Equal(ca.cert) {
+		t.Fatal("wrong issuer")
+	}
+
+	bare := ca.issue(t, "bare.test")
+	bare.Certificate = bare.Certificate[:1]
+	if _, err := findIssuer(http.DefaultClient, newEntry(bare), nil); err == nil {
+		t.Fatal("expected an error for a chain without an issuer")
+	}
+}
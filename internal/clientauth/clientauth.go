@@ -0,0 +1,302 @@
+// Package clientauth requires and verifies TLS client certificates per server name.
+package clientauth
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Headers carrying the verified client identity to HTTP backends
+const (
+	HeaderSubject     = "X-Client-Cert-Subject"
+	HeaderSANs        = "X-Client-Cert-SAN"
+	HeaderFingerprint = "X-Client-Cert-Fingerprint"
+)
+
+// Time each server name's CRL expires, so an issuer that stops publishing is noticed before handshakes fail
+var crlNextUpdate = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "tls_client_crl_next_update_timestamp_seconds",
+	Help: "Time the client certificate revocation list expires, by server name.",
+}, []string{"server_name"})
+
+func init() {
+	prometheus.MustRegister(crlNextUpdate)
+}
+
+// Policy describes how clients of one server name must authenticate
+type Policy struct {
+	CAFile  string `json:"ca_file" yaml:"ca_file"`   // PEM bundle of CAs that may issue client certificates
+	CRLFile string `json:"crl_file" yaml:"crl_file"` // Optional PEM or DER revocation list issued by one of the CAs
+}
+
+// Verifier enforces a loaded Policy
+type Verifier struct {
+	policy Policy
+	roots  *x509.CertPool
+	cas    []*x509.Certificate
+	crl    atomic.Pointer[crl] // nil without a CRL file
+	now    func() time.Time
+}
+
+// crl is a verified revocation list
+type crl struct {
+	issuer     []byte          // Raw subject of the CRL's issuer
+	revoked    map[string]bool // Serial numbers revoked by the CRL
+	thisUpdate time.Time
+	nextUpdate time.Time // Zero if the CRL doesn't say
+	modTime    time.Time // Of the file when it was read
+}
+
+// expired reports whether the issuer has promised a newer CRL by now
+func (c *crl) expired(now time.Time) bool {
+	return !c.nextUpdate.IsZero() && now.After(c.nextUpdate)
+}
+
+// Identity is what the proxy learned about a verified client
+type Identity struct {
+	Subject     string
+	DNSNames    []string
+	Emails      []string
+	URIs        []string
+	Fingerprint string // Hex SHA-256 of the client certificate
+}
+
+// Load reads the CA bundle and CRL of a policy
+func Load(policy Policy) (*Verifier, error) {
+	caPEM, err := os.ReadFile(policy.CAFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client CA bundle: %w", err)
+	}
+
+	var cas []*x509.Certificate
+	roots := x509.NewCertPool()
+	for block, rest := pem.Decode(caPEM); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		ca, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse client CA: %w", err)
+		}
+		roots.AddCert(ca)
+		cas = append(cas, ca)
+	}
+	if len(cas) == 0 {
+		return nil, fmt.Errorf("no certificates found in %s", policy.CAFile)
+	}
+
+	verifier := &Verifier{policy: policy, roots: roots, cas: cas, now: time.Now}
+	if policy.CRLFile != "" {
+		if _, err := verifier.ReloadCRL(); err != nil {
+			return nil, err
+		}
+	}
+	return verifier, nil
+}
+
+// ReloadCRL reads the policy's CRL if the file changed since it was last read, and reports
+// whether it did. A CRL older than the one in use is refused, so a stale copy can't unrevoke certificates.
+func (v *Verifier) ReloadCRL() (bool, error) {
+	path := v.policy.CRLFile
+	info, err := os.Stat(path)
+	if err != nil {
+		return false, fmt.Errorf("failed to read CRL: %w", err)
+	}
+	current := v.crl.Load()
+	if current != nil && info.ModTime().Equal(current.modTime) {
+		return false, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false, fmt.Errorf("failed to read CRL: %w", err)
+	}
+	if block, _ := pem.Decode(data); block != nil {
+		data = block.Bytes
+	}
+
+	list, err := x509.ParseRevocationList(data)
+	if err != nil {
+		return false, fmt.Errorf("failed to parse CRL: %w", err)
+	}
+
+	// Only trust a CRL signed by one of the policy's CAs
+	signed := false
+	for _, ca := range v.cas {
+		if list.CheckSignatureFrom(ca) == nil {
+			signed = true
+			break
+		}
+	}
+	if !signed {
+		return false, fmt.Errorf("CRL %s is not signed by a configured client CA", path)
+	}
+	if current != nil && bytes.Equal(list.RawIssuer, current.issuer) && list.ThisUpdate.Before(current.thisUpdate) {
+		return false, fmt.Errorf("CRL %s was issued at %v, before the one in use", path, list.ThisUpdate)
+	}
+
+	next := &crl{
+		issuer:     list.RawIssuer,
+		revoked:    make(map[string]bool, len(list.RevokedCertificateEntries)),
+		thisUpdate: list.ThisUpdate,
+		nextUpdate: list.NextUpdate,
+		modTime:    info.ModTime(),
+	}
+	for _, entry := range list.RevokedCertificateEntries {
+		next.revoked[entry.SerialNumber.String()] = true
+	}
+	v.crl.Store(next)
+	return true, nil
+}
+
+// CRLExpired reports whether the CRL in use is past its next update time. Handshakes fail until a newer one is loaded.
+func (v *Verifier) CRLExpired() bool {
+	current := v.crl.Load()
+	return current != nil && current.expired(v.now())
+}
+
+// Apply makes a server configuration require client certificates issued by the policy's CAs
+func (v *Verifier) Apply(config *tls.Config) {
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	config.ClientCAs = v.roots
+	config.VerifyPeerCertificate = func(_ [][]byte, chains [][]*x509.Certificate) error {
+		current := v.crl.Load()
+		if len(chains) == 0 || current == nil {
+			return nil
+		}
+		// Without a current CRL revoked certificates can't be told apart, so fail closed
+		if current.expired(v.now()) {
+			return fmt.Errorf("client CRL %s expired at %v", v.policy.CRLFile, current.nextUpdate)
+		}
+		// Serial numbers are only unique per issuer
+		leaf := chains[0][0]
+		if bytes.Equal(leaf.RawIssuer, current.issuer) && current.revoked[leaf.SerialNumber.String()] {
+			return fmt.Errorf("client certificate %s has been revoked", leaf.Subject)
+		}
+		return nil
+	}
+}
+
+// Verifiers holds the verifier of every server name that requires client certificates
+type Verifiers map[string]*Verifier
+
+// LoadAll loads a policy per server name. Names may be wildcards such as *.example.com.
+func LoadAll(policies map[string]Policy) (Verifiers, error) {
+	verifiers := make(Verifiers, len(policies))
+	for name, policy := range policies {
+		verifier, err := Load(policy)
+		if err != nil {
+			return nil, fmt.Errorf("client auth for %s: %w", name, err)
+		}
+		verifiers[strings.ToLower(name)] = verifier
+	}
+	return verifiers, nil
+}
+
+// Watch reloads changed CRL files at an interval, keeping the previous CRL when a file
+// doesn't load, and warns while a CRL is past its next update time
+func (v Verifiers) Watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	warned := make(map[string]bool) // Names whose expired CRL was already reported
+	for {
+		for name, verifier := range v {
+			if verifier.policy.CRLFile == "" {
+				continue
+			}
+			reloaded, err := verifier.ReloadCRL()
+			if err != nil {
+				log.Printf("Failed to reload CRL for %s, keeping the previous one: %v", name, err)
+			} else if reloaded {
+				log.Printf("Reloaded CRL for %s from %s", name, verifier.policy.CRLFile)
+			}
+
+			current := verifier.crl.Load()
+			if !current.nextUpdate.IsZero() {
+				crlNextUpdate.WithLabelValues(name).Set(float64(current.nextUpdate.Unix()))
+			}
+			expired := current.expired(verifier.now())
+			if expired && !warned[name] {
+				log.Printf("Warning: CRL for %s expired at %v; refusing client certificates until %s is updated",
+					name, current.nextUpdate, verifier.policy.CRLFile)
+			}
+			warned[name] = expired
+		}
+		<-ticker.C
+	}
+}
+
+// Lookup returns the verifier for a server name, or nil if its clients don't need certificates
+func (v Verifiers) Lookup(serverName string) *Verifier {
+	name := strings.ToLower(strings.TrimSuffix(serverName, "."))
+	if verifier, ok := v[name]; ok {
+		return verifier
+	}
+	if _, parent, ok := strings.Cut(name, "."); ok {
+		return v["*."+parent]
+	}
+	return nil
+}
+
+// IdentityFrom extracts the verified client identity from a completed handshake
+func IdentityFrom(state tls.ConnectionState) (*Identity, bool) {
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil, false
+	}
+	leaf := state.VerifiedChains[0][0]
+	fingerprint := sha256.Sum256(leaf.Raw)
+
+	identity := &Identity{
+		Subject:     leaf.Subject.String(),
+		DNSNames:    leaf.DNSNames,
+		Emails:      leaf.EmailAddresses,
+		Fingerprint: hex.EncodeToString(fingerprint[:]),
+	}
+	for _, uri := range leaf.URIs {
+		identity.URIs = append(identity.URIs, uri.String())
+	}
+	return identity, true
+}
+
+// SANs returns every subject alternative name of the client certificate
+func (id *Identity) SANs() []string {
+	sans := make([]string, 0, len(id.DNSNames)+len(id.Emails)+len(id.URIs))
+	for _, name := range id.DNSNames {
+		sans = append(sans, "DNS:"+name)
+	}
+	for _, email := range id.Emails {
+		sans = append(sans, "email:"+email)
+	}
+	for _, uri := range id.URIs {
+		sans = append(sans, "URI:"+uri)
+	}
+	return sans
+}
+
+// SetHeaders adds the identity to an HTTP request bound for a backend
+func (id *Identity) SetHeaders(header http.Header) {
+	header.Set(HeaderSubject, id.Subject)
+	header.Set(HeaderSANs, strings.Join(id.SANs(), ", "))
+	header.Set(HeaderFingerprint, id.Fingerprint)
+}
+
+// StripHeaders removes identity headers a client may have sent itself
+func StripHeaders(header http.Header) {
+	header.Del(HeaderSubject)
+	header.Del(HeaderSANs)
+	header.Del(HeaderFingerprint)
+}
@@ -0,0 +1,238 @@
+package clientauth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var epoch = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+type authority struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newAuthority(t *testing.T, name string) *authority {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             epoch.Add(-time.Hour),
+		NotAfter:              epoch.Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &authority{cert: cert, key: key}
+}
+
+// issue returns a client certificate with a serial number
+func (a *authority) issue(t *testing.T, serial int64) *x509.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "client"},
+		NotBefore:    epoch.Add(-time.Hour),
+		NotAfter:     epoch.Add(24 * time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, a.cert, &key.PublicKey, a.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// writeCRL writes a PEM CRL issued at thisUpdate and valid for a day, revoking serials,
+// and moves the file's modification time on so a reload notices it
+func (a *authority) writeCRL(t *testing.T, path string, number int64, thisUpdate time.Time, serials ...int64) {
+	t.Helper()
+	template := &x509.RevocationList{
+		Number:     big.NewInt(number),
+		ThisUpdate: thisUpdate,
+		NextUpdate: thisUpdate.Add(24 * time.Hour),
+	}
+	for _, serial := range serials {
+		template.RevokedCertificateEntries = append(template.RevokedCertificateEntries,
+			x509.RevocationListEntry{SerialNumber: big.NewInt(serial), RevocationTime: thisUpdate})
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, template, a.cert, a.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	modTime := epoch.Add(time.Duration(number) * time.Minute)
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeCA writes the CA certificate as a bundle and returns its path
+func (a *authority) writeCA(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: a.cert.Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// newVerifier loads a policy trusting ca with the CRL at crlPath, on a clock set to now
+func newVerifier(t *testing.T, ca *authority, crlPath string, now *time.Time) *Verifier {
+	t.Helper()
+	verifier, err := Load(Policy{CAFile: ca.writeCA(t), CRLFile: crlPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifier.now = func() time.Time { return *now }
+	return verifier
+}
+
+// verify runs the verification a handshake would for a client certificate chain
+func verify(verifier *Verifier, leaf, ca *x509.Certificate) error {
+	config := &tls.Config{}
+	verifier.Apply(config)
+	return config.VerifyPeerCertificate(nil, [][]*x509.Certificate{{leaf, ca}})
+}
+
+func TestRevokedCertificateRefused(t *testing.T) {
+	ca, other := newAuthority(t, "client CA"), newAuthority(t, "other CA")
+	crlPath := filepath.Join(t.TempDir(), "ca.crl")
+	ca.writeCRL(t, crlPath, 1, epoch, 2)
+	now := epoch.Add(time.Hour)
+	verifier := newVerifier(t, ca, crlPath, &now)
+
+	if err := verify(verifier, ca.issue(t, 3), ca.cert); err != nil {
+		t.Errorf("valid certificate refused: %v", err)
+	}
+	if err := verify(verifier, ca.issue(t, 2), ca.cert); err == nil || !strings.Contains(err.Error(), "revoked") {
+		t.Errorf("revoked certificate: got %v", err)
+	}
+	// Serial numbers only count for the CRL's issuer
+	if err := verify(verifier, other.issue(t, 2), other.cert); err != nil {
+		t.Errorf("certificate of another issuer with a revoked serial number refused: %v", err)
+	}
+
+	// A CRL from a CA outside the policy is refused outright
+	otherCRL := filepath.Join(t.TempDir(), "other.crl")
+	other.writeCRL(t, otherCRL, 1, epoch)
+	if _, err := Load(Policy{CAFile: ca.writeCA(t), CRLFile: otherCRL}); err == nil {
+		t.Error("CRL signed by another CA loaded")
+	}
+}
+
+func TestCRLReloadedWhenFileChanges(t *testing.T) {
+	ca := newAuthority(t, "client CA")
+	crlPath := filepath.Join(t.TempDir(), "ca.crl")
+	ca.writeCRL(t, crlPath, 1, epoch)
+	now := epoch.Add(time.Hour)
+	verifier := newVerifier(t, ca, crlPath, &now)
+	client := ca.issue(t, 2)
+
+	if reloaded, err := verifier.ReloadCRL(); reloaded || err != nil {
+		t.Fatalf("unchanged CRL reloaded: %v, %v", reloaded, err)
+	}
+	if err := verify(verifier, client, ca.cert); err != nil {
+		t.Fatalf("certificate refused before its revocation: %v", err)
+	}
+
+	// A newer CRL takes effect on reload, also for configurations applied before it
+	config := &tls.Config{}
+	verifier.Apply(config)
+	ca.writeCRL(t, crlPath, 2, epoch.Add(30*time.Minute), 2)
+	if reloaded, err := verifier.ReloadCRL(); !reloaded || err != nil {
+		t.Fatalf("changed CRL not reloaded: %v, %v", reloaded, err)
+	}
+	if err := config.VerifyPeerCertificate(nil, [][]*x509.Certificate{{client, ca.cert}}); err == nil {
+		t.Fatal("certificate revoked by the reloaded CRL accepted")
+	}
+
+	// Files that don't load, or hold an older CRL, leave the current one in place
+	if err := os.WriteFile(crlPath, []byte("not a CRL"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verifier.ReloadCRL(); err == nil {
+		t.Error("unparseable CRL reloaded")
+	}
+	ca.writeCRL(t, crlPath, 3, epoch)
+	if _, err := verifier.ReloadCRL(); err == nil || !strings.Contains(err.Error(), "before the one in use") {
+		t.Errorf("older CRL: got %v", err)
+	}
+	if err := os.Remove(crlPath); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verifier.ReloadCRL(); err == nil {
+		t.Error("missing CRL reloaded")
+	}
+	if err := verify(verifier, client, ca.cert); err == nil {
+		t.Fatal("failed reloads unrevoked a certificate")
+	}
+}
+
+func TestExpiredCRLFailsClosed(t *testing.T) {
+	ca := newAuthority(t, "client CA")
+	crlPath := filepath.Join(t.TempDir(), "ca.crl")
+	ca.writeCRL(t, crlPath, 1, epoch)
+	now := epoch.Add(24 * time.Hour)
+	verifier := newVerifier(t, ca, crlPath, &now)
+	client := ca.issue(t, 2)
+
+	if verifier.CRLExpired() || verify(verifier, client, ca.cert) != nil {
+		t.Fatal("CRL expired at its next update time")
+	}
+	now = now.Add(time.Second)
+	if !verifier.CRLExpired() {
+		t.Fatal("CRL past its next update time not expired")
+	}
+	if err := verify(verifier, client, ca.cert); err == nil || !strings.Contains(err.Error(), "expired") {
+		t.Fatalf("certificate checked against an expired CRL: got %v", err)
+	}
+
+	// Publishing a new CRL restores access
+	ca.writeCRL(t, crlPath, 2, now)
+	if _, err := verifier.ReloadCRL(); err != nil {
+		t.Fatal(err)
+	}
+	if err := verify(verifier, client, ca.cert); err != nil {
+		t.Fatalf("certificate refused after a new CRL: %v", err)
+	}
+
+	// Without a CRL file nothing expires
+	noCRL := newVerifier(t, ca, "", &now)
+	if noCRL.CRLExpired() || verify(noCRL, client, ca.cert) != nil {
+		t.Fatal("policy without a CRL refused a certificate")
+	}
+}
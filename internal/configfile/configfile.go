@@ -0,0 +1,282 @@
+// Package configfile loads the declarative configuration of a proxy from a YAML or JSON file.
+//
+// The file describes listeners, TLS settings, the admin API and static routes with their
+// backends. Fields left out keep their defaults, unknown fields are errors, and any scalar
+// field can be overridden by an environment variable named after its path, e.g.
+// RPROXY_LISTENERS_PROXY=:8443 or RPROXY_TLS_ACME_EMAIL=ops@example.com.
+package configfile
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"reverse-proxy/internal/apiauth"
+	"reverse-proxy/internal/clientauth"
+	"reverse-proxy/internal/tlspolicy"
+	"reverse-proxy/internal/upstreamtls"
+)
+
+// Kind selects the proxy a file configures; some sections only apply to the L4 proxy
+type Kind string
+
+const (
+	L4 Kind = "l4"
+	L7 Kind = "l7"
+)
+
+// Prefix of the environment variables that override file values
+const EnvPrefix = "RPROXY_"
+
+// Route modes of the L4 proxy
+const (
+	ModePassthrough = "passthrough"
+	ModeTerminate   = "terminate"
+	ModeHTTP        = "http"
+)
+
+// File is the configuration of one proxy
+type File struct {
+	Listeners Listeners `json:"listeners" yaml:"listeners"`
+	TLS       TLS       `json:"tls" yaml:"tls"`
+	Admin     Admin     `json:"admin" yaml:"admin"`
+	Routes    []Route   `json:"routes" yaml:"routes"`
+	UDP       UDP       `json:"udp" yaml:"udp"`               // L4 proxy only
+	DNS       DNS       `json:"dns" yaml:"dns"`               // L4 proxy only
+	HTTPCache HTTPCache `json:"http_cache" yaml:"http_cache"` // L4 proxy only
+	Discovery Discovery `json:"discovery" yaml:"discovery"`
+}
+
+// Listeners are the addresses the proxy serves on. Empty optional listeners are disabled.
+type Listeners struct {
+	Proxy   string `json:"proxy" yaml:"proxy"`     // TLS (and SNI-routed TCP) traffic
+	QUIC    string `json:"quic" yaml:"quic"`       // UDP address for SNI routing of QUIC (L4 proxy only, optional)
+	Admin   string `json:"admin" yaml:"admin"`     // Registration and admin APIs
+	Metrics string `json:"metrics" yaml:"metrics"` // Prometheus metrics (optional)
+	Pprof   string `json:"pprof" yaml:"pprof"`     // Go profiling endpoints (optional)
+}
+
+// TLS holds certificates and per-name TLS policies
+type TLS struct {
+	Termination       bool                          `json:"termination" yaml:"termination"` // Default mode of routes without one: terminate instead of passthrough (L4 proxy only)
+	CertFile          string                        `json:"cert_file" yaml:"cert_file"`
+	KeyFile           string                        `json:"key_file" yaml:"key_file"`
+	CertDir           string                        `json:"cert_dir" yaml:"cert_dir"`
+	TicketKeyFile     string                        `json:"ticket_key_file" yaml:"ticket_key_file"`
+	TicketKeyRotation Duration                      `json:"ticket_key_rotation" yaml:"ticket_key_rotation"`
+	ACME              ACME                          `json:"acme" yaml:"acme"`
+	Policies          map[string]tlspolicy.Policy   `json:"policies" yaml:"policies"`
+	ClientAuth        map[string]clientauth.Policy  `json:"client_auth" yaml:"client_auth"`
+	Upstream          map[string]upstreamtls.Policy `json:"upstream" yaml:"upstream"`
+}
+
+// ACME configures automatic certificates; it is disabled while DirectoryURL is empty
+type ACME struct {
+	DirectoryURL string `json:"directory_url" yaml:"directory_url"`
+	Email        string `json:"email" yaml:"email"`
+	CacheDir     string `json:"cache_dir" yaml:"cache_dir"`
+	CARoot       string `json:"ca_root" yaml:"ca_root"`
+	HTTPAddress  string `json:"http_address" yaml:"http_address"` // Listener for HTTP-01 challenges
+}
+
+// Admin configures the registration and admin APIs and the registry behind them
+type Admin struct {
+	Auth         apiauth.Policy `json:"auth" yaml:"auth"`                   // Open to anyone reaching the listener while it has no grants
+	RegistryFile string         `json:"registry_file" yaml:"registry_file"` // Empty to keep registrations in memory
+}
+
+// Route is a static route with its backends. Backends registered over the APIs are added to it.
+type Route struct {
+	Name      string    `json:"name" yaml:"name"`             // SNI, host or host/path; for L4 port forwarding a listener address such as ":5432"
+	Mode      string    `json:"mode" yaml:"mode"`             // passthrough, terminate or http (L4 proxy only)
+	Balancing string    `json:"balancing" yaml:"balancing"`   // How backends are picked, one of balancer.Policies; weighted by default
+	HTTPCache bool      `json:"http_cache" yaml:"http_cache"` // Cache GET responses of terminated traffic (L4 proxy only)
+	Backends  []Backend `json:"backends" yaml:"backends"`
+}
+
+// Backend is a static backend of a route
+type Backend struct {
+	Address  string            `json:"address" yaml:"address"`
+	Weight   *int              `json:"weight" yaml:"weight"` // 1 when left out; 0 sends no traffic
+	Metadata map[string]string `json:"metadata" yaml:"metadata"`
+}
+
+// UDP configures datagram routes of the L4 proxy
+type UDP struct {
+	Routes         map[string]string `json:"routes" yaml:"routes"` // Listener address to route name; none by default
+	SessionTimeout Duration          `json:"session_timeout" yaml:"session_timeout"`
+	MaxSessions    int               `json:"max_sessions" yaml:"max_sessions"` // Per listener, 0 for unlimited
+}
+
+// DNS configures how the L4 proxy resolves backend hostnames
+type DNS struct {
+	Server   string   `json:"server" yaml:"server"` // host:port; empty for the system resolver
+	CacheTTL Duration `json:"cache_ttl" yaml:"cache_ttl"`
+}
+
+// HTTPCache bounds the L4 proxy's response cache
+type HTTPCache struct {
+	MaxBody    int64 `json:"max_body" yaml:"max_body"`       // Largest response body stored, in bytes
+	MaxEntries int   `json:"max_entries" yaml:"max_entries"` // Most resources stored; the least recently used go first
+	MaxSize    int64 `json:"max_size" yaml:"max_size"`       // Most bytes of stored responses; the least recently used go first
+}
+
+// Discovery configures sources that keep backends up to date on their own, next to the
+// static routes and the registration APIs
+type Discovery struct {
+	Docker Docker `json:"docker" yaml:"docker"`
+	Files  Files  `json:"files" yaml:"files"`
+}
+
+// Docker discovers backends from the labels of running containers; disabled while Socket is empty
+type Docker struct {
+	Socket string `json:"socket" yaml:"socket"` // Docker Engine API socket, such as /var/run/docker.sock
+}
+
+// Files discovers backends from target files in the format of Prometheus file_sd; disabled while Paths is empty
+type Files struct {
+	Paths           []string `json:"paths" yaml:"paths"`                       // Files or glob patterns; JSON if named *.json, YAML otherwise
+	RefreshInterval Duration `json:"refresh_interval" yaml:"refresh_interval"` // How often the files are checked for changes
+}
+
+// Duration is a time.Duration written as a string such as "30s" or "1h"
+type Duration time.Duration
+
+// Time returns the duration as a time.Duration
+func (d Duration) Time() time.Duration {
+	return time.Duration(d)
+}
+
+func (d *Duration) UnmarshalYAML(node *yaml.Node) error {
+	var value string
+	if err := node.Decode(&value); err != nil {
+		return err
+	}
+	return d.parse(value)
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return fmt.Errorf("duration must be a string such as \"30s\"")
+	}
+	return d.parse(value)
+}
+
+func (d Duration) MarshalYAML() (any, error) {
+	return time.Duration(d).String(), nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) parse(value string) error {
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return fmt.Errorf("invalid duration %q", value)
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// Defaults returns the configuration of a proxy started without a file
+func Defaults(kind Kind) *File {
+	f := &File{
+		Listeners: Listeners{
+			Proxy:   ":443",
+			Admin:   ":8081",
+			Metrics: ":9100",
+			Pprof:   ":6060",
+		},
+		TLS: TLS{
+			CertFile:          "cert.pem",
+			KeyFile:           "key.pem",
+			CertDir:           "certs",
+			TicketKeyRotation: Duration(time.Hour),
+			ACME: ACME{
+				CacheDir:    "acme",
+				HTTPAddress: ":80",
+			},
+		},
+		Admin: Admin{
+			RegistryFile: "registry.log",
+		},
+		Discovery: Discovery{
+			Files: Files{RefreshInterval: Duration(5 * time.Second)},
+		},
+	}
+	if kind == L4 {
+		f.UDP.SessionTimeout = Duration(30 * time.Second)
+		f.UDP.MaxSessions = 10000
+		f.DNS.CacheTTL = Duration(30 * time.Second)
+		f.HTTPCache.MaxBody = 1 << 20
+		f.HTTPCache.MaxEntries = 10000
+		f.HTTPCache.MaxSize = 256 << 20
+	}
+	return f
+}
+
+// Load reads the file at path over the defaults of a proxy, applies environment overrides
+// and validates the result. An empty path loads the defaults with overrides.
+// Files ending in .json are JSON; anything else is YAML.
+func Load(path string, kind Kind) (*File, error) {
+	f := Defaults(kind)
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read configuration: %w", err)
+		}
+		if err := decode(data, strings.EqualFold(filepath.Ext(path), ".json"), f); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	if err := applyEnv(f, os.Environ()); err != nil {
+		return nil, err
+	}
+	if err := f.Validate(kind); err != nil {
+		source := path
+		if source == "" {
+			source = "defaults"
+		}
+		// One problem per line, so all of them can be fixed in one go
+		return nil, fmt.Errorf("invalid configuration %s:\n  %s", source, strings.ReplaceAll(err.Error(), "\n", "\n  "))
+	}
+	return f, nil
+}
+
+// decode strictly decodes one YAML or JSON document onto f
+func decode(data []byte, isJSON bool, f *File) error {
+	if isJSON {
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(f); err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		if decoder.More() {
+			return fmt.Errorf("unexpected data after the configuration object")
+		}
+		return nil
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(f); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	var extra yaml.Node
+	if err := decoder.Decode(&extra); !errors.Is(err, io.EOF) {
+		return fmt.Errorf("configuration must be a single YAML document")
+	}
+	return nil
+}
@@ -0,0 +1,305 @@
+package configfile
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const exampleYAML = `
+listeners:
+  proxy: ":8443"
+  admin: "127.0.0.1:8081"
+tls:
+  ticket_key_rotation: 30m
+routes:
+  - name: app.example.com
+    mode: terminate
+    balancing: round_robin
+    backends:
+      - address: 10.0.0.10:8443
+      - address: 10.0.0.11:8443
+        weight: 0
+        metadata: {zone: b}
+  - name: ":5432"
+    backends:
+      - address: db.internal:5432
+udp:
+  routes:
+    ":53": dns
+dns:
+  cache_ttl: 1m
+`
+
+const exampleJSON = `{
+  "listeners": {"proxy": ":8443", "admin": "127.0.0.1:8081"},
+  "tls": {"ticket_key_rotation": "30m"},
+  "routes": [
+    {"name": "app.example.com", "mode": "terminate", "balancing": "round_robin", "backends": [
+      {"address": "10.0.0.10:8443"},
+      {"address": "10.0.0.11:8443", "weight": 0, "metadata": {"zone": "b"}}
+    ]},
+    {"name": ":5432", "backends": [{"address": "db.internal:5432"}]}
+  ],
+  "udp": {"routes": {":53": "dns"}},
+  "dns": {"cache_ttl": "1m"}
+}`
+
+func writeFile(t *testing.T, name, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestDecodeIsStrict(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		data   string
+		isJSON bool
+		valid  bool
+	}{
+		{"YAML", exampleYAML, false, true},
+		{"JSON", exampleJSON, true, true},
+		{"empty YAML", "", false, true},
+		{"empty JSON", "", true, true},
+		{"YAML document marker", "---\nlisteners:\n  proxy: \":8443\"\n", false, true},
+		{"unknown YAML field", "listeners:\n  proxy: \":8443\"\n  proxi: \":8444\"\n", false, false},
+		{"unknown YAML section", "listener:\n  proxy: \":8443\"\n", false, false},
+		{"unknown JSON field", `{"listeners": {"proxi": ":8444"}}`, true, false},
+		{"unknown backend field", "routes:\n  - name: a.com\n    backends:\n      - addr: 10.0.0.1:443\n", false, false},
+		{"two YAML documents", "listeners:\n  proxy: \":8443\"\n---\nlisteners:\n  proxy: \":8444\"\n", false, false},
+		{"trailing document marker", "listeners:\n  proxy: \":8443\"\n---\n", false, false},
+		{"two JSON objects", `{"listeners": {}} {"listeners": {}}`, true, false},
+		{"YAML in a JSON file", exampleYAML, true, false},
+		{"wrong type", "udp:\n  max_sessions: many\n", false, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := decode([]byte(tc.data), tc.isJSON, Defaults(L4))
+			if tc.valid && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !tc.valid && err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
+
+func TestLoadJSONAndYAML(t *testing.T) {
+	fromYAML, err := Load(writeFile(t, "proxy.yaml", exampleYAML), L4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromJSON, err := Load(writeFile(t, "proxy.JSON", exampleJSON), L4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(fromYAML, fromJSON) {
+		t.Fatalf("YAML and JSON differ:\n%+v\n%+v", fromYAML, fromJSON)
+	}
+
+	// Values from the file over the defaults
+	if fromYAML.Listeners.Proxy != ":8443" || fromYAML.Listeners.Metrics != ":9100" {
+		t.Errorf("listeners = %+v", fromYAML.Listeners)
+	}
+	if fromYAML.TLS.TicketKeyRotation.Time() != 30*time.Minute || fromYAML.UDP.SessionTimeout.Time() != 30*time.Second {
+		t.Errorf("durations = %v, %v", fromYAML.TLS.TicketKeyRotation.Time(), fromYAML.UDP.SessionTimeout.Time())
+	}
+	backends := fromYAML.Routes[0].Backends
+	if backends[0].AdminBackend().Weight != 1 || backends[1].AdminBackend().Weight != 0 || backends[1].Metadata["zone"] != "b" {
+		t.Errorf("backends = %+v", backends)
+	}
+
+	// Any other extension is YAML
+	if _, err := Load(writeFile(t, "proxy.conf", exampleJSON), L4); err != nil {
+		t.Errorf("JSON is valid YAML too: %v", err)
+	}
+	if _, err := Load(writeFile(t, "proxy.json", exampleYAML), L4); err == nil {
+		t.Error("YAML loaded from a .json file")
+	}
+	if _, err := Load(filepath.Join(t.TempDir(), "missing.yaml"), L4); err == nil {
+		t.Error("missing file loaded")
+	}
+	if f, err := Load("", L7); err != nil || !reflect.DeepEqual(f, Defaults(L7)) {
+		t.Errorf("no file loaded %+v, %v; want the defaults", f, err)
+	}
+}
+
+func TestEnvOverrides(t *testing.T) {
+	f := Defaults(L4)
+	err := applyEnv(f, []string{
+		"PATH=/usr/bin",
+		"RPROXY_LISTENERS_PROXY=:9443",
+		"RPROXY_TLS_ACME_EMAIL=ops@example.com",
+		"RPROXY_TLS_TERMINATION=true",
+		"RPROXY_UDP_MAX_SESSIONS=5",
+		"RPROXY_DNS_CACHE_TTL=2m",
+		"RPROXY_HTTP_CACHE_MAX_SIZE=1048576",
+		"RPROXY_DISCOVERY_DOCKER_SOCKET=",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Listeners.Proxy != ":9443" || f.TLS.ACME.Email != "ops@example.com" || !f.TLS.Termination ||
+		f.UDP.MaxSessions != 5 || f.DNS.CacheTTL.Time() != 2*time.Minute || f.HTTPCache.MaxSize != 1<<20 {
+		t.Fatalf("overrides not applied: %+v", f)
+	}
+
+	for _, entry := range []string{
+		"RPROXY_LISTENERS_PROXI=:9443",     // Typo
+		"RPROXY_LISTENERS=:9443",           // A section, not a field
+		"RPROXY_UDP_ROUTES=:53=dns",        // Maps and lists only come from the file
+		"RPROXY_TLS_TERMINATION=sometimes", // Not a boolean
+		"RPROXY_UDP_MAX_SESSIONS=many",     // Not an integer
+		"RPROXY_DNS_CACHE_TTL=60",          // A duration needs a unit
+	} {
+		if err := applyEnv(Defaults(L4), []string{entry}); err == nil {
+			t.Errorf("%s: expected an error", entry)
+		} else if name, _, _ := strings.Cut(entry, "="); !strings.Contains(err.Error(), name) {
+			t.Errorf("%s: error %q doesn't name the variable", entry, err)
+		}
+	}
+}
+
+func TestLoadAppliesEnvOverFile(t *testing.T) {
+	path := writeFile(t, "proxy.yaml", exampleYAML)
+	t.Setenv("RPROXY_LISTENERS_PROXY", ":10443")
+	f, err := Load(path, L4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Listeners.Proxy != ":10443" {
+		t.Fatalf("listeners.proxy = %q, want the environment's", f.Listeners.Proxy)
+	}
+
+	// Overrides are validated like the file
+	t.Setenv("RPROXY_LISTENERS_PROXY", "nowhere")
+	if _, err := Load(path, L4); err == nil || !strings.Contains(err.Error(), "listeners.proxy") {
+		t.Fatalf("invalid override loaded: %v", err)
+	}
+	t.Setenv("RPROXY_LISTENERS_PROXY", ":10443")
+	t.Setenv("RPROXY_NO_SUCH_FIELD", "1")
+	if _, err := Load(path, L4); err == nil || !strings.Contains(err.Error(), "RPROXY_NO_SUCH_FIELD") {
+		t.Fatalf("unknown variable accepted: %v", err)
+	}
+}
+
+func TestDuration(t *testing.T) {
+	for value, want := range map[string]time.Duration{"30s": 30 * time.Second, "1h30m": 90 * time.Minute, "250ms": 250 * time.Millisecond} {
+		var fromYAML, fromJSON Duration
+		if err := yaml.Unmarshal([]byte(value), &fromYAML); err != nil || fromYAML.Time() != want {
+			t.Errorf("YAML %s = %v, %v", value, fromYAML.Time(), err)
+		}
+		if err := json.Unmarshal([]byte(`"`+value+`"`), &fromJSON); err != nil || fromJSON.Time() != want {
+			t.Errorf("JSON %s = %v, %v", value, fromJSON.Time(), err)
+		}
+	}
+
+	var d Duration
+	for _, value := range []string{"30", "soon", "[30s]"} {
+		if err := yaml.Unmarshal([]byte(value), &d); err == nil {
+			t.Errorf("YAML %s: expected an error", value)
+		}
+	}
+	for _, value := range []string{"30", `"30"`, `"soon"`} {
+		if err := json.Unmarshal([]byte(value), &d); err == nil {
+			t.Errorf("JSON %s: expected an error", value)
+		}
+	}
+
+	// Durations are written the way they are read
+	data, err := json.Marshal(Duration(90 * time.Second))
+	if err != nil || string(data) != `"1m30s"` {
+		t.Errorf("JSON = %s, %v", data, err)
+	}
+	out, err := yaml.Marshal(Duration(90 * time.Second))
+	if err != nil || strings.TrimSpace(string(out)) != "1m30s" {
+		t.Errorf("YAML = %s, %v", out, err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, kind := range []Kind{L4, L7} {
+		if err := Defaults(kind).Validate(kind); err != nil {
+			t.Errorf("%s defaults: %v", kind, err)
+		}
+	}
+
+	weight := func(n int) *int { return &n }
+	for _, tc := range []struct {
+		name   string
+		kind   Kind
+		change func(f *File)
+		want   string // Path of the field at fault
+	}{
+		{"missing proxy listener", L4, func(f *File) { f.Listeners.Proxy = "" }, "listeners.proxy"},
+		{"listener without port", L4, func(f *File) { f.Listeners.Admin = "localhost" }, "listeners.admin"},
+		{"listener port out of range", L4, func(f *File) { f.Listeners.Metrics = ":70000" }, "listeners.metrics"},
+		{"QUIC on L7", L7, func(f *File) { f.Listeners.QUIC = ":443" }, "listeners.quic"},
+		{"termination on L7", L7, func(f *File) { f.TLS.Termination = true }, "tls.termination"},
+		{"certificate without key", L4, func(f *File) { f.TLS.KeyFile = "" }, "tls"},
+		{"ticket key rotation", L4, func(f *File) { f.TLS.TicketKeyRotation = 0 }, "tls.ticket_key_rotation"},
+		{"ACME without cache", L4, func(f *File) { f.TLS.ACME.DirectoryURL = "https://acme.example.com"; f.TLS.ACME.CacheDir = "" }, "tls.acme.cache_dir"},
+		{"route without name", L4, func(f *File) { f.Routes = []Route{{}} }, "routes[0].name"},
+		{"duplicate route", L4, func(f *File) { f.Routes = []Route{{Name: "a.com"}, {Name: "A.com"}} }, "routes[1] (A.com).name"},
+		{"port-forward on L7", L7, func(f *File) { f.Routes = []Route{{Name: ":5432"}} }, "routes[0] (:5432).name"},
+		{"invalid route name", L4, func(f *File) { f.Routes = []Route{{Name: "a.com:x:y"}} }, "routes[0] (a.com:x:y).name"},
+		{"unknown mode", L4, func(f *File) { f.Routes = []Route{{Name: "a.com", Mode: "tunnel"}} }, "routes[0] (a.com).mode"},
+		{"mode on L7", L7, func(f *File) { f.Routes = []Route{{Name: "a.com", Mode: ModeHTTP}} }, "routes[0] (a.com).mode"},
+		{"mode of port-forward", L4, func(f *File) { f.Routes = []Route{{Name: ":5432", Mode: ModeTerminate}} }, "routes[0] (:5432).mode"},
+		{"HTTP cache on L7", L7, func(f *File) { f.Routes = []Route{{Name: "a.com", HTTPCache: true}} }, "routes[0] (a.com).http_cache"},
+		{"unknown balancing", L4, func(f *File) { f.Routes = []Route{{Name: "a.com", Balancing: "fastest"}} }, "routes[0] (a.com).balancing"},
+		{"backend without address", L4, func(f *File) { f.Routes = []Route{{Name: "a.com", Backends: []Backend{{}}}} }, "routes[0] (a.com).backends[0]"},
+		{"negative weight", L4, func(f *File) {
+			f.Routes = []Route{{Name: "a.com", Backends: []Backend{{Address: "10.0.0.1:443", Weight: weight(-1)}}}}
+		}, "routes[0] (a.com).backends[0]"},
+		{"duplicate backend", L4, func(f *File) {
+			f.Routes = []Route{{Name: "a.com", Backends: []Backend{{Address: "10.0.0.1:443"}, {Address: "10.0.0.1:443"}}}}
+		}, "routes[0] (a.com).backends[1]"},
+		{"Docker over TCP", L4, func(f *File) { f.Discovery.Docker.Socket = "tcp://127.0.0.1:2375" }, "discovery.docker.socket"},
+		{"bad target file pattern", L4, func(f *File) { f.Discovery.Files.Paths = []string{"targets/[.json"} }, "discovery.files.paths[0]"},
+		{"target file refresh", L4, func(f *File) { f.Discovery.Files.RefreshInterval = 0 }, "discovery.files.refresh_interval"},
+		{"UDP on L7", L7, func(f *File) { f.UDP.MaxSessions = 10 }, "udp"},
+		{"DNS on L7", L7, func(f *File) { f.DNS.Server = "10.0.0.2:53" }, "dns"},
+		{"HTTP cache section on L7", L7, func(f *File) { f.HTTPCache.MaxBody = 1 }, "http_cache"},
+		{"UDP listener", L4, func(f *File) { f.UDP.Routes = map[string]string{"53": "dns"} }, "udp.routes[53]"},
+		{"UDP route name", L4, func(f *File) { f.UDP.Routes = map[string]string{":53": ""} }, "udp.routes[:53]"},
+		{"UDP session timeout", L4, func(f *File) { f.UDP.SessionTimeout = 0 }, "udp.session_timeout"},
+		{"negative UDP sessions", L4, func(f *File) { f.UDP.MaxSessions = -1 }, "udp.max_sessions"},
+		{"DNS server", L4, func(f *File) { f.DNS.Server = "10.0.0.2" }, "dns.server"},
+		{"DNS cache TTL", L4, func(f *File) { f.DNS.CacheTTL = 0 }, "dns.cache_ttl"},
+		{"cache smaller than a body", L4, func(f *File) { f.HTTPCache.MaxSize = f.HTTPCache.MaxBody - 1 }, "http_cache.max_size"},
+		{"cache without entries", L4, func(f *File) { f.HTTPCache.MaxEntries = 0 }, "http_cache.max_entries"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			f := Defaults(tc.kind)
+			tc.change(f)
+			err := f.Validate(tc.kind)
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if !strings.HasPrefix(err.Error(), tc.want+": ") {
+				t.Fatalf("error %q doesn't start with %s", err, tc.want)
+			}
+		})
+	}
+
+	// Every problem is reported, one per line
+	f := Defaults(L4)
+	f.Listeners.Proxy = ""
+	f.UDP.MaxSessions = -1
+	f.Routes = []Route{{Name: "a.com", Balancing: "fastest"}}
+	err := f.Validate(L4)
+	if err == nil || strings.Count(err.Error(), "\n") != 2 {
+		t.Fatalf("want three problems, got %v", err)
+	}
+}
@@ -0,0 +1,84 @@
+package configfile
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var durationType = reflect.TypeOf(Duration(0))
+
+// applyEnv overrides scalar fields from RPROXY_ variables named after their path in the file,
+// e.g. tls.acme.email is RPROXY_TLS_ACME_EMAIL. Variables matching no field are errors, so a
+// typo doesn't silently leave the file's value in place.
+func applyEnv(f *File, environ []string) error {
+	fields := make(map[string]reflect.Value)
+	collectFields(reflect.ValueOf(f).Elem(), strings.TrimSuffix(EnvPrefix, "_"), fields)
+
+	for _, entry := range environ {
+		name, value, _ := strings.Cut(entry, "=")
+		if !strings.HasPrefix(name, EnvPrefix) {
+			continue
+		}
+		field, ok := fields[name]
+		if !ok {
+			return fmt.Errorf("%s: no such configuration field", name)
+		}
+		if err := setField(field, value); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// collectFields maps the variable name of every scalar field under v to the field
+func collectFields(v reflect.Value, prefix string, fields map[string]reflect.Value) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		tag, _, _ := strings.Cut(t.Field(i).Tag.Get("yaml"), ",")
+		if tag == "" || tag == "-" {
+			continue
+		}
+		name := prefix + "_" + strings.ToUpper(tag)
+		field := v.Field(i)
+		switch {
+		case field.Type() == durationType:
+			fields[name] = field
+		case field.Kind() == reflect.Struct:
+			collectFields(field, name, fields)
+		case field.Kind() == reflect.String, field.Kind() == reflect.Bool, field.Kind() == reflect.Int, field.Kind() == reflect.Int64:
+			fields[name] = field
+		}
+	}
+}
+
+func setField(field reflect.Value, value string) error {
+	if field.Type() == durationType {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q", value)
+		}
+		field.SetInt(int64(d))
+		return nil
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", value)
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", value)
+		}
+		field.SetInt(n)
+	}
+	return nil
+}
@@ -0,0 +1,230 @@
+package configfile
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"reverse-proxy/internal/adminapi"
+)
+
+// Metrics for reloads
+var (
+	reloads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "config_reloads_total",
+		Help: "Total number of configuration reloads, by result.",
+	}, []string{"result"})
+	lastReloadSuccessful = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "config_last_reload_successful",
+		Help: "Whether the last configuration reload was applied (1) or rejected (0).",
+	})
+	lastReloadSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "config_last_reload_success_timestamp_seconds",
+		Help: "Time of the last configuration reload that was applied.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(reloads, lastReloadSuccessful, lastReloadSuccess)
+	lastReloadSuccessful.Set(1)
+}
+
+// Diff is what changed between two configurations. Only routes are applied while the proxy
+// runs; the other sections are reported in Restart.
+type Diff struct {
+	Added   []string // Route names
+	Removed []string
+	Changed []string
+	Restart []string // Sections whose changes only apply after a restart
+}
+
+// Compare diffs the configuration a proxy runs against a new one
+func Compare(old, next *File) Diff {
+	var d Diff
+
+	oldRoutes := make(map[string]Route, len(old.Routes))
+	for _, route := range old.Routes {
+		oldRoutes[route.Name] = route
+	}
+	nextRoutes := make(map[string]bool, len(next.Routes))
+	for _, route := range next.Routes {
+		nextRoutes[route.Name] = true
+		previous, ok := oldRoutes[route.Name]
+		switch {
+		case !ok:
+			d.Added = append(d.Added, route.Name)
+		case !reflect.DeepEqual(previous, route):
+			d.Changed = append(d.Changed, route.Name)
+		}
+	}
+	for _, route := range old.Routes {
+		if !nextRoutes[route.Name] {
+			d.Removed = append(d.Removed, route.Name)
+		}
+	}
+
+	for _, section := range []struct {
+		name      string
+		old, next any
+	}{
+		{"listeners", old.Listeners, next.Listeners},
+		{"tls", old.TLS, next.TLS},
+		{"admin", old.Admin, next.Admin},
+		{"udp", old.UDP, next.UDP},
+		{"dns", old.DNS, next.DNS},
+		{"http_cache", old.HTTPCache, next.HTTPCache},
+		{"discovery", old.Discovery, next.Discovery},
+	} {
+		if !reflect.DeepEqual(section.old, section.next) {
+			d.Restart = append(d.Restart, section.name)
+		}
+	}
+	return d
+}
+
+// Empty reports whether no route changed
+func (d Diff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+// Changes lists the route changes, one line each
+func (d Diff) Changes() []string {
+	var changes []string
+	for _, name := range d.Added {
+		changes = append(changes, "added route "+name)
+	}
+	for _, name := range d.Removed {
+		changes = append(changes, "removed route "+name)
+	}
+	for _, name := range d.Changed {
+		changes = append(changes, "changed route "+name)
+	}
+	return changes
+}
+
+// Reloader re-reads a configuration file on SIGHUP, when the file changes, or when asked through
+// the admin API, and hands the routes that changed to the proxy. A file that fails to load or
+// apply leaves the running configuration in place.
+type Reloader struct {
+	path  string
+	load  func() (*File, error)
+	apply func(old, next *File, diff Diff) error
+
+	mu      sync.Mutex
+	current *File // Routes as last applied; other sections as the proxy started with them
+	status  adminapi.ReloadStatus
+}
+
+// NewReloader returns a reloader for the file the proxy started with. load reads the file the way
+// the proxy did at startup; apply updates the running routes and rejects changes it can't make.
+func NewReloader(path string, current *File, load func() (*File, error), apply func(old, next *File, diff Diff) error) *Reloader {
+	return &Reloader{
+		path:    path,
+		load:    load,
+		apply:   apply,
+		current: current,
+		status:  adminapi.ReloadStatus{Path: path},
+	}
+}
+
+// Reload loads, validates and applies the file as it is on disk
+func (r *Reloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	r.status.LastAttempt = &now
+
+	next, err := r.load()
+	var diff Diff
+	if err == nil {
+		diff = Compare(r.current, next)
+		if !diff.Empty() {
+			err = r.apply(r.current, next, diff)
+		}
+	}
+	if err != nil {
+		r.status.LastError = err.Error()
+		reloads.WithLabelValues("failure").Inc()
+		lastReloadSuccessful.Set(0)
+		log.Printf("Rejected configuration reload from %s, keeping the running configuration: %v", r.path, err)
+		return err
+	}
+
+	running := *r.current
+	running.Routes = next.Routes
+	r.current = &running
+
+	r.status.LastSuccess = &now
+	r.status.LastError = ""
+	r.status.RestartRequired = diff.Restart
+	if !diff.Empty() {
+		r.status.Generation++
+		r.status.Changes = diff.Changes()
+	}
+	reloads.WithLabelValues("success").Inc()
+	lastReloadSuccessful.Set(1)
+	lastReloadSuccess.Set(float64(now.Unix()))
+
+	if diff.Empty() {
+		log.Printf("Reloaded configuration from %s: routes unchanged", r.path)
+	} else {
+		log.Printf("Reloaded configuration from %s: %d routes added, %d removed, %d changed", r.path, len(diff.Added), len(diff.Removed), len(diff.Changed))
+	}
+	if len(diff.Restart) > 0 {
+		log.Printf("Warning: changes to %v in %s take effect after a restart", diff.Restart, r.path)
+	}
+	return nil
+}
+
+// ReloadStatus returns the outcome of the last reload
+func (r *Reloader) ReloadStatus() adminapi.ReloadStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.status
+}
+
+// Run reloads on SIGHUP and whenever the file's contents change, checking every interval
+func (r *Reloader) Run(interval time.Duration) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	last, _ := fingerprint(r.path)
+	for {
+		select {
+		case <-hangup:
+			log.Printf("Received SIGHUP, reloading configuration from %s", r.path)
+			last, _ = fingerprint(r.path)
+			r.Reload()
+		case <-ticker.C:
+			// A file that fails to reload is retried only once it changes again
+			state, err := fingerprint(r.path)
+			if err != nil || state == last {
+				continue
+			}
+			last = state
+			r.Reload()
+		}
+	}
+}
+
+// fingerprint hashes the file's contents, which unlike its modification time also changes when
+// a symlinked file (as in a mounted ConfigMap) is swapped
+func fingerprint(path string) ([sha256.Size]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return [sha256.Size]byte{}, fmt.Errorf("failed to read configuration: %w", err)
+	}
+	return sha256.Sum256(data), nil
+}
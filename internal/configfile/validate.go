@@ -0,0 +1,221 @@
+package configfile
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"reverse-proxy/internal/adminapi"
+	"reverse-proxy/internal/apiauth"
+	"reverse-proxy/internal/balancer"
+	"reverse-proxy/internal/clientauth"
+	"reverse-proxy/internal/tlspolicy"
+	"reverse-proxy/internal/upstreamtls"
+)
+
+// Validate checks a configuration for a proxy, reporting every problem with the path of the field at fault
+func (f *File) Validate(kind Kind) error {
+	var errs []error
+	fail := func(path, format string, args ...any) {
+		errs = append(errs, fmt.Errorf("%s: %s", path, fmt.Sprintf(format, args...)))
+	}
+
+	// Listeners
+	for _, l := range []struct {
+		path, address string
+		required      bool
+	}{
+		{"listeners.proxy", f.Listeners.Proxy, true},
+		{"listeners.quic", f.Listeners.QUIC, false},
+		{"listeners.admin", f.Listeners.Admin, true},
+		{"listeners.metrics", f.Listeners.Metrics, false},
+		{"listeners.pprof", f.Listeners.Pprof, false},
+		{"tls.acme.http_address", f.TLS.ACME.HTTPAddress, f.TLS.ACME.DirectoryURL != ""},
+	} {
+		if l.address == "" {
+			if l.required {
+				fail(l.path, "address is required")
+			}
+			continue
+		}
+		if err := checkAddress(l.address); err != nil {
+			fail(l.path, "%v", err)
+		}
+	}
+	if kind == L7 && f.Listeners.QUIC != "" {
+		fail("listeners.quic", "only supported by the L4 proxy")
+	}
+
+	// TLS
+	if kind == L7 && f.TLS.Termination {
+		fail("tls.termination", "only supported by the L4 proxy; the L7 proxy always terminates TLS")
+	}
+	if (f.TLS.CertFile == "") != (f.TLS.KeyFile == "") {
+		fail("tls", "cert_file and key_file must be set together")
+	}
+	if f.TLS.TicketKeyRotation <= 0 {
+		fail("tls.ticket_key_rotation", "must be positive")
+	}
+	if f.TLS.ACME.DirectoryURL != "" && f.TLS.ACME.CacheDir == "" {
+		fail("tls.acme.cache_dir", "required when ACME is enabled")
+	}
+	if _, err := tlspolicy.LoadAll(f.TLS.Policies); err != nil {
+		fail("tls.policies", "%v", err)
+	}
+	if _, err := clientauth.LoadAll(f.TLS.ClientAuth); err != nil {
+		fail("tls.client_auth", "%v", err)
+	}
+	if _, err := upstreamtls.LoadAll(f.TLS.Upstream); err != nil {
+		fail("tls.upstream", "%v", err)
+	}
+
+	// Admin
+	if _, err := apiauth.Load(f.Admin.Auth); err != nil {
+		fail("admin.auth", "%v", err)
+	}
+
+	// Routes
+	names := make(map[string]bool)
+	for i, route := range f.Routes {
+		path := fmt.Sprintf("routes[%d]", i)
+		name := strings.ToLower(route.Name)
+		if name == "" {
+			fail(path+".name", "is required")
+		} else {
+			path = fmt.Sprintf("routes[%d] (%s)", i, route.Name)
+			if names[name] {
+				fail(path+".name", "duplicate route")
+			}
+			names[name] = true
+		}
+
+		portForward := false
+		if _, _, err := net.SplitHostPort(name); err == nil {
+			portForward = true
+			if kind == L7 {
+				fail(path+".name", "port-forward routes are only supported by the L4 proxy")
+			} else if err := checkAddress(name); err != nil {
+				fail(path+".name", "%v", err)
+			}
+		} else if strings.Contains(name, ":") {
+			fail(path+".name", "invalid route name")
+		}
+
+		switch route.Mode {
+		case "":
+		case ModePassthrough, ModeTerminate, ModeHTTP:
+			if kind == L7 {
+				fail(path+".mode", "only supported by the L4 proxy")
+			} else if portForward {
+				fail(path+".mode", "port-forward routes carry no TLS")
+			}
+		default:
+			fail(path+".mode", "unknown mode %q (want %s, %s or %s)", route.Mode, ModePassthrough, ModeTerminate, ModeHTTP)
+		}
+		if route.HTTPCache && kind == L7 {
+			fail(path+".http_cache", "only supported by the L4 proxy")
+		}
+
+		if err := balancer.Valid(route.Balancing); err != nil {
+			fail(path+".balancing", "%v", err)
+		}
+
+		addresses := make(map[string]bool)
+		for j, backend := range route.Backends {
+			backendPath := fmt.Sprintf("%s.backends[%d]", path, j)
+			if err := backend.AdminBackend().Validate(); err != nil {
+				fail(backendPath, "%v", err)
+				continue
+			}
+			if addresses[backend.Address] {
+				fail(backendPath, "duplicate backend %s", backend.Address)
+			}
+			addresses[backend.Address] = true
+		}
+	}
+
+	// Discovery
+	if socket := f.Discovery.Docker.Socket; socket != "" && strings.Contains(socket, "://") && !strings.HasPrefix(socket, "unix://") {
+		fail("discovery.docker.socket", "only Unix sockets are supported")
+	}
+	for i, pattern := range f.Discovery.Files.Paths {
+		if _, err := filepath.Match(pattern, ""); err != nil || pattern == "" {
+			fail(fmt.Sprintf("discovery.files.paths[%d]", i), "invalid path or pattern %q", pattern)
+		}
+	}
+	if f.Discovery.Files.RefreshInterval <= 0 {
+		fail("discovery.files.refresh_interval", "must be positive")
+	}
+
+	// L4-only sections are empty in the L7 proxy's defaults, so anything set there came from the file
+	if kind == L7 {
+		if f.UDP.Routes != nil || f.UDP.SessionTimeout != 0 || f.UDP.MaxSessions != 0 {
+			fail("udp", "only supported by the L4 proxy")
+		}
+		if f.DNS != (DNS{}) {
+			fail("dns", "only supported by the L4 proxy")
+		}
+		if f.HTTPCache != (HTTPCache{}) {
+			fail("http_cache", "only supported by the L4 proxy")
+		}
+		return errors.Join(errs...)
+	}
+
+	for address, route := range f.UDP.Routes {
+		if err := checkAddress(address); err != nil {
+			fail("udp.routes["+address+"]", "%v", err)
+		}
+		if route == "" {
+			fail("udp.routes["+address+"]", "route name is required")
+		}
+	}
+	if f.UDP.SessionTimeout <= 0 {
+		fail("udp.session_timeout", "must be positive")
+	}
+	if f.UDP.MaxSessions < 0 {
+		fail("udp.max_sessions", "must not be negative")
+	}
+	if f.DNS.Server != "" {
+		if err := checkAddress(f.DNS.Server); err != nil {
+			fail("dns.server", "%v", err)
+		}
+	}
+	if f.DNS.CacheTTL <= 0 {
+		fail("dns.cache_ttl", "must be positive")
+	}
+	if f.HTTPCache.MaxBody <= 0 {
+		fail("http_cache.max_body", "must be positive")
+	}
+	if f.HTTPCache.MaxEntries <= 0 {
+		fail("http_cache.max_entries", "must be positive")
+	}
+	if f.HTTPCache.MaxSize < f.HTTPCache.MaxBody {
+		fail("http_cache.max_size", "must be at least max_body")
+	}
+
+	return errors.Join(errs...)
+}
+
+// checkAddress requires a host:port listener or server address with a numeric port
+func checkAddress(address string) error {
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Errorf("invalid address %q: want host:port or :port", address)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+		return fmt.Errorf("invalid port in address %q", address)
+	}
+	return nil
+}
+
+// AdminBackend returns the backend as the registry stores it, with the default weight if the file has none
+func (b Backend) AdminBackend() adminapi.Backend {
+	weight := adminapi.DefaultWeight
+	if b.Weight != nil {
+		weight = *b.Weight
+	}
+	return adminapi.Backend{Address: b.Address, Weight: weight, Metadata: b.Metadata}
+}
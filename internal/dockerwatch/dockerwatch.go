@@ -0,0 +1,346 @@
+// Package dockerwatch discovers backends from the labels of running Docker containers.
+//
+// It talks to the Docker Engine API over its Unix socket: it lists labeled containers, then
+// follows the events stream and lists them again whenever a container starts, stops or
+// changes state, handing every listing to the proxy as the complete set of targets. A
+// container is a backend when it carries
+//
+//	rproxy.sni=foo.com      route the container serves (rproxy.host is accepted too);
+//	                        several routes are separated by commas
+//	rproxy.port=8443        port the proxy connects to on the container's address
+//
+// and optionally rproxy.weight, rproxy.network (which network's address to use when the
+// container is on several) and rproxy.scheme (http or https, for the L7 proxy).
+package dockerwatch
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"reverse-proxy/internal/adminapi"
+)
+
+// Labels read from containers
+const (
+	LabelSNI     = "rproxy.sni"
+	LabelHost    = "rproxy.host"
+	LabelPort    = "rproxy.port"
+	LabelWeight  = "rproxy.weight"
+	LabelNetwork = "rproxy.network"
+	LabelScheme  = "rproxy.scheme"
+)
+
+// Bounds of the delay before reconnecting to a Docker daemon that went away
+const (
+	minRetryDelay = time.Second
+	maxRetryDelay = 30 * time.Second
+)
+
+// Metrics for discovery
+var (
+	syncs = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "docker_discovery_syncs_total",
+		Help: "Total number of container listings applied or failed, by result.",
+	}, []string{"result"})
+	targets = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "docker_discovery_targets",
+		Help: "Number of backends discovered from container labels.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(syncs, targets)
+}
+
+// Target is one route of one labeled container
+type Target struct {
+	Container string // Container name, or ID if it has none
+	Route     string
+	Address   string // host:port
+	Scheme    string // From rproxy.scheme; empty if unset
+	Weight    int
+}
+
+// Backend returns the target as a backend of its route; address is the target's address in
+// the form the proxy dials, such as a URL for the L7 proxy
+func (t Target) Backend(address string) adminapi.Backend {
+	return adminapi.Backend{
+		Address:  address,
+		Weight:   t.Weight,
+		Metadata: map[string]string{"source": "docker", "container": t.Container},
+	}
+}
+
+// Watcher follows a Docker daemon and reports its labeled containers
+type Watcher struct {
+	socket string
+	client *http.Client
+	sync   func([]Target)
+}
+
+// New returns a watcher for the Engine API at socket, a path or unix:// URL, that hands
+// every complete set of targets to sync
+func New(socket string, sync func([]Target)) *Watcher {
+	socket = strings.TrimPrefix(socket, "unix://")
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", socket)
+		},
+	}
+	return &Watcher{socket: socket, client: &http.Client{Transport: transport}, sync: sync}
+}
+
+// Run watches the daemon until ctx is done, reconnecting with a growing delay when it fails.
+// The last set of targets stays in place while the daemon can't be reached.
+func (w *Watcher) Run(ctx context.Context) {
+	delay := minRetryDelay
+	for {
+		started := time.Now()
+		err := w.watch(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		syncs.WithLabelValues("error").Inc()
+		if time.Since(started) > maxRetryDelay {
+			delay = minRetryDelay
+		}
+		log.Printf("Docker discovery on %s failed, retrying in %s: %v", w.socket, delay, err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay = min(2*delay, maxRetryDelay)
+	}
+}
+
+// watch subscribes to container events, then lists the containers and lists them again on
+// every event that may change the targets. Subscribing first means no change is missed.
+func (w *Watcher) watch(ctx context.Context) error {
+	filters := url.QueryEscape(`{"type":["container"]}`)
+	resp, err := w.get(ctx, "/events?filters="+filters)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := w.refresh(ctx); err != nil {
+		return err
+	}
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var event struct {
+			Type   string `json:"Type"`
+			Action string `json:"Action"`
+		}
+		if err := decoder.Decode(&event); err != nil {
+			if err == io.EOF {
+				return fmt.Errorf("events stream closed")
+			}
+			return fmt.Errorf("failed to read events: %w", err)
+		}
+		if event.Type != "container" || !changesTargets(event.Action) {
+			continue
+		}
+		if err := w.refresh(ctx); err != nil {
+			return err
+		}
+	}
+}
+
+// changesTargets reports whether a container event may add or remove a target.
+// Health and exec actions carry a suffix, as in "health_status: healthy".
+func changesTargets(action string) bool {
+	action, _, _ = strings.Cut(action, ":")
+	switch action {
+	case "start", "restart", "die", "stop", "kill", "destroy", "pause", "unpause", "rename", "update":
+		return true
+	}
+	return false
+}
+
+// refresh lists the labeled containers and hands their targets to sync
+func (w *Watcher) refresh(ctx context.Context) error {
+	list, err := w.List(ctx)
+	if err != nil {
+		return err
+	}
+	w.sync(list)
+	syncs.WithLabelValues("success").Inc()
+	targets.Set(float64(len(list)))
+	return nil
+}
+
+// container is the part of a container listing discovery reads
+type container struct {
+	ID         string            `json:"Id"`
+	Names      []string          `json:"Names"`
+	Labels     map[string]string `json:"Labels"`
+	HostConfig struct {
+		NetworkMode string `json:"NetworkMode"`
+	} `json:"HostConfig"`
+	NetworkSettings struct {
+		Networks map[string]endpoint `json:"Networks"`
+	} `json:"NetworkSettings"`
+}
+
+// endpoint is a container's attachment to one network
+type endpoint struct {
+	IPAddress         string `json:"IPAddress"`
+	GlobalIPv6Address string `json:"GlobalIPv6Address"`
+}
+
+// List returns the targets of every running container with a port label, sorted by route and address.
+// Containers with labels that can't be used are logged and skipped.
+func (w *Watcher) List(ctx context.Context) ([]Target, error) {
+	filters := url.QueryEscape(`{"status":["running"],"label":["` + LabelPort + `"]}`)
+	resp, err := w.get(ctx, "/containers/json?filters="+filters)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var containers []container
+	if err := json.NewDecoder(resp.Body).Decode(&containers); err != nil {
+		return nil, fmt.Errorf("failed to decode container list: %w", err)
+	}
+
+	var list []Target
+	for _, c := range containers {
+		found, err := c.targets()
+		if err != nil {
+			log.Printf("Ignoring container %s: %v", c.name(), err)
+			continue
+		}
+		list = append(list, found...)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Route != list[j].Route {
+			return list[i].Route < list[j].Route
+		}
+		return list[i].Address < list[j].Address
+	})
+	return list, nil
+}
+
+func (w *Watcher) get(ctx context.Context, path string) (*http.Response, error) {
+	// The host is ignored; every request goes to the socket
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://docker"+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach Docker API: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		resp.Body.Close()
+		return nil, fmt.Errorf("Docker API answered %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return resp, nil
+}
+
+func (c container) name() string {
+	if len(c.Names) > 0 {
+		return strings.TrimPrefix(c.Names[0], "/")
+	}
+	return c.ID
+}
+
+// targets reads a container's labels into one target per route
+func (c container) targets() ([]Target, error) {
+	routes := c.Labels[LabelSNI]
+	if routes == "" {
+		routes = c.Labels[LabelHost]
+	}
+	if routes == "" {
+		return nil, fmt.Errorf("%s label is missing", LabelSNI)
+	}
+
+	port, err := strconv.Atoi(c.Labels[LabelPort])
+	if err != nil || port <= 0 || port > 65535 {
+		return nil, fmt.Errorf("invalid %s label %q", LabelPort, c.Labels[LabelPort])
+	}
+
+	weight := adminapi.DefaultWeight
+	if value, ok := c.Labels[LabelWeight]; ok {
+		if weight, err = strconv.Atoi(value); err != nil || weight < 0 || weight > adminapi.MaxWeight {
+			return nil, fmt.Errorf("invalid %s label %q", LabelWeight, value)
+		}
+	}
+
+	scheme := c.Labels[LabelScheme]
+	if scheme != "" && scheme != "http" && scheme != "https" {
+		return nil, fmt.Errorf("invalid %s label %q (want http or https)", LabelScheme, scheme)
+	}
+
+	host, err := c.address()
+	if err != nil {
+		return nil, err
+	}
+
+	var found []Target
+	for _, route := range strings.Split(routes, ",") {
+		route = strings.ToLower(strings.TrimSpace(route))
+		if route == "" {
+			continue
+		}
+		found = append(found, Target{
+			Container: c.name(),
+			Route:     route,
+			Address:   net.JoinHostPort(host, strconv.Itoa(port)),
+			Scheme:    scheme,
+			Weight:    weight,
+		})
+	}
+	return found, nil
+}
+
+// address returns the IP the proxy reaches a container at: on the network named by its label,
+// else on its only network, else on the first of its networks by name
+func (c container) address() (string, error) {
+	if c.HostConfig.NetworkMode == "host" {
+		return "127.0.0.1", nil
+	}
+
+	networks := c.NetworkSettings.Networks
+	if name := c.Labels[LabelNetwork]; name != "" {
+		network, ok := networks[name]
+		if !ok {
+			return "", fmt.Errorf("not attached to network %s", name)
+		}
+		networks = map[string]endpoint{name: network}
+	}
+
+	names := make([]string, 0, len(networks))
+	for name := range networks {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		if ip := networks[name].IPAddress; ip != "" {
+			return ip, nil
+		}
+		if ip := networks[name].GlobalIPv6Address; ip != "" {
+			return ip, nil
+		}
+	}
+	return "", fmt.Errorf("no network address")
+}
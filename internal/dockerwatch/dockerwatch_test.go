@@ -0,0 +1,211 @@
+package dockerwatch
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeDocker serves the two Engine API endpoints discovery uses on a Unix socket
+type fakeDocker struct {
+	socket string
+
+	mu          sync.Mutex
+	containers  []map[string]any
+	events      chan string   // Actions to send on the open events stream
+	closeEvents chan struct{} // Ends the open events stream
+	subscribed  chan struct{} // Receives a value per events subscription
+}
+
+func newFakeDocker(t *testing.T) *fakeDocker {
+	t.Helper()
+	d := &fakeDocker{
+		socket:      filepath.Join(t.TempDir(), "docker.sock"),
+		events:      make(chan string),
+		closeEvents: make(chan struct{}),
+		subscribed:  make(chan struct{}, 10),
+	}
+	listener, err := net.Listen("unix", d.socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/containers/json", func(w http.ResponseWriter, r *http.Request) {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		json.NewEncoder(w).Encode(d.containers)
+	})
+	mux.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		d.subscribed <- struct{}{}
+		for {
+			select {
+			case action := <-d.events:
+				json.NewEncoder(w).Encode(map[string]string{"Type": "container", "Action": action})
+				w.(http.Flusher).Flush()
+			case <-d.closeEvents:
+				return
+			case <-r.Context().Done():
+				return
+			}
+		}
+	})
+	server := &http.Server{Handler: mux}
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Close() })
+	return d
+}
+
+func (d *fakeDocker) set(containers ...map[string]any) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.containers = containers
+}
+
+func labeled(name, ip string, labels map[string]string) map[string]any {
+	return map[string]any{
+		"Id":     name + "-id",
+		"Names":  []string{"/" + name},
+		"Labels": labels,
+		"NetworkSettings": map[string]any{
+			"Networks": map[string]any{"bridge": map[string]string{"IPAddress": ip}},
+		},
+	}
+}
+
+func web(name, ip string) map[string]any {
+	return labeled(name, ip, map[string]string{LabelSNI: "foo.com", LabelPort: "8443"})
+}
+
+// watch runs a watcher against the fake and returns the target sets it syncs
+func watch(t *testing.T, d *fakeDocker) <-chan []Target {
+	t.Helper()
+	synced := make(chan []Target, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go New("unix://"+d.socket, func(targets []Target) { synced <- targets }).Run(ctx)
+	return synced
+}
+
+func next(t *testing.T, synced <-chan []Target, timeout time.Duration) []Target {
+	t.Helper()
+	select {
+	case targets := <-synced:
+		return targets
+	case <-time.After(timeout):
+		t.Fatal("no sync")
+		return nil
+	}
+}
+
+func addressesOf(targets []Target) []string {
+	var list []string
+	for _, target := range targets {
+		list = append(list, target.Route+" "+target.Address)
+	}
+	return list
+}
+
+func TestWatcherSyncsOnStartAndStop(t *testing.T) {
+	d := newFakeDocker(t)
+	d.set(web("a", "172.17.0.2"))
+	synced := watch(t, d)
+
+	if got := addressesOf(next(t, synced, time.Second)); len(got) != 1 || got[0] != "foo.com 172.17.0.2:8443" {
+		t.Fatalf("initial targets = %v", got)
+	}
+
+	d.set(web("a", "172.17.0.2"), web("b", "172.17.0.3"))
+	d.events <- "start"
+	if got := next(t, synced, time.Second); len(got) != 2 {
+		t.Fatalf("targets after start = %v", addressesOf(got))
+	}
+
+	// Events that can't change the targets don't cause a listing
+	d.events <- "exec_start: sh"
+	d.set(web("b", "172.17.0.3"))
+	d.events <- "die"
+	got := next(t, synced, time.Second)
+	if len(got) != 1 || got[0].Container != "b" {
+		t.Fatalf("targets after die = %v", addressesOf(got))
+	}
+	select {
+	case extra := <-synced:
+		t.Fatalf("unexpected sync: %v", addressesOf(extra))
+	default:
+	}
+}
+
+func TestWatcherReconnects(t *testing.T) {
+	d := newFakeDocker(t)
+	d.set(web("a", "172.17.0.2"))
+	synced := watch(t, d)
+	next(t, synced, time.Second)
+	<-d.subscribed
+
+	// The daemon goes away; what changed meanwhile is picked up after reconnecting
+	d.set(web("b", "172.17.0.3"))
+	d.closeEvents <- struct{}{}
+
+	got := next(t, synced, minRetryDelay+2*time.Second)
+	if len(got) != 1 || got[0].Address != "172.17.0.3:8443" {
+		t.Fatalf("targets after reconnecting = %v", addressesOf(got))
+	}
+	select {
+	case <-d.subscribed:
+	case <-time.After(time.Second):
+		t.Fatal("watcher didn't subscribe to events again")
+	}
+}
+
+func TestListReadsLabels(t *testing.T) {
+	d := newFakeDocker(t)
+	multi := labeled("multi", "", map[string]string{
+		LabelSNI: "Foo.com, bar.com", LabelPort: "80", LabelWeight: "3", LabelNetwork: "backend", LabelScheme: "https",
+	})
+	multi["NetworkSettings"] = map[string]any{"Networks": map[string]any{
+		"bridge":  map[string]string{"IPAddress": "172.17.0.5"},
+		"backend": map[string]string{"IPAddress": "10.1.0.5"},
+	}}
+	host := labeled("host", "", map[string]string{LabelHost: "baz.com", LabelPort: "9000"})
+	host["HostConfig"] = map[string]string{"NetworkMode": "host"}
+	d.set(
+		multi,
+		host,
+		labeled("noport", "172.17.0.6", map[string]string{LabelSNI: "foo.com", LabelPort: "http"}),
+		labeled("nosni", "172.17.0.7", map[string]string{LabelPort: "80"}),
+		labeled("badnet", "172.17.0.8", map[string]string{LabelSNI: "foo.com", LabelPort: "80", LabelNetwork: "missing"}),
+	)
+
+	targets, err := New(d.socket, nil).List(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Target{
+		{Container: "multi", Route: "bar.com", Address: "10.1.0.5:80", Scheme: "https", Weight: 3},
+		{Container: "host", Route: "baz.com", Address: "127.0.0.1:9000", Weight: 1},
+		{Container: "multi", Route: "foo.com", Address: "10.1.0.5:80", Scheme: "https", Weight: 3},
+	}
+	if len(targets) != len(want) {
+		t.Fatalf("targets = %+v, want %+v", targets, want)
+	}
+	for i := range want {
+		if targets[i] != want[i] {
+			t.Errorf("target %d = %+v, want %+v", i, targets[i], want[i])
+		}
+	}
+}
+
+func TestListFailsWithoutDaemon(t *testing.T) {
+	w := New(filepath.Join(t.TempDir(), "missing.sock"), nil)
+	if _, err := w.List(context.Background()); err == nil {
+		t.Fatal("expected an error without a daemon")
+	}
+}
@@ -0,0 +1,275 @@
+// Package filesd discovers backends from target files in the format of Prometheus file_sd.
+//
+// Each file holds a list of target groups, as JSON if its name ends in .json and as YAML otherwise:
+//
+//	[{"targets": ["10.0.0.1:8443", "10.0.0.2:8443"], "labels": {"sni": "foo.com", "zone": "b"}}]
+//
+// Targets are host:port, or URLs such as unix:// sockets; a file with any other target is
+// rejected as a whole. The sni label (or host) names the route of a group's targets. The
+// optional weight label sets their weight and scheme (http or https) how the L7 proxy
+// reaches them; any other label is copied to the backends' metadata.
+//
+// Files are named by path or glob pattern and read again whenever their content changes,
+// handing the targets of all of them to the proxy as the complete set. A file that can't
+// be read or parsed keeps its last good targets; a file that is deleted loses them.
+package filesd
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v3"
+
+	"reverse-proxy/internal/adminapi"
+)
+
+// Labels with a meaning of their own; the others are copied to the backends' metadata
+const (
+	LabelSNI    = "sni"
+	LabelHost   = "host"
+	LabelWeight = "weight"
+	LabelScheme = "scheme"
+)
+
+// Metrics for discovery
+var (
+	readErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "file_discovery_read_errors_total",
+		Help: "Total number of target files that couldn't be read or parsed.",
+	})
+	targets = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "file_discovery_targets",
+		Help: "Number of backends discovered from target files.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(readErrors, targets)
+}
+
+// Group is one entry of a target file
+type Group struct {
+	Targets []string          `json:"targets" yaml:"targets"`
+	Labels  map[string]string `json:"labels" yaml:"labels"`
+}
+
+// Target is one target of one group
+type Target struct {
+	File     string // File the target was read from
+	Route    string
+	Address  string // As written in the file, usually host:port
+	Scheme   string // From the scheme label; empty if unset
+	Weight   int
+	Metadata map[string]string // Labels other than the ones above
+}
+
+// Backend returns the target as a backend of its route; address is the target's address in
+// the form the proxy dials, such as a URL for the L7 proxy
+func (t Target) Backend(address string) adminapi.Backend {
+	return adminapi.Backend{Address: address, Weight: t.Weight, Metadata: t.Metadata}
+}
+
+// Watcher follows a set of target files
+type Watcher struct {
+	patterns []string
+	sync     func([]Target)
+
+	files  map[string]*file // Last good read by path
+	synced bool
+}
+
+type file struct {
+	sum     [sha256.Size]byte
+	targets []Target
+}
+
+// New returns a watcher for the files matching patterns that hands every complete set of targets to sync
+func New(patterns []string, sync func([]Target)) *Watcher {
+	return &Watcher{patterns: patterns, sync: sync, files: make(map[string]*file)}
+}
+
+// Run reads the files now and then every interval until ctx is done, syncing whenever the targets change
+func (w *Watcher) Run(ctx context.Context, interval time.Duration) {
+	w.Refresh()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			w.Refresh()
+		}
+	}
+}
+
+// Refresh reads every file whose content changed, and files that appeared or disappeared, then
+// syncs if any of them changed the targets. It reports whether it synced.
+func (w *Watcher) Refresh() bool {
+	paths := make(map[string]bool)
+	for _, pattern := range w.patterns {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			log.Printf("Invalid target file pattern %s: %v", pattern, err)
+			continue
+		}
+		for _, path := range matches {
+			paths[path] = true
+		}
+	}
+
+	changed := !w.synced // The first refresh always syncs, even if there is nothing
+	for path := range w.files {
+		if !paths[path] {
+			delete(w.files, path)
+			log.Printf("Target file %s is gone, removing its targets", path)
+			changed = true
+		}
+	}
+	for path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			if !errors.Is(err, os.ErrNotExist) { // Deleted since the glob; the next refresh drops it
+				readErrors.Inc()
+				log.Printf("Failed to read target file %s, keeping its last targets: %v", path, err)
+			}
+			continue
+		}
+		sum := sha256.Sum256(data)
+		if previous, ok := w.files[path]; ok && previous.sum == sum {
+			continue
+		}
+
+		found, err := Parse(path, data)
+		if err != nil {
+			readErrors.Inc()
+			log.Printf("Failed to parse target file %s, keeping its last targets: %v", path, err)
+			if previous, ok := w.files[path]; ok {
+				previous.sum = sum // Don't log the same bad content every interval
+			} else {
+				w.files[path] = &file{sum: sum}
+			}
+			continue
+		}
+		w.files[path] = &file{sum: sum, targets: found}
+		changed = true
+	}
+	if !changed {
+		return false
+	}
+
+	var all []Target
+	for _, f := range w.files {
+		all = append(all, f.targets...)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].Route != all[j].Route {
+			return all[i].Route < all[j].Route
+		}
+		return all[i].Address < all[j].Address
+	})
+	w.sync(all)
+	w.synced = true
+	targets.Set(float64(len(all)))
+	return true
+}
+
+// Parse reads the target groups of a file, JSON if path ends in .json and YAML otherwise
+func Parse(path string, data []byte) ([]Target, error) {
+	var groups []Group
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&groups); err != nil {
+			return nil, err
+		}
+	} else {
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(&groups); err != nil && !errors.Is(err, io.EOF) { // An empty file has no groups
+			return nil, err
+		}
+	}
+
+	var found []Target
+	for i, group := range groups {
+		route := group.Labels[LabelSNI]
+		if route == "" {
+			route = group.Labels[LabelHost]
+		}
+		if route == "" {
+			return nil, fmt.Errorf("group %d: %s or %s label is required", i, LabelSNI, LabelHost)
+		}
+
+		weight := adminapi.DefaultWeight
+		if value, ok := group.Labels[LabelWeight]; ok {
+			var err error
+			if weight, err = strconv.Atoi(value); err != nil || weight < 0 || weight > adminapi.MaxWeight {
+				return nil, fmt.Errorf("group %d: invalid %s label %q", i, LabelWeight, value)
+			}
+		}
+
+		scheme := group.Labels[LabelScheme]
+		if scheme != "" && scheme != "http" && scheme != "https" {
+			return nil, fmt.Errorf("group %d: invalid %s label %q (want http or https)", i, LabelScheme, scheme)
+		}
+
+		metadata := maps.Clone(group.Labels)
+		for _, label := range []string{LabelSNI, LabelHost, LabelWeight, LabelScheme} {
+			delete(metadata, label)
+		}
+		if len(metadata) == 0 {
+			metadata = nil
+		}
+
+		for _, address := range group.Targets {
+			if err := checkTarget(address); err != nil {
+				return nil, fmt.Errorf("group %d: %w", i, err)
+			}
+			found = append(found, Target{
+				File:     path,
+				Route:    strings.ToLower(route),
+				Address:  address,
+				Scheme:   scheme,
+				Weight:   weight,
+				Metadata: metadata,
+			})
+		}
+	}
+	return found, nil
+}
+
+// checkTarget requires a host:port target, or a URL such as a unix:// socket
+func checkTarget(address string) error {
+	if strings.Contains(address, "://") {
+		if _, err := url.Parse(address); err != nil {
+			return fmt.Errorf("invalid target %q: %w", address, err)
+		}
+		return nil
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || host == "" {
+		return fmt.Errorf("invalid target %q: want host:port", address)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+		return fmt.Errorf("invalid target %q: invalid port", address)
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+package filesd
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// watch returns a watcher of patterns and the targets of its last sync
+func watch(patterns ...string) (*Watcher, *[]Target) {
+	var synced []Target
+	return New(patterns, func(targets []Target) { synced = targets }), &synced
+}
+
+func write(t *testing.T, path, data string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// addresses lists targets as "route address"
+func addresses(targets []Target) []string {
+	var listed []string
+	for _, target := range targets {
+		listed = append(listed, target.Route+" "+target.Address)
+	}
+	return listed
+}
+
+func TestParse(t *testing.T) {
+	const yamlGroups = `
+- targets: ["10.0.0.1:8443", "10.0.0.2:8443"]
+  labels: {sni: Foo.com, zone: b, weight: "3"}
+- targets: ["unix:///run/app.sock"]
+  labels: {host: bar.com, scheme: https}
+`
+	const jsonGroups = `[
+  {"targets": ["10.0.0.1:8443", "10.0.0.2:8443"], "labels": {"sni": "Foo.com", "zone": "b", "weight": "3"}},
+  {"targets": ["unix:///run/app.sock"], "labels": {"host": "bar.com", "scheme": "https"}}
+]`
+	want := []Target{
+		{File: "targets", Route: "foo.com", Address: "10.0.0.1:8443", Weight: 3, Metadata: map[string]string{"zone": "b"}},
+		{File: "targets", Route: "foo.com", Address: "10.0.0.2:8443", Weight: 3, Metadata: map[string]string{"zone": "b"}},
+		{File: "targets", Route: "bar.com", Address: "unix:///run/app.sock", Scheme: "https", Weight: 1},
+	}
+
+	for path, data := range map[string]string{"targets.yaml": yamlGroups, "targets.yml": yamlGroups, "targets.json": jsonGroups, "targets.JSON": jsonGroups} {
+		found, err := Parse(path, []byte(data))
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		for i := range want {
+			want[i].File = path
+		}
+		if !reflect.DeepEqual(found, want) {
+			t.Fatalf("%s: parsed %+v\nwant %+v", path, found, want)
+		}
+	}
+
+	if found, err := Parse("empty.yaml", nil); err != nil || len(found) != 0 {
+		t.Errorf("empty file parsed to %v, %v", found, err)
+	}
+	if found, err := Parse("empty.json", []byte("[]")); err != nil || len(found) != 0 {
+		t.Errorf("empty list parsed to %v, %v", found, err)
+	}
+	if found, _ := Parse("t.yaml", []byte(`[{targets: ["10.0.0.1:443"], labels: {sni: a.com, sni_zone: x}}]`)); found[0].Weight != 1 {
+		t.Errorf("target without a weight label has weight %d", found[0].Weight)
+	}
+}
+
+func TestParseRejectsFile(t *testing.T) {
+	for name, data := range map[string]string{
+		"no route label":       `[{targets: ["10.0.0.1:443"], labels: {zone: b}}]`,
+		"no labels":            `[{targets: ["10.0.0.1:443"]}]`,
+		"weight not a number":  `[{targets: ["10.0.0.1:443"], labels: {sni: a.com, weight: heavy}}]`,
+		"negative weight":      `[{targets: ["10.0.0.1:443"], labels: {sni: a.com, weight: "-1"}}]`,
+		"weight above maximum": `[{targets: ["10.0.0.1:443"], labels: {sni: a.com, weight: "1000000"}}]`,
+		"unknown scheme":       `[{targets: ["10.0.0.1:443"], labels: {sni: a.com, scheme: ftp}}]`,
+		"target without port":  `[{targets: ["10.0.0.1"], labels: {sni: a.com}}]`,
+		"target without host":  `[{targets: [":443"], labels: {sni: a.com}}]`,
+		"target port range":    `[{targets: ["10.0.0.1:0"], labels: {sni: a.com}}]`,
+		"invalid URL target":   `[{targets: ["http://[::1"], labels: {sni: a.com}}]`,
+		"one bad target":       `[{targets: ["10.0.0.1:443"], labels: {sni: a.com}}, {targets: ["bad"], labels: {sni: b.com}}]`,
+		"unknown field":        `[{targets: ["10.0.0.1:443"], labels: {sni: a.com}, weight: 3}]`,
+		"not a list":           `{targets: ["10.0.0.1:443"], labels: {sni: a.com}}`,
+	} {
+		if _, err := Parse("targets.yaml", []byte(data)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+	if _, err := Parse("targets.json", []byte(`[{"targets": ["10.0.0.1:443"], "labels": {"sni": "a.com"}, "extra": 1}]`)); err == nil {
+		t.Error("unknown JSON field: expected an error")
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	dir := t.TempDir()
+	a, b := filepath.Join(dir, "a.yaml"), filepath.Join(dir, "b.json")
+	write(t, a, `[{targets: ["10.0.0.1:443"], labels: {sni: foo.com}}]`)
+	write(t, b, `[{"targets": ["10.0.0.2:443", "10.0.0.3:443"], "labels": {"sni": "bar.com"}}]`)
+
+	w, synced := watch(filepath.Join(dir, "*.yaml"), filepath.Join(dir, "*.json"), a)
+	if !w.Refresh() {
+		t.Fatal("first refresh didn't sync")
+	}
+	// Sorted by route and address; a file matched by two patterns counts once
+	want := []string{"bar.com 10.0.0.2:443", "bar.com 10.0.0.3:443", "foo.com 10.0.0.1:443"}
+	if got := addresses(*synced); !reflect.DeepEqual(got, want) {
+		t.Fatalf("synced %v, want %v", got, want)
+	}
+
+	// Unchanged files don't sync again
+	if w.Refresh() {
+		t.Fatal("refresh without changes synced")
+	}
+
+	// A changed file replaces its targets
+	write(t, a, `[{targets: ["10.0.0.4:443"], labels: {sni: foo.com}}]`)
+	if !w.Refresh() {
+		t.Fatal("changed file didn't sync")
+	}
+	want = []string{"bar.com 10.0.0.2:443", "bar.com 10.0.0.3:443", "foo.com 10.0.0.4:443"}
+	if got := addresses(*synced); !reflect.DeepEqual(got, want) {
+		t.Fatalf("synced %v, want %v", got, want)
+	}
+
+	// A file that stops parsing keeps its last good targets
+	write(t, a, `[{targets: ["10.0.0.5"], labels: {sni: foo.com}}]`)
+	if w.Refresh() {
+		t.Fatalf("broken file synced %v", addresses(*synced))
+	}
+	write(t, a, `[{targets: ["10.0.0.5:443"], labels: {sni: foo.com}}]`)
+	if !w.Refresh() || !reflect.DeepEqual(addresses(*synced), []string{"bar.com 10.0.0.2:443", "bar.com 10.0.0.3:443", "foo.com 10.0.0.5:443"}) {
+		t.Fatalf("fixed file synced %v", addresses(*synced))
+	}
+
+	// New files matching a pattern are picked up
+	c := filepath.Join(dir, "c.yaml")
+	write(t, c, `[{targets: ["10.0.0.6:443"], labels: {sni: baz.com}}]`)
+	if !w.Refresh() || len(*synced) != 4 {
+		t.Fatalf("new file synced %v", addresses(*synced))
+	}
+}
+
+func TestVanishedFileLosesTargets(t *testing.T) {
+	dir := t.TempDir()
+	a, b := filepath.Join(dir, "a.yaml"), filepath.Join(dir, "b.yaml")
+	write(t, a, `[{targets: ["10.0.0.1:443"], labels: {sni: foo.com}}]`)
+	write(t, b, `[{targets: ["10.0.0.2:443"], labels: {sni: bar.com}}]`)
+
+	w, synced := watch(filepath.Join(dir, "*.yaml"))
+	w.Refresh()
+	if len(*synced) != 2 {
+		t.Fatalf("synced %v", addresses(*synced))
+	}
+
+	if err := os.Remove(a); err != nil {
+		t.Fatal(err)
+	}
+	if !w.Refresh() {
+		t.Fatal("removing a file didn't sync")
+	}
+	if got := addresses(*synced); !reflect.DeepEqual(got, []string{"bar.com 10.0.0.2:443"}) {
+		t.Fatalf("synced %v after a file vanished", got)
+	}
+
+	// A broken file that then vanishes takes its last good targets with it
+	write(t, b, `not: [a, list`)
+	w.Refresh()
+	if err := os.Remove(b); err != nil {
+		t.Fatal(err)
+	}
+	if !w.Refresh() || len(*synced) != 0 {
+		t.Fatalf("synced %v after every file vanished", addresses(*synced))
+	}
+}
+
+func TestFirstRefreshSyncsNothing(t *testing.T) {
+	// With no files yet the first refresh still hands over the empty set, so sources start out in sync
+	w, synced := watch(filepath.Join(t.TempDir(), "*.yaml"), "[")
+	*synced = []Target{{Route: "stale"}}
+	if !w.Refresh() || len(*synced) != 0 {
+		t.Fatalf("first refresh synced %v", addresses(*synced))
+	}
+	if w.Refresh() {
+		t.Fatal("second refresh without files synced")
+	}
+}
@@ -0,0 +1,126 @@
+// Package lease expires backend registrations that are not renewed in time.
+//
+// A backend registered with a TTL holds a lease on its route. Registering again before the
+// lease runs out renews it; once it runs out the backend is evicted.
+package lease
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// MaxTTL is the longest lease a registration may ask for
+const MaxTTL = 24 * time.Hour
+
+// Metrics for leases
+var (
+	activeLeases = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "registry_leases",
+		Help: "Number of backend registrations held by a lease.",
+	})
+	evictions = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "registry_lease_evictions_total",
+		Help: "Total number of backends evicted because their lease expired.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(activeLeases, evictions)
+}
+
+type key struct {
+	route   string
+	address string
+}
+
+// Table tracks when the lease of each leased backend expires
+type Table struct {
+	mu     sync.Mutex
+	leases map[key]time.Time
+	now    func() time.Time // Clock of renewals, replaced in tests
+}
+
+func NewTable() *Table {
+	return &Table{leases: make(map[key]time.Time), now: time.Now}
+}
+
+// TTL converts a registration's TTL in seconds, where 0 means no lease
+func TTL(seconds int) (time.Duration, error) {
+	ttl := time.Duration(seconds) * time.Second
+	if seconds < 0 || ttl > MaxTTL {
+		return 0, fmt.Errorf("ttl must be between 0 and %d seconds", int(MaxTTL/time.Second))
+	}
+	return ttl, nil
+}
+
+// Renew starts or extends the lease of a backend and returns when it expires
+func (t *Table) Renew(route, address string, ttl time.Duration) time.Time {
+	expires := t.now().Add(ttl)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.leases[key{route, address}] = expires
+	activeLeases.Set(float64(len(t.leases)))
+	return expires
+}
+
+// Expiry returns when the lease of a backend runs out, if it has one
+func (t *Table) Expiry(route, address string) (time.Time, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	expires, ok := t.leases[key{route, address}]
+	return expires, ok
+}
+
+// Release drops the lease of a backend, which then stays until removed explicitly
+func (t *Table) Release(route, address string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.leases, key{route, address})
+	activeLeases.Set(float64(len(t.leases)))
+}
+
+// ReleaseRoute drops the leases of every backend of a route
+func (t *Table) ReleaseRoute(route string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for k := range t.leases {
+		if k.route == route {
+			delete(t.leases, k)
+		}
+	}
+	activeLeases.Set(float64(len(t.leases)))
+}
+
+// Run evicts backends whose lease expired, checking every interval. Evictions happen under the
+// table's lock, so a renewal racing an expiry either keeps the backend or registers it again;
+// evict must therefore only change state in memory, never block on disk or the network.
+func (t *Table) Run(interval time.Duration, evict func(route, address string)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		t.expire(evict)
+	}
+}
+
+// expire evicts the backends whose lease ran out by now
+func (t *Table) expire(evict func(route, address string)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	for k, expires := range t.leases {
+		if now.After(expires) {
+			delete(t.leases, k)
+			evict(k.route, k.address)
+			evictions.Inc()
+			log.Printf("Lease of backend %s for %s expired; evicted", k.address, k.route)
+		}
+	}
+	activeLeases.Set(float64(len(t.leases)))
+}
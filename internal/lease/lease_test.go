@@ -0,0 +1,132 @@
+package lease
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock that only moves when told to
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func (c *fakeClock) advance(d time.Duration) { c.now = c.now.Add(d) }
+
+func newTestTable() (*Table, *fakeClock) {
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	table := NewTable()
+	table.now = clock.Now
+	return table, clock
+}
+
+// expire runs one eviction pass and returns the evicted backends as "route address"
+func expire(table *Table) []string {
+	var evicted []string
+	table.expire(func(route, address string) {
+		evicted = append(evicted, route+" "+address)
+	})
+	slices.Sort(evicted)
+	return evicted
+}
+
+func TestTTL(t *testing.T) {
+	for seconds, want := range map[int]time.Duration{0: 0, 30: 30 * time.Second, int(MaxTTL / time.Second): MaxTTL} {
+		if ttl, err := TTL(seconds); err != nil || ttl != want {
+			t.Errorf("TTL(%d) = %v, %v; want %v", seconds, ttl, err, want)
+		}
+	}
+	for _, seconds := range []int{-1, int(MaxTTL/time.Second) + 1} {
+		if _, err := TTL(seconds); err == nil {
+			t.Errorf("TTL(%d): expected an error", seconds)
+		}
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	table, clock := newTestTable()
+	table.Renew("foo.com", "10.0.0.1:443", 30*time.Second)
+	table.Renew("foo.com", "10.0.0.2:443", time.Minute)
+	table.Renew("bar.com", "10.0.0.1:443", 30*time.Second)
+
+	// Nothing expires before its time, and a lease runs until the instant it ends
+	clock.advance(30 * time.Second)
+	if evicted := expire(table); len(evicted) != 0 {
+		t.Fatalf("evicted %v before the leases ran out", evicted)
+	}
+	clock.advance(time.Nanosecond)
+	want := []string{"bar.com 10.0.0.1:443", "foo.com 10.0.0.1:443"}
+	if evicted := expire(table); !slices.Equal(evicted, want) {
+		t.Fatalf("evicted %v, want %v", evicted, want)
+	}
+
+	// An evicted backend is evicted once, and its lease is gone
+	if evicted := expire(table); len(evicted) != 0 {
+		t.Fatalf("evicted %v again", evicted)
+	}
+	if _, ok := table.Expiry("foo.com", "10.0.0.1:443"); ok {
+		t.Fatal("evicted backend still has a lease")
+	}
+	if expires, ok := table.Expiry("foo.com", "10.0.0.2:443"); !ok || !expires.Equal(clock.now.Add(30*time.Second-time.Nanosecond)) {
+		t.Fatalf("remaining lease expires at %v, %v", expires, ok)
+	}
+}
+
+func TestRenew(t *testing.T) {
+	table, clock := newTestTable()
+	table.Renew("foo.com", "10.0.0.1:443", 30*time.Second)
+
+	// Renewing before the lease runs out extends it from the time of renewal
+	clock.advance(20 * time.Second)
+	if expires := table.Renew("foo.com", "10.0.0.1:443", 30*time.Second); !expires.Equal(clock.now.Add(30 * time.Second)) {
+		t.Fatalf("renewed lease expires at %v", expires)
+	}
+	clock.advance(20 * time.Second)
+	if evicted := expire(table); len(evicted) != 0 {
+		t.Fatalf("renewed lease evicted %v", evicted)
+	}
+
+	// A renewal may also shorten a lease
+	table.Renew("foo.com", "10.0.0.1:443", time.Second)
+	clock.advance(2 * time.Second)
+	if evicted := expire(table); !slices.Equal(evicted, []string{"foo.com 10.0.0.1:443"}) {
+		t.Fatalf("evicted %v after the shortened lease ran out", evicted)
+	}
+}
+
+func TestRelease(t *testing.T) {
+	table, clock := newTestTable()
+	table.Renew("foo.com", "10.0.0.1:443", time.Second)
+	table.Renew("foo.com", "10.0.0.2:443", time.Second)
+	table.Renew("bar.com", "10.0.0.1:443", time.Second)
+	table.Renew("baz.com", "10.0.0.1:443", time.Second)
+
+	// Released backends stay until removed explicitly
+	table.Release("baz.com", "10.0.0.1:443")
+	table.ReleaseRoute("foo.com")
+	clock.advance(time.Minute)
+	if evicted := expire(table); !slices.Equal(evicted, []string{"bar.com 10.0.0.1:443"}) {
+		t.Fatalf("evicted %v, want only the lease that wasn't released", evicted)
+	}
+	table.Release("qux.com", "10.0.0.1:443") // Releasing without a lease does nothing
+}
+
+func TestRun(t *testing.T) {
+	table := NewTable()
+	table.Renew("foo.com", "10.0.0.1:443", 10*time.Millisecond)
+
+	evicted := make(chan string, 1)
+	go table.Run(5*time.Millisecond, func(route, address string) {
+		evicted <- route + " " + address
+	})
+	select {
+	case got := <-evicted:
+		if got != "foo.com 10.0.0.1:443" {
+			t.Fatalf("evicted %s", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expired lease never evicted")
+	}
+}
@@ -0,0 +1,338 @@
+// Package registrystore keeps a proxy's backend registry on disk so it survives restarts.
+//
+// Mutations are appended to a log of JSON lines and synced before the API answers. The log is
+// compacted periodically, and whenever it grows well past the state it describes, by rewriting
+// it as one record per live entry and atomically replacing the old file.
+package registrystore
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"reverse-proxy/internal/adminapi"
+)
+
+// Record operations
+const (
+	OpSet         = "set"          // Backend added or changed, with its lease if it has one
+	OpDelete      = "delete"       // Backend removed
+	OpDeleteRoute = "delete_route" // Route and all its backends removed
+	OpMode        = "mode"         // TLS mode of a route (L4 proxy)
+	OpSRV         = "srv"          // SRV discovery of a route (L4 proxy)
+	OpDeleteSRV   = "delete_srv"   // SRV discovery of a route stopped (L4 proxy)
+	OpBalancing   = "balancing"    // Balancing policy of a route; an empty value restores the default
+)
+
+// Compact once the log holds this many records more than the state it describes
+const compactSlack = 1000
+
+// Record is one line of the log
+type Record struct {
+	Op      string            `json:"op"`
+	Route   string            `json:"route"`
+	Backend *adminapi.Backend `json:"backend,omitempty"` // OpSet
+	Address string            `json:"address,omitempty"` // OpDelete
+	Expires *time.Time        `json:"expires,omitempty"` // OpSet: when the backend's lease runs out
+	Value   string            `json:"value,omitempty"`   // OpMode: the mode; OpSRV, OpDeleteSRV: the SRV name; OpBalancing: the policy
+}
+
+// state is what the log describes, keyed by route
+type state struct {
+	backends map[string]map[string]Record // Route, then address, to its OpSet record
+	modes    map[string]string
+	policies map[string]string          // Route to its balancing policy
+	srv      map[string]map[string]bool // Route to its SRV names
+}
+
+func newState() *state {
+	return &state{
+		backends: make(map[string]map[string]Record),
+		modes:    make(map[string]string),
+		policies: make(map[string]string),
+		srv:      make(map[string]map[string]bool),
+	}
+}
+
+// check reports whether a record can be applied
+func (r Record) check() error {
+	switch r.Op {
+	case OpSet:
+		if r.Backend == nil {
+			return fmt.Errorf("set record without backend")
+		}
+	case OpDelete, OpDeleteRoute, OpMode, OpBalancing, OpSRV, OpDeleteSRV:
+	default:
+		return fmt.Errorf("unknown operation %q", r.Op)
+	}
+	return nil
+}
+
+func (s *state) apply(record Record) error {
+	if err := record.check(); err != nil {
+		return err
+	}
+	switch record.Op {
+	case OpSet:
+		if s.backends[record.Route] == nil {
+			s.backends[record.Route] = make(map[string]Record)
+		}
+		s.backends[record.Route][record.Backend.Address] = record
+	case OpDelete:
+		delete(s.backends[record.Route], record.Address)
+		if len(s.backends[record.Route]) == 0 {
+			delete(s.backends, record.Route)
+		}
+	case OpDeleteRoute:
+		delete(s.backends, record.Route)
+		delete(s.srv, record.Route)
+	case OpMode:
+		s.modes[record.Route] = record.Value
+	case OpBalancing:
+		if record.Value == "" {
+			delete(s.policies, record.Route)
+		} else {
+			s.policies[record.Route] = record.Value
+		}
+	case OpSRV:
+		if s.srv[record.Route] == nil {
+			s.srv[record.Route] = make(map[string]bool)
+		}
+		s.srv[record.Route][record.Value] = true
+	case OpDeleteSRV:
+		delete(s.srv[record.Route], record.Value)
+		if len(s.srv[record.Route]) == 0 {
+			delete(s.srv, record.Route)
+		}
+	}
+	return nil
+}
+
+func (s *state) size() int {
+	n := len(s.modes) + len(s.policies)
+	for _, backends := range s.backends {
+		n += len(backends)
+	}
+	for _, names := range s.srv {
+		n += len(names)
+	}
+	return n
+}
+
+// records returns the state as the shortest log that rebuilds it: modes, balancing policies, SRV
+// discoveries, then backends.
+// Backends whose lease ran out are left out.
+func (s *state) records(now time.Time) []Record {
+	var records []Record
+	for _, route := range sortedKeys(s.modes) {
+		records = append(records, Record{Op: OpMode, Route: route, Value: s.modes[route]})
+	}
+	for _, route := range sortedKeys(s.policies) {
+		records = append(records, Record{Op: OpBalancing, Route: route, Value: s.policies[route]})
+	}
+	for _, route := range sortedKeys(s.srv) {
+		for _, name := range sortedKeys(s.srv[route]) {
+			records = append(records, Record{Op: OpSRV, Route: route, Value: name})
+		}
+	}
+	for _, route := range sortedKeys(s.backends) {
+		for _, address := range sortedKeys(s.backends[route]) {
+			record := s.backends[route][address]
+			if record.Expires != nil && !now.Before(*record.Expires) {
+				continue
+			}
+			records = append(records, record)
+		}
+	}
+	return records
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Store is an open registry log. A nil Store discards every record, for proxies without persistence.
+type Store struct {
+	path string
+
+	mu      sync.Mutex
+	file    *os.File
+	state   *state
+	records int // In the log file
+}
+
+// Open reads the log at path, creating it if needed, and returns the records that restore its state.
+// With empty set the previous log is discarded and the proxy starts with an empty registry.
+func Open(path string, empty bool) (*Store, []Record, error) {
+	s := &Store{path: path, state: newState()}
+
+	if !empty {
+		if err := s.load(); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// Rewriting on open drops expired leases and any torn record from a crash
+	if err := s.compact(); err != nil {
+		return nil, nil, err
+	}
+	return s, s.state.records(time.Now()), nil
+}
+
+func (s *Store) load() error {
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read registry log: %w", err)
+	}
+
+	lines := bytes.Split(data, []byte("\n"))
+	for i, line := range lines {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var record Record
+		err := json.Unmarshal(line, &record)
+		if err == nil {
+			err = s.state.apply(record)
+		}
+		if err != nil {
+			// Only the last record can be torn by a crash mid-write
+			if len(bytes.TrimSpace(bytes.Join(lines[i+1:], nil))) == 0 {
+				log.Printf("Ignoring incomplete last record of registry log %s: %v", s.path, err)
+				break
+			}
+			return fmt.Errorf("registry log %s line %d: %w", s.path, i+1, err)
+		}
+	}
+	return nil
+}
+
+// Append writes records through to disk in one write, returning once they are synced. Records
+// that can't be written are cut from the log again, so the next one starts on a line of its own.
+func (s *Store) Append(records ...Record) error {
+	if s == nil || len(records) == 0 {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var data []byte
+	for _, record := range records {
+		if err := record.check(); err != nil {
+			return fmt.Errorf("failed to persist registry record: %w", err)
+		}
+		line, err := json.Marshal(record)
+		if err != nil {
+			return fmt.Errorf("failed to persist registry record: %w", err)
+		}
+		data = append(append(data, line...), '\n')
+	}
+
+	end, err := s.file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return fmt.Errorf("failed to persist registry record: %w", err)
+	}
+	if _, err := s.file.Write(data); err != nil {
+		s.file.Truncate(end)
+		return fmt.Errorf("failed to persist registry record: %w", err)
+	}
+	if err := s.file.Sync(); err != nil {
+		s.file.Truncate(end)
+		return fmt.Errorf("failed to sync registry log: %w", err)
+	}
+	for _, record := range records {
+		s.state.apply(record)
+	}
+	s.records += len(records)
+
+	// The record is durable; a failed compaction only leaves the log longer
+	if s.records > s.state.size()+compactSlack {
+		if err := s.compact(); err != nil {
+			log.Printf("Failed to compact registry log: %v", err)
+		}
+	}
+	return nil
+}
+
+// Compact rewrites the log as the records of its current state
+func (s *Store) Compact() error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.compact()
+}
+
+func (s *Store) compact() error {
+	records := s.state.records(time.Now())
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, record := range records {
+		if err := encoder.Encode(record); err != nil {
+			return err
+		}
+	}
+
+	// Write the new log beside the old one and swap it in, so a crash leaves one of them intact
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create registry log: %w", err)
+	}
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to write registry log: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to sync registry log: %w", err)
+	}
+	tmp.Close()
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to replace registry log: %w", err)
+	}
+
+	file, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open registry log: %w", err)
+	}
+	if s.file != nil {
+		s.file.Close()
+	}
+	s.file = file
+	s.records = len(records)
+	return nil
+}
+
+// Run compacts the log every interval
+func (s *Store) Run(interval time.Duration) {
+	if s == nil {
+		return
+	}
+	for range time.Tick(interval) {
+		if err := s.Compact(); err != nil {
+			log.Printf("Failed to compact registry log: %v", err)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package registrystore
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"reverse-proxy/internal/adminapi"
+)
+
+func set(route, address string) Record {
+	return Record{Op: OpSet, Route: route, Backend: &adminapi.Backend{Address: address, Weight: 1}}
+}
+
+func open(t *testing.T, path string) (*Store, []Record) {
+	t.Helper()
+	store, records, err := Open(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.file.Close() })
+	return store, records
+}
+
+func TestAppendAndReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "registry.log")
+	store, records := open(t, path)
+	if len(records) != 0 {
+		t.Fatalf("new log replays %v", records)
+	}
+
+	for _, record := range []Record{
+		set("foo.com", "10.0.0.1:443"),
+		set("foo.com", "10.0.0.2:443"),
+		{Op: OpMode, Route: "foo.com", Value: "terminate"},
+		{Op: OpBalancing, Route: "foo.com", Value: "round_robin"},
+		{Op: OpSRV, Route: "bar.com", Value: "_https._tcp.bar.com"},
+		{Op: OpDelete, Route: "foo.com", Address: "10.0.0.1:443"},
+		set("baz.com", "10.0.0.3:443"),
+	} {
+		if err := store.Append(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Records appended together land together
+	if err := store.Append(set("qux.com", "10.0.0.4:443"), Record{Op: OpDeleteRoute, Route: "baz.com"}); err != nil {
+		t.Fatal(err)
+	}
+
+	_, replayed := open(t, path)
+	want := []Record{
+		{Op: OpMode, Route: "foo.com", Value: "terminate"},
+		{Op: OpBalancing, Route: "foo.com", Value: "round_robin"},
+		{Op: OpSRV, Route: "bar.com", Value: "_https._tcp.bar.com"},
+		set("foo.com", "10.0.0.2:443"),
+		set("qux.com", "10.0.0.4:443"),
+	}
+	if !reflect.DeepEqual(replayed, want) {
+		t.Fatalf("replayed %+v\nwant %+v", replayed, want)
+	}
+
+	// Starting empty discards the log
+	if _, records, err := Open(path, true); err != nil || len(records) != 0 {
+		t.Fatalf("empty open replayed %v, %v", records, err)
+	}
+}
+
+func TestReplayDropsExpiredLeases(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "registry.log")
+	store, _ := open(t, path)
+
+	past, future := time.Now().Add(-time.Minute), time.Now().Add(time.Hour)
+	expired, leased := set("foo.com", "10.0.0.1:443"), set("foo.com", "10.0.0.2:443")
+	expired.Expires, leased.Expires = &past, &future
+	if err := store.Append(expired, leased); err != nil {
+		t.Fatal(err)
+	}
+
+	_, replayed := open(t, path)
+	if len(replayed) != 1 || replayed[0].Backend.Address != "10.0.0.2:443" || !replayed[0].Expires.Equal(future) {
+		t.Fatalf("replayed %+v, want only the unexpired lease", replayed)
+	}
+}
+
+func TestReplayTruncatedTail(t *testing.T) {
+	complete := `{"op":"set","route":"foo.com","backend":{"address":"10.0.0.1:443","weight":1}}` + "\n"
+	torn := `{"op":"set","route":"foo.com","backend":{"addr`
+
+	for _, tc := range []struct {
+		name, log string
+		records   int
+		fails     bool
+	}{
+		{"torn last record", complete + torn, 1, false},
+		{"torn last record and blank lines", complete + torn + "\n\n", 1, false},
+		{"unknown operation last", complete + `{"op":"rename","route":"foo.com"}`, 1, false},
+		{"only a torn record", torn, 0, false},
+		{"torn record in the middle", torn + "\n" + complete, 0, true},
+		{"invalid record in the middle", `{"op":"set","route":"foo.com"}` + "\n" + complete, 0, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "registry.log")
+			if err := os.WriteFile(path, []byte(tc.log), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			store, records, err := Open(path, false)
+			if tc.fails {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer store.file.Close()
+			if len(records) != tc.records {
+				t.Fatalf("replayed %d records, want %d", len(records), tc.records)
+			}
+
+			// Opening rewrote the log, so new records start on a line of their own
+			if err := store.Append(set("bar.com", "10.0.0.2:443")); err != nil {
+				t.Fatal(err)
+			}
+			_, replayed := open(t, path)
+			if len(replayed) != tc.records+1 {
+				t.Fatalf("after an append replayed %d records, want %d", len(replayed), tc.records+1)
+			}
+		})
+	}
+}
+
+func TestFailedAppendLeavesNoTrace(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "registry.log")
+	store, _ := open(t, path)
+	if err := store.Append(set("foo.com", "10.0.0.1:443")); err != nil {
+		t.Fatal(err)
+	}
+	writable := store.file
+
+	// Records that can't be applied are refused before anything is written
+	if err := store.Append(set("foo.com", "10.0.0.2:443"), Record{Op: OpSet, Route: "foo.com"}); err == nil {
+		t.Fatal("expected an error for a set record without backend")
+	}
+
+	// A log that can't be written
+	readOnly, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer readOnly.Close()
+	store.file = readOnly
+	if err := store.Append(set("foo.com", "10.0.0.3:443")); err == nil {
+		t.Fatal("expected an error writing to a read-only log")
+	}
+
+	// A log that takes the write but can't be synced; character devices don't support fsync
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer devNull.Close()
+	store.file = devNull
+	if err := store.Append(set("foo.com", "10.0.0.4:443")); err == nil || !strings.Contains(err.Error(), "sync") {
+		t.Fatalf("expected a sync error, got %v", err)
+	}
+
+	// None of the failed records made it into the state or the log
+	store.file = writable
+	if got := len(store.state.backends["foo.com"]); got != 1 {
+		t.Fatalf("state holds %d backends of foo.com, want 1", got)
+	}
+	if err := store.Append(set("foo.com", "10.0.0.5:443")); err != nil {
+		t.Fatal(err)
+	}
+	_, replayed := open(t, path)
+	var addresses []string
+	for _, record := range replayed {
+		addresses = append(addresses, record.Backend.Address)
+	}
+	if !reflect.DeepEqual(addresses, []string{"10.0.0.1:443", "10.0.0.5:443"}) {
+		t.Fatalf("replayed %v", addresses)
+	}
+}
+
+func TestNilStore(t *testing.T) {
+	var store *Store
+	if err := store.Append(set("foo.com", "10.0.0.1:443")); err != nil {
+		t.Fatalf("nil store: %v", err)
+	}
+	if err := store.Compact(); err != nil {
+		t.Fatalf("nil store: %v", err)
+	}
+}
+
+func TestCompactKeepsState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "registry.log")
+	store, _ := open(t, path)
+	for i := 0; i < 10; i++ {
+		if err := store.Append(set("foo.com", "10.0.0.1:443"), Record{Op: OpDelete, Route: "foo.com", Address: "10.0.0.1:443"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Append(set("foo.com", "10.0.0.2:443")); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Compact(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(data), "\n"); lines != 1 {
+		t.Fatalf("compacted log has %d lines, want 1", lines)
+	}
+	if _, replayed := open(t, path); len(replayed) != 1 || replayed[0].Backend.Address != "10.0.0.2:443" {
+		t.Fatalf("replayed %+v", replayed)
+	}
+}
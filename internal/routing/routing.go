@@ -0,0 +1,360 @@
+// Package routing holds a proxy's routes and their backends as an immutable snapshot.
+//
+// Every write builds a new snapshot and publishes it through an atomic pointer, so the
+// connection path reads a stable, sorted backend slice without locks or allocations, and
+// several routes can change in one swap. Writers are serialized; reads never wait for them.
+// Each route picks its backends with the balancer of its policy, which lives as long as the route.
+package routing
+
+import (
+	"maps"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"reverse-proxy/internal/adminapi"
+	"reverse-proxy/internal/balancer"
+)
+
+// Table is the routing table of a proxy
+type Table struct {
+	mu       sync.Mutex                    // Serializes writers
+	policies map[string]string             // Balancing policy by route, kept while a route has no backends; guarded by mu
+	sources  map[string]map[string]*Source // Discovery source of each backend one put in the table, by route and address; guarded by mu
+	removed  []func(name, address string)  // Called for every backend that leaves a route; guarded by mu
+	current  atomic.Pointer[snapshot]
+}
+
+type snapshot struct {
+	routes map[string]*route
+}
+
+// route is immutable once published, apart from the state of its balancer
+type route struct {
+	backends []adminapi.Backend // Sorted by address
+	policy   string
+	balancer balancer.Balancer // Kept across snapshots while the policy stays
+}
+
+func NewTable() *Table {
+	t := &Table{policies: make(map[string]string), sources: make(map[string]map[string]*Source)}
+	t.current.Store(&snapshot{routes: make(map[string]*route)})
+	return t
+}
+
+// Pick returns a backend of a route chosen by its balancer; key identifies the client.
+// It reports false if the route has no backend with a weight above zero.
+func (t *Table) Pick(name, key string) (string, bool) {
+	r := t.current.Load().routes[name]
+	if r == nil {
+		return "", false
+	}
+	return r.balancer.Pick(key)
+}
+
+// Report tells a route's balancer how a pick went
+func (t *Table) Report(name, address string, latency time.Duration, err error) {
+	if r := t.current.Load().routes[name]; r != nil {
+		r.balancer.Report(address, latency, err)
+	}
+}
+
+// Policy returns the balancing policy set for a route, "" for the default
+func (t *Table) Policy(name string) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.policies[name]
+}
+
+// SetPolicy changes the balancing policy of a route; "" restores the default. A route
+// with backends gets a fresh balancer, so adaptive statistics start over.
+func (t *Table) SetPolicy(name, policy string) error {
+	if err := balancer.Valid(policy); err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if policy == "" {
+		delete(t.policies, name)
+	} else {
+		t.policies[name] = policy
+	}
+
+	old := t.current.Load()
+	r := old.routes[name]
+	if r == nil || r.policy == policy {
+		return nil
+	}
+	next := &snapshot{routes: maps.Clone(old.routes)}
+	next.routes[name] = newRoute(r.backends, policy)
+	t.current.Store(next)
+	return nil
+}
+
+// Has reports whether a route has any backend
+func (t *Table) Has(name string) bool {
+	_, ok := t.current.Load().routes[name]
+	return ok
+}
+
+// Backends returns the backends of a route sorted by address. The slice is shared with
+// the snapshot and must not be modified.
+func (t *Table) Backends(name string) []adminapi.Backend {
+	if r := t.current.Load().routes[name]; r != nil {
+		return r.backends
+	}
+	return nil
+}
+
+// Backend returns one backend of a route
+func (t *Table) Backend(name, address string) (adminapi.Backend, bool) {
+	backends := t.Backends(name)
+	i, ok := slices.BinarySearchFunc(backends, address, func(b adminapi.Backend, address string) int {
+		return strings.Compare(b.Address, address)
+	})
+	if !ok {
+		return adminapi.Backend{}, false
+	}
+	return backends[i], true
+}
+
+// Names returns the name of every route with backends, sorted
+func (t *Table) Names() []string {
+	routes := t.current.Load().routes
+	names := make([]string, 0, len(routes))
+	for name := range routes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Update applies changes to any number of routes and publishes them in one swap. fn receives
+// every route's backends and may add, replace or delete entries, but must not modify the
+// slices it was given in place. Routes left without backends are dropped. Backends fn adds
+// or changes no longer belong to the discovery source that put them in the table.
+func (t *Table) Update(fn func(routes map[string][]adminapi.Backend)) {
+	t.update(nil, fn)
+}
+
+// OnRemove registers fn to be called for every backend that leaves a route, including routes
+// deleted as a whole. It runs after the change is published, outside the table's lock, so it
+// may read the table; a backend that is changed in place doesn't leave its route.
+func (t *Table) OnRemove(fn func(name, address string)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.removed = append(t.removed, fn)
+}
+
+// update applies fn for a source, or for the table's other writers if source is nil, and
+// tells the OnRemove callbacks about the backends that left
+func (t *Table) update(source *Source, fn func(routes map[string][]adminapi.Backend)) {
+	old, next, callbacks := t.apply(source, fn)
+	if len(callbacks) == 0 {
+		return
+	}
+	for name, r := range old.routes {
+		for _, backend := range r.backends {
+			if !Contains(next.backends(name), backend.Address) {
+				for _, callback := range callbacks {
+					callback(name, backend.Address)
+				}
+			}
+		}
+	}
+}
+
+// apply publishes the snapshot fn makes of the routes and returns it along with the one it
+// replaced and the OnRemove callbacks. The source records what it owns itself; fn runs with mu held.
+func (t *Table) apply(source *Source, fn func(routes map[string][]adminapi.Backend)) (old, next *snapshot, callbacks []func(name, address string)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	old = t.current.Load()
+	routes := make(map[string][]adminapi.Backend, len(old.routes))
+	for name, r := range old.routes {
+		routes[name] = r.backends
+	}
+	fn(routes)
+
+	// Removed backends belong to nobody, and others' writes take backends over from their source
+	for name, owners := range t.sources {
+		for address := range owners {
+			if !Contains(routes[name], address) {
+				delete(owners, address)
+			}
+		}
+	}
+	if source == nil {
+		for name, backends := range routes {
+			for _, backend := range backends {
+				if !containsEqual(old.backends(name), backend) {
+					t.disown(name, backend.Address)
+				}
+			}
+		}
+	}
+	for name, owners := range t.sources {
+		if len(owners) == 0 {
+			delete(t.sources, name)
+		}
+	}
+
+	next = &snapshot{routes: make(map[string]*route, len(routes))}
+	for name, backends := range routes {
+		if len(backends) == 0 {
+			continue
+		}
+		previous := old.routes[name]
+		switch {
+		case previous == nil:
+			next.routes[name] = newRoute(backends, t.policies[name])
+		case sameSlice(previous.backends, backends):
+			next.routes[name] = previous
+		default:
+			next.routes[name] = previous.update(backends)
+		}
+	}
+	t.current.Store(next)
+	return old, next, t.removed
+}
+
+func (s *snapshot) backends(name string) []adminapi.Backend {
+	if r := s.routes[name]; r != nil {
+		return r.backends
+	}
+	return nil
+}
+
+// disown makes a backend the table's own, out of reach of the source that put it there; mu must be held
+func (t *Table) disown(name, address string) {
+	if owners := t.sources[name]; owners != nil {
+		delete(owners, address)
+	}
+}
+
+func newRoute(backends []adminapi.Backend, policy string) *route {
+	b, _ := balancer.New(policy) // Validated by SetPolicy
+	r := &route{backends: slices.Clone(backends), policy: policy, balancer: b}
+	adminapi.SortBackends(r.backends)
+	for _, backend := range r.backends {
+		b.Add(backend)
+	}
+	return r
+}
+
+// update returns the route with other backends, telling the balancer what changed
+func (r *route) update(backends []adminapi.Backend) *route {
+	next := &route{backends: slices.Clone(backends), policy: r.policy, balancer: r.balancer}
+	adminapi.SortBackends(next.backends)
+	for _, backend := range r.backends {
+		if !Contains(next.backends, backend.Address) {
+			r.balancer.Remove(backend.Address)
+		}
+	}
+	for _, backend := range next.backends {
+		unchanged := slices.ContainsFunc(r.backends, func(b adminapi.Backend) bool {
+			return b.Address == backend.Address && b.Weight == backend.Weight
+		})
+		if !unchanged {
+			r.balancer.Add(backend)
+		}
+	}
+	return next
+}
+
+// Add adds a backend unless the route already has one at its address, reporting whether it did.
+// Either way the backend is the table's own from then on, even if a discovery source added it.
+func (t *Table) Add(name string, backend adminapi.Backend) bool {
+	added := false
+	t.Update(func(routes map[string][]adminapi.Backend) {
+		if !Contains(routes[name], backend.Address) {
+			routes[name] = append(slices.Clip(routes[name]), backend)
+			added = true
+		}
+		t.disown(name, backend.Address)
+	})
+	return added
+}
+
+// Set adds a backend or replaces the one at its address, which is the table's own from then on
+func (t *Table) Set(name string, backend adminapi.Backend) {
+	t.Update(func(routes map[string][]adminapi.Backend) {
+		routes[name] = With(routes[name], backend)
+		t.disown(name, backend.Address)
+	})
+}
+
+// Replace sets a route's backends to exactly the ones given in one swap; they are the table's own from then on
+func (t *Table) Replace(name string, backends []adminapi.Backend) {
+	t.Update(func(routes map[string][]adminapi.Backend) {
+		for _, backend := range routes[name] {
+			t.disown(name, backend.Address)
+		}
+		routes[name] = slices.Clone(backends)
+		for _, backend := range backends {
+			t.disown(name, backend.Address)
+		}
+	})
+}
+
+// Remove deletes a backend, reporting whether it existed
+func (t *Table) Remove(name, address string) bool {
+	removed := false
+	t.Update(func(routes map[string][]adminapi.Backend) {
+		if Contains(routes[name], address) {
+			routes[name] = Without(routes[name], address)
+			removed = true
+		}
+	})
+	return removed
+}
+
+// RemoveRoute deletes a route and all its backends, reporting whether it existed
+func (t *Table) RemoveRoute(name string) bool {
+	removed := false
+	t.Update(func(routes map[string][]adminapi.Backend) {
+		_, removed = routes[name]
+		delete(routes, name)
+	})
+	return removed
+}
+
+// With returns a copy of backends with backend added or replacing the one at its address
+func With(backends []adminapi.Backend, backend adminapi.Backend) []adminapi.Backend {
+	backends = Without(backends, backend.Address)
+	return append(backends, backend)
+}
+
+// Without returns a copy of backends without the one at address
+func Without(backends []adminapi.Backend, address string) []adminapi.Backend {
+	return slices.DeleteFunc(slices.Clone(backends), func(b adminapi.Backend) bool {
+		return b.Address == address
+	})
+}
+
+// Contains reports whether backends has one at address
+func Contains(backends []adminapi.Backend, address string) bool {
+	return slices.ContainsFunc(backends, func(b adminapi.Backend) bool {
+		return b.Address == address
+	})
+}
+
+// containsEqual reports whether backends has one identical to backend
+func containsEqual(backends []adminapi.Backend, backend adminapi.Backend) bool {
+	for _, b := range backends {
+		if b.Address == backend.Address {
+			return b.Weight == backend.Weight && maps.Equal(b.Metadata, backend.Metadata)
+		}
+	}
+	return false
+}
+
+// sameSlice reports whether fn left a route's slice as it was
+func sameSlice(a, b []adminapi.Backend) bool {
+	return len(a) == len(b) && (len(a) == 0 || &a[0] == &b[0])
+}
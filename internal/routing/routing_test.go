@@ -0,0 +1,128 @@
+package routing
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"reverse-proxy/internal/adminapi"
+	"reverse-proxy/internal/balancer"
+)
+
+func TestPickCyclesInAddressOrder(t *testing.T) {
+	for _, policy := range []string{"", balancer.RoundRobin} {
+		t.Run(fmt.Sprintf("policy=%q", policy), func(t *testing.T) {
+			table := NewTable()
+			if err := table.SetPolicy("foo.com", policy); err != nil {
+				t.Fatal(err)
+			}
+			// Registered out of order
+			for _, address := range []string{"10.0.0.3:443", "10.0.0.1:443", "10.0.0.2:443"} {
+				table.Add("foo.com", backend(address))
+			}
+
+			want := []string{"10.0.0.1:443", "10.0.0.2:443", "10.0.0.3:443"}
+			for i := 0; i < 2*len(want); i++ {
+				got, ok := table.Pick("foo.com", "")
+				if !ok || got != want[i%len(want)] {
+					t.Fatalf("pick %d = %q, %v; want %q", i, got, ok, want[i%len(want)])
+				}
+			}
+		})
+	}
+}
+
+func TestPickSkipsZeroWeight(t *testing.T) {
+	table := NewTable()
+	table.Add("foo.com", adminapi.Backend{Address: "10.0.0.1:443", Weight: 0})
+	if _, ok := table.Pick("foo.com", ""); ok {
+		t.Fatal("picked a backend with weight zero")
+	}
+	table.Add("foo.com", backend("10.0.0.2:443"))
+	for i := 0; i < 3; i++ {
+		if got, _ := table.Pick("foo.com", ""); got != "10.0.0.2:443" {
+			t.Fatalf("pick = %q, want 10.0.0.2:443", got)
+		}
+	}
+	if _, ok := table.Pick("bar.com", ""); ok {
+		t.Fatal("picked a backend of an unknown route")
+	}
+}
+
+func TestReportEndsLeastConnectionsPicks(t *testing.T) {
+	table := NewTable()
+	if err := table.SetPolicy("foo.com", balancer.LeastConnections); err != nil {
+		t.Fatal(err)
+	}
+	table.Add("foo.com", backend("10.0.0.1:443"))
+	table.Add("foo.com", backend("10.0.0.2:443"))
+
+	first, _ := table.Pick("foo.com", "")
+	second, _ := table.Pick("foo.com", "")
+	if first == second {
+		t.Fatalf("both picks went to %s", first)
+	}
+	// The proxies end every pick through the table, which passes it on to the route's balancer
+	table.Report("foo.com", first, time.Millisecond, nil)
+	for i := 0; i < 2; i++ {
+		got, _ := table.Pick("foo.com", "")
+		if i == 0 && got != first {
+			t.Fatalf("pick after the report went to %s, want %s", got, first)
+		}
+		table.Report("foo.com", got, time.Millisecond, nil)
+	}
+
+	// Changing the backends keeps the balancer and its counts
+	table.Add("foo.com", backend("10.0.0.3:443"))
+	if got, _ := table.Pick("foo.com", ""); got == second {
+		t.Fatalf("pick went to %s, which still has a pick in progress", got)
+	}
+}
+
+func TestOnRemove(t *testing.T) {
+	table := NewTable()
+	var removed []string
+	table.OnRemove(func(name, address string) {
+		// Callbacks run outside the lock, so they may read the table
+		if table.Has(name) && Contains(table.Backends(name), address) {
+			t.Errorf("%s %s reported removed while still in the table", name, address)
+		}
+		removed = append(removed, name+" "+address)
+	})
+
+	table.Add("foo.com", backend("10.0.0.1:443"))
+	table.Add("foo.com", backend("10.0.0.2:443"))
+	table.Add("bar.com", backend("10.0.0.3:443"))
+	table.Set("foo.com", adminapi.Backend{Address: "10.0.0.1:443", Weight: 5})
+	if len(removed) != 0 {
+		t.Fatalf("adding and changing backends reported %v", removed)
+	}
+
+	table.Remove("foo.com", "10.0.0.1:443")
+	table.Replace("foo.com", []adminapi.Backend{backend("10.0.0.4:443")})
+	table.RemoveRoute("bar.com")
+	table.Remove("bar.com", "10.0.0.3:443")
+	want := []string{"foo.com 10.0.0.1:443", "foo.com 10.0.0.2:443", "bar.com 10.0.0.3:443"}
+	if !slices.Equal(removed, want) {
+		t.Fatalf("removed %v, want %v", removed, want)
+	}
+}
+
+func BenchmarkPick(b *testing.B) {
+	table := NewTable()
+	for i := 0; i < 8; i++ {
+		table.Add("foo.com", backend(fmt.Sprintf("10.0.0.%d:443", i+1)))
+	}
+
+	b.ReportAllocs()
+	b.SetParallelism(8)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, ok := table.Pick("foo.com", ""); !ok {
+				b.Fatal("no backend")
+			}
+		}
+	})
+}
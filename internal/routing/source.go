@@ -0,0 +1,60 @@
+package routing
+
+import (
+	"sync"
+
+	"reverse-proxy/internal/adminapi"
+)
+
+// Source owns the backends one discovery mechanism put in a table. Syncing replaces them with
+// the mechanism's current view and leaves every other backend alone: registered and configured
+// ones, and those of other sources. A backend stops belonging to its source as soon as anything
+// else registers, configures or changes it at the same address.
+type Source struct {
+	table *Table
+	mu    sync.Mutex // Serializes syncs
+}
+
+// NewSource returns a source with no backends in the table yet
+func (t *Table) NewSource() *Source {
+	return &Source{table: t}
+}
+
+// Sync makes the source's backends in the table exactly routes, in one swap. Backends at an
+// address the route already has from elsewhere are skipped; they are added by a later sync
+// if that address is free by then. It returns how many backends were added or changed, how
+// many were removed and how many were skipped.
+func (s *Source) Sync(routes map[string][]adminapi.Backend) (changed, removed, skipped int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t := s.table
+	t.update(s, func(table map[string][]adminapi.Backend) {
+		for route, owners := range t.sources {
+			for address, owner := range owners {
+				if owner == s && !Contains(routes[route], address) {
+					table[route] = Without(table[route], address)
+					delete(owners, address)
+					removed++
+				}
+			}
+		}
+		for route, backends := range routes {
+			for _, backend := range backends {
+				if Contains(table[route], backend.Address) && t.sources[route][backend.Address] != s {
+					skipped++
+					continue
+				}
+				if !containsEqual(table[route], backend) {
+					table[route] = With(table[route], backend)
+					changed++
+				}
+				if t.sources[route] == nil {
+					t.sources[route] = make(map[string]*Source)
+				}
+				t.sources[route][backend.Address] = s
+			}
+		}
+	})
+	return changed, removed, skipped
+}
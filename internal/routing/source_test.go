@@ -0,0 +1,133 @@
+package routing
+
+import (
+	"testing"
+
+	"reverse-proxy/internal/adminapi"
+)
+
+func backend(address string) adminapi.Backend {
+	return adminapi.Backend{Address: address, Weight: adminapi.DefaultWeight}
+}
+
+func addresses(t *Table, route string) []string {
+	var list []string
+	for _, b := range t.Backends(route) {
+		list = append(list, b.Address)
+	}
+	return list
+}
+
+func TestSourceSync(t *testing.T) {
+	table := NewTable()
+	source := table.NewSource()
+
+	changed, removed, skipped := source.Sync(map[string][]adminapi.Backend{
+		"foo.com": {backend("10.0.0.1:443"), backend("10.0.0.2:443")},
+	})
+	if changed != 2 || removed != 0 || skipped != 0 {
+		t.Fatalf("first sync = %d, %d, %d; want 2, 0, 0", changed, removed, skipped)
+	}
+
+	changed, removed, _ = source.Sync(map[string][]adminapi.Backend{
+		"foo.com": {backend("10.0.0.2:443")},
+	})
+	if changed != 0 || removed != 1 {
+		t.Fatalf("second sync = %d, %d; want 0, 1", changed, removed)
+	}
+	if got := addresses(table, "foo.com"); len(got) != 1 || got[0] != "10.0.0.2:443" {
+		t.Fatalf("backends = %v", got)
+	}
+
+	source.Sync(nil)
+	if table.Has("foo.com") {
+		t.Fatal("empty sync left the route in place")
+	}
+}
+
+// Registered backends stay, whether they were there before the source or came after it
+func TestSourceLeavesRegisteredBackends(t *testing.T) {
+	table := NewTable()
+	source := table.NewSource()
+	table.Add("foo.com", backend("10.0.0.1:443"))
+
+	_, _, skipped := source.Sync(map[string][]adminapi.Backend{
+		"foo.com": {{Address: "10.0.0.1:443", Weight: 5}, backend("10.0.0.2:443")},
+	})
+	if skipped != 1 {
+		t.Fatalf("skipped = %d, want 1", skipped)
+	}
+	if b, _ := table.Backend("foo.com", "10.0.0.1:443"); b.Weight != adminapi.DefaultWeight {
+		t.Fatalf("source changed the registered backend: %+v", b)
+	}
+
+	// Registering a discovered address takes it over
+	table.Add("foo.com", backend("10.0.0.2:443"))
+	source.Sync(nil)
+	if got := addresses(table, "foo.com"); len(got) != 2 {
+		t.Fatalf("backends after the source emptied = %v, want both registered ones", got)
+	}
+}
+
+func TestSourcesLeaveEachOtherAlone(t *testing.T) {
+	table := NewTable()
+	docker := table.NewSource()
+	files := table.NewSource()
+
+	docker.Sync(map[string][]adminapi.Backend{"foo.com": {backend("10.0.0.1:443")}})
+	_, _, skipped := files.Sync(map[string][]adminapi.Backend{"foo.com": {backend("10.0.0.1:443"), backend("10.0.0.2:443")}})
+	if skipped != 1 {
+		t.Fatalf("skipped = %d, want 1", skipped)
+	}
+
+	files.Sync(nil)
+	if got := addresses(table, "foo.com"); len(got) != 1 || got[0] != "10.0.0.1:443" {
+		t.Fatalf("backends = %v, want the Docker one only", got)
+	}
+
+	// Once the address is free, the other source may have it
+	docker.Sync(nil)
+	files.Sync(map[string][]adminapi.Backend{"foo.com": {backend("10.0.0.1:443")}})
+	if got := addresses(table, "foo.com"); len(got) != 1 {
+		t.Fatalf("backends = %v, want the file one", got)
+	}
+}
+
+// Changes made through Update take a backend from its source
+func TestUpdateTakesOverChangedBackends(t *testing.T) {
+	table := NewTable()
+	source := table.NewSource()
+	source.Sync(map[string][]adminapi.Backend{"foo.com": {backend("10.0.0.1:443"), backend("10.0.0.2:443")}})
+
+	table.Update(func(routes map[string][]adminapi.Backend) {
+		routes["foo.com"] = With(routes["foo.com"], adminapi.Backend{Address: "10.0.0.1:443", Weight: 3})
+	})
+	source.Sync(nil)
+	if got := addresses(table, "foo.com"); len(got) != 1 || got[0] != "10.0.0.1:443" {
+		t.Fatalf("backends = %v, want the updated one only", got)
+	}
+}
+
+// A replaced route is the table's own, so the source that discovered its backends can't take them away
+func TestReplaceTakesOverFromSource(t *testing.T) {
+	table := NewTable()
+	source := table.NewSource()
+	source.Sync(map[string][]adminapi.Backend{
+		"foo.com": {backend("10.0.0.1:443"), backend("10.0.0.2:443")},
+	})
+
+	table.Replace("foo.com", []adminapi.Backend{backend("10.0.0.2:443"), backend("10.0.0.3:443")})
+	if got := addresses(table, "foo.com"); len(got) != 2 || got[0] != "10.0.0.2:443" || got[1] != "10.0.0.3:443" {
+		t.Fatalf("backends = %v", got)
+	}
+
+	source.Sync(nil)
+	if got := addresses(table, "foo.com"); len(got) != 2 {
+		t.Fatalf("source removed replaced backends: %v", got)
+	}
+
+	table.Replace("foo.com", nil)
+	if table.Has("foo.com") {
+		t.Fatal("replacing with no backends left the route in place")
+	}
+}
@@ -0,0 +1,170 @@
+// Package ticketkeys rotates TLS session ticket keys on a schedule.
+//
+// Keys are derived from a secret seed and the current rotation period, so every
+// proxy instance that reads the same key file encrypts and accepts the same tickets
+// without having to coordinate.
+package ticketkeys
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const minSeedSize = 32
+
+// Config describes where the seed is kept and how often keys rotate
+type Config struct {
+	KeyFile  string        // Base64 seed shared by all instances; generated if missing, in-memory seed if empty
+	Rotation time.Duration // How long each key encrypts new tickets
+	Keep     int           // How many previous keys are still accepted
+}
+
+// Rotator installs the keys of the current period into TLS server configurations
+type Rotator struct {
+	config Config
+
+	mu      sync.Mutex
+	seed    []byte
+	modTime time.Time // Of the key file when the seed was read
+	targets []*tls.Config
+}
+
+// New loads or creates the seed
+func New(config Config) (*Rotator, error) {
+	if config.Rotation <= 0 {
+		return nil, fmt.Errorf("ticket key rotation interval must be positive")
+	}
+	if config.Keep < 0 {
+		config.Keep = 0
+	}
+
+	r := &Rotator{config: config}
+	if config.KeyFile == "" {
+		r.seed = make([]byte, minSeedSize)
+		if _, err := rand.Read(r.seed); err != nil {
+			return nil, fmt.Errorf("failed to generate ticket key seed: %w", err)
+		}
+		return r, nil
+	}
+
+	if _, err := os.Stat(config.KeyFile); errors.Is(err, os.ErrNotExist) {
+		if err := createKeyFile(config.KeyFile); err != nil {
+			return nil, err
+		}
+		log.Printf("Generated session ticket key file %s", config.KeyFile)
+	}
+	if err := r.readKeyFile(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func createKeyFile(path string) error {
+	seed := make([]byte, minSeedSize)
+	if _, err := rand.Read(seed); err != nil {
+		return fmt.Errorf("failed to generate ticket key seed: %w", err)
+	}
+	data := base64.StdEncoding.EncodeToString(seed) + "\n"
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		return fmt.Errorf("failed to write ticket key file: %w", err)
+	}
+	return nil
+}
+
+// readKeyFile loads the seed if the file changed since it was last read
+func (r *Rotator) readKeyFile() error {
+	info, err := os.Stat(r.config.KeyFile)
+	if err != nil {
+		return fmt.Errorf("failed to read ticket key file: %w", err)
+	}
+	if info.ModTime().Equal(r.modTime) {
+		return nil
+	}
+
+	data, err := os.ReadFile(r.config.KeyFile)
+	if err != nil {
+		return fmt.Errorf("failed to read ticket key file: %w", err)
+	}
+	seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return fmt.Errorf("ticket key file %s is not base64: %w", r.config.KeyFile, err)
+	}
+	if len(seed) < minSeedSize {
+		return fmt.Errorf("ticket key file %s holds %d bytes, need at least %d", r.config.KeyFile, len(seed), minSeedSize)
+	}
+
+	r.mu.Lock()
+	r.seed = seed
+	r.modTime = info.ModTime()
+	r.mu.Unlock()
+	return nil
+}
+
+// Keys returns the keys for a point in time: the current period's key first, which encrypts new tickets,
+// then the next period's key for instances whose clocks run slightly ahead, then the Keep previous keys.
+func (r *Rotator) Keys(now time.Time) [][32]byte {
+	r.mu.Lock()
+	seed := r.seed
+	r.mu.Unlock()
+
+	period := now.UnixNano() / int64(r.config.Rotation)
+	keys := [][32]byte{deriveKey(seed, period), deriveKey(seed, period+1)}
+	for i := int64(1); i <= int64(r.config.Keep); i++ {
+		keys = append(keys, deriveKey(seed, period-i))
+	}
+	return keys
+}
+
+func deriveKey(seed []byte, period int64) [32]byte {
+	mac := hmac.New(sha256.New, seed)
+	mac.Write([]byte("session ticket key"))
+	mac.Write(binary.BigEndian.AppendUint64(nil, uint64(period)))
+
+	var key [32]byte
+	copy(key[:], mac.Sum(nil))
+	return key
+}
+
+// Apply installs the current keys into a server configuration and keeps them current from then on.
+// Configurations cloned from it during a handshake inherit its keys.
+func (r *Rotator) Apply(config *tls.Config) {
+	config.SetSessionTicketKeys(r.Keys(time.Now()))
+
+	r.mu.Lock()
+	r.targets = append(r.targets, config)
+	r.mu.Unlock()
+}
+
+// Run rotates the keys of every applied configuration at each period boundary,
+// picking up a replaced key file on the way
+func (r *Rotator) Run() {
+	for {
+		period := time.Now().UnixNano() / int64(r.config.Rotation)
+		time.Sleep(time.Until(time.Unix(0, (period+1)*int64(r.config.Rotation))))
+
+		if r.config.KeyFile != "" {
+			if err := r.readKeyFile(); err != nil {
+				log.Printf("Failed to reload session ticket keys, keeping the previous seed: %v", err)
+			}
+		}
+
+		keys := r.Keys(time.Now())
+		r.mu.Lock()
+		for _, config := range r.targets {
+			config.SetSessionTicketKeys(keys)
+		}
+		r.mu.Unlock()
+		log.Printf("Rotated session ticket keys")
+	}
+}
@@ -0,0 +1,181 @@
+package tlspolicy
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"slices"
+)
+
+// TLS alerts sent when a ClientHello is rejected
+const (
+	AlertHandshakeFailure      = 40
+	AlertProtocolVersion       = 70
+	AlertNoApplicationProtocol = 120
+)
+
+// ClientHello holds what a client offers, as far as policies are concerned
+type ClientHello struct {
+	ServerName   string
+	Versions     []uint16
+	CipherSuites []uint16
+	Curves       []tls.CurveID // Empty if the client sent no supported_groups extension
+	ALPN         []string      // Empty if the client sent no ALPN extension
+}
+
+// Rejection explains why a ClientHello offers nothing a rule accepts
+type Rejection struct {
+	Alert  uint8 // TLS alert to answer the client with
+	Reason string
+}
+
+func (r *Rejection) Error() string {
+	return r.Reason
+}
+
+// AlertRecord returns the fatal alert record to send before closing the connection
+func (r *Rejection) AlertRecord() []byte {
+	return []byte{0x15, 0x03, 0x03, 0x00, 0x02, 0x02, r.Alert}
+}
+
+// ParseClientHello parses a ClientHello handshake message, starting at its handshake type byte
+func ParseClientHello(msg []byte) (*ClientHello, error) {
+	if len(msg) < 4 || msg[0] != 0x01 {
+		return nil, fmt.Errorf("not a ClientHello message")
+	}
+	length := int(msg[1])<<16 | int(msg[2])<<8 | int(msg[3])
+	if len(msg) < 4+length {
+		return nil, fmt.Errorf("incomplete ClientHello")
+	}
+	body := msg[4 : 4+length]
+
+	// Legacy version and random, then the session ID
+	if len(body) < 34 {
+		return nil, fmt.Errorf("invalid ClientHello header")
+	}
+	legacyVersion := binary.BigEndian.Uint16(body)
+	_, body, ok := readVector(body[34:], 1)
+	if !ok {
+		return nil, fmt.Errorf("invalid ClientHello session ID")
+	}
+
+	hello := &ClientHello{}
+	suites, body, ok := readVector(body, 2)
+	if !ok {
+		return nil, fmt.Errorf("invalid ClientHello cipher suites")
+	}
+	for ; len(suites) >= 2; suites = suites[2:] {
+		hello.CipherSuites = append(hello.CipherSuites, binary.BigEndian.Uint16(suites))
+	}
+
+	_, body, ok = readVector(body, 1)
+	if !ok {
+		return nil, fmt.Errorf("invalid ClientHello compression methods")
+	}
+
+	extensions, _, _ := readVector(body, 2) // Absent in very old clients
+	for len(extensions) >= 4 {
+		extType := binary.BigEndian.Uint16(extensions)
+		var ext []byte
+		ext, extensions, ok = readVector(extensions[2:], 2)
+		if !ok {
+			return nil, fmt.Errorf("invalid ClientHello extension")
+		}
+
+		switch extType {
+		case 0x0000: // server_name
+			list, _, _ := readVector(ext, 2)
+			if len(list) > 0 && list[0] == 0 { // host_name
+				name, _, _ := readVector(list[1:], 2)
+				hello.ServerName = string(name)
+			}
+		case 0x000a: // supported_groups
+			groups, _, _ := readVector(ext, 2)
+			for ; len(groups) >= 2; groups = groups[2:] {
+				hello.Curves = append(hello.Curves, tls.CurveID(binary.BigEndian.Uint16(groups)))
+			}
+		case 0x0010: // application_layer_protocol_negotiation
+			protocols, _, _ := readVector(ext, 2)
+			for len(protocols) > 0 {
+				var protocol []byte
+				if protocol, protocols, ok = readVector(protocols, 1); !ok {
+					break
+				}
+				hello.ALPN = append(hello.ALPN, string(protocol))
+			}
+		case 0x002b: // supported_versions
+			list, _, _ := readVector(ext, 1)
+			for ; len(list) >= 2; list = list[2:] {
+				hello.Versions = append(hello.Versions, binary.BigEndian.Uint16(list))
+			}
+		}
+	}
+
+	// Without supported_versions a client offers every version up to the legacy one
+	if len(hello.Versions) == 0 {
+		for version := uint16(tls.VersionTLS10); version <= legacyVersion && version <= tls.VersionTLS12; version++ {
+			hello.Versions = append(hello.Versions, version)
+		}
+	}
+
+	return hello, nil
+}
+
+// Check reports whether a ClientHello offers at least one handshake the rule accepts
+func (r *Rule) Check(hello *ClientHello) error {
+	versionOffered, suiteOffered := false, false
+	for _, version := range hello.Versions {
+		if version < tls.VersionTLS10 || version > tls.VersionTLS13 { // Skips GREASE values
+			continue
+		}
+		if (r.minVersion != 0 && version < r.minVersion) || (r.maxVersion != 0 && version > r.maxVersion) {
+			continue
+		}
+		versionOffered = true
+
+		allowed := r.suites12
+		if version == tls.VersionTLS13 {
+			allowed = r.suites13
+		}
+		if len(allowed) == 0 || overlaps(hello.CipherSuites, allowed) {
+			suiteOffered = true
+			break
+		}
+	}
+
+	switch {
+	case !versionOffered:
+		return &Rejection{AlertProtocolVersion, "client offers no permitted TLS version"}
+	case !suiteOffered:
+		return &Rejection{AlertHandshakeFailure, "client offers no permitted cipher suite"}
+	case len(r.curves) > 0 && len(hello.Curves) > 0 && !overlaps(hello.Curves, r.curves):
+		return &Rejection{AlertHandshakeFailure, "client offers no permitted curve"}
+	case len(r.alpn) > 0 && len(hello.ALPN) > 0 && !overlaps(hello.ALPN, r.alpn):
+		return &Rejection{AlertNoApplicationProtocol, "client offers no permitted application protocol"}
+	}
+	return nil
+}
+
+func overlaps[T comparable](offered, allowed []T) bool {
+	for _, value := range offered {
+		if slices.Contains(allowed, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// readVector splits a field prefixed with a lengthBytes-byte length off the front of data
+func readVector(data []byte, lengthBytes int) (value, rest []byte, ok bool) {
+	if len(data) < lengthBytes {
+		return nil, nil, false
+	}
+	length := 0
+	for _, b := range data[:lengthBytes] {
+		length = length<<8 | int(b)
+	}
+	if len(data) < lengthBytes+length {
+		return nil, nil, false
+	}
+	return data[lengthBytes : lengthBytes+length], data[lengthBytes+length:], true
+}
@@ -0,0 +1,161 @@
+// Package tlspolicy restricts the TLS versions, cipher suites, curves and ALPN protocols per server name.
+package tlspolicy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Policy describes the handshakes accepted for one server name. Empty fields impose no restriction.
+type Policy struct {
+	MinVersion   string   `json:"min_version" yaml:"min_version"`     // Lowest TLS version, e.g. "1.2"
+	MaxVersion   string   `json:"max_version" yaml:"max_version"`     // Highest TLS version, e.g. "1.3"
+	CipherSuites []string `json:"cipher_suites" yaml:"cipher_suites"` // IANA names such as TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256
+	Curves       []string `json:"curves" yaml:"curves"`               // Key exchange groups in order of preference: X25519, P-256, P-384, P-521
+	ALPN         []string `json:"alpn" yaml:"alpn"`                   // Application protocols in order of preference, e.g. h2, http/1.1
+}
+
+// Rule is a loaded Policy
+type Rule struct {
+	minVersion uint16
+	maxVersion uint16
+	suites12   []uint16 // Suites for TLS 1.2 and earlier
+	suites13   []uint16 // TLS 1.3 suites; only enforced when inspecting ClientHellos, Go always offers all three
+	curves     []tls.CurveID
+	alpn       []string
+}
+
+var versions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var curves = map[string]tls.CurveID{
+	"X25519": tls.X25519,
+	"P-256":  tls.CurveP256,
+	"P-384":  tls.CurveP384,
+	"P-521":  tls.CurveP521,
+}
+
+// Load validates a policy
+func Load(policy Policy) (*Rule, error) {
+	rule := &Rule{alpn: policy.ALPN}
+
+	var err error
+	if rule.minVersion, err = parseVersion(policy.MinVersion); err != nil {
+		return nil, err
+	}
+	if rule.maxVersion, err = parseVersion(policy.MaxVersion); err != nil {
+		return nil, err
+	}
+	if rule.minVersion != 0 && rule.maxVersion != 0 && rule.minVersion > rule.maxVersion {
+		return nil, fmt.Errorf("min_version %s is above max_version %s", policy.MinVersion, policy.MaxVersion)
+	}
+
+	for _, name := range policy.CipherSuites {
+		suite := findSuite(name)
+		if suite == nil {
+			return nil, fmt.Errorf("unknown cipher suite %q", name)
+		}
+		if slices.Contains(suite.SupportedVersions, tls.VersionTLS13) {
+			rule.suites13 = append(rule.suites13, suite.ID)
+		} else {
+			rule.suites12 = append(rule.suites12, suite.ID)
+		}
+	}
+
+	for _, name := range policy.Curves {
+		curve, ok := curves[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown curve %q", name)
+		}
+		rule.curves = append(rule.curves, curve)
+	}
+
+	return rule, nil
+}
+
+func parseVersion(name string) (uint16, error) {
+	if name == "" {
+		return 0, nil
+	}
+	version, ok := versions[strings.TrimSpace(strings.TrimPrefix(name, "TLS"))]
+	if !ok {
+		return 0, fmt.Errorf("unknown TLS version %q", name)
+	}
+	return version, nil
+}
+
+func findSuite(name string) *tls.CipherSuite {
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		if suite.Name == name {
+			return suite
+		}
+	}
+	return nil
+}
+
+// Apply restricts a server configuration to the rule
+func (r *Rule) Apply(config *tls.Config) {
+	if r.minVersion != 0 {
+		config.MinVersion = r.minVersion
+	}
+	if r.maxVersion != 0 {
+		config.MaxVersion = r.maxVersion
+	}
+	if len(r.suites12) > 0 {
+		config.CipherSuites = r.suites12
+	}
+	if len(r.curves) > 0 {
+		config.CurvePreferences = r.curves
+	}
+	if len(r.alpn) > 0 {
+		config.NextProtos = r.alpn
+	}
+}
+
+// Rules holds the rule of every server name with a TLS policy
+type Rules map[string]*Rule
+
+// LoadAll loads a policy per server name. Names may be wildcards such as *.example.com.
+func LoadAll(policies map[string]Policy) (Rules, error) {
+	rules := make(Rules, len(policies))
+	for name, policy := range policies {
+		if err := checkName(name); err != nil {
+			return nil, fmt.Errorf("TLS policy for %q: %w", name, err)
+		}
+		rule, err := Load(policy)
+		if err != nil {
+			return nil, fmt.Errorf("TLS policy for %s: %w", name, err)
+		}
+		rules[strings.ToLower(name)] = rule
+	}
+	return rules, nil
+}
+
+// checkName requires a name Lookup can match: a server name, or one with a leading wildcard
+// label such as *.example.com, without port or trailing dot
+func checkName(name string) error {
+	host := strings.TrimPrefix(name, "*.")
+	if host == "" || strings.ContainsAny(host, "*:/ ") || strings.HasPrefix(host, ".") ||
+		strings.HasSuffix(host, ".") || strings.Contains(host, "..") {
+		return fmt.Errorf("invalid server name")
+	}
+	return nil
+}
+
+// Lookup returns the rule for a server name, or nil if it accepts the defaults
+func (r Rules) Lookup(serverName string) *Rule {
+	name := strings.ToLower(strings.TrimSuffix(serverName, "."))
+	if rule, ok := r[name]; ok {
+		return rule
+	}
+	if _, parent, ok := strings.Cut(name, "."); ok {
+		return r["*."+parent]
+	}
+	return nil
+}
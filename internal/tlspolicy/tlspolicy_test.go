@@ -0,0 +1,238 @@
+package tlspolicy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func selfSigned(t *testing.T) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		DNSNames:     []string{"example.com", "*.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// handshake connects a client to a server that applies the rule of the server name per
+// handshake, the way the proxies do, and returns what was negotiated
+func handshake(t *testing.T, rules Rules, client *tls.Config) (tls.ConnectionState, error) {
+	t.Helper()
+	base := &tls.Config{Certificates: []tls.Certificate{selfSigned(t)}}
+	base.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		rule := rules.Lookup(hello.ServerName)
+		if rule == nil {
+			return nil, nil
+		}
+		perName := base.Clone()
+		perName.GetConfigForClient = nil
+		rule.Apply(perName)
+		return perName, nil
+	}
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+	server := tls.Server(serverConn, base)
+	go func() {
+		server.Handshake()
+		serverConn.Close()
+	}()
+
+	client.InsecureSkipVerify = true
+	conn := tls.Client(clientConn, client)
+	err := conn.Handshake()
+	return conn.ConnectionState(), err
+}
+
+func TestRulesApplyPerServerName(t *testing.T) {
+	rules, err := LoadAll(map[string]Policy{
+		"modern.example.com": {MinVersion: "1.3"},
+		"*.legacy.example.com": {
+			MaxVersion:   "TLS1.2",
+			CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384"},
+			Curves:       []string{"P-384"},
+			ALPN:         []string{"http/1.1"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A TLS 1.2 client is turned away by the name requiring 1.3, and only by that name
+	tls12 := func(serverName string) *tls.Config {
+		return &tls.Config{ServerName: serverName, MaxVersion: tls.VersionTLS12}
+	}
+	if _, err := handshake(t, rules, tls12("modern.example.com")); err == nil {
+		t.Error("TLS 1.2 client completed a handshake with a name requiring 1.3")
+	}
+	if state, err := handshake(t, rules, tls12("other.example.com")); err != nil || state.Version != tls.VersionTLS12 {
+		t.Errorf("name without a policy: version %x, %v", state.Version, err)
+	}
+	if state, err := handshake(t, rules, &tls.Config{ServerName: "MODERN.example.com."}); err != nil || state.Version != tls.VersionTLS13 {
+		t.Errorf("name requiring 1.3, spelled differently: version %x, %v", state.Version, err)
+	}
+
+	// The wildcard pins names under it to its version, suite, curve and protocol
+	state, err := handshake(t, rules, &tls.Config{ServerName: "api.legacy.example.com", NextProtos: []string{"h2", "http/1.1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Version != tls.VersionTLS12 || state.CipherSuite != tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384 || state.NegotiatedProtocol != "http/1.1" {
+		t.Errorf("wildcard name negotiated version %x, suite %x, protocol %q", state.Version, state.CipherSuite, state.NegotiatedProtocol)
+	}
+	restricted := &tls.Config{
+		ServerName:   "api.legacy.example.com",
+		CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+	}
+	if _, err := handshake(t, rules, restricted); err == nil {
+		t.Error("client without the permitted cipher suite completed a handshake")
+	}
+	if _, err := handshake(t, rules, &tls.Config{ServerName: "api.legacy.example.com", CurvePreferences: []tls.CurveID{tls.X25519}}); err == nil {
+		t.Error("client without the permitted curve completed a handshake")
+	}
+	// The wildcard covers one label only
+	if state, err := handshake(t, rules, &tls.Config{ServerName: "legacy.example.com"}); err != nil || state.Version != tls.VersionTLS13 {
+		t.Errorf("parent of the wildcard: version %x, %v", state.Version, err)
+	}
+}
+
+func TestLoadRejectsInvalidPolicies(t *testing.T) {
+	for name, policy := range map[string]Policy{
+		"unknown min version":  {MinVersion: "1.4"},
+		"unknown max version":  {MaxVersion: "SSLv3"},
+		"inverted versions":    {MinVersion: "1.3", MaxVersion: "1.2"},
+		"unknown cipher suite": {CipherSuites: []string{"TLS_RSA_WITH_RC5"}},
+		"unknown curve":        {Curves: []string{"P-192"}},
+	} {
+		if _, err := Load(policy); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+	if _, err := Load(Policy{MinVersion: "TLS 1.2", MaxVersion: "1.3", Curves: []string{"X25519"}}); err != nil {
+		t.Errorf("valid policy: %v", err)
+	}
+}
+
+func TestLoadAllRejectsInvalidNames(t *testing.T) {
+	for _, name := range []string{"", "*", "*.", "foo.*.com", "*.*.example.com", "example.com:443", "example.com.", ".example.com", "a..example.com", "exa mple.com", "https://example.com"} {
+		if _, err := LoadAll(map[string]Policy{name: {MinVersion: "1.2"}}); err == nil {
+			t.Errorf("name %q: expected an error", name)
+		}
+	}
+
+	rules, err := LoadAll(map[string]Policy{"Example.COM": {}, "*.example.com": {}, "localhost": {}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"example.com", "api.example.com", "localhost"} {
+		if rules.Lookup(name) == nil {
+			t.Errorf("no rule for %s", name)
+		}
+	}
+	if rules.Lookup("a.b.example.com") != nil || rules.Lookup("example.org") != nil {
+		t.Error("rule found for a name no policy covers")
+	}
+
+	// A bad policy is reported with its name
+	if _, err := LoadAll(map[string]Policy{"pay.example.com": {MinVersion: "2.0"}}); err == nil || !strings.Contains(err.Error(), "pay.example.com") {
+		t.Errorf("invalid policy: got %v", err)
+	}
+}
+
+// clientHello captures the ClientHello message a client sends
+func clientHello(t *testing.T, config *tls.Config) []byte {
+	t.Helper()
+	clientConn, serverConn := net.Pipe()
+	defer serverConn.Close()
+	go func() {
+		tls.Client(clientConn, config).Handshake()
+		clientConn.Close()
+	}()
+
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(serverConn, header); err != nil {
+		t.Fatal(err)
+	}
+	msg := make([]byte, int(header[3])<<8|int(header[4]))
+	if _, err := io.ReadFull(serverConn, msg); err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func TestCheckClientHello(t *testing.T) {
+	msg := clientHello(t, &tls.Config{
+		ServerName:       "pay.example.com",
+		MinVersion:       tls.VersionTLS12,
+		MaxVersion:       tls.VersionTLS12,
+		CipherSuites:     []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
+		CurvePreferences: []tls.CurveID{tls.CurveP256},
+		NextProtos:       []string{"h2"},
+	})
+	hello, err := ParseClientHello(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hello.ServerName != "pay.example.com" || !slices.Contains(hello.Versions, tls.VersionTLS12) ||
+		!slices.Equal(hello.Curves, []tls.CurveID{tls.CurveP256}) || !slices.Equal(hello.ALPN, []string{"h2"}) {
+		t.Fatalf("parsed %+v", hello)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		policy Policy
+		alert  uint8 // 0 if the ClientHello passes
+	}{
+		{"no restrictions", Policy{}, 0},
+		{"matching policy", Policy{MinVersion: "1.2", CipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"}, Curves: []string{"P-256"}, ALPN: []string{"h2"}}, 0},
+		{"version too old", Policy{MinVersion: "1.3"}, AlertProtocolVersion},
+		{"no permitted suite", Policy{CipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"}}, AlertHandshakeFailure},
+		{"no permitted curve", Policy{Curves: []string{"X25519"}}, AlertHandshakeFailure},
+		{"no permitted protocol", Policy{ALPN: []string{"http/1.1"}}, AlertNoApplicationProtocol},
+	} {
+		rule, err := Load(tc.policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = rule.Check(hello)
+		var rejection *Rejection
+		switch {
+		case tc.alert == 0 && err != nil:
+			t.Errorf("%s: rejected: %v", tc.name, err)
+		case tc.alert != 0 && (!errors.As(err, &rejection) || rejection.Alert != tc.alert):
+			t.Errorf("%s: got %v, want alert %d", tc.name, err, tc.alert)
+		}
+	}
+
+	// Truncated messages are errors, not panics
+	for n := 0; n < len(msg); n += 7 {
+		ParseClientHello(msg[:n])
+	}
+	if _, err := ParseClientHello(msg[:len(msg)-1]); err == nil {
+		t.Error("truncated ClientHello parsed")
+	}
+}
@@ -0,0 +1,110 @@
+// Package upstreamtls configures TLS from the proxy to its backends.
+package upstreamtls
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Policy describes how the proxy connects to the backends of one route
+type Policy struct {
+	CAFile     string   `json:"ca_file" yaml:"ca_file"`         // PEM bundle trusted for backend certificates (system roots if empty)
+	ServerName string   `json:"server_name" yaml:"server_name"` // SNI and verification name (backend host if empty)
+	CertFile   string   `json:"cert_file" yaml:"cert_file"`     // Optional client certificate presented to backends
+	KeyFile    string   `json:"key_file" yaml:"key_file"`       // Private key of CertFile
+	Pins       []string `json:"pins" yaml:"pins"`               // Optional "sha256/<base64>" SPKI pins; one must match the backend's chain
+}
+
+// Settings is a loaded Policy
+type Settings struct {
+	base *tls.Config
+}
+
+// Load reads the CA bundle and client certificate of a policy
+func Load(policy Policy) (*Settings, error) {
+	base := &tls.Config{
+		ServerName: policy.ServerName,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if policy.CAFile != "" {
+		caPEM, err := os.ReadFile(policy.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read upstream CA bundle: %w", err)
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("no certificates found in %s", policy.CAFile)
+		}
+		base.RootCAs = roots
+	}
+
+	if policy.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(policy.CertFile, policy.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load upstream client certificate: %w", err)
+		}
+		base.Certificates = []tls.Certificate{cert}
+	}
+
+	if len(policy.Pins) > 0 {
+		pins := make(map[string]bool, len(policy.Pins))
+		for _, pin := range policy.Pins {
+			pins[strings.TrimPrefix(pin, "sha256/")] = true
+		}
+		// Runs after the chain has been verified against RootCAs
+		base.VerifyConnection = func(state tls.ConnectionState) error {
+			for _, chain := range state.VerifiedChains {
+				for _, cert := range chain {
+					if pins[spkiHash(cert)] {
+						return nil
+					}
+				}
+			}
+			return fmt.Errorf("backend certificate for %s matches no pinned key", state.ServerName)
+		}
+	}
+
+	return &Settings{base: base}, nil
+}
+
+func spkiHash(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// ClientConfig returns the TLS configuration for connecting to a backend.
+// The backend host is used as server name unless the policy overrides it; an empty host leaves it for the caller.
+func (s *Settings) ClientConfig(host string) *tls.Config {
+	config := s.base.Clone()
+	if config.ServerName == "" {
+		config.ServerName = host
+	}
+	return config
+}
+
+// Routes holds the upstream TLS settings of every route that re-encrypts to its backends
+type Routes map[string]*Settings
+
+// LoadAll loads a policy per route
+func LoadAll(policies map[string]Policy) (Routes, error) {
+	routes := make(Routes, len(policies))
+	for route, policy := range policies {
+		settings, err := Load(policy)
+		if err != nil {
+			return nil, fmt.Errorf("upstream TLS for %s: %w", route, err)
+		}
+		routes[route] = settings
+	}
+	return routes, nil
+}
+
+// Lookup returns the settings for a route, or nil if its backends are reached in plaintext
+func (r Routes) Lookup(route string) *Settings {
+	return r[route]
+}